@@ -0,0 +1,86 @@
+// Package btrfsbackup runs the backups of btrfs-backup within a host application. The
+// host follows the runs on the Events channel, e.g. to render its own UI, and cancels them
+// with the context it passes, instead of running the btrfs-backup command and reading its
+// logs. The targets and repositories are configured as for the command.
+package btrfsbackup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"btrfs-backup/internal/backup"
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/events"
+	"btrfs-backup/progress"
+)
+
+// ErrMaintenance is returned by Backup while maintenance mode is on, see 'btrfs-backup
+// maintenance'. The run is skipped without sending any event.
+var ErrMaintenance = backup.ErrMaintenance
+
+// Runner runs the backups of the targets of a main configuration, one at a time.
+type Runner struct {
+	config  *config.Config
+	manager *backup.Manager
+	mu      sync.Mutex // serializes the runs of manager
+}
+
+// New loads the main configuration at configPath, or from the environment alone if it
+// doesn't exist and BTRFSBACKUP_ variables are set, and returns a Runner for its targets.
+func New(configPath string) (*Runner, error) {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{config: cfg, manager: backup.NewManager(cfg, false)}, nil
+}
+
+// Targets returns the names of the configured targets, sorted.
+func (r *Runner) Targets() ([]string, error) {
+	targets, err := config.DiscoverTargets(r.config.TargetDir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, t.Name)
+	}
+	return names, nil
+}
+
+// Events returns the channel receiving the progress of the runs: an EventRunStarted, an
+// EventStepStarted per workflow step, EventProgress while restic uploads, EventWarning
+// for failures that don't fail the run, and an EventRunFinished carrying the run's error.
+// Events are dropped rather than delaying a backup while the channel's buffer is full, so
+// the host should receive them continuously. The channel is never closed.
+func (r *Runner) Events() <-chan progress.Event {
+	return r.manager.Events()
+}
+
+// Backup runs the backup workflow of the named target, like 'btrfs-backup backup' without
+// its notifications: snapshot, upload, retention, verification and cleanup, with the
+// target's hooks. Cancelling ctx stops the running btrfs or restic command and fails the
+// run as interrupted, as SIGTERM does for the command. Runs of the Runner wait for each
+// other.
+func (r *Runner) Backup(ctx context.Context, target string) error {
+	targets, err := config.DiscoverTargets(r.config.TargetDir)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if t.Name != target {
+			continue
+		}
+		targetConfig, err := config.LoadTargetConfig(t.Path)
+		if err != nil {
+			return fmt.Errorf("target '%s': %w", target, err)
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.manager.SetRunID(events.NewRunID(), false)
+		return r.manager.RunBackup(ctx, target, targetConfig)
+	}
+	return fmt.Errorf("target '%s' not found in %s", target, r.config.TargetDir)
+}
@@ -0,0 +1,52 @@
+package btrfsbackup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a main configuration with the targets home and docs to a temporary
+// directory and returns its path.
+func writeConfig(t *testing.T) string {
+	dir := t.TempDir()
+	targetDir := filepath.Join(dir, "targets")
+	if err := os.Mkdir(targetDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		filepath.Join(dir, "config.yaml"): "target_dir: " + targetDir + "\nsnapshot_dir: " + filepath.Join(dir, "snapshots") +
+			"\nrestic_repo_dir: " + filepath.Join(dir, "repos") + "\n",
+		filepath.Join(targetDir, "home.yaml"): "subvolume: /mnt/btrfs/home\nprefix: home\nrepository: b2-home\n",
+		filepath.Join(targetDir, "docs.yaml"): "subvolume: /mnt/btrfs/docs\nprefix: docs\nrepository: b2-home\n",
+	} {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+func TestRunner(t *testing.T) {
+	runner, err := New(writeConfig(t))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	targets, err := runner.Targets()
+	if err != nil || !slices.Equal(targets, []string{"docs", "home"}) {
+		t.Errorf("Expected targets [docs home], got %v (%v)", targets, err)
+	}
+	if ch := runner.Events(); ch == nil || runner.Events() != ch {
+		t.Error("Expected Events to return the same channel on every call")
+	}
+	if err := runner.Backup(context.Background(), "media"); err == nil || !strings.Contains(err.Error(), "target 'media' not found") {
+		t.Errorf("Expected error for an unknown target, got %v", err)
+	}
+
+	if _, err := New(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected error for a missing configuration")
+	}
+}
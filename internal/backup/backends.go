@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"btrfs-backup/internal/restic"
+)
+
+// backendField is a key of a typed repository configuration.
+type backendField struct {
+	key      string
+	required bool
+	variable string // environment variable the value is exported as, empty for parts of the repository URL or options
+}
+
+// repositoryBackend describes the keys of a typed repository configuration of one
+// backend and builds the restic repository URL from them, and optionally restic options
+// as KEY=VALUE pairs, see restic.IsOption. The configuration can't set the optionKeys
+// itself once options returned any.
+type repositoryBackend struct {
+	fields     []backendField
+	repository func(values map[string]string) (string, error)
+	options    func(values map[string]string) ([]string, error)
+	optionKeys []string
+}
+
+// commonBackendFields are the keys of typed repository configurations of every backend.
+var commonBackendFields = []backendField{
+	{key: "password", variable: "RESTIC_PASSWORD"},
+	{key: "password_file", variable: "RESTIC_PASSWORD_FILE"},
+}
+
+// repositoryBackends are the backends of typed repository configurations, by the value
+// of their backend key.
+var repositoryBackends = map[string]repositoryBackend{
+	"local": {
+		fields: []backendField{{key: "path", required: true}},
+		repository: func(values map[string]string) (string, error) {
+			if !filepath.IsAbs(values["path"]) {
+				return "", fmt.Errorf("path must be absolute, got '%s'", values["path"])
+			}
+			return values["path"], nil
+		},
+	},
+	"s3": {
+		fields: []backendField{
+			{key: "endpoint"},
+			{key: "bucket", required: true},
+			{key: "prefix"},
+			{key: "region", variable: "AWS_DEFAULT_REGION"},
+			{key: "access_key_id", variable: "AWS_ACCESS_KEY_ID"},
+			{key: "secret_access_key", variable: "AWS_SECRET_ACCESS_KEY"},
+		},
+		repository: func(values map[string]string) (string, error) {
+			if strings.Contains(values["bucket"], "/") {
+				return "", fmt.Errorf("bucket must be a bucket name, set the path in it as prefix")
+			}
+			endpoint := values["endpoint"]
+			if endpoint == "" {
+				endpoint = "s3.amazonaws.com"
+			}
+			return "s3:" + joinRepositoryPath(strings.TrimSuffix(endpoint, "/")+"/"+values["bucket"], values["prefix"]), nil
+		},
+	},
+	"b2": {
+		fields: []backendField{
+			{key: "bucket", required: true},
+			{key: "prefix"},
+			{key: "account_id", variable: "B2_ACCOUNT_ID"},
+			{key: "account_key", variable: "B2_ACCOUNT_KEY"},
+		},
+		repository: func(values map[string]string) (string, error) {
+			if strings.ContainsAny(values["bucket"], "/:") {
+				return "", fmt.Errorf("bucket must be a bucket name, set the path in it as prefix")
+			}
+			if values["prefix"] == "" {
+				return "b2:" + values["bucket"], nil
+			}
+			return "b2:" + values["bucket"] + ":" + strings.Trim(values["prefix"], "/"), nil
+		},
+	},
+	"sftp": {
+		fields: []backendField{
+			{key: "host", required: true},
+			{key: "user"},
+			{key: "port"},
+			{key: "path", required: true},
+			{key: "jump_host"},
+			{key: "identity_file"},
+			{key: "known_hosts_file"},
+		},
+		repository: func(values map[string]string) (string, error) {
+			host := values["host"]
+			if values["user"] != "" {
+				host = values["user"] + "@" + host
+			}
+			if values["port"] == "" {
+				return "sftp:" + host + ":" + values["path"], nil
+			}
+			// The URL form is needed for the port; its path is relative to the home
+			// directory unless it starts with a second slash
+			return "sftp://" + host + ":" + values["port"] + "/" + values["path"], nil
+		},
+		// The SSH options are passed as arguments of the ssh command restic runs, so they
+		// don't depend on the ~/.ssh/config of the user running the backups
+		options: func(values map[string]string) ([]string, error) {
+			var args []string
+			if values["jump_host"] != "" {
+				args = append(args, "-J", values["jump_host"])
+			}
+			for _, key := range []string{"identity_file", "known_hosts_file"} {
+				if values[key] != "" && !filepath.IsAbs(values[key]) {
+					return nil, fmt.Errorf("%s must be absolute, got '%s'", key, values[key])
+				}
+			}
+			if values["identity_file"] != "" {
+				args = append(args, "-i", values["identity_file"], "-o", "IdentitiesOnly=yes")
+			}
+			if values["known_hosts_file"] != "" {
+				args = append(args, "-o", "UserKnownHostsFile="+values["known_hosts_file"], "-o", "StrictHostKeyChecking=yes")
+			}
+			if len(args) == 0 {
+				return nil, nil
+			}
+			// restic splits sftp.args like a shell, so white space and quotes would split or
+			// mangle the arguments
+			for _, arg := range args {
+				if strings.ContainsAny(arg, " \t'\"\\") {
+					return nil, fmt.Errorf("SSH argument '%s' can't contain white space or quotes", arg)
+				}
+			}
+			return []string{"sftp.args=" + strings.Join(args, " ")}, nil
+		},
+		optionKeys: []string{"sftp.args", "sftp.command"},
+	},
+	"rest": {
+		fields: []backendField{
+			{key: "url", required: true},
+			{key: "rest_username", variable: "RESTIC_REST_USERNAME"},
+			{key: "rest_password", variable: "RESTIC_REST_PASSWORD"},
+		},
+		repository: func(values map[string]string) (string, error) {
+			if !strings.HasPrefix(values["url"], "http://") && !strings.HasPrefix(values["url"], "https://") {
+				return "", fmt.Errorf("url must start with http:// or https://, got '%s'", values["url"])
+			}
+			return "rest:" + values["url"], nil
+		},
+	},
+	"rclone": {
+		fields: []backendField{
+			{key: "remote", required: true},
+			{key: "path"},
+		},
+		repository: func(values map[string]string) (string, error) {
+			return "rclone:" + strings.TrimSuffix(values["remote"], ":") + ":" + values["path"], nil
+		},
+	},
+}
+
+// joinRepositoryPath appends prefix, without surrounding slashes, to a repository path.
+func joinRepositoryPath(path, prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return path
+	}
+	return path + "/" + prefix
+}
+
+// isTypedKey reports whether key is a key of a typed repository configuration, which
+// are lower case, rather than an environment variable, a restic option or the extra
+// arguments of restic.
+func isTypedKey(key string) bool {
+	return key == strings.ToLower(key) && !restic.IsOption(key) && key != restic.ExtraArgsKey
+}
+
+// expandRepositoryBackend replaces the keys of a typed repository configuration, one
+// with a backend key, by the environment variables restic reads: RESTIC_REPOSITORY
+// built from the keys of the backend, followed by the variables of its credential keys.
+// Other variables are kept. Configurations without a backend key are returned as they
+// are. Returns an error for an unknown backend, keys the backend doesn't have, missing
+// required keys and invalid values.
+func expandRepositoryBackend(vars []string) ([]string, error) {
+	i := slices.IndexFunc(vars, hasKey("backend"))
+	if i < 0 {
+		return vars, nil
+	}
+	name := strings.TrimPrefix(vars[i], "backend=")
+	backend, ok := repositoryBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend '%s', must be one of %s", name, strings.Join(slices.Sorted(maps.Keys(repositoryBackends)), ", "))
+	}
+	if slices.ContainsFunc(vars, hasKey("RESTIC_REPOSITORY")) {
+		return nil, fmt.Errorf("RESTIC_REPOSITORY can't be set with backend, which builds it")
+	}
+
+	fields := append(slices.Clone(backend.fields), commonBackendFields...)
+	values := map[string]string{}
+	var credentials, others []string
+	for j, kv := range vars {
+		key, value, _ := strings.Cut(kv, "=")
+		if j == i || !isTypedKey(key) {
+			if j != i {
+				others = append(others, kv)
+			}
+			continue
+		}
+		k := slices.IndexFunc(fields, func(f backendField) bool { return f.key == key })
+		if k < 0 {
+			keys := make([]string, len(fields))
+			for n, f := range fields {
+				keys[n] = f.key
+			}
+			return nil, fmt.Errorf("unknown key '%s' for backend %s, must be one of %s", key, name, strings.Join(keys, ", "))
+		}
+		if fields[k].variable != "" {
+			if slices.ContainsFunc(vars, hasKey(fields[k].variable)) {
+				return nil, fmt.Errorf("%s and %s set the same variable", key, fields[k].variable)
+			}
+			credentials = append(credentials, fields[k].variable+"="+value)
+		}
+		values[key] = value
+	}
+	for _, field := range fields {
+		if field.required && values[field.key] == "" {
+			return nil, fmt.Errorf("backend %s requires %s", name, field.key)
+		}
+	}
+
+	repository, err := backend.repository(values)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %w", name, err)
+	}
+	var options []string
+	if backend.options != nil {
+		if options, err = backend.options(values); err != nil {
+			return nil, fmt.Errorf("backend %s: %w", name, err)
+		}
+	}
+	for _, option := range options {
+		built, _, _ := strings.Cut(option, "=")
+		for _, key := range backend.optionKeys {
+			if slices.ContainsFunc(others, hasKey(key)) {
+				return nil, fmt.Errorf("%s can't be set with the keys of backend %s that build %s", key, name, built)
+			}
+		}
+	}
+	return slices.Concat([]string{"RESTIC_REPOSITORY=" + repository}, credentials, options, others), nil
+}
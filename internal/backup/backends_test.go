@@ -0,0 +1,166 @@
+package backup
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandRepositoryBackend(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        string
+		expected      []string
+		errorContains string
+	}{
+		{
+			name:     "untyped",
+			config:   "RESTIC_REPOSITORY: b2:bucket/home\nRESTIC_PASSWORD: secret\n",
+			expected: []string{"RESTIC_REPOSITORY=b2:bucket/home", "RESTIC_PASSWORD=secret"},
+		},
+		{
+			name:     "local",
+			config:   "backend: local\npath: /srv/restic/home\npassword: secret\n",
+			expected: []string{"RESTIC_REPOSITORY=/srv/restic/home", "RESTIC_PASSWORD=secret"},
+		},
+		{
+			name: "s3",
+			config: "backend: s3\nendpoint: https://minio.example.com:9000/\nbucket: backups\nprefix: /home/\n" +
+				"access_key_id: AKIA\nsecret_access_key: vault:secret/data/s3#key\npassword_command: pass show restic\nAWS_SESSION_TOKEN: token\n",
+			expected: []string{"RESTIC_REPOSITORY=s3:https://minio.example.com:9000/backups/home", "AWS_ACCESS_KEY_ID=AKIA",
+				"AWS_SECRET_ACCESS_KEY=vault:secret/data/s3#key", "RESTIC_PASSWORD_COMMAND=pass show restic", "AWS_SESSION_TOKEN=token"},
+		},
+		{
+			name:     "s3_default_endpoint",
+			config:   "backend: s3\nbucket: backups\nregion: eu-central-1\n",
+			expected: []string{"RESTIC_REPOSITORY=s3:s3.amazonaws.com/backups", "AWS_DEFAULT_REGION=eu-central-1"},
+		},
+		{
+			name:     "b2",
+			config:   "backend: b2\nbucket: backups\nprefix: home\naccount_id: id\naccount_key: key\n",
+			expected: []string{"RESTIC_REPOSITORY=b2:backups:home", "B2_ACCOUNT_ID=id", "B2_ACCOUNT_KEY=key"},
+		},
+		{
+			name:     "sftp",
+			config:   "backend: sftp\nuser: backup\nhost: nas\npath: /srv/restic\n",
+			expected: []string{"RESTIC_REPOSITORY=sftp:backup@nas:/srv/restic"},
+		},
+		{
+			name:     "sftp_port",
+			config:   "backend: sftp\nhost: nas\nport: 2222\npath: /srv/restic\n",
+			expected: []string{"RESTIC_REPOSITORY=sftp://nas:2222//srv/restic"},
+		},
+		{
+			name: "sftp_ssh_options",
+			config: "backend: sftp\nuser: backup\nhost: nas\npath: /srv/restic\njump_host: admin@bastion.example.com:2222\n" +
+				"identity_file: /etc/btrfs-backup/id_ed25519\nknown_hosts_file: /etc/btrfs-backup/known_hosts\nsftp.connections: \"2\"\n",
+			expected: []string{"RESTIC_REPOSITORY=sftp:backup@nas:/srv/restic",
+				"sftp.args=-J admin@bastion.example.com:2222 -i /etc/btrfs-backup/id_ed25519 -o IdentitiesOnly=yes" +
+					" -o UserKnownHostsFile=/etc/btrfs-backup/known_hosts -o StrictHostKeyChecking=yes",
+				"sftp.connections=2"},
+		},
+		{
+			name:     "untyped_sftp_command",
+			config:   "RESTIC_REPOSITORY: sftp:nas:/srv/restic\nsftp.command: ssh -J bastion backup@nas -s sftp\n",
+			expected: []string{"RESTIC_REPOSITORY=sftp:nas:/srv/restic", "sftp.command=ssh -J bastion backup@nas -s sftp"},
+		},
+		{
+			name:     "rest",
+			config:   "backend: rest\nurl: https://backup.example.com:8000/home\nrest_username: home\nrest_password: secret\n",
+			expected: []string{"RESTIC_REPOSITORY=rest:https://backup.example.com:8000/home", "RESTIC_REST_USERNAME=home", "RESTIC_REST_PASSWORD=secret"},
+		},
+		{
+			name:     "rclone",
+			config:   "backend: rclone\nremote: gdrive:\npath: backups/home\n",
+			expected: []string{"RESTIC_REPOSITORY=rclone:gdrive:backups/home"},
+		},
+		{
+			name:     "rclone_options",
+			config:   "backend: rclone\nremote: gdrive\npath: backups/home\nrclone.program: /usr/local/bin/rclone\nrclone.args: serve restic --stdio --drive-use-trash=false\n",
+			expected: []string{"RESTIC_REPOSITORY=rclone:gdrive:backups/home", "rclone.program=/usr/local/bin/rclone", "rclone.args=serve restic --stdio --drive-use-trash=false"},
+		},
+		{
+			name:     "untyped_options",
+			config:   "RESTIC_REPOSITORY: s3:s3.amazonaws.com/backups\ns3.storage-class: STANDARD_IA\n",
+			expected: []string{"RESTIC_REPOSITORY=s3:s3.amazonaws.com/backups", "s3.storage-class=STANDARD_IA"},
+		},
+		{
+			name:          "unknown_backend",
+			config:        "backend: ftp\n",
+			errorContains: "unknown backend 'ftp', must be one of b2, local, rclone, rest, s3, sftp",
+		},
+		{
+			name:          "unknown_key",
+			config:        "backend: s3\nbucket: backups\nbuckett: typo\n",
+			errorContains: "unknown key 'buckett' for backend s3",
+		},
+		{
+			name:          "missing_required",
+			config:        "backend: b2\nprefix: home\n",
+			errorContains: "backend b2 requires bucket",
+		},
+		{
+			name:          "bucket_with_path",
+			config:        "backend: s3\nbucket: backups/home\n",
+			errorContains: "set the path in it as prefix",
+		},
+		{
+			name:          "relative_local_path",
+			config:        "backend: local\npath: restic\n",
+			errorContains: "path must be absolute",
+		},
+		{
+			name:          "relative_identity_file",
+			config:        "backend: sftp\nhost: nas\npath: /srv/restic\nidentity_file: .ssh/id_ed25519\n",
+			errorContains: "identity_file must be absolute",
+		},
+		{
+			name:          "ssh_argument_with_space",
+			config:        "backend: sftp\nhost: nas\npath: /srv/restic\nidentity_file: /etc/btrfs backup/id_ed25519\n",
+			errorContains: "can't contain white space or quotes",
+		},
+		{
+			name:          "sftp_command_with_ssh_options",
+			config:        "backend: sftp\nhost: nas\npath: /srv/restic\njump_host: bastion\nsftp.command: ssh nas -s sftp\n",
+			errorContains: "sftp.command can't be set with the keys of backend sftp that build sftp.args",
+		},
+		{
+			name:          "rest_without_scheme",
+			config:        "backend: rest\nurl: backup.example.com\n",
+			errorContains: "url must start with http:// or https://",
+		},
+		{
+			name:          "repository_set_twice",
+			config:        "backend: local\npath: /srv/restic\nRESTIC_REPOSITORY: /srv/other\n",
+			errorContains: "RESTIC_REPOSITORY can't be set with backend",
+		},
+		{
+			name:          "variable_set_twice",
+			config:        "backend: b2\nbucket: backups\naccount_id: id\nB2_ACCOUNT_ID: other\n",
+			errorContains: "account_id and B2_ACCOUNT_ID set the same variable",
+		},
+		{
+			name:          "password_and_command",
+			config:        "backend: local\npath: /srv/restic\npassword: secret\npassword_command: pass show restic\n",
+			errorContains: "sets both RESTIC_PASSWORD and password_command",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars, err := checkRepositoryVariables(parseRepositoryVariables([]byte(tt.config)), "repository config")
+			if tt.errorContains != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got %v", tt.errorContains, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			if !slices.Equal(vars, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, vars)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"btrfs-backup/internal/checksum"
+	"btrfs-backup/internal/config"
+)
+
+// checksumTag replaces the "btrfs-backup" tag on the restic snapshots holding checksum
+// manifests, so they are listed, forgotten and verified apart from the backups.
+const checksumTag = "btrfs-backup-checksums"
+
+// checksumFile returns the name of the checksum manifest of a local snapshot in the
+// repository.
+func checksumFile(snapshotName string) string {
+	return snapshotName + ".sha256"
+}
+
+// BackupChecksums uploads the checksum manifest of a snapshot, listing the SHA-256 of the
+// share of its files set by the target's checksum_manifest, see checksum.Write, with
+// 'restic backup --stdin' as a file named after the snapshot, in a restic snapshot tagged
+// with checksumTag, the target's prefix and the snapshot name.
+// In dry-run mode only the restic command is printed.
+func (bm *Manager) BackupChecksums(ctx context.Context, snapshotPath string, target *config.TargetConfig) error {
+	snapshotName := filepath.Base(snapshotPath)
+	return bm.uploadManifest(ctx, target, snapshotName, checksumTag, checksumFile(snapshotName), "checksum manifest", func(w io.Writer) error {
+		files, err := checksum.Write(ctx, os.DirFS(snapshotPath), w, target.ChecksumPercent())
+		if err != nil {
+			return fmt.Errorf("checksum manifest failed: %w", err)
+		}
+		slog.Debug("Checksum manifest written", "snapshot", snapshotName, "files", files)
+		return nil
+	})
+}
+
+// VerifyChecksums checks the tree restored at dir against the checksum manifest uploaded
+// by BackupChecksums for a snapshot of the target, independently of restic's own
+// integrity checks. The manifest is selected by local snapshot name, or the newest one if
+// snapshot is empty, and read with 'restic dump' using the read-only credentials of the
+// repository if configured. Returns the name of the snapshot of the manifest and the
+// result, which holds the files that differ or are missing.
+func (bm *Manager) VerifyChecksums(ctx context.Context, target *config.TargetConfig, snapshot, dir string) (string, *checksum.Result, error) {
+	var result *checksum.Result
+	snapshotName, err := bm.readManifest(ctx, target, snapshot, checksumTag, "checksum manifest", checksumFile, func(r io.Reader) error {
+		var err error
+		result, err = checksum.Verify(ctx, os.DirFS(dir), r)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return snapshotName, result, nil
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/restic"
+)
+
+func TestBackupChecksums(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "home-20230102-120000")
+	if err := os.MkdirAll(filepath.Join(snapshotPath, "docs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(snapshotPath, "docs", "a.txt"), []byte("alpha"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockRestic := NewMockResticClient(t)
+	mgr := NewManagerWithDeps(&config.Config{ResticRepoDir: "/repos"}, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+	target := &config.TargetConfig{Prefix: "home", Repository: "b2-home", ChecksumManifest: config.ChecksumFull}
+
+	mockRestic.ExpectBackupSummary(&restic.Summary{})
+	if err := mgr.BackupChecksums(context.Background(), snapshotPath, target); err != nil {
+		t.Fatalf("BackupChecksums failed: %v", err)
+	}
+	if mockRestic.lastFilename != "home-20230102-120000.sha256" ||
+		!slices.Equal(mockRestic.lastBackup.Tags, []string{checksumTag, "home", "home-20230102-120000"}) {
+		t.Errorf("Unexpected manifest upload %s with tags %v", mockRestic.lastFilename, mockRestic.lastBackup.Tags)
+	}
+	expected := "8ed3f6ad685b959ead7022518e1af76cd816f8e8ec7ccdda1ed4018e8f2223f8  docs/a.txt\n"
+	if mockRestic.lastStdin != expected {
+		t.Errorf("Expected manifest:\n%s\ngot:\n%s", expected, mockRestic.lastStdin)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockRestic := NewMockResticClient(t)
+	mockRestic.dumpOutput = "8ed3f6ad685b959ead7022518e1af76cd816f8e8ec7ccdda1ed4018e8f2223f8  a.txt\n" +
+		"3b2d6ba6ea1b0d6e2e6e4bd4e6e4b5c2a2ee6c1a0bb1e58c0c6e6fa8bdf8c3d0  b.txt\n"
+	mgr := NewManagerWithDeps(&config.Config{ResticRepoDir: "/repos"}, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+	target := &config.TargetConfig{Prefix: "home", Repository: "b2-home", ChecksumManifest: "10%"}
+	manifests := []restic.Snapshot{
+		{ID: "aaa111", ShortID: "aaa111", Time: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC), Tags: []string{checksumTag, "home", "home-20230101-120000"}},
+		{ID: "bbb222", ShortID: "bbb222", Time: time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC), Tags: []string{checksumTag, "home", "home-20230102-120000"}},
+	}
+
+	mockRestic.ExpectSnapshots([]string{checksumTag, "home"}, manifests, 0)
+	mockRestic.ExpectDump("aaa111", "/home-20230101-120000.sha256", 0)
+	snapshot, result, err := mgr.VerifyChecksums(context.Background(), target, "home-20230101-120000", dir)
+	if err != nil {
+		t.Fatalf("VerifyChecksums failed: %v", err)
+	}
+	if snapshot != "home-20230101-120000" || result.Checked != 1 || !slices.Equal(result.Missing, []string{"b.txt"}) || len(result.Mismatched) != 0 {
+		t.Errorf("Unexpected verification of %s: %+v", snapshot, result)
+	}
+
+	mockRestic.ExpectSnapshots([]string{checksumTag, "home"}, nil, 0)
+	if _, _, err := mgr.VerifyChecksums(context.Background(), target, "", dir); err == nil || !strings.Contains(err.Error(), "repository has no checksum manifests of home") {
+		t.Errorf("Expected missing manifest error, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+
+	"btrfs-backup/internal/state"
+)
+
+// ChurnPeriod is the data a target added to its repository in a day or week.
+type ChurnPeriod struct {
+	Start     time.Time `json:"start"`
+	Uploads   int       `json:"uploads"`
+	DataAdded int64     `json:"data_added"`
+}
+
+// ChurnReport summarizes the rate of change of a target over a window, from the
+// uploads recorded in its state file.
+type ChurnReport struct {
+	Target         string        `json:"target"`
+	From           time.Time     `json:"from"` // start of the window, or of the upload history if it's shorter
+	To             time.Time     `json:"to"`
+	Uploads        int           `json:"uploads"`
+	DataAdded      int64         `json:"data_added"`
+	DailyAverage   int64         `json:"daily_average"`
+	WeeklyAverage  int64         `json:"weekly_average"`
+	ProjectedMonth int64         `json:"projected_30d"`  // repository growth in the next 30 days at the daily average
+	ProjectedYear  int64         `json:"projected_365d"` // repository growth in the next 365 days at the daily average
+	Days           []ChurnPeriod `json:"days"`
+	Weeks          []ChurnPeriod `json:"weeks"` // weeks starting on Monday
+}
+
+// Churn reports the data a target added to its repository per day and week in the
+// window up to now, and projects the growth of the repository at the daily average.
+// Days and weeks are in the time zone of now. Averages are taken over the part of the
+// window covered by the upload history, so a target recording uploads for only a week
+// isn't averaged over a month, and only count data restic reported as added, before
+// restic retention removes any.
+func (bm *Manager) Churn(targetName string, window time.Duration, now time.Time) (*ChurnReport, error) {
+	if bm.config.StateDir == "" {
+		return nil, fmt.Errorf("no state_dir configured to record uploads in")
+	}
+	st, err := state.Load(bm.config.StateDir, targetName)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ChurnReport{Target: targetName, From: now.Add(-window), To: now, Days: []ChurnPeriod{}, Weeks: []ChurnPeriod{}}
+	if len(st.Uploads) > 0 && st.Uploads[0].Time.After(report.From) {
+		report.From = st.Uploads[0].Time
+	}
+
+	for day := startOfDay(report.From); day.Before(now); day = day.AddDate(0, 0, 1) {
+		report.Days = append(report.Days, ChurnPeriod{Start: day})
+	}
+	for week := startOfWeek(report.From); week.Before(now); week = week.AddDate(0, 0, 7) {
+		report.Weeks = append(report.Weeks, ChurnPeriod{Start: week})
+	}
+
+	for _, upload := range st.Uploads {
+		if upload.Time.Before(report.From) || upload.Time.After(now) {
+			continue
+		}
+		report.Uploads++
+		report.DataAdded += upload.DataAdded
+		addToPeriod(report.Days, upload)
+		addToPeriod(report.Weeks, upload)
+	}
+
+	days := max(report.To.Sub(report.From).Hours()/24, 1)
+	daily := float64(report.DataAdded) / days
+	report.DailyAverage = int64(daily)
+	report.WeeklyAverage = int64(daily * 7)
+	report.ProjectedMonth = int64(daily * 30)
+	report.ProjectedYear = int64(daily * 365)
+	return report, nil
+}
+
+// addToPeriod adds an upload to the last of the periods, sorted by start, it falls in.
+func addToPeriod(periods []ChurnPeriod, upload state.Upload) {
+	for i := len(periods) - 1; i >= 0; i-- {
+		if !upload.Time.Before(periods[i].Start) {
+			periods[i].Uploads++
+			periods[i].DataAdded += upload.DataAdded
+			return
+		}
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// startOfWeek returns the start of the Monday of t's week.
+func startOfWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/state"
+)
+
+func TestChurn(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	// Wednesday noon; daily uploads of 1 MiB for the last 10 days and one older upload
+	now := time.Date(2023, 3, 15, 12, 0, 0, 0, time.UTC)
+	st := &state.Target{}
+	st.AddUpload(state.Upload{Time: now.AddDate(0, 0, -40), DataAdded: 1 << 30})
+	for i := 10; i >= 1; i-- {
+		st.AddUpload(state.Upload{Time: now.AddDate(0, 0, -i).Add(-9 * time.Hour), DataAdded: 1 << 20})
+	}
+	if err := state.Save(cfg.StateDir, "home", st); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	report, err := mgr.Churn("home", 14*24*time.Hour, now)
+	if err != nil {
+		t.Fatalf("Churn failed: %v", err)
+	}
+
+	if report.Uploads != 10 || report.DataAdded != 10<<20 {
+		t.Errorf("Expected 10 uploads adding 10 MiB in the window, got %d adding %d", report.Uploads, report.DataAdded)
+	}
+	if report.DailyAverage != 10<<20/14 || report.ProjectedMonth != 30*(10<<20)/14 {
+		t.Errorf("Expected averages over the 14 day window, got daily %d and 30 days %d", report.DailyAverage, report.ProjectedMonth)
+	}
+	if len(report.Days) != 15 || report.Days[4].Start != time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC) || report.Days[4].Uploads != 1 {
+		t.Errorf("Unexpected days %+v", report.Days)
+	}
+	if len(report.Weeks) != 3 || report.Weeks[0].Start != time.Date(2023, 2, 27, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("Expected 3 weeks starting on Monday 2023-02-27, got %+v", report.Weeks)
+	}
+	// Uploads on Sunday 5 March, Monday 6 to Sunday 12 March and 13 to 14 March
+	if report.Weeks[0].Uploads != 1 || report.Weeks[1].Uploads != 7 || report.Weeks[2].Uploads != 2 {
+		t.Errorf("Unexpected weekly uploads %+v", report.Weeks)
+	}
+
+	// A history shorter than the window is averaged over the history only
+	report, err = mgr.Churn("home", 365*24*time.Hour, now)
+	if err != nil {
+		t.Fatalf("Churn failed: %v", err)
+	}
+	if !report.From.Equal(st.Uploads[0].Time) || report.Uploads != 11 {
+		t.Errorf("Expected the window to start at the first upload, got %v with %d uploads", report.From, report.Uploads)
+	}
+
+	if _, err := NewManagerWithDeps(&config.Config{}, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t)).Churn("home", time.Hour, now); err == nil {
+		t.Error("Expected error without state_dir")
+	}
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"btrfs-backup/internal/command"
+	"btrfs-backup/internal/config"
+)
+
+// CredentialProvider reads repository configurations stored in one particular way, e.g.
+// encrypted, and returns their plaintext contents without writing them to disk.
+type CredentialProvider interface {
+	// Suffix is the file name suffix of the repository configurations the provider
+	// reads, empty for plaintext files.
+	Suffix() string
+	// Read returns the plaintext contents of the repository configuration at path.
+	Read(path string) ([]byte, error)
+}
+
+// defaultCredentialProviders returns the providers of the repository configurations of
+// cfg in the order their files are looked up: plaintext, age and GPG.
+func defaultCredentialProviders(cfg *config.Config, fs FileSystem) []CredentialProvider {
+	return []CredentialProvider{
+		plainCredentials{fs: fs},
+		ageCredentials{bin: cfg.AgeBin, identity: cfg.AgeIdentity},
+		gpgCredentials{bin: cfg.GPGBin},
+	}
+}
+
+// plainCredentials reads plaintext repository configurations.
+type plainCredentials struct {
+	fs FileSystem
+}
+
+func (p plainCredentials) Suffix() string { return "" }
+
+func (p plainCredentials) Read(path string) ([]byte, error) {
+	return p.fs.ReadFile(path)
+}
+
+// ageCredentials decrypts repository configurations ending in .age with the age binary
+// and the age_identity of the main configuration.
+type ageCredentials struct {
+	bin      string
+	identity string
+}
+
+func (a ageCredentials) Suffix() string { return ".age" }
+
+func (a ageCredentials) Read(path string) ([]byte, error) {
+	if a.identity == "" {
+		return nil, fmt.Errorf("file is age-encrypted, but no age_identity is configured")
+	}
+	data, err := command.Output(command.Command(context.Background(), a.bin, "--decrypt", "--identity", a.identity, path))
+	if err != nil {
+		return nil, fmt.Errorf("age decryption failed: %w", err)
+	}
+	return data, nil
+}
+
+// gpgCredentials decrypts repository configurations ending in .gpg with gpg, which
+// gets the secret key from gpg-agent. gpg runs in batch mode, so a key whose passphrase
+// isn't cached by the agent fails instead of waiting for input.
+type gpgCredentials struct {
+	bin string
+}
+
+func (g gpgCredentials) Suffix() string { return ".gpg" }
+
+func (g gpgCredentials) Read(path string) ([]byte, error) {
+	data, err := command.Output(command.Command(context.Background(), g.bin, "--batch", "--quiet", "--decrypt", path))
+	if err != nil {
+		return nil, fmt.Errorf("gpg decryption failed: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,265 @@
+package backup
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/keyring"
+)
+
+func TestRepositoryVariablesAge(t *testing.T) {
+	dir := t.TempDir()
+	// Stand-in for age that "decrypts" by reversing the lines of the file
+	ageBin := filepath.Join(dir, "age")
+	script := "#!/bin/sh\n[ \"$1 $2 $3\" = \"--decrypt --identity /etc/btrfs-backup/key.txt\" ] || exit 1\ntac \"$4\"\n"
+	if err := os.WriteFile(ageBin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	repoDir := filepath.Join(dir, "repos")
+	if err := os.Mkdir(repoDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repoDir, "b2-home.age"), []byte("RESTIC_PASSWORD: secret\nRESTIC_REPOSITORY: b2:bucket/home\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{ResticRepoDir: repoDir, AgeBin: ageBin}
+	if _, err := NewManager(cfg, false).RepositoryVariables("b2-home"); err == nil || !strings.Contains(err.Error(), "no age_identity") {
+		t.Errorf("Expected error without age_identity, got %v", err)
+	}
+
+	cfg.AgeIdentity = "/etc/btrfs-backup/key.txt"
+	vars, err := NewManager(cfg, false).ReadOnlyRepositoryVariables("b2-home")
+	if err != nil {
+		t.Fatalf("ReadOnlyRepositoryVariables failed: %v", err)
+	}
+	if !slices.Equal(vars, []string{"RESTIC_REPOSITORY=b2:bucket/home", "RESTIC_PASSWORD=secret"}) {
+		t.Errorf("Unexpected decrypted variables %v", vars)
+	}
+
+	cfg.AgeIdentity = "/wrong/key.txt"
+	if _, err := NewManager(cfg, false).RepositoryVariables("b2-home"); err == nil || !strings.Contains(err.Error(), "age decryption failed") {
+		t.Errorf("Expected decryption error, got %v", err)
+	}
+}
+
+func TestRepositoryVariablesGPG(t *testing.T) {
+	dir := t.TempDir()
+	// Stand-in for gpg that "decrypts" by upper-casing the file
+	gpgBin := filepath.Join(dir, "gpg")
+	script := "#!/bin/sh\n[ \"$1 $2 $3\" = \"--batch --quiet --decrypt\" ] || exit 2\ngrep -q FAIL \"$4\" && { echo 'gpg: decryption failed: No secret key' >&2; exit 2; }\ntr a-z A-Z < \"$4\"\n"
+	if err := os.WriteFile(gpgBin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	repoDir := filepath.Join(dir, "repos")
+	if err := os.Mkdir(repoDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"b2-home.gpg":          "restic_password: secret\n",
+		"b2-home.readonly.gpg": "restic_password: read-only\n",
+		"local":                "RESTIC_PASSWORD: plain\n",
+		"local.gpg":            "restic_password: encrypted\n",
+		"broken.gpg":           "FAIL\n",
+	} {
+		if err := os.WriteFile(filepath.Join(repoDir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mgr := NewManager(&config.Config{ResticRepoDir: repoDir, GPGBin: gpgBin}, false)
+	for _, tt := range []struct {
+		repository string
+		readOnly   bool
+		expected   string
+	}{
+		{repository: "b2-home", expected: "RESTIC_PASSWORD=SECRET"},
+		{repository: "b2-home", readOnly: true, expected: "RESTIC_PASSWORD=READ-ONLY"},
+		{repository: "local", expected: "RESTIC_PASSWORD=plain"},
+	} {
+		lookup := mgr.RepositoryVariables
+		if tt.readOnly {
+			lookup = mgr.ReadOnlyRepositoryVariables
+		}
+		vars, err := lookup(tt.repository)
+		if err != nil {
+			t.Fatalf("Reading repository %s failed: %v", tt.repository, err)
+		}
+		if !slices.Equal(vars, []string{tt.expected}) {
+			t.Errorf("Expected %s for repository %s (read-only %v), got %v", tt.expected, tt.repository, tt.readOnly, vars)
+		}
+	}
+
+	_, err := mgr.RepositoryVariables("broken")
+	if err == nil || !strings.Contains(err.Error(), "gpg decryption failed") || !strings.Contains(err.Error(), "No secret key") {
+		t.Errorf("Expected decryption error with gpg's message, got %v", err)
+	}
+}
+
+// reversedCredentials is a credential provider reading files ending in .rev backwards.
+type reversedCredentials struct {
+	fs FileSystem
+}
+
+func (r reversedCredentials) Suffix() string { return ".rev" }
+
+func (r reversedCredentials) Read(path string) ([]byte, error) {
+	data, err := r.fs.ReadFile(path)
+	slices.Reverse(data)
+	return data, err
+}
+
+func TestSetCredentialProviders(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddFile("/repos/b2-home.rev", []byte("terces :DROWSSAP_CITSER"))
+	fs.AddFile("/repos/local", []byte("RESTIC_PASSWORD: plain"))
+	fs.SetStatError("/repos/b2-home", os.ErrNotExist)
+	fs.SetStatError("/repos/local.rev", os.ErrNotExist)
+
+	mgr := NewManagerWithDeps(&config.Config{ResticRepoDir: "/repos"}, false, fs, NewMockBtrfsClient(t), NewMockResticClient(t))
+	mgr.SetCredentialProviders(reversedCredentials{fs: fs})
+
+	vars, err := mgr.RepositoryVariables("b2-home")
+	if err != nil || !slices.Equal(vars, []string{"RESTIC_PASSWORD=secret"}) {
+		t.Errorf("Expected variables read by the custom provider, got %v (%v)", vars, err)
+	}
+	if _, err := mgr.RepositoryVariables("local"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected plaintext configuration to be ignored without its provider, got %v", err)
+	}
+}
+
+func TestRepositoryVariablesKeyring(t *testing.T) {
+	dir := t.TempDir()
+	// Stand-in for secret-tool keeping one file per repository
+	bin := filepath.Join(dir, "secret-tool")
+	script := "#!/bin/sh\nop=$1; shift\n[ \"$op\" = store ] && shift 2\nfile=\"" + dir + "/$4\"\n" +
+		"case $op in\nlookup) [ -f \"$file\" ] || exit 1; cat \"$file\" ;;\nstore) cat > \"$file\" ;;\nesac\n"
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	mgr := NewManager(&config.Config{SecretBackend: config.SecretBackendKeyring, SecretToolBin: bin}, false)
+	ctx := t.Context()
+	if _, err := mgr.RepositoryVariables("b2-home"); !errors.Is(err, keyring.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for missing keyring entry, got %v", err)
+	}
+	if err := mgr.StoreRepositorySecret(ctx, "b2-home", []byte("just a password\n")); err == nil {
+		t.Error("Expected error storing a configuration without variables")
+	}
+
+	if err := mgr.StoreRepositorySecret(ctx, "b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/home\nRESTIC_PASSWORD: secret\n")); err != nil {
+		t.Fatalf("StoreRepositorySecret failed: %v", err)
+	}
+	vars, err := mgr.ReadOnlyRepositoryVariables("b2-home")
+	if err != nil || !slices.Equal(vars, []string{"RESTIC_REPOSITORY=b2:bucket/home", "RESTIC_PASSWORD=secret"}) {
+		t.Errorf("Expected variables from the keyring, got %v (%v)", vars, err)
+	}
+
+	if err := mgr.StoreRepositorySecret(ctx, "b2-home.readonly", []byte("RESTIC_PASSWORD: read-only\n")); err != nil {
+		t.Fatalf("StoreRepositorySecret failed: %v", err)
+	}
+	vars, err = mgr.ReadOnlyRepositoryVariables("b2-home")
+	if err != nil || !slices.Equal(vars, []string{"RESTIC_PASSWORD=read-only"}) {
+		t.Errorf("Expected read-only variables from the keyring, got %v (%v)", vars, err)
+	}
+}
+
+func TestRepositoryVariablesEnv(t *testing.T) {
+	t.Setenv("RESTIC_REPOSITORY", "")
+	t.Setenv("RESTIC_REPOSITORY_FILE", "")
+	mgr := NewManager(&config.Config{SecretBackend: config.SecretBackendEnv}, false)
+	if _, err := mgr.RepositoryVariables("b2-home"); err == nil || !strings.Contains(err.Error(), "BTRFSBACKUP_REPOSITORY_B2_HOME") {
+		t.Errorf("Expected error naming the repository variable, got %v", err)
+	}
+
+	// restic reads its own variables from the environment, but only for the inline target
+	// as the only target
+	t.Setenv("RESTIC_REPOSITORY", "s3:s3.amazonaws.com/bucket")
+	if _, err := mgr.RepositoryVariables("b2-home"); err == nil {
+		t.Error("Expected error for RESTIC_REPOSITORY without the inline target")
+	}
+	t.Setenv("BTRFSBACKUP_TARGET_SUBVOLUME", "/home")
+	t.Setenv("BTRFSBACKUP_TARGET_PREFIX", "home")
+	t.Setenv("BTRFSBACKUP_TARGET_REPOSITORY", "b2-home")
+	// The targets are loaded once per manager
+	if _, err := mgr.RepositoryVariables("b2-home"); err == nil {
+		t.Error("Expected the targets loaded by the first call to be kept")
+	}
+	mgr = NewManager(&config.Config{SecretBackend: config.SecretBackendEnv}, false)
+	if vars, err := mgr.RepositoryVariables("b2-home"); err != nil || len(vars) != 0 {
+		t.Errorf("Expected no variables besides the environment, got %v (%v)", vars, err)
+	}
+	if _, err := mgr.RepositoryVariables("nas"); err == nil {
+		t.Error("Expected error for RESTIC_REPOSITORY with a repository other than the inline target's")
+	}
+	targetDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(targetDir, "docs.yaml"), []byte("subvolume: /docs\nprefix: docs\nrepository: nas\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	withTargets := NewManager(&config.Config{SecretBackend: config.SecretBackendEnv, TargetDir: targetDir}, false)
+	if _, err := withTargets.RepositoryVariables("b2-home"); err == nil {
+		t.Error("Expected error for RESTIC_REPOSITORY with target files besides the inline target")
+	}
+
+	// Repositories mapping to the same variable
+	colliding := NewManager(&config.Config{
+		SecretBackend: config.SecretBackendEnv,
+		Repositories:  map[string]config.RepositoryConfig{"b2_home": {}},
+	}, false)
+	if _, err := colliding.RepositoryVariables("b2-home"); err == nil || !strings.Contains(err.Error(), "b2_home") {
+		t.Errorf("Expected error for repositories mapping to the same variable, got %v", err)
+	}
+
+	t.Setenv("BTRFSBACKUP_REPOSITORY_B2_HOME", "RESTIC_REPOSITORY: b2:bucket/home\nRESTIC_PASSWORD: secret\n")
+	vars, err := mgr.ReadOnlyRepositoryVariables("b2-home")
+	if err != nil || !slices.Equal(vars, []string{"RESTIC_REPOSITORY=b2:bucket/home", "RESTIC_PASSWORD=secret"}) {
+		t.Errorf("Expected variables from the environment, got %v (%v)", vars, err)
+	}
+	t.Setenv("BTRFSBACKUP_REPOSITORY_B2_HOME_READONLY", "RESTIC_PASSWORD: read-only")
+	vars, err = mgr.ReadOnlyRepositoryVariables("b2-home")
+	if err != nil || !slices.Equal(vars, []string{"RESTIC_PASSWORD=read-only"}) {
+		t.Errorf("Expected read-only variables from the environment, got %v (%v)", vars, err)
+	}
+}
+
+func TestRepositoryVariablesVault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/backup/b2" || r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"data":{"key_id":"id123","key":"key123"},"metadata":{}}}`))
+	}))
+	defer server.Close()
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "s.token")
+
+	fs := NewMockFileSystem()
+	fs.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/home\n"+
+		"B2_ACCOUNT_ID: vault:secret/data/backup/b2#key_id\nB2_ACCOUNT_KEY: vault:secret/data/backup/b2#key\n"))
+	fs.AddFile("/repos/denied", []byte("RESTIC_PASSWORD: vault:secret/data/other#password\n"))
+	mgr := NewManagerWithDeps(&config.Config{ResticRepoDir: "/repos"}, false, fs, NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	vars, err := mgr.RepositoryVariables("b2-home")
+	expected := []string{"RESTIC_REPOSITORY=b2:bucket/home", "B2_ACCOUNT_ID=id123", "B2_ACCOUNT_KEY=key123"}
+	if err != nil || !slices.Equal(vars, expected) {
+		t.Errorf("Expected %v, got %v (%v)", expected, vars, err)
+	}
+
+	_, err = mgr.RepositoryVariables("denied")
+	if err == nil || !strings.Contains(err.Error(), "RESTIC_PASSWORD") || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected Vault error naming the variable, got %v", err)
+	}
+
+	t.Setenv("VAULT_ADDR", "")
+	if _, err := mgr.RepositoryVariables("b2-home"); err == nil || !strings.Contains(err.Error(), "VAULT_ADDR") {
+		t.Errorf("Expected error without VAULT_ADDR, got %v", err)
+	}
+}
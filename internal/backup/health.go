@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/schedule"
+	"btrfs-backup/internal/state"
+)
+
+// Health is the health score of a target's backup chain, from 0 to 100, and the issues
+// that lowered it. The score adds up:
+//
+//   - freshness, 40 points: all while at most one scheduled run passed since the last
+//     successful backup, as that run may still be in progress, half after two and none
+//     after three or if the target never succeeded
+//   - failures, 25 points: 15 after one failed run in a row, 5 after two and none after
+//     three or more
+//   - repository check, 20 points: none while the last verification failed
+//   - verification age, 15 points: all while no more scheduled runs than verify_every
+//     passed since the last successful verification, half while no more than twice as
+//     many, none beyond or if the repository was never verified
+//
+// Targets that don't verify their repository get the points of both verification parts.
+// Runs are counted by the target's schedule, or daily if it has none.
+type Health struct {
+	Score  int      `json:"score"`
+	Issues []string `json:"issues,omitempty"`
+}
+
+// Health points of the parts of the score.
+const (
+	healthFreshness = 40
+	healthFailures  = 25
+	healthCheck     = 20
+	healthVerifyAge = 15
+)
+
+// TargetHealth computes the health of a target from its state at now.
+func TargetHealth(target *config.TargetConfig, st *state.Target, now time.Time) Health {
+	var health Health
+	add := func(points int, issue string, args ...any) {
+		health.Score += points
+		if issue != "" {
+			health.Issues = append(health.Issues, fmt.Sprintf(issue, args...))
+		}
+	}
+
+	switch missed := scheduledRuns(target, st.LastSuccess, now, 3); {
+	case st.LastSuccess.IsZero():
+		add(0, "never backed up successfully")
+	case missed <= 1:
+		add(healthFreshness, "")
+	case missed == 2:
+		add(healthFreshness/2, "2 scheduled runs since the last successful backup")
+	default:
+		add(0, "3 or more scheduled runs since the last successful backup")
+	}
+
+	switch failures := st.ConsecutiveFailures; failures {
+	case 0:
+		add(healthFailures, "")
+	case 1:
+		add(15, "last run failed")
+	case 2:
+		add(5, "2 runs failed in a row")
+	default:
+		add(0, "%d runs failed in a row", failures)
+	}
+
+	if !target.Verify {
+		add(healthCheck+healthVerifyAge, "")
+		return health
+	}
+	if st.LastVerifyError != "" {
+		add(0, "last repository check failed")
+	} else {
+		add(healthCheck, "")
+	}
+	every := max(target.VerifyEvery, 1)
+	switch runs := scheduledRuns(target, st.LastVerify, now, 2*every+1); {
+	case st.LastVerify.IsZero():
+		add(0, "repository never verified")
+	case runs <= every:
+		add(healthVerifyAge, "")
+	case runs <= 2*every:
+		add(healthVerifyAge/2, "repository not verified for %d scheduled runs", runs)
+	default:
+		add(0, "repository not verified for more than %d scheduled runs", 2*every)
+	}
+	return health
+}
+
+// scheduledRuns counts the runs of the target's schedule after since up to now, stopping
+// at limit. Targets without a schedule, or with one passed to systemd as it is, are
+// counted as running daily.
+func scheduledRuns(target *config.TargetConfig, since, now time.Time, limit int) int {
+	if since.IsZero() {
+		return limit
+	}
+	s, err := schedule.Parse(target.Schedule)
+	if err != nil {
+		return min(int(now.Sub(since)/(24*time.Hour)), limit)
+	}
+	runs := 0
+	for next := s.Next(since); runs < limit && !next.After(now); next = s.Next(next) {
+		runs++
+	}
+	return runs
+}
@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/state"
+)
+
+func TestTargetHealth(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	daily := &config.TargetConfig{Schedule: "daily at 03:00"}
+	verified := &config.TargetConfig{Schedule: "daily at 03:00", Verify: true, VerifyEvery: 2}
+	lastRun := time.Date(2024, 3, 10, 3, 0, 5, 0, time.Local)
+
+	tests := []struct {
+		name         string
+		target       *config.TargetConfig
+		state        state.Target
+		expectScore  int
+		expectIssues []string
+	}{
+		{
+			name:        "healthy",
+			target:      verified,
+			state:       state.Target{LastSuccess: lastRun, LastVerify: lastRun.Add(-24 * time.Hour)},
+			expectScore: 100,
+		},
+		{
+			name:        "one_run_pending",
+			target:      daily,
+			state:       state.Target{LastSuccess: lastRun.Add(-24 * time.Hour)},
+			expectScore: 100,
+		},
+		{
+			name:         "stale_and_failing",
+			target:       daily,
+			state:        state.Target{LastSuccess: lastRun.Add(-48 * time.Hour), ConsecutiveFailures: 2},
+			expectScore:  20 + 5 + 35,
+			expectIssues: []string{"2 scheduled runs since the last successful backup", "2 runs failed in a row"},
+		},
+		{
+			name:         "never_succeeded",
+			target:       daily,
+			state:        state.Target{ConsecutiveFailures: 4},
+			expectScore:  35,
+			expectIssues: []string{"never backed up successfully", "4 runs failed in a row"},
+		},
+		{
+			name:         "check_failed",
+			target:       verified,
+			state:        state.Target{LastSuccess: lastRun, LastVerify: lastRun.Add(-72 * time.Hour), LastVerifyError: "repository verification failed"},
+			expectScore:  40 + 25 + 7,
+			expectIssues: []string{"last repository check failed", "repository not verified for 3 scheduled runs"},
+		},
+		{
+			name:         "never_verified",
+			target:       verified,
+			state:        state.Target{LastSuccess: lastRun},
+			expectScore:  85,
+			expectIssues: []string{"repository never verified"},
+		},
+		{
+			name:         "unparsed_schedule_counts_days",
+			target:       &config.TargetConfig{Schedule: "*-*-01 04:00"},
+			state:        state.Target{LastSuccess: now.Add(-73 * time.Hour)},
+			expectScore:  60,
+			expectIssues: []string{"3 or more scheduled runs since the last successful backup"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := TargetHealth(tt.target, &tt.state, now)
+			if health.Score != tt.expectScore || !slices.Equal(health.Issues, tt.expectIssues) {
+				t.Errorf("Expected score %d with issues %q, got %d with %q", tt.expectScore, tt.expectIssues, health.Score, health.Issues)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os/exec"
+	"time"
+
+	"btrfs-backup/internal/restic"
+	"btrfs-backup/internal/state"
+)
+
+// resticFor returns the client running the restic commands against repository, for the
+// target with prefix or, with an empty prefix, for the whole repository. The commands are
+// recorded in the repository's history in state_dir, see state.AppendHistory, unless
+// there is no state_dir or the manager is in dry-run mode.
+func (bm *Manager) resticFor(repository, prefix string) ResticClient {
+	if bm.config.StateDir == "" || bm.dryRun {
+		return bm.restic
+	}
+	return &historyClient{client: bm.restic, stateDir: bm.config.StateDir, repository: repository, prefix: prefix, runID: bm.runID}
+}
+
+// historyClient wraps a Client and records every command it runs in the history of a
+// repository. A history that can't be written is logged and doesn't fail the command.
+type historyClient struct {
+	client     ResticClient
+	stateDir   string
+	repository string
+	prefix     string
+	runID      string
+}
+
+// record appends the command started at start and ending with err to the history.
+func (c *historyClient) record(ctx context.Context, command string, start time.Time, err error) {
+	invocation := state.Invocation{
+		Time:     start.UTC(),
+		Command:  command,
+		Prefix:   c.prefix,
+		RunID:    c.runID,
+		Duration: time.Since(start).Seconds(),
+		Exit:     state.ExitSuccess,
+	}
+	if err != nil {
+		invocation.Error = err.Error()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			invocation.ExitCode = exitErr.ExitCode()
+		}
+		switch {
+		case ctx.Err() != nil:
+			invocation.Exit = state.ExitInterrupted
+		case restic.IsTransient(err):
+			invocation.Exit = state.ExitTransient
+		default:
+			invocation.Exit = state.ExitFailure
+		}
+	}
+	if historyErr := state.AppendHistory(c.stateDir, c.repository, invocation); historyErr != nil {
+		slog.Warn("Failed to record restic command in repository history", "repository", c.repository, "command", command, "error", historyErr)
+	}
+}
+
+func (c *historyClient) Backup(ctx context.Context, repositoryEnv []string, snapshotPath string, options restic.BackupOptions) (*restic.Summary, error) {
+	start := time.Now()
+	summary, err := c.client.Backup(ctx, repositoryEnv, snapshotPath, options)
+	c.record(ctx, "backup", start, err)
+	return summary, err
+}
+
+func (c *historyClient) BackupStdin(ctx context.Context, repositoryEnv []string, r io.Reader, filename string, options restic.BackupOptions) (*restic.Summary, error) {
+	start := time.Now()
+	summary, err := c.client.BackupStdin(ctx, repositoryEnv, r, filename, options)
+	c.record(ctx, "backup --stdin", start, err)
+	return summary, err
+}
+
+func (c *historyClient) Check(ctx context.Context, repositoryEnv []string, readDataSubset string) error {
+	start := time.Now()
+	err := c.client.Check(ctx, repositoryEnv, readDataSubset)
+	command := "check"
+	if readDataSubset != "" {
+		command += " --read-data-subset " + readDataSubset
+	}
+	c.record(ctx, command, start, err)
+	return err
+}
+
+func (c *historyClient) Restore(ctx context.Context, repositoryEnv []string, snapshotID, path, targetDir string) error {
+	start := time.Now()
+	err := c.client.Restore(ctx, repositoryEnv, snapshotID, path, targetDir)
+	c.record(ctx, "restore "+snapshotID, start, err)
+	return err
+}
+
+func (c *historyClient) Dump(ctx context.Context, repositoryEnv []string, snapshotID, path string, w io.Writer) error {
+	start := time.Now()
+	err := c.client.Dump(ctx, repositoryEnv, snapshotID, path, w)
+	c.record(ctx, "dump "+snapshotID, start, err)
+	return err
+}
+
+func (c *historyClient) Snapshots(ctx context.Context, repositoryEnv []string, tags []string, noLock bool) ([]restic.Snapshot, error) {
+	start := time.Now()
+	snapshots, err := c.client.Snapshots(ctx, repositoryEnv, tags, noLock)
+	c.record(ctx, "snapshots", start, err)
+	return snapshots, err
+}
+
+func (c *historyClient) Forget(ctx context.Context, repositoryEnv []string, tags []string, policy restic.ForgetPolicy, prune bool) error {
+	start := time.Now()
+	err := c.client.Forget(ctx, repositoryEnv, tags, policy, prune)
+	command := "forget"
+	if prune {
+		command += " --prune"
+	}
+	c.record(ctx, command, start, err)
+	return err
+}
+
+func (c *historyClient) Prune(ctx context.Context, repositoryEnv []string, maxUnused string) error {
+	start := time.Now()
+	err := c.client.Prune(ctx, repositoryEnv, maxUnused)
+	c.record(ctx, "prune", start, err)
+	return err
+}
+
+func (c *historyClient) Tag(ctx context.Context, repositoryEnv []string, snapshotID string, add, remove []string) error {
+	start := time.Now()
+	err := c.client.Tag(ctx, repositoryEnv, snapshotID, add, remove)
+	c.record(ctx, "tag "+snapshotID, start, err)
+	return err
+}
+
+func (c *historyClient) Init(ctx context.Context, repositoryEnv []string) error {
+	start := time.Now()
+	err := c.client.Init(ctx, repositoryEnv)
+	c.record(ctx, "init", start, err)
+	return err
+}
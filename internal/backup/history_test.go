@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/restic"
+	"btrfs-backup/internal/state"
+)
+
+func TestRepositoryHistory(t *testing.T) {
+	cfg := &config.Config{ResticRepoDir: "/repos", StateDir: t.TempDir()}
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockRestic := NewMockResticClient(t)
+	mockRestic.ExpectForget([]string{"btrfs-backup", "home"}, restic.ForgetPolicy{KeepDaily: 7}, true, 0)
+	mockRestic.ExpectCheck("5%", 1)
+
+	mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+	mgr.SetRunID("9f2c4e1a7b3d5f60", false)
+	target := &config.TargetConfig{Prefix: "home", Repository: "b2-home", ResticKeep: config.ResticKeepConfig{KeepDaily: 7}}
+	if err := mgr.ForgetSnapshots(context.Background(), target); err != nil {
+		t.Fatalf("ForgetSnapshots failed: %v", err)
+	}
+	if err := mgr.VerifyRepository(context.Background(), "b2-home", "5%", nil); err == nil {
+		t.Fatal("Expected VerifyRepository to fail")
+	}
+
+	history, err := state.LoadHistory(cfg.StateDir, "b2-home")
+	if err != nil {
+		t.Fatalf("LoadHistory failed: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 recorded commands, got %+v", history)
+	}
+	forget, check := history[0], history[1]
+	if forget.Command != "forget --prune" || forget.Prefix != "home" || forget.RunID != "9f2c4e1a7b3d5f60" || forget.Exit != state.ExitSuccess || forget.Time.IsZero() {
+		t.Errorf("Unexpected forget record %+v", forget)
+	}
+	if check.Command != "check --read-data-subset 5%" || check.Prefix != "" || check.Exit != state.ExitFailure || !strings.Contains(check.Error, "exit code 1") {
+		t.Errorf("Unexpected check record %+v", check)
+	}
+
+	// Dry runs don't touch the repository and aren't recorded
+	mgr.SetDryRun(&strings.Builder{})
+	if err := mgr.VerifyRepository(context.Background(), "b2-home", "5%", nil); err != nil {
+		t.Fatalf("VerifyRepository failed: %v", err)
+	}
+	if history, _ = state.LoadHistory(cfg.StateDir, "b2-home"); len(history) != 2 {
+		t.Errorf("Expected the dry run not to be recorded, got %+v", history)
+	}
+}
@@ -2,7 +2,10 @@
 package backup
 
 import (
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 
 	"btrfs-backup/internal/btrfs"
 	"btrfs-backup/internal/restic"
@@ -13,6 +16,11 @@ type FileSystem interface {
 	Stat(name string) (os.FileInfo, error)
 	ReadDir(name string) ([]os.DirEntry, error)
 	ReadFile(filename string) ([]byte, error)
+	WalkDir(root string, fn fs.WalkDirFunc) error
+	Open(name string) (io.ReadCloser, error)
+	MkdirTemp(dir, pattern string) (string, error)
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
 }
 
 // BtrfsClient interface abstracts BTRFS operations.
@@ -36,3 +44,23 @@ func (s *DefaultFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
 func (s *DefaultFileSystem) ReadFile(filename string) ([]byte, error) {
 	return os.ReadFile(filename)
 }
+
+func (s *DefaultFileSystem) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(root, fn)
+}
+
+func (s *DefaultFileSystem) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (s *DefaultFileSystem) MkdirTemp(dir, pattern string) (string, error) {
+	return os.MkdirTemp(dir, pattern)
+}
+
+func (s *DefaultFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (s *DefaultFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
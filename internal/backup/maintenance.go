@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"btrfs-backup/internal/state"
+)
+
+// ErrMaintenance is returned by RunBackup while maintenance mode is on, see
+// state.Maintenance.
+var ErrMaintenance = errors.New("maintenance mode is on")
+
+// Maintenance returns the maintenance mode in effect, or nil if it is off. Without a
+// state_dir, maintenance mode is always off.
+func (bm *Manager) Maintenance() (*state.Maintenance, error) {
+	if bm.config.StateDir == "" {
+		return nil, nil
+	}
+	m, err := state.LoadMaintenance(bm.config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Active(time.Now()) {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// CheckMaintenance returns an error wrapping ErrMaintenance, with the reason and end of
+// maintenance mode, while it is on. Dry runs are never skipped. A maintenance file that
+// can't be read is logged and doesn't stop the backups, as a missed backup is worse than
+// one run during maintenance.
+func (bm *Manager) CheckMaintenance() error {
+	if bm.dryRun {
+		return nil
+	}
+	m, err := bm.Maintenance()
+	if err != nil {
+		slog.Warn("Failed to read maintenance mode", "error", err)
+		return nil
+	}
+	if m == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrMaintenance, DescribeMaintenance(m))
+}
+
+// DescribeMaintenance describes maintenance mode m for the user, with its reason and end.
+func DescribeMaintenance(m *state.Maintenance) string {
+	description := "since " + m.Since.Local().Format(time.DateTime)
+	if !m.Until.IsZero() {
+		description += " until " + m.Until.Local().Format(time.DateTime)
+	}
+	if m.Reason != "" {
+		description += " (" + m.Reason + ")"
+	}
+	return description
+}
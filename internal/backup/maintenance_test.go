@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/state"
+)
+
+func TestRunBackupMaintenance(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos", StateDir: t.TempDir()}
+	target := &config.TargetConfig{Subvolume: "/mnt/btrfs/home", Prefix: "home", Repository: "b2-home"}
+	err := state.SaveMaintenance(cfg.StateDir, &state.Maintenance{Reason: "RAID rebuild", Since: time.Now(), Until: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("SaveMaintenance failed: %v", err)
+	}
+
+	// No btrfs or restic command is expected
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+	finished := false
+	mgr.SetRunFinished(func(RunResult) { finished = true })
+
+	err = mgr.RunBackup(context.Background(), "home", target)
+	if !errors.Is(err, ErrMaintenance) || !strings.Contains(err.Error(), "RAID rebuild") {
+		t.Errorf("Expected ErrMaintenance with the reason, got %v", err)
+	}
+	if finished {
+		t.Error("Expected a skipped run not to be reported as finished")
+	}
+	st, err := state.Load(cfg.StateDir, "home")
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if !st.LastAttempt.IsZero() {
+		t.Errorf("Expected a skipped run not to be recorded, got %+v", st)
+	}
+
+	// Dry runs only print the commands and are never skipped
+	mgr.SetDryRun(&strings.Builder{})
+	if err := mgr.CheckMaintenance(); err != nil {
+		t.Errorf("Expected dry runs not to be skipped, got %v", err)
+	}
+}
+
+func TestMaintenanceExpired(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	err := state.SaveMaintenance(cfg.StateDir, &state.Maintenance{Since: time.Now().Add(-2 * time.Hour), Until: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatalf("SaveMaintenance failed: %v", err)
+	}
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+	if m, err := mgr.Maintenance(); err != nil || m != nil {
+		t.Errorf("Expected expired maintenance mode to be off, got %+v (%v)", m, err)
+	}
+	if err := mgr.CheckMaintenance(); err != nil {
+		t.Errorf("Expected backups to run after maintenance mode ended, got %v", err)
+	}
+}
@@ -2,16 +2,34 @@
 package backup
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"btrfs-backup/internal/btrfs"
 	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/events"
+	"btrfs-backup/internal/hooks"
+	"btrfs-backup/internal/keyring"
+	"btrfs-backup/internal/metadata"
+	"btrfs-backup/internal/metrics"
 	"btrfs-backup/internal/restic"
+	"btrfs-backup/internal/state"
+	"btrfs-backup/internal/vault"
+	"btrfs-backup/progress"
 )
 
 // Manager handles BTRFS backup operations including snapshot creation,
@@ -22,213 +40,1761 @@ type Manager struct {
 	fs      FileSystem
 	btrfs   BtrfsClient
 	restic  ResticClient
+
+	dryRun           bool
+	dryRunOut        io.Writer
+	pendingSnapshots []snapshotEntry // snapshots "created" in dry-run mode
+
+	events   *events.Log
+	runID    string
+	tagRunID bool
+	sleep    func(context.Context, time.Duration) error // waits between retries of failed uploads
+
+	credentials []CredentialProvider // readers of repository configurations, see SetCredentialProviders
+	keyring     *keyring.Keyring     // holds the repository configurations with secret_backend "keyring"
+	metadata    metadata.Tools       // capture and apply metadata manifests, see BackupMetadata
+
+	progress    atomic.Pointer[chan progress.Event] // channel returned by Events, nil until it is called
+	uploads     PhaseLimit                          // bounds the runs in their restic phases, see SetUploadLimit
+	runFinished func(RunResult)                     // called at the end of each run, see SetRunFinished
+
+	targetRepositoriesOnce sync.Once // loads the target configurations once, see targetRepositories
+	targetRepos            []string
+	inlineOnly             bool
+}
+
+// Hook phases of the backup workflow, named after the target configuration keys.
+const (
+	HookPreSnapshot  = "pre_snapshot"
+	HookPostSnapshot = "post_snapshot"
+	HookPreBackup    = "pre_backup"
+	HookPostBackup   = "post_backup"
+	HookPostFailure  = "post_failure"
+)
+
+// NewManager creates a new backup manager with the provided configuration.
+// The verbose parameter controls whether detailed command logging is enabled.
+func NewManager(cfg *config.Config, verbose bool) *Manager {
+	bm := &Manager{
+		config:   cfg,
+		verbose:  verbose,
+		fs:       &DefaultFileSystem{},
+		btrfs:    btrfs.NewIoctlClient(btrfs.NewDefaultClient()),
+		restic:   restic.NewDefaultClient(cfg.ResticBin),
+		sleep:    sleepContext,
+		keyring:  keyring.New(cfg.SecretToolBin),
+		metadata: metadata.DefaultTools(),
+	}
+	if cfg.BtrfsHelperSocket != "" {
+		bm.btrfs = btrfs.NewHelperClient(cfg.BtrfsHelperSocket)
+	}
+	bm.credentials = defaultCredentialProviders(cfg, bm.fs)
+	return bm
+}
+
+// NewManagerWithDeps creates a new backup manager with custom dependencies for testing.
+func NewManagerWithDeps(cfg *config.Config, verbose bool, fs FileSystem, btrfs BtrfsClient, restic ResticClient) *Manager {
+	bm := &Manager{
+		config:   cfg,
+		verbose:  verbose,
+		fs:       fs,
+		btrfs:    btrfs,
+		restic:   restic,
+		sleep:    sleepContext,
+		keyring:  keyring.New(cfg.SecretToolBin),
+		metadata: metadata.DefaultTools(),
+	}
+	bm.credentials = defaultCredentialProviders(cfg, bm.fs)
+	return bm
+}
+
+// SetDryRun switches the manager to dry-run mode. Read-only operations such as
+// environment validation and snapshot listing still run, but BTRFS and Restic
+// commands that would create, delete or upload data are printed to out instead.
+// Snapshots that would have been created are taken into account by cleanup, so
+// the printed deletions match what a real run would do.
+func (bm *Manager) SetDryRun(out io.Writer) {
+	bm.dryRun = true
+	bm.dryRunOut = out
+	bm.btrfs = btrfs.NewDryRunClient(bm.btrfs, out)
+	bm.restic = restic.NewDryRunClient(bm.restic, out, bm.config.ResticBin)
+}
+
+// SetCredentialProviders replaces the readers of repository configurations, by default
+// those of plaintext, age- and GPG-encrypted files. Files are looked up in the order of
+// the providers.
+func (bm *Manager) SetCredentialProviders(providers ...CredentialProvider) {
+	bm.credentials = providers
+}
+
+// SetEventLog makes the manager record snapshot creations and deletions, uploads and
+// restic retention runs in the given event log. Events recorded in dry-run mode are
+// flagged as such.
+func (bm *Manager) SetEventLog(log *events.Log) {
+	bm.events = log
+}
+
+// SetRunID makes the manager record id, the run ID of the invocation, in the state of
+// the targets it backs up and, with tag, in the restic tag run-id:<id> of the uploaded
+// snapshots, so that a snapshot can be matched with the logs, events and notifications
+// of its run.
+func (bm *Manager) SetRunID(id string, tag bool) {
+	bm.runID = id
+	bm.tagRunID = tag
+}
+
+// SetUploadLimit makes RunBackup wait for limit before its upload and hold it through
+// the restic retention and verification steps, so that the runs of targets in parallel
+// don't all upload at the same time.
+func (bm *Manager) SetUploadLimit(limit PhaseLimit) {
+	bm.uploads = limit
+}
+
+// SetRunFinished makes RunBackup call fn at the end of every run, after its hooks and
+// once its metrics and state were written, e.g. to send notifications.
+func (bm *Manager) SetRunFinished(fn func(RunResult)) {
+	bm.runFinished = fn
+}
+
+// emit records an event, marking it as failed if err is not nil. Failures to write
+// the event log are logged but never interrupt the backup workflow.
+func (bm *Manager) emit(e events.Event, err error) {
+	if err != nil {
+		e.Outcome = events.OutcomeFailure
+		e.Error = err.Error()
+	}
+	e.DryRun = bm.dryRun
+
+	if emitErr := bm.events.Emit(e); emitErr != nil {
+		slog.Warn("Failed to write event log", "event", e.Type, "error", emitErr)
+	}
+}
+
+// RunResult describes a finished backup run, see SetRunFinished.
+type RunResult struct {
+	Started  time.Time
+	Snapshot string          // path of the snapshot created, empty if none was
+	Summary  *restic.Summary // statistics of the upload, nil if it didn't complete or in dry-run mode
+	// UploadStarted and Uploaded report whether the restic upload of the snapshot was
+	// started and completed.
+	UploadStarted bool
+	Uploaded      bool
+	Err           error // failure of the run, nil if it succeeded
+}
+
+// RunBackup executes the complete backup workflow for a target.
+// An incremental target is run as a full backup when its full_every interval is due,
+// see ScheduledTarget.
+// It performs environment validation, creates a BTRFS snapshot surrounded by the
+// pre/post snapshot hooks, optionally guards against empty snapshots, backs up to
+// Restic surrounded by the pre/post backup hooks, optionally applies the restic
+// retention policy and verifies the repository, and cleans up old snapshots.
+// Post-snapshot hooks run whenever a snapshot was attempted, so services stopped
+// by a pre-snapshot hook are restarted even if snapshot creation fails or the run is
+// interrupted.
+// If any step up to the upload and its manifests fails, the process stops and returns an
+// error with context, and the post_failure_hooks run, see RunFailureHooks, preceded by
+// the post_backup hooks if they run always and hadn't run yet. Failures of the post
+// hooks and of the restic retention, verification and cleanup steps are logged as
+// warnings and don't fail the run, unless it was interrupted.
+// Snapshot creation, the upload, verification and each cleanup step are limited by the
+// target's phase timeouts. Once ctx is done the running command is stopped, and the
+// snapshot is deleted if the run was interrupted before the upload completed, see
+// DiscardInterruptedSnapshot, after the post_backup and post_failure hooks got its path.
+// The steps entered and the warnings of the run are sent to the Events channel, and the
+// run is reported to the function set with SetRunFinished.
+// While maintenance mode is on, the run is skipped and an error wrapping ErrMaintenance
+// is returned, see CheckMaintenance.
+func (bm *Manager) RunBackup(ctx context.Context, targetName string, target *config.TargetConfig) (err error) {
+	logger := slog.With("target", targetName, "repository", target.Repository)
+	// Skipped runs are not runs: they leave no events, state or notifications behind
+	if err := bm.CheckMaintenance(); err != nil {
+		logger.Info("Backup skipped", "reason", err)
+		return err
+	}
+	start := time.Now()
+	result := RunResult{Started: start}
+	bm.emit(events.Event{Type: events.RunStarted, Target: targetName, Repository: target.Repository}, nil)
+	bm.notify(progress.Event{Kind: progress.EventRunStarted, Target: targetName})
+	defer func() {
+		bm.emit(events.Event{Type: events.RunFinished, Target: targetName, Repository: target.Repository}, err)
+		// The state first, so the health score exported with the metrics includes this run
+		if stateErr := bm.RecordRun(targetName, start, result.Snapshot, result.Summary, err); stateErr != nil {
+			bm.warn(logger, targetName, "Failed to record run in target state", stateErr)
+		}
+		if metricsErr := bm.WriteMetrics(targetName, target, time.Since(start), err); metricsErr != nil {
+			bm.warn(logger, targetName, "Failed to write metrics", metricsErr)
+		}
+		if err != nil {
+			logger.Error("Backup failed", "duration", time.Since(start), "error", err)
+		} else {
+			logger.Info("Backup process completed successfully", "duration", time.Since(start))
+		}
+		if bm.runFinished != nil {
+			result.Err = err
+			bm.runFinished(result)
+		}
+		bm.notify(progress.Event{Kind: progress.EventRunFinished, Target: targetName, Err: err})
+	}()
+
+	logger.Info("Starting BTRFS backup process",
+		"subvolume", strings.Join(target.SourceSubvolumes(), ","),
+		"type", target.Type,
+		"verify", target.Verify,
+		"keep_snapshots", target.KeepSnapshots)
+	target = bm.ScheduledTarget(targetName, target)
+	var step string
+	var stepStart time.Time
+	enter := func(s string) {
+		step, stepStart = s, time.Now()
+		bm.notify(progress.Event{Kind: progress.EventStepStarted, Target: targetName, Step: s})
+	}
+	// Failures of the steps after the upload only warn, unless the run was interrupted
+	warnStep := func(msg string, err error) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("backup interrupted: %w", ctx.Err())
+		}
+		bm.warn(logger, targetName, msg, err, "phase", step, "duration", time.Since(stepStart))
+		return nil
+	}
+	enter("validate")
+	postBackupRan, snapshotCreated := false, false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if target.PostBackupWhen == config.HookWhenAlways && !postBackupRan {
+			if hookErr := bm.RunHooks(context.WithoutCancel(ctx), HookPostBackup, targetName, target, result.Snapshot); hookErr != nil {
+				bm.warn(logger, targetName, "Post-backup hook failed", hookErr, "phase", HookPostBackup)
+			}
+		}
+		if hookErr := bm.RunFailureHooks(ctx, targetName, target, result.Snapshot, step, err); hookErr != nil {
+			bm.warn(logger, targetName, "Post-failure hook failed", hookErr, "phase", HookPostFailure)
+		}
+		// Only once the hooks got SNAPSHOT_PATH
+		if snapshotCreated && !result.Uploaded {
+			if discardErr := bm.DiscardInterruptedSnapshot(ctx, result.Snapshot, target); discardErr != nil {
+				bm.warn(logger, targetName, "Failed to delete snapshot of interrupted backup", discardErr)
+			}
+		}
+	}()
+
+	logger.Info("Validating backup environment", "phase", "validate")
+	err = bm.config.CheckClassification(target)
+	if err != nil {
+		return fmt.Errorf("classification policy violated: %w", err)
+	}
+
+	err = bm.ValidateEnvironment(ctx, target.SourceSubvolumes()...)
+	if err != nil {
+		return fmt.Errorf("environment validation failed: %w", err)
+	}
+
+	if target.SubvolumeUUID != "" || target.SnapshotDirUUID != "" {
+		logger.Debug("Checking pinned filesystem UUIDs", "phase", "validate")
+	}
+	err = bm.ValidateFilesystems(ctx, target)
+	if err != nil {
+		return fmt.Errorf("environment validation failed: %w", err)
+	}
+
+	err = bm.CheckDeviceErrors(ctx, targetName, target)
+	if err != nil {
+		return fmt.Errorf("environment validation failed: %w", err)
+	}
+	logger.Info("Environment validation completed successfully", "phase", "validate", "duration", time.Since(stepStart))
+
+	enter(HookPreSnapshot)
+	err = bm.RunHooks(ctx, HookPreSnapshot, targetName, target, "")
+	if err != nil {
+		return fmt.Errorf("pre-snapshot hook failed: %w", err)
+	}
+
+	enter("snapshot")
+	logger.Info("Creating BTRFS snapshot", "phase", "snapshot", "prefix", target.Prefix)
+	err = WithTimeout(ctx, target.SnapshotTimeout, func(ctx context.Context) (err error) {
+		result.Snapshot, err = bm.CreateSnapshot(ctx, target)
+		return err
+	})
+	snapshotPath := result.Snapshot
+	// Services stopped by the pre-snapshot hooks are restarted even after an interrupt
+	hookErr := bm.RunHooks(context.WithoutCancel(ctx), HookPostSnapshot, targetName, target, snapshotPath)
+	if err != nil {
+		if hookErr != nil {
+			bm.warn(logger, targetName, "Post-snapshot hook failed", hookErr, "phase", HookPostSnapshot)
+		}
+		return fmt.Errorf("snapshot creation failed: %w", err)
+	}
+	snapshotCreated = true
+	logger = logger.With("snapshot", snapshotPath)
+	logger.Info("Snapshot created successfully", "phase", "snapshot", "duration", time.Since(stepStart))
+	if hookErr != nil {
+		enter(HookPostSnapshot)
+		if err = warnStep("Post-snapshot hook failed", hookErr); err != nil {
+			return err
+		}
+	}
+
+	enter("empty_guard")
+	err = bm.CheckSnapshotContents(snapshotPath, target)
+	if err != nil {
+		return fmt.Errorf("empty snapshot guard failed (snapshot preserved at %s): %w", snapshotPath, err)
+	}
+
+	enter(HookPreBackup)
+	err = bm.RunHooks(ctx, HookPreBackup, targetName, target, snapshotPath)
+	if err != nil {
+		return fmt.Errorf("pre-backup hook failed (snapshot preserved at %s): %w", snapshotPath, err)
+	}
+
+	enter("backup")
+	release, err := bm.uploads.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("backup interrupted while waiting for other uploads: %w", err)
+	}
+	defer release()
+	logger.Info("Starting Restic backup", "phase", "backup", "type", target.Type)
+	result.UploadStarted = true
+	err = WithTimeout(ctx, target.BackupTimeout, func(ctx context.Context) (err error) {
+		result.Summary, err = bm.PerformBackup(ctx, snapshotPath, target)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("backup operation failed (snapshot preserved at %s): %w", snapshotPath, err)
+	}
+	logger.Info("Restic backup completed successfully", "phase", "backup", "duration", time.Since(stepStart))
+	result.Uploaded = true
+	if target.Type == "full" {
+		if stateErr := bm.RecordFullBackup(targetName, start); stateErr != nil {
+			bm.warn(logger, targetName, "Failed to record full backup in target state", stateErr, "phase", "backup")
+		}
+	}
+
+	if target.Metadata {
+		enter("metadata")
+		logger.Info("Uploading metadata manifest", "phase", "metadata")
+		err = WithTimeout(ctx, target.BackupTimeout, func(ctx context.Context) error {
+			return bm.BackupMetadata(ctx, snapshotPath, target)
+		})
+		if err != nil {
+			return fmt.Errorf("metadata manifest upload failed: %w", err)
+		}
+		logger.Info("Metadata manifest uploaded successfully", "phase", "metadata", "duration", time.Since(stepStart))
+	}
+	if target.ChecksumManifest != "" {
+		enter("checksums")
+		logger.Info("Uploading checksum manifest", "phase", "checksums", "files", target.ChecksumManifest)
+		err = WithTimeout(ctx, target.BackupTimeout, func(ctx context.Context) error {
+			return bm.BackupChecksums(ctx, snapshotPath, target)
+		})
+		if err != nil {
+			return fmt.Errorf("checksum manifest upload failed: %w", err)
+		}
+		logger.Info("Checksum manifest uploaded successfully", "phase", "checksums", "duration", time.Since(stepStart))
+	}
+
+	enter("success_criteria")
+	err = bm.CheckSuccessCriteria(result.Summary, target)
+	if err != nil {
+		if target.SuccessCriteria.OnViolation == config.ViolationWarn {
+			bm.warn(logger, targetName, "Backup violates success criteria", err, "phase", "success_criteria")
+		} else {
+			return fmt.Errorf("success criteria not met (snapshot preserved at %s): %w", snapshotPath, err)
+		}
+	}
+
+	enter(HookPostBackup)
+	postBackupRan = true
+	err = bm.RunHooks(ctx, HookPostBackup, targetName, target, snapshotPath)
+	if err != nil {
+		if err = warnStep("Post-backup hook failed", err); err != nil {
+			return err
+		}
+	}
+
+	if target.ResticKeep.IsEnabled() {
+		enter("forget")
+		logger.Info("Applying restic retention policy", "phase", "forget")
+		err = WithTimeout(ctx, target.CleanupTimeout, func(ctx context.Context) error {
+			return bm.ForgetSnapshots(ctx, target)
+		})
+		if err != nil {
+			if err = warnStep("Restic retention failed", err); err != nil {
+				return err
+			}
+		} else {
+			logger.Info("Restic retention completed successfully", "phase", "forget", "duration", time.Since(stepStart))
+		}
+	}
+
+	if target.Verify {
+		enter("verify")
+		verified := false
+		if bm.VerificationDue(targetName, target) {
+			logger.Info("Verifying repository integrity", "phase", "verify")
+			err = WithTimeout(ctx, target.VerifyTimeout, func(ctx context.Context) error {
+				return bm.VerifyRepository(ctx, target.Repository, target.VerifySubset, target.ResticExtraArgs)
+			})
+			verified = err == nil
+		}
+		if stateErr := bm.RecordVerification(targetName, target.VerifySubset, verified, err); stateErr != nil {
+			bm.warn(logger, targetName, "Failed to record verification in target state", stateErr, "phase", "verify")
+		}
+		if err != nil {
+			if err = warnStep("Repository verification failed", err); err != nil {
+				return err
+			}
+		} else if verified {
+			logger.Info("Repository verification completed successfully", "phase", "verify", "duration", time.Since(stepStart))
+		}
+	}
+
+	if bm.OldSnapshotVerificationDue(targetName, target) {
+		enter("verify_old")
+		logger.Info("Verifying an older restic snapshot", "phase", "verify_old")
+		var verification *SnapshotVerification
+		err = WithTimeout(ctx, target.VerifyTimeout, func(ctx context.Context) (err error) {
+			verification, err = bm.VerifySnapshot(ctx, targetName, target, "")
+			return err
+		})
+		if err != nil {
+			if err = warnStep("Verification of an older snapshot failed", err); err != nil {
+				return err
+			}
+		} else {
+			logger.Info("Older snapshot verified successfully", "phase", "verify_old", "duration", time.Since(stepStart),
+				"restic_snapshot", verification.RepositorySnapshot, "snapshot_time", verification.SnapshotTime, "bytes", verification.Bytes)
+		}
+	}
+
+	// The snapshot of the next target running in parallel may upload while this one cleans up
+	release()
+
+	enter("cleanup")
+	logger.Info("Cleaning up old snapshots", "phase", "cleanup", "keep_snapshots", target.KeepSnapshots)
+	err = WithTimeout(ctx, target.CleanupTimeout, func(ctx context.Context) error {
+		return bm.CleanupOldSnapshots(ctx, target, target.KeepSnapshots)
+	})
+	if err != nil {
+		if err = warnStep("Failed to cleanup old snapshots", err); err != nil {
+			return err
+		}
+	} else {
+		logger.Info("Snapshot cleanup completed successfully", "phase", "cleanup", "duration", time.Since(stepStart))
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("backup interrupted: %w", ctx.Err())
+	}
+	return nil
+}
+
+// TakeSnapshot creates a local snapshot of the target like RunBackup, validating the
+// environment and running the pre/post snapshot hooks around it, without any restic
+// involvement, e.g. as a manual rollback point. With prune, old snapshots beyond the
+// target's keep_snapshots are removed afterwards, see CleanupOldSnapshots.
+// Returns the path of the snapshot, also when only pruning failed.
+func (bm *Manager) TakeSnapshot(ctx context.Context, targetName string, target *config.TargetConfig, prune bool) (snapshotPath string, err error) {
+	err = bm.ValidateEnvironment(ctx, target.SourceSubvolumes()...)
+	if err == nil {
+		err = bm.ValidateFilesystems(ctx, target)
+	}
+	if err != nil {
+		return "", fmt.Errorf("environment validation failed: %w", err)
+	}
+
+	err = bm.RunHooks(ctx, HookPreSnapshot, targetName, target, "")
+	if err != nil {
+		return "", fmt.Errorf("pre-snapshot hook failed: %w", err)
+	}
+
+	err = WithTimeout(ctx, target.SnapshotTimeout, func(ctx context.Context) (err error) {
+		snapshotPath, err = bm.CreateSnapshot(ctx, target)
+		return err
+	})
+	hookErr := bm.RunHooks(context.WithoutCancel(ctx), HookPostSnapshot, targetName, target, snapshotPath)
+	if err != nil {
+		return "", fmt.Errorf("snapshot creation failed: %w", errors.Join(err, hookErr))
+	}
+	if hookErr != nil {
+		return snapshotPath, fmt.Errorf("post-snapshot hook failed: %w", hookErr)
+	}
+
+	if prune {
+		err = WithTimeout(ctx, target.CleanupTimeout, func(ctx context.Context) error {
+			return bm.CleanupOldSnapshots(ctx, target, target.KeepSnapshots)
+		})
+		if err != nil {
+			return snapshotPath, fmt.Errorf("snapshot cleanup failed: %w", err)
+		}
+	}
+	return snapshotPath, nil
+}
+
+// WriteMetrics exports the metrics of a backup run that took duration and failed with
+// runErr, or succeeded if runErr is nil: as node_exporter textfile to the configured
+// metrics_textfile_dir, and pushed to metrics_pushgateway and metrics_remote_write.
+// The snapshot count reflects the local snapshots of the target after the run. The last
+// success of a failed run is taken from the target's state file, which RecordRun updates
+// only afterwards. Nothing is exported if no exporter is configured or in dry-run mode.
+func (bm *Manager) WriteMetrics(targetName string, target *config.TargetConfig, duration time.Duration, runErr error) error {
+	if bm.config.MetricsDir == "" && bm.config.MetricsPushgateway == "" && bm.config.MetricsRemoteWrite == "" || bm.dryRun {
+		return nil
+	}
+
+	snapshots, err := bm.getSnapshotNames(target)
+	if err != nil {
+		return fmt.Errorf("failed to count snapshots: %w", err)
+	}
+
+	run := metrics.Run{
+		Target:        targetName,
+		Success:       runErr == nil,
+		Duration:      duration,
+		SnapshotCount: len(snapshots),
+		Finished:      time.Now(),
+	}
+	if bm.config.StateDir != "" {
+		if st, err := state.Load(bm.config.StateDir, targetName); err == nil {
+			run.LastSuccess = st.LastSuccess
+			health := TargetHealth(target, st, run.Finished)
+			run.Health = &health.Score
+		}
+	}
+
+	var errs []error
+	if bm.config.MetricsDir != "" {
+		errs = append(errs, metrics.WriteTextfile(bm.config.MetricsDir, run))
+	}
+	if bm.config.MetricsPushgateway != "" {
+		errs = append(errs, metrics.Push(bm.config.MetricsPushgateway, run))
+	}
+	if bm.config.MetricsRemoteWrite != "" {
+		errs = append(errs, metrics.RemoteWrite(bm.config.MetricsRemoteWrite, run))
+	}
+	return errors.Join(errs...)
+}
+
+// RunHooks runs the target's hook commands for the given phase, each limited by the
+// target's hook_timeout. The commands receive TARGET_NAME, HOOK_PHASE and, once a snapshot
+// exists, SNAPSHOT_PATH in their environment. In dry-run mode the commands are printed
+// instead of executed. Returns an error if the phase is unknown or a command fails.
+func (bm *Manager) RunHooks(ctx context.Context, phase, targetName string, target *config.TargetConfig, snapshotPath string) error {
+	var commands []string
+	switch phase {
+	case HookPreSnapshot:
+		commands = target.PreSnapshot
+	case HookPostSnapshot:
+		commands = target.PostSnapshot
+	case HookPreBackup:
+		commands = target.PreBackup
+	case HookPostBackup:
+		commands = target.PostBackup
+	default:
+		return fmt.Errorf("unknown hook phase: %s", phase)
+	}
+	return bm.runHooks(ctx, phase, commands, targetName, target, snapshotPath)
+}
+
+// RunFailureHooks runs the target's post_failure_hooks after a run failed with runErr in
+// step, e.g. "backup" or "pre_snapshot". Besides the environment of RunHooks, the commands
+// receive ERROR_STEP and ERROR_MESSAGE. They run even once ctx is done, so an interrupted
+// or timed-out run still triggers them, each command limited by the target's hook_timeout.
+func (bm *Manager) RunFailureHooks(ctx context.Context, targetName string, target *config.TargetConfig, snapshotPath, step string, runErr error) error {
+	if len(target.PostFailure) == 0 {
+		return nil
+	}
+	return bm.runHooks(context.WithoutCancel(ctx), HookPostFailure, target.PostFailure, targetName, target, snapshotPath,
+		"ERROR_STEP="+step, "ERROR_MESSAGE="+runErr.Error())
+}
+
+// runHooks runs the hook commands of phase, with the environment of RunHooks extended with env.
+func (bm *Manager) runHooks(ctx context.Context, phase string, commands []string, targetName string, target *config.TargetConfig, snapshotPath string, env ...string) error {
+	if bm.dryRun {
+		for _, command := range commands {
+			if _, err := fmt.Fprintf(bm.dryRunOut, "[dry-run] %s hook: %s\n", phase, command); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	env = append([]string{"TARGET_NAME=" + targetName, "HOOK_PHASE=" + phase}, env...)
+	if snapshotPath != "" {
+		env = append(env, "SNAPSHOT_PATH="+snapshotPath)
+	}
+
+	return hooks.Run(ctx, phase, commands, target.HookTimeout, env)
+}
+
+// ValidateEnvironment checks that the backup environment is properly configured.
+// It verifies that the snapshots directory exists and that the source subvolumes
+// are valid BTRFS subvolumes. Source subvolumes inside the snapshots directory or
+// read-only ones are refused: they are snapshots that never change, so backing them
+// up would silently upload the same stale data on every run.
+// Returns an error if any validation fails.
+func (bm *Manager) ValidateEnvironment(ctx context.Context, subvolumes ...string) error {
+	_, err := bm.fs.Stat(bm.config.SnapshotDir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("snapshots directory does not exist: %s", bm.config.SnapshotDir)
+	}
+
+	for _, subvolume := range subvolumes {
+		rel, err := filepath.Rel(bm.config.SnapshotDir, subvolume)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("source subvolume %s is inside the snapshots directory %s, "+
+				"set subvolume to the live subvolume the snapshots are taken of", subvolume, bm.config.SnapshotDir)
+		}
+
+		info, err := bm.btrfs.ShowSubvolume(ctx, subvolume)
+		if err != nil {
+			return fmt.Errorf("source subvolume invalid or not BTRFS: %s", subvolume)
+		}
+		if info.ReadOnly {
+			return fmt.Errorf("source subvolume %s is a read-only snapshot, "+
+				"set subvolume to the live subvolume it was taken of", subvolume)
+		}
+	}
+
+	return nil
+}
+
+// ValidateFilesystems checks that the subvolume and the snapshots directory live on the
+// filesystems pinned in the target configuration, so that a different disk mounted at the
+// same path is never backed up or pruned. Paths without a pinned UUID are not checked.
+func (bm *Manager) ValidateFilesystems(ctx context.Context, target *config.TargetConfig) error {
+	type pin struct {
+		name string
+		path string
+		uuid string
+	}
+	var pins []pin
+	for _, subvolume := range target.SourceSubvolumes() {
+		pins = append(pins, pin{"subvolume", subvolume, target.SubvolumeUUID})
+	}
+	pins = append(pins, pin{"snapshots directory", bm.config.SnapshotDir, target.SnapshotDirUUID})
+
+	for _, pin := range pins {
+		if pin.uuid == "" {
+			continue
+		}
+
+		uuid, err := bm.btrfs.FilesystemUUID(ctx, pin.path)
+		if err != nil {
+			return fmt.Errorf("could not determine filesystem UUID of %s %s: %w", pin.name, pin.path, err)
+		}
+		if !strings.EqualFold(uuid, pin.uuid) {
+			return fmt.Errorf("%s %s is on filesystem %s, expected %s", pin.name, pin.path, uuid, pin.uuid)
+		}
+	}
+
+	return nil
+}
+
+// CheckDeviceErrors compares the btrfs device error counters of the filesystems of the
+// target's subvolumes with those recorded in the target's state file at the last check,
+// all zero without state_dir, since backing up from a filesystem with new I/O or checksum
+// errors may upload corrupt data as the latest backup. Rising counters fail the check with
+// device_errors "fail", which keeps failing until the counters are reset with
+// 'btrfs device stats -z', and are logged as a warning with "warn", after which the new
+// counters are recorded. Nothing is checked with "ignore" or if device_errors is unset.
+func (bm *Manager) CheckDeviceErrors(ctx context.Context, targetName string, target *config.TargetConfig) error {
+	if target.DeviceErrors == "" || target.DeviceErrors == config.DeviceErrorsIgnore {
+		return nil
+	}
+	fail := target.DeviceErrors == config.DeviceErrorsFail
+
+	counters, previous, err := bm.deviceErrorCounters(ctx, targetName, target)
+	if err != nil {
+		if fail {
+			return err
+		}
+		slog.Warn("Skipping btrfs device error check", "target", targetName, "error", err)
+		return nil
+	}
+	var rising []string
+	for _, key := range slices.Sorted(maps.Keys(counters)) {
+		if counters[key] > previous[key] {
+			rising = append(rising, fmt.Sprintf("%s %d -> %d", key, previous[key], counters[key]))
+		}
+	}
+
+	if len(rising) > 0 {
+		err := fmt.Errorf("btrfs device error counters rose: %s", strings.Join(rising, ", "))
+		if fail {
+			return err
+		}
+		slog.Warn("Filesystem reports new errors, the backup may contain corrupt data", "target", targetName, "error", err)
+	}
+
+	if bm.config.StateDir == "" || bm.dryRun {
+		return nil
+	}
+	return state.Update(bm.config.StateDir, targetName, func(st *state.Target) {
+		st.DeviceErrors = counters
+	})
+}
+
+// deviceErrorCounters returns the current btrfs device error counters of the filesystems
+// of the target's subvolumes and those recorded at the last check.
+func (bm *Manager) deviceErrorCounters(ctx context.Context, targetName string, target *config.TargetConfig) (counters, previous map[string]int64, err error) {
+	counters = map[string]int64{}
+	for _, subvolume := range target.SourceSubvolumes() {
+		stats, err := bm.btrfs.DeviceStats(ctx, subvolume)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read btrfs device stats of %s: %w", subvolume, err)
+		}
+		for _, stat := range stats {
+			counters[stat.Device+" "+stat.Counter] = stat.Value
+		}
+	}
+
+	if bm.config.StateDir != "" {
+		st, err := state.Load(bm.config.StateDir, targetName)
+		if err != nil {
+			return nil, nil, err
+		}
+		previous = st.DeviceErrors
+	}
+	return counters, previous, nil
+}
+
+// CreateSnapshot creates a read-only BTRFS snapshot of the target's subvolume.
+// The snapshot is named after the target's name template with the current time, by
+// default the prefix and a YYYYMMDD-HHMMSS timestamp.
+// Several subvolumes are snapshotted one after another into a new subvolume under that
+// name, each named after its source, so they are backed up and cleaned up together.
+// Returns the full path to the created snapshot or an error if creation fails.
+func (bm *Manager) CreateSnapshot(ctx context.Context, target *config.TargetConfig) (string, error) {
+	naming, err := target.SnapshotNaming()
+	if err != nil {
+		return "", fmt.Errorf("invalid snapshot name template: %w", err)
+	}
+	snapshotName := naming.Name(time.Now())
+	snapshotPath := filepath.Join(bm.config.SnapshotDir, snapshotName)
+
+	err = bm.createSnapshot(ctx, target.SourceSubvolumes(), snapshotName, snapshotPath)
+	bm.emit(events.Event{Type: events.SnapshotCreated, Snapshot: snapshotPath}, err)
+	if err != nil {
+		return "", err
+	}
+
+	return snapshotPath, nil
+}
+
+func (bm *Manager) createSnapshot(ctx context.Context, subvolumes []string, snapshotName, snapshotPath string) error {
+	var err error
+	if len(subvolumes) == 1 {
+		err = bm.btrfs.CreateSnapshot(ctx, subvolumes[0], snapshotPath, true)
+	} else {
+		err = bm.createSnapshotSet(ctx, subvolumes, snapshotPath)
+	}
+	if err != nil {
+		return fmt.Errorf("BTRFS snapshot command failed: %w", err)
+	}
+
+	if bm.dryRun {
+		bm.pendingSnapshots = append(bm.pendingSnapshots, snapshotEntry{name: snapshotName, mtime: time.Now()})
+		return nil
+	}
+
+	_, err = bm.fs.Stat(snapshotPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("snapshot not found after creation: %s", snapshotPath)
+	}
+
+	return nil
+}
+
+// createSnapshotSet creates snapshotPath as a subvolume holding a read-only snapshot of each
+// of the subvolumes, named after the last element of its path. If a snapshot fails, those
+// already created and snapshotPath are deleted again, so no partial set is left behind for
+// the next run to find.
+func (bm *Manager) createSnapshotSet(ctx context.Context, subvolumes []string, snapshotPath string) error {
+	err := bm.btrfs.CreateSubvolume(ctx, snapshotPath)
+	if err != nil {
+		return err
+	}
+
+	var created []string
+	for _, subvolume := range subvolumes {
+		path := filepath.Join(snapshotPath, filepath.Base(subvolume))
+		err = bm.btrfs.CreateSnapshot(ctx, subvolume, path, true)
+		if err != nil {
+			bm.discardSnapshotSet(ctx, snapshotPath, created)
+			return err
+		}
+		created = append(created, path)
+	}
+	return nil
+}
+
+// discardSnapshotSet deletes the snapshots created of a set whose creation failed, then
+// the set itself. The deletion isn't bound to ctx, which may be done if it interrupted the
+// creation. Failures are only logged, the error of the creation is the one reported.
+func (bm *Manager) discardSnapshotSet(ctx context.Context, snapshotPath string, created []string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), interruptedCleanupTimeout)
+	defer cancel()
+
+	for _, path := range slices.Backward(created) {
+		if err := bm.btrfs.DeleteSubvolume(ctx, path); err != nil {
+			slog.Warn("Failed to delete snapshot of incomplete snapshot set", "snapshot", path, "error", err)
+			return
+		}
+	}
+	if err := bm.btrfs.DeleteSubvolume(ctx, snapshotPath); err != nil {
+		slog.Warn("Failed to delete incomplete snapshot set", "snapshot", snapshotPath, "error", err)
+	}
+}
+
+// interruptedCleanupTimeout limits the deletion of the snapshot of an interrupted backup run,
+// which can't be bound to the context of the run as that is already done.
+const interruptedCleanupTimeout = time.Minute
+
+// DiscardInterruptedSnapshot deletes the snapshot created by a backup run that was interrupted,
+// meaning ctx is done, before its upload completed. Nothing is deleted unless the target's
+// delete_interrupted_snapshot is set, as a snapshot can still be uploaded by the next run.
+func (bm *Manager) DiscardInterruptedSnapshot(ctx context.Context, snapshotPath string, target *config.TargetConfig) error {
+	if ctx.Err() == nil || snapshotPath == "" || !target.DeleteInterruptedSnapshot {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), interruptedCleanupTimeout)
+	defer cancel()
+
+	err := bm.deleteSnapshot(ctx, filepath.Base(snapshotPath))
+	if err != nil {
+		return err
+	}
+	slog.Info("Deleted snapshot of interrupted backup", "snapshot", snapshotPath)
+	return nil
+}
+
+// CheckSnapshotContents guards against uploading a (nearly) empty snapshot, the classic
+// symptom of snapshotting a mountpoint whose filesystem was not mounted. It fails if the
+// snapshot holds fewer files than the target's min_files, or if it is smaller than
+// min_size_ratio times the previous snapshot with the same prefix. Both checks walk the
+// snapshot trees, so they are only performed when enabled. Nothing is checked in dry-run mode.
+func (bm *Manager) CheckSnapshotContents(snapshotPath string, target *config.TargetConfig) error {
+	guard := target.EmptyGuard
+	if !guard.IsEnabled() || bm.dryRun {
+		return nil
+	}
+
+	current := bm.snapshotStats(snapshotPath)
+	if guard.MinFiles > 0 && current.files < guard.MinFiles {
+		return fmt.Errorf("snapshot %s looks empty: %d files, expected at least %d", snapshotPath, current.files, guard.MinFiles)
+	}
+
+	if guard.MinSizeRatio > 0 {
+		previousPath, err := bm.previousSnapshot(snapshotPath, target)
+		if err != nil {
+			return err
+		}
+		if previousPath == "" {
+			return nil
+		}
+
+		previous := bm.snapshotStats(previousPath)
+		if float64(current.bytes) < guard.MinSizeRatio*float64(previous.bytes) {
+			return fmt.Errorf("snapshot %s looks empty: %d bytes in %d files, previous snapshot %s has %d bytes in %d files",
+				snapshotPath, current.bytes, current.files, filepath.Base(previousPath), previous.bytes, previous.files)
+		}
+	}
+
+	return nil
+}
+
+// previousSnapshot returns the path of the newest snapshot of the target other than
+// snapshotPath, or an empty string if there is none.
+func (bm *Manager) previousSnapshot(snapshotPath string, target *config.TargetConfig) (string, error) {
+	snapshots, err := bm.getSnapshotNames(target)
+	if err != nil {
+		return "", fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	for _, name := range snapshots {
+		path := filepath.Join(bm.config.SnapshotDir, name)
+		if path != snapshotPath {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+// PerformBackup backs up the specified snapshot to a Restic repository.
+// It loads the repository environment configuration, builds the appropriate
+// Restic command (incremental or full), and executes the backup.
+// Uploads that fail with a transient error, such as a network or backend hiccup, are
+// retried up to the target's retries times, starting after retry_delay and doubling
+// the delay for each further retry.
+// Returns the summary reported by restic, which is nil in dry-run mode, or an error if
+// the snapshot doesn't exist, repository config fails, or backup fails.
+func (bm *Manager) PerformBackup(ctx context.Context, snapshotPath string, target *config.TargetConfig) (*restic.Summary, error) {
+	_, err := bm.fs.Stat(snapshotPath)
+	if os.IsNotExist(err) && !bm.isPendingSnapshot(snapshotPath) {
+		return nil, fmt.Errorf("snapshot path does not exist: %s", snapshotPath)
+	}
+
+	env, err := bm.loadRepositoryEnv(target.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("repository configuration failed: %w", err)
+	}
+	env = withExtraArgs(env, target.ResticExtraArgs)
+
+	options := restic.BackupOptions{
+		Tags:          []string{"btrfs-backup", target.Prefix, filepath.Base(snapshotPath)},
+		ExcludeCaches: true,
+		Force:         target.Type == "full",
+		Excludes:      snapshotExcludes(snapshotPath, target.Excludes),
+		ExcludeFiles:  target.ExcludeFiles,
+		Limit:         restic.BandwidthLimit{Upload: target.UploadLimit, Download: target.DownloadLimit},
+		Progress:      bm.uploadProgress(target.Repository, snapshotPath),
+	}
+	if bm.tagRunID && bm.runID != "" {
+		options.Tags = append(options.Tags, runIDTag+bm.runID)
+	}
+
+	upload := func() (*restic.Summary, error) {
+		return bm.resticFor(target.Repository, target.Prefix).Backup(ctx, env, snapshotPath, options)
+	}
+	if target.BackupMode == config.BackupModeSend {
+		parentPath := ""
+		if target.Type != "full" {
+			parentPath = bm.sendParent(ctx, env, snapshotPath, target)
+		}
+		if parentPath != "" {
+			options.Tags = append(options.Tags, sendParentTag+filepath.Base(parentPath))
+		}
+		options.ExcludeCaches = false
+		options.Force = false
+		upload = func() (*restic.Summary, error) {
+			return bm.sendBackup(ctx, env, snapshotPath, parentPath, target, options)
+		}
+	}
+
+	unlock, err := bm.lockUpload(ctx, target.Repository)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var summary *restic.Summary
+	delay := target.RetryDelay
+	for attempt := 0; ; attempt++ {
+		summary, err = upload()
+		if err == nil || attempt >= target.Retries || ctx.Err() != nil || !restic.IsTransient(err) {
+			break
+		}
+		slog.Warn("Restic backup failed, retrying", "repository", target.Repository, "snapshot", snapshotPath,
+			"attempt", attempt+1, "retries", target.Retries, "delay", delay, "error", err)
+		if bm.sleep(ctx, delay) != nil {
+			break
+		}
+		delay *= 2
+	}
+	bm.emit(events.Event{Type: events.UploadFinished, Repository: target.Repository, Snapshot: snapshotPath}, err)
+	if err != nil {
+		return nil, fmt.Errorf("restic backup command failed: %w", err)
+	}
+	if summary != nil {
+		slog.Info("Restic backup summary", "repository", target.Repository, "restic_snapshot", summary.SnapshotID,
+			"files_processed", summary.TotalFilesProcessed, "files_new", summary.FilesNew, "files_changed", summary.FilesChanged,
+			"bytes_processed", summary.TotalBytesProcessed, "data_added", summary.DataAdded,
+			"dedup_ratio", fmt.Sprintf("%.2f", summary.DedupRatio()))
+	}
+
+	return summary, nil
+}
+
+// progressLogInterval is the minimum time between logged progress messages of an upload.
+const progressLogInterval = time.Minute
+
+// uploadProgress returns the restic progress callback of the upload of snapshotPath,
+// sending every status to the Events channel and logging one at debug level per
+// progressLogInterval.
+func (bm *Manager) uploadProgress(repository, snapshotPath string) func(restic.Status) {
+	var logged time.Time
+	return func(status restic.Status) {
+		bm.notify(progress.Event{Kind: progress.EventProgress, Progress: (*progress.Status)(&status)})
+		if time.Since(logged) < progressLogInterval {
+			return
+		}
+		logged = time.Now()
+		slog.Debug("Restic backup progress", "repository", repository, "snapshot", snapshotPath,
+			"percent_done", fmt.Sprintf("%.1f", status.PercentDone*100), "files_done", status.FilesDone,
+			"total_files", status.TotalFiles, "bytes_done", status.BytesDone, "total_bytes", status.TotalBytes)
+	}
+}
+
+// WithTimeout runs the workflow phase fn with ctx limited to timeout, or unlimited if timeout
+// is zero. Once the timeout expires the running command is stopped, and the error fn returns
+// says the phase timed out.
+func WithTimeout(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := fn(ctx)
+	if err != nil && timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return err
+}
+
+// sleepContext waits for the duration d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendParentTag prefixes the restic tag naming the parent snapshot of an incremental send stream.
+const sendParentTag = "parent:"
+
+// runIDTag prefixes the restic tag holding the run ID, see SetRunID.
+const runIDTag = "run-id:"
+
+// sendParent returns the path of the snapshot an incremental send stream of snapshotPath can
+// be based on: the previous local snapshot of the target, provided its own stream is stored in
+// the repository. Returns an empty string, meaning a full send, if there is no such snapshot.
+func (bm *Manager) sendParent(ctx context.Context, env []string, snapshotPath string, target *config.TargetConfig) string {
+	parentPath, err := bm.previousSnapshot(snapshotPath, target)
+	if err != nil || parentPath == "" {
+		return ""
+	}
+
+	uploaded, err := bm.resticFor(target.Repository, target.Prefix).Snapshots(ctx, env, []string{"btrfs-backup", target.Prefix, filepath.Base(parentPath)}, target.NoLock)
+	if err != nil {
+		slog.Warn("Could not check the repository for the parent snapshot, sending a full stream",
+			"repository", target.Repository, "parent", parentPath, "error", err)
+		return ""
+	}
+	if len(uploaded) == 0 {
+		slog.Info("Parent snapshot is not in the repository, sending a full stream", "repository", target.Repository, "parent", parentPath)
+		return ""
+	}
+	return parentPath
+}
+
+// sendBackup streams 'btrfs send' of the snapshot, incremental to parentPath if set, into
+// 'restic backup --stdin', storing the send stream as a single file named after the snapshot
+// with a .btrfs extension.
+// If either command fails the other one is stopped and the errors of both are returned.
+func (bm *Manager) sendBackup(ctx context.Context, env []string, snapshotPath, parentPath string, target *config.TargetConfig, options restic.BackupOptions) (*restic.Summary, error) {
+	reader, writer := io.Pipe()
+	sent := make(chan error, 1)
+	go func() {
+		err := bm.btrfs.Send(ctx, snapshotPath, parentPath, writer)
+		_ = writer.CloseWithError(err)
+		sent <- err
+	}()
+
+	summary, err := bm.resticFor(target.Repository, target.Prefix).BackupStdin(ctx, env, reader, filepath.Base(snapshotPath)+".btrfs", options)
+	// Unblock btrfs send if restic stopped reading early
+	_ = reader.CloseWithError(io.ErrClosedPipe)
+
+	sendErr := <-sent
+	switch {
+	case sendErr == nil:
+		return summary, err
+	case err == nil:
+		return nil, fmt.Errorf("btrfs send failed: %w", sendErr)
+	default:
+		return nil, errors.Join(err, fmt.Errorf("btrfs send failed: %w", sendErr))
+	}
+}
+
+// snapshotExcludes anchors exclude patterns starting with a slash at the snapshot root,
+// so "/.cache" excludes the .cache directory at the top of the subvolume. Other patterns
+// are passed to restic unchanged and match at any depth.
+func snapshotExcludes(snapshotPath string, excludes []string) []string {
+	var patterns []string
+	for _, pattern := range excludes {
+		if strings.HasPrefix(pattern, "/") {
+			pattern = filepath.Join(snapshotPath, pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// CheckSuccessCriteria compares the summary of a restic backup with the target's
+// success_criteria and returns an error listing every violated criterion.
+// Nothing is checked without criteria or a summary, as in dry-run mode.
+func (bm *Manager) CheckSuccessCriteria(summary *restic.Summary, target *config.TargetConfig) error {
+	criteria := target.SuccessCriteria
+	if !criteria.IsEnabled() || summary == nil {
+		return nil
+	}
+
+	var violations []string
+	if criteria.MinFiles > 0 && summary.TotalFilesProcessed < criteria.MinFiles {
+		violations = append(violations, fmt.Sprintf("%d files processed, expected at least %d", summary.TotalFilesProcessed, criteria.MinFiles))
+	}
+	if criteria.MinBytes != "" {
+		minBytes, err := config.ParseSize(criteria.MinBytes)
+		if err != nil {
+			return err
+		}
+		if summary.TotalBytesProcessed < minBytes {
+			violations = append(violations, fmt.Sprintf("%d bytes processed, expected at least %s", summary.TotalBytesProcessed, criteria.MinBytes))
+		}
+	}
+	duration := time.Duration(summary.TotalDuration * float64(time.Second))
+	if criteria.MaxDuration > 0 && duration > criteria.MaxDuration {
+		violations = append(violations, fmt.Sprintf("backup took %s, expected at most %s", duration.Round(time.Second), criteria.MaxDuration))
+	}
+	if len(violations) > 0 {
+		return errors.New(strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+func (bm *Manager) loadRepositoryEnv(repository string) ([]string, error) {
+	vars, err := bm.RepositoryVariables(repository)
+	if err != nil {
+		return nil, err
+	}
+	return append(os.Environ(), vars...), nil
+}
+
+// loadReadOnlyRepositoryEnv is loadRepositoryEnv for commands that only read the
+// repository. It prefers the repository's read-only credentials, if configured.
+func (bm *Manager) loadReadOnlyRepositoryEnv(repository string) ([]string, error) {
+	vars, err := bm.ReadOnlyRepositoryVariables(repository)
+	if err != nil {
+		return nil, err
+	}
+	return append(os.Environ(), vars...), nil
+}
+
+// ReadOnlyRepositoryVariables returns the variables of the read-only repository
+// configuration '<repository>.readonly' if it exists, and those of the regular
+// repository configuration otherwise. Keeping restricted credentials, e.g. S3 keys
+// without delete permission, in the read-only configuration confines the write
+// credentials to the hosts and commands that back up.
+func (bm *Manager) ReadOnlyRepositoryVariables(repository string) ([]string, error) {
+	readOnly := repository + ".readonly"
+	if bm.config.SecretBackend == config.SecretBackendEnv {
+		if _, ok := os.LookupEnv(config.RepositoryEnv(readOnly)); ok {
+			return bm.RepositoryVariables(readOnly)
+		}
+		return bm.RepositoryVariables(repository)
+	}
+	if bm.config.SecretBackend == config.SecretBackendKeyring {
+		vars, err := bm.RepositoryVariables(readOnly)
+		if errors.Is(err, keyring.ErrNotFound) {
+			return bm.RepositoryVariables(repository)
+		}
+		return vars, err
+	}
+	if _, provider := bm.repositoryFile(readOnly); provider != nil {
+		return bm.RepositoryVariables(readOnly)
+	}
+	return bm.RepositoryVariables(repository)
+}
+
+// repositoryFile returns the path of a repository configuration and the provider reading
+// it: the first file named after the repository plus the suffix of a credential provider
+// that exists. provider is nil if none exists.
+func (bm *Manager) repositoryFile(repository string) (path string, provider CredentialProvider) {
+	path = filepath.Join(bm.config.ResticRepoDir, repository)
+	for _, provider := range bm.credentials {
+		if _, err := bm.fs.Stat(path + provider.Suffix()); err == nil {
+			return path + provider.Suffix(), provider
+		}
+	}
+	return path, nil
+}
+
+// RepositoryVariables returns the environment variables defined by a repository
+// configuration as KEY=VALUE pairs, in the order they appear in the file. Instead of
+// the plaintext file '<repository>', the configuration can be '<repository>.age' or
+// '<repository>.gpg', decrypted by the credential providers; their contents are only
+// held in memory. With secret_backend "keyring" the configuration is looked up in the
+// system keyring instead, see StoreRepositorySecret, and with secret_backend "env" in an
+// environment variable, see environmentRepositoryVariables. Values referencing a HashiCorp
+// Vault secret as 'vault:<path>#<field>' are replaced with the field of the secret.
+func (bm *Manager) RepositoryVariables(repository string) ([]string, error) {
+	if bm.config.SecretBackend == config.SecretBackendEnv {
+		return bm.environmentRepositoryVariables(repository)
+	}
+	if bm.config.SecretBackend == config.SecretBackendKeyring {
+		data, err := bm.keyring.Lookup(context.Background(), repository)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read repository config '%s': %w", repository, err)
+		}
+		return resolveRepositoryVariables(parseRepositoryVariables(data), "keyring entry "+repository)
+	}
+
+	repoFile, provider := bm.repositoryFile(repository)
+	if provider == nil {
+		return nil, fmt.Errorf("repository configuration '%s' not found: %s", repository, repoFile)
+	}
+
+	data, err := provider.Read(repoFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository config %s: %w", repoFile, err)
+	}
+
+	return resolveRepositoryVariables(parseRepositoryVariables(data), "repository config "+repoFile)
+}
+
+// environmentRepositoryVariables returns the variables of the repository configuration held
+// by the environment variable config.RepositoryEnv names, for secret_backend "env". Without
+// that variable, restic reads its own variables such as RESTIC_REPOSITORY and
+// RESTIC_PASSWORD from the environment the commands inherit, so no variables are returned,
+// provided RESTIC_REPOSITORY or RESTIC_REPOSITORY_FILE is set and the inline target is the
+// only target, backing up to repository. With more repositories in use, falling back to
+// the environment would send all of them to the same one.
+func (bm *Manager) environmentRepositoryVariables(repository string) ([]string, error) {
+	targetRepositories, inlineOnly := bm.targetRepositories()
+	repositories := append(slices.Collect(maps.Keys(bm.config.Repositories)), targetRepositories...)
+	if err := config.CheckRepositoryEnv(append(repositories, strings.TrimSuffix(repository, ".readonly"))); err != nil {
+		return nil, err
+	}
+
+	name := config.RepositoryEnv(repository)
+	if data, ok := os.LookupEnv(name); ok {
+		return resolveRepositoryVariables(parseRepositoryVariables([]byte(data)), "environment variable "+name)
+	}
+	if os.Getenv("RESTIC_REPOSITORY") == "" && os.Getenv("RESTIC_REPOSITORY_FILE") == "" {
+		return nil, fmt.Errorf("repository configuration '%s' not found: neither %s nor RESTIC_REPOSITORY is set", repository, name)
+	}
+	if !inlineOnly || !slices.Equal(targetRepositories, []string{repository}) {
+		return nil, fmt.Errorf("repository configuration '%s' not found: %s is not set, and RESTIC_REPOSITORY only applies to the inline target as the only target", repository, name)
+	}
+	return nil, nil
+}
+
+// targetRepositories returns the repositories of the targets DiscoverTargets finds, and
+// whether the inline target, see config.InlineTarget, is the only target. Targets whose
+// configuration fails to load are left out, they fail when they run. The targets are
+// loaded on the first call, rather than for every repository configuration read.
+func (bm *Manager) targetRepositories() (repositories []string, inlineOnly bool) {
+	bm.targetRepositoriesOnce.Do(func() {
+		bm.targetRepos, bm.inlineOnly = loadTargetRepositories(bm.config.TargetDir)
+	})
+	return bm.targetRepos, bm.inlineOnly
+}
+
+// loadTargetRepositories loads the targets in targetDir for targetRepositories.
+func loadTargetRepositories(targetDir string) (repositories []string, inlineOnly bool) {
+	targets, err := config.DiscoverTargets(targetDir)
+	if err != nil {
+		return nil, false
+	}
+	for _, file := range targets {
+		target, err := config.LoadTargetConfig(file.Path)
+		if err == nil && target.Repository != "" {
+			repositories = append(repositories, target.Repository)
+		}
+	}
+	return repositories, len(targets) == 1 && targets[0].Path == ""
+}
+
+// StoreRepositorySecret stores the repository configuration data, in the format of the
+// files in restic_repo_dir, in the system keyring under the repository's name, for
+// secret_backend "keyring". A '<repository>.readonly' entry holds read-only credentials.
+// Returns an error if data defines no variables or the keyring is unavailable.
+func (bm *Manager) StoreRepositorySecret(ctx context.Context, repository string, data []byte) error {
+	vars, err := checkRepositoryVariables(parseRepositoryVariables(data), "repository config")
+	if err != nil {
+		return err
+	}
+	if len(vars) == 0 {
+		return fmt.Errorf("repository config defines no variables, expected KEY: value lines")
+	}
+	return bm.keyring.Store(ctx, repository, data)
+}
+
+// resolveRepositoryVariables returns the variables of the repository configuration source
+// with their Vault references resolved, see vault.NewFromEnv for the Vault connection.
+// The connection is only set up if a value references Vault.
+func resolveRepositoryVariables(vars []string, source string) ([]string, error) {
+	vars, err := checkRepositoryVariables(vars, source)
+	if err != nil {
+		return nil, err
+	}
+
+	var client *vault.Client
+	for i, kv := range vars {
+		key, value, _ := strings.Cut(kv, "=")
+		path, field, ok, err := vault.ParseReference(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s, %s: %w", source, key, err)
+		}
+		if !ok {
+			continue
+		}
+		if client == nil {
+			if client, err = vault.NewFromEnv(); err != nil {
+				return nil, fmt.Errorf("%s references Vault, but the Vault client can't be set up: %w", source, err)
+			}
+		}
+		secret, err := client.Field(context.Background(), path, field)
+		if err != nil {
+			return nil, fmt.Errorf("%s, %s: %w", source, key, err)
+		}
+		vars[i] = key + "=" + secret
+	}
+	return vars, nil
+}
+
+// checkRepositoryVariables returns the variables of the repository configuration source,
+// with a typed configuration expanded, see expandRepositoryBackend, and its
+// restic_extra_args split at white space into a restic.ExtraArgsKey pair per argument.
+// Returns an error if it is invalid or the variables set both a password and a password
+// command.
+func checkRepositoryVariables(vars []string, source string) ([]string, error) {
+	vars, err := expandRepositoryBackend(vars)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	if slices.ContainsFunc(vars, hasKey("RESTIC_PASSWORD")) && slices.ContainsFunc(vars, hasKey("RESTIC_PASSWORD_COMMAND")) {
+		return nil, fmt.Errorf("%s sets both RESTIC_PASSWORD and password_command", source)
+	}
+	if i := slices.IndexFunc(vars, hasKey(restic.ExtraArgsKey)); i >= 0 {
+		args := strings.Fields(strings.TrimPrefix(vars[i], restic.ExtraArgsKey+"="))
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			return nil, fmt.Errorf("%s: %s must start with a flag, got '%s'", source, restic.ExtraArgsKey, args[0])
+		}
+		vars = slices.Concat(vars[:i], withExtraArgs(nil, args), vars[i+1:])
+	}
+	return vars, nil
 }
 
-// NewManager creates a new backup manager with the provided configuration.
-// The verbose parameter controls whether detailed command logging is enabled.
-func NewManager(cfg *config.Config, verbose bool) *Manager {
-	return &Manager{
-		config:  cfg,
-		verbose: verbose,
-		fs:      &DefaultFileSystem{},
-		btrfs:   btrfs.NewDefaultClient(),
-		restic:  restic.NewDefaultClient(cfg.ResticBin),
+// withExtraArgs returns a copy of a repository environment with args added as
+// restic.ExtraArgsKey pairs, appended to the restic backup, check and forget commands after
+// the extra arguments of the repository configuration.
+func withExtraArgs(env []string, args []string) []string {
+	env = slices.Clone(env)
+	for _, arg := range args {
+		env = append(env, restic.ExtraArgsKey+"="+arg)
 	}
+	return env
 }
 
-// NewManagerWithDeps creates a new backup manager with custom dependencies for testing.
-func NewManagerWithDeps(cfg *config.Config, verbose bool, fs FileSystem, btrfs BtrfsClient, restic ResticClient) *Manager {
-	return &Manager{
-		config:  cfg,
-		verbose: verbose,
-		fs:      fs,
-		btrfs:   btrfs,
-		restic:  restic,
+// hasKey returns a function reporting whether a KEY=VALUE pair has the given key.
+func hasKey(key string) func(string) bool {
+	return func(kv string) bool {
+		return strings.HasPrefix(kv, key+"=")
 	}
 }
 
-// RunBackup executes the complete backup workflow for a target.
-// It performs environment validation, creates a BTRFS snapshot, backs up to Restic,
-// optionally verifies the repository, and cleans up old snapshots.
-// If any step fails, the process stops and returns an error with context.
-func (bm *Manager) RunBackup(targetName string, target *config.TargetConfig) error {
-	err := bm.ValidateEnvironment(target.Subvolume)
-	if err != nil {
-		return fmt.Errorf("environment validation failed: %w", err)
+// parseRepositoryVariables parses the YAML-style KEY: value lines of a repository
+// configuration into KEY=VALUE pairs, skipping blank lines and comments. Values
+// enclosed in matching quotes are unquoted. The password_command key is exported as
+// RESTIC_PASSWORD_COMMAND, so restic gets the password from a command like
+// 'pass show restic' instead of the file.
+func parseRepositoryVariables(data []byte) []string {
+	var env []string
+	content := string(data)
+	for len(content) > 0 {
+		var line string
+		if newlineIdx := strings.Index(content, "\n"); newlineIdx >= 0 {
+			line = content[:newlineIdx]
+			content = content[newlineIdx+1:]
+		} else {
+			line = content
+			content = ""
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		if key == "password_command" {
+			key = "RESTIC_PASSWORD_COMMAND"
+		}
+		value = unquote(strings.TrimSpace(value))
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
 	}
 
-	snapshotPath, err := bm.CreateSnapshot(target.Subvolume, target.Prefix)
-	if err != nil {
-		return fmt.Errorf("snapshot creation failed: %w", err)
+	return env
+}
+
+// unquote removes a pair of matching single or double quotes around value, keeping
+// quotes inside it, e.g. in the arguments of a password_command.
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// ForgetSnapshots applies the target's restic retention policy to its repository.
+// It runs 'restic forget --prune' limited to snapshots tagged with the target's prefix,
+// so other targets sharing the repository are never affected. With metadata_manifest,
+// the metadata manifests of the target are forgotten by the same policy first.
+// If the repository has prune_every, 'restic forget' runs without --prune and the
+// repository is pruned by PruneRepository only when PruneDue, or postponed to the next
+// run while another target uploads to it.
+// Returns an error if no retention policy is configured or the restic command fails.
+func (bm *Manager) ForgetSnapshots(ctx context.Context, target *config.TargetConfig) error {
+	if !target.ResticKeep.IsEnabled() {
+		return fmt.Errorf("no restic_keep retention policy configured")
 	}
 
-	err = bm.PerformBackup(snapshotPath, target)
+	env, err := bm.loadRepositoryEnv(target.Repository)
 	if err != nil {
-		return fmt.Errorf("backup operation failed (snapshot preserved at %s): %w", snapshotPath, err)
+		return fmt.Errorf("repository configuration failed for retention: %w", err)
 	}
+	env = withExtraArgs(env, target.ResticExtraArgs)
 
-	if target.Verify {
-		err = bm.VerifyRepository(target.Repository)
+	policy := restic.ForgetPolicy{
+		KeepLast:    target.ResticKeep.KeepLast,
+		KeepDaily:   target.ResticKeep.KeepDaily,
+		KeepWeekly:  target.ResticKeep.KeepWeekly,
+		KeepMonthly: target.ResticKeep.KeepMonthly,
+		KeepTags:    target.ResticKeep.KeepTags,
+	}
+	client := bm.resticFor(target.Repository, target.Prefix)
+
+	// The manifests are forgotten like the backups they belong to and pruned with them
+	if target.Metadata {
+		err = client.Forget(ctx, env, []string{metadataTag, target.Prefix}, policy, false)
+		if err != nil {
+			return fmt.Errorf("restic forget command failed for metadata manifests: %w", err)
+		}
+	}
+	if target.ChecksumManifest != "" {
+		err = client.Forget(ctx, env, []string{checksumTag, target.Prefix}, policy, false)
 		if err != nil {
-			return fmt.Errorf("repository verification failed: %w", err)
+			return fmt.Errorf("restic forget command failed for checksum manifests: %w", err)
 		}
 	}
 
-	err = bm.CleanupOldSnapshots(target.Prefix, target.KeepSnapshots)
+	scheduled := bm.config.Repository(target.Repository).PruneEvery != ""
+	err = client.Forget(ctx, env, []string{"btrfs-backup", target.Prefix}, policy, !scheduled)
+	bm.emit(events.Event{Type: events.ResticForgotten, Repository: target.Repository}, err)
 	if err != nil {
-		return fmt.Errorf("snapshot cleanup failed: %w", err)
+		return fmt.Errorf("restic forget command failed: %w", err)
 	}
 
-	return nil
+	if !scheduled || !bm.PruneDue(target.Repository) {
+		return nil
+	}
+	err = bm.PruneRepository(ctx, target.Repository)
+	if errors.Is(err, ErrRepositoryBusy) {
+		slog.Info("Repository in use, postponing prune to the next run", "repository", target.Repository)
+		return nil
+	}
+	return err
 }
 
-// ValidateEnvironment checks that the backup environment is properly configured.
-// It verifies that the snapshots directory exists and that the source subvolume
-// is a valid BTRFS subvolume. Returns an error if any validation fails.
-func (bm *Manager) ValidateEnvironment(subvolume string) error {
-	_, err := bm.fs.Stat(bm.config.SnapshotDir)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("snapshots directory does not exist: %s", bm.config.SnapshotDir)
+// InitRepository creates the Restic repository described by a repository configuration.
+// It returns an error wrapping restic.ErrRepositoryExists if the repository is already
+// initialized, so callers can treat repeated initialization as a no-op.
+func (bm *Manager) InitRepository(ctx context.Context, repository string) error {
+	env, err := bm.loadRepositoryEnv(repository)
+	if err != nil {
+		return fmt.Errorf("repository configuration failed for initialization: %w", err)
 	}
 
-	err = bm.btrfs.ShowSubvolume(subvolume)
+	err = bm.resticFor(repository, "").Init(ctx, env)
 	if err != nil {
-		return fmt.Errorf("source subvolume invalid or not BTRFS: %s", subvolume)
+		return fmt.Errorf("repository initialization failed: %s - %w", repository, err)
 	}
 
 	return nil
 }
 
-// CreateSnapshot creates a read-only BTRFS snapshot of the specified subvolume.
-// The snapshot is named using the provided prefix and current timestamp (YYYYMMDD-HHMMSS format).
-// Returns the full path to the created snapshot or an error if creation fails.
-func (bm *Manager) CreateSnapshot(subvolume, prefix string) (string, error) {
-	timestamp := time.Now().Format("20060102-150405")
-	snapshotName := fmt.Sprintf("%s-%s", prefix, timestamp)
-	snapshotPath := filepath.Join(bm.config.SnapshotDir, snapshotName)
+// VerifyRepository performs integrity verification on a Restic repository.
+// It runs 'restic check' reading the given subset of the data, see the target's
+// verify_subset, using the read-only credentials of the repository if configured, with
+// the extra arguments of the target appended.
+// Returns an error if the repository configuration fails or verification detects issues.
+func (bm *Manager) VerifyRepository(ctx context.Context, repository, subset string, extraArgs []string) error {
+	env, err := bm.loadReadOnlyRepositoryEnv(repository)
+	if err != nil {
+		return fmt.Errorf("repository configuration failed for verification: %w", err)
+	}
+	env = withExtraArgs(env, extraArgs)
 
-	err := bm.btrfs.CreateSnapshot(subvolume, snapshotPath, true)
+	err = bm.resticFor(repository, "").Check(ctx, env, subset)
 	if err != nil {
-		return "", fmt.Errorf("BTRFS snapshot command failed: %w", err)
+		return fmt.Errorf("repository verification failed: %s - %w", repository, err)
 	}
 
-	_, err = bm.fs.Stat(snapshotPath)
-	if os.IsNotExist(err) {
-		return "", fmt.Errorf("snapshot not found after creation: %s", snapshotPath)
+	return nil
+}
+
+// VerificationDue reports whether the repository of a target is to be verified after the
+// current backup: always if verify_every is 0 or 1, and otherwise once verify_every backups
+// were uploaded since the last successful verification, as counted by RecordVerification
+// in the target's state file. Verification is due if the state can't be read.
+func (bm *Manager) VerificationDue(targetName string, target *config.TargetConfig) bool {
+	if target.VerifyEvery <= 1 || bm.config.StateDir == "" {
+		return true
 	}
 
-	return snapshotPath, nil
+	st, err := state.Load(bm.config.StateDir, targetName)
+	if err != nil {
+		slog.Warn("Failed to read target state, verifying repository", "target", targetName, "error", err)
+		return true
+	}
+
+	lastVerified := "never"
+	if !st.LastVerify.IsZero() {
+		lastVerified = st.LastVerify.Format(time.RFC3339)
+	}
+	due := st.BackupsSinceVerify+1 >= target.VerifyEvery
+	if !due {
+		slog.Info("Repository verification not due yet", "target", targetName, "last_verified", lastVerified,
+			"backups_since_verify", st.BackupsSinceVerify, "verify_every", target.VerifyEvery)
+	} else {
+		slog.Info("Repository verification due", "target", targetName, "last_verified", lastVerified,
+			"backups_since_verify", st.BackupsSinceVerify, "verify_every", target.VerifyEvery)
+	}
+	return due
 }
 
-// PerformBackup backs up the specified snapshot to a Restic repository.
-// It loads the repository environment configuration, builds the appropriate
-// Restic command (incremental or full), and executes the backup.
-// Returns an error if the snapshot doesn't exist, repository config fails, or backup fails.
-func (bm *Manager) PerformBackup(snapshotPath string, target *config.TargetConfig) error {
-	_, err := bm.fs.Stat(snapshotPath)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("snapshot path does not exist: %s", snapshotPath)
+// ScheduledTarget returns the target to back up in this run: a copy of target with the
+// verification settings of its repository in the main configuration applied, promoted
+// to a full backup if its full_every interval passed since the last full backup, and
+// verifying all data if its verify_full_every interval passed since the last full
+// verification, as recorded in the target's state file by RecordFullBackup and
+// RecordVerification. A target that never had one recorded is promoted. Without a
+// state_dir, or if the state can't be read, full_every and verify_full_every have no
+// effect.
+func (bm *Manager) ScheduledTarget(targetName string, target *config.TargetConfig) *config.TargetConfig {
+	scheduled := *target
+	repository := bm.config.Repository(target.Repository)
+	if repository.VerifySubset != "" {
+		scheduled.VerifySubset = repository.VerifySubset
+	}
+	if repository.VerifyFullEvery != "" {
+		scheduled.VerifyFullEvery = repository.VerifyFullEvery
 	}
 
-	env, err := bm.loadRepositoryEnv(target.Repository)
+	fullDue := scheduled.FullEvery != "" && scheduled.Type != "full"
+	fullVerifyDue := scheduled.VerifyFullEvery != "" && scheduled.Verify && scheduled.VerifySubset != config.VerifyFull
+	if (!fullDue && !fullVerifyDue) || bm.config.StateDir == "" {
+		return &scheduled
+	}
+	st, err := state.Load(bm.config.StateDir, targetName)
 	if err != nil {
-		return fmt.Errorf("repository configuration failed: %w", err)
+		slog.Warn("Failed to read target state, keeping the configured backup type and verify_subset", "target", targetName, "error", err)
+		return &scheduled
 	}
 
-	tags := []string{"btrfs-backup", target.Prefix, filepath.Base(snapshotPath)}
-	force := target.Type == "full"
+	if fullDue && intervalPassed(scheduled.FullEvery, st.LastFull) {
+		slog.Info("Full backup due", "target", targetName, "last_full", formatLast(st.LastFull), "full_every", scheduled.FullEvery)
+		scheduled.Type = "full"
+	}
+	if fullVerifyDue && intervalPassed(scheduled.VerifyFullEvery, st.LastFullVerify) {
+		slog.Info("Full verification due", "target", targetName, "last_full_verify", formatLast(st.LastFullVerify),
+			"verify_full_every", scheduled.VerifyFullEvery)
+		scheduled.VerifySubset = config.VerifyFull
+	}
+	return &scheduled
+}
 
-	err = bm.restic.Backup(env, snapshotPath, tags, true, force)
+// intervalPassed reports whether interval, see config.ParseInterval, passed since last,
+// which is always the case if last is zero.
+func intervalPassed(interval string, last time.Time) bool {
+	d, err := config.ParseInterval(interval)
 	if err != nil {
-		return fmt.Errorf("restic backup command failed: %w", err)
+		return false
 	}
+	return last.IsZero() || time.Since(last) >= d
+}
 
-	return nil
+// formatLast formats the time of the last occurrence of something for logging.
+func formatLast(last time.Time) string {
+	if last.IsZero() {
+		return "never"
+	}
+	return last.Format(time.RFC3339)
 }
 
-func (bm *Manager) loadRepositoryEnv(repository string) ([]string, error) {
-	repoFile := filepath.Join(bm.config.ResticRepoDir, repository)
-	_, err := bm.fs.Stat(repoFile)
-	if os.IsNotExist(err) {
-		return nil, fmt.Errorf("repository configuration '%s' not found: %s", repository, repoFile)
+// RecordFullBackup records in the target's state file that a full backup started at
+// started was uploaded, restarting the full_every interval. Nothing is recorded in
+// dry-run mode or if no state_dir is configured.
+func (bm *Manager) RecordFullBackup(targetName string, started time.Time) error {
+	if bm.config.StateDir == "" || bm.dryRun {
+		return nil
 	}
 
-	env := os.Environ()
+	return state.Update(bm.config.StateDir, targetName, func(st *state.Target) {
+		st.LastFull = started
+	})
+}
 
-	data, err := bm.fs.ReadFile(repoFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read repository config %s: %w", repoFile, err)
+// RecordVerification updates the target's state file after an uploaded backup: a
+// successful verification reading subset resets the count of backups since the last
+// verification and records its time, also as the last full verification if subset is
+// "full", otherwise the count is incremented. The error of a failed verification,
+// verifyErr, is kept until a verification succeeds. Nothing is recorded in dry-run mode
+// or if no state_dir is configured.
+func (bm *Manager) RecordVerification(targetName, subset string, verified bool, verifyErr error) error {
+	if bm.config.StateDir == "" || bm.dryRun {
+		return nil
 	}
 
-	// Parse YAML-style repository config
-	content := string(data)
-	for len(content) > 0 {
-		var line string
-		if newlineIdx := strings.Index(content, "\n"); newlineIdx >= 0 {
-			line = content[:newlineIdx]
-			content = content[newlineIdx+1:]
-		} else {
-			line = content
-			content = ""
-		}
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	return state.Update(bm.config.StateDir, targetName, func(st *state.Target) {
+		if verifyErr != nil {
+			st.LastVerifyError = verifyErr.Error()
 		}
-
-		key, value, found := strings.Cut(line, ":")
-		if !found {
-			continue
+		if verified {
+			st.LastVerifyError = ""
+			st.BackupsSinceVerify = 0
+			st.LastVerify = time.Now()
+			if subset == config.VerifyFull {
+				st.LastFullVerify = st.LastVerify
+			}
+		} else {
+			st.BackupsSinceVerify++
 		}
+	})
+}
 
-		key = strings.TrimSpace(key)
-		value = strings.Trim(strings.TrimSpace(value), "\"'")
-		env = append(env, fmt.Sprintf("%s=%s", key, value))
+// RecordRun records a backup run of a target that started at started in the target's
+// state file: its run ID, the snapshot it created and the restic snapshot it uploaded, if
+// any, with the data it added to the upload history, and runErr, or the time of the run
+// as the last success if runErr is nil, counting the runs failed in a row. Nothing is
+// recorded in dry-run mode or if no state_dir is configured.
+func (bm *Manager) RecordRun(targetName string, started time.Time, snapshotPath string, summary *restic.Summary, runErr error) error {
+	if bm.config.StateDir == "" || bm.dryRun {
+		return nil
 	}
 
-	return env, nil
+	return state.Update(bm.config.StateDir, targetName, func(st *state.Target) {
+		st.LastAttempt = started
+		st.LastRunID = bm.runID
+		if snapshotPath != "" {
+			st.LastSnapshot = snapshotPath
+		}
+		if summary != nil && summary.SnapshotID != "" {
+			st.LastResticSnapshot = summary.SnapshotID
+			st.AddUpload(state.Upload{Time: started, DataAdded: summary.DataAdded, BytesProcessed: summary.TotalBytesProcessed,
+				FilesProcessed: summary.TotalFilesProcessed})
+		}
+		st.LastError = ""
+		if runErr != nil {
+			st.LastError = runErr.Error()
+			st.ConsecutiveFailures++
+		} else {
+			st.LastSuccess = started
+			st.ConsecutiveFailures = 0
+		}
+	})
+}
+
+// RepositorySnapshot is a restic snapshot of a target together with the name of the
+// local BTRFS snapshot it was created from, as recorded in its tags.
+type RepositorySnapshot struct {
+	ID            string    `json:"id"`
+	ShortID       string    `json:"short_id"`
+	Time          time.Time `json:"time"`
+	Hostname      string    `json:"hostname"`
+	Paths         []string  `json:"paths"`
+	Tags          []string  `json:"tags"`
+	LocalSnapshot string    `json:"local_snapshot"`
+	LocalExists   bool      `json:"local_exists"`
 }
 
-// VerifyRepository performs integrity verification on a Restic repository.
-// It runs 'restic check' with a 5% data subset check to verify repository consistency.
-// Returns an error if the repository configuration fails or verification detects issues.
-func (bm *Manager) VerifyRepository(repository string) error {
-	env, err := bm.loadRepositoryEnv(repository)
+// ListRepositorySnapshots returns the restic snapshots created for a target, oldest first.
+// Snapshots are selected by the tags PerformBackup attaches, and each one is matched to
+// its local snapshot name so callers can tell whether the local copy still exists.
+// The read-only credentials of the repository are used if configured.
+func (bm *Manager) ListRepositorySnapshots(ctx context.Context, target *config.TargetConfig) ([]RepositorySnapshot, error) {
+	env, err := bm.loadReadOnlyRepositoryEnv(target.Repository)
 	if err != nil {
-		return fmt.Errorf("repository configuration failed for verification: %w", err)
+		return nil, fmt.Errorf("repository configuration failed: %w", err)
 	}
 
-	err = bm.restic.Check(env, "5%")
+	snapshots, err := bm.resticFor(target.Repository, target.Prefix).Snapshots(ctx, env, []string{"btrfs-backup", target.Prefix}, target.NoLock)
 	if err != nil {
-		return fmt.Errorf("repository verification failed: %s - %w", repository, err)
+		return nil, fmt.Errorf("restic snapshots command failed: %w", err)
 	}
 
-	return nil
+	localNames, err := bm.getSnapshotNames(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local snapshots: %w", err)
+	}
+	naming, err := target.SnapshotNaming()
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot name template: %w", err)
+	}
+
+	result := make([]RepositorySnapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		local := localSnapshotTag(s.Tags, naming)
+		result = append(result, RepositorySnapshot{
+			ID:            s.ID,
+			ShortID:       s.ShortID,
+			Time:          s.Time,
+			Hostname:      s.Hostname,
+			Paths:         s.Paths,
+			Tags:          s.Tags,
+			LocalSnapshot: local,
+			LocalExists:   local != "" && slices.Contains(localNames, local),
+		})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+
+	return result, nil
+}
+
+// localSnapshotTag returns the tag naming the local snapshot a restic snapshot was made from.
+func localSnapshotTag(tags []string, naming config.SnapshotNaming) string {
+	for _, tag := range tags {
+		if _, ok := naming.Parse(tag); ok {
+			return tag
+		}
+	}
+	return ""
 }
 
 // CleanupOldSnapshots removes old snapshots beyond the retention limit.
-// It finds all snapshots with the given prefix, sorts them by modification time (newest first),
-// and deletes snapshots beyond the retention count. Returns an error if any deletions fail.
-func (bm *Manager) CleanupOldSnapshots(prefix string, retention int) error {
-	snapshots, err := bm.getSnapshotsByPrefix(prefix)
+// It finds all snapshots of the target, sorts them by the timestamp in their names (newest first),
+// and deletes snapshots beyond the retention count. If the target sets max_snapshot_space, the
+// oldest of the remaining snapshots are deleted as well while their exclusive space exceeds it,
+// see enforceSnapshotSpace. Returns an error if any deletions fail.
+func (bm *Manager) CleanupOldSnapshots(ctx context.Context, target *config.TargetConfig, retention int) error {
+	snapshots, err := bm.getSnapshotNames(target)
 	if err != nil {
 		return fmt.Errorf("failed to list snapshots: %w", err)
 	}
 
-	if len(snapshots) <= retention {
-		return nil
-	}
-
-	snapshotsToDelete := snapshots[retention:]
+	kept := snapshots[:min(retention, len(snapshots))]
 	var failedDeletions []string
 
-	for _, snapshot := range snapshotsToDelete {
-		err = bm.deleteSnapshot(snapshot)
+	for _, snapshot := range snapshots[len(kept):] {
+		err = bm.deleteSnapshot(ctx, snapshot)
 		if err != nil {
 			failedDeletions = append(failedDeletions, snapshot)
 		}
 	}
 
+	if target.MaxSnapshotSpace != "" {
+		failed, err := bm.enforceSnapshotSpace(ctx, target, kept)
+		if err != nil {
+			return fmt.Errorf("failed to check snapshot space: %w", err)
+		}
+		failedDeletions = append(failedDeletions, failed...)
+	}
+
 	if len(failedDeletions) > 0 {
 		return fmt.Errorf("failed to delete some snapshots: %v", failedDeletions)
 	}
@@ -236,10 +1802,152 @@ func (bm *Manager) CleanupOldSnapshots(prefix string, retention int) error {
 	return nil
 }
 
-func (bm *Manager) getSnapshotsByPrefix(prefix string) ([]string, error) {
-	_, err := bm.fs.Stat(bm.config.SnapshotDir)
+// enforceSnapshotSpace deletes the oldest of the snapshots, given newest first, while the sum of
+// their exclusive space as reported by BTRFS quota groups exceeds the target's max_snapshot_space.
+// The newest min_keep_snapshots snapshots are never deleted. Deleting a snapshot can make data it
+// shared with an older one exclusive to that one, so the sum is approximate and a later cleanup
+// may delete more. Returns the snapshots that failed to delete.
+func (bm *Manager) enforceSnapshotSpace(ctx context.Context, target *config.TargetConfig, snapshots []string) ([]string, error) {
+	limit, err := config.ParseSize(target.MaxSnapshotSpace)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make([]int64, len(snapshots))
+	var total int64
+	for i, snapshot := range snapshots {
+		sizes[i], err = bm.snapshotSpace(ctx, snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("could not determine exclusive space of snapshot %s: %w", snapshot, err)
+		}
+		total += sizes[i]
+	}
+
+	var failed []string
+	for i := len(snapshots) - 1; i >= target.MinKeepSnapshots && total > limit; i-- {
+		slog.Info("Deleting snapshot to stay within max_snapshot_space", "snapshot", snapshots[i],
+			"space", total, "max_snapshot_space", target.MaxSnapshotSpace)
+		err = bm.deleteSnapshot(ctx, snapshots[i])
+		if err != nil {
+			failed = append(failed, snapshots[i])
+			continue
+		}
+		total -= sizes[i]
+	}
+	if total > limit {
+		slog.Warn("Snapshots exceed max_snapshot_space, but min_keep_snapshots are kept",
+			"space", total, "max_snapshot_space", target.MaxSnapshotSpace, "min_keep_snapshots", target.MinKeepSnapshots)
+	}
+
+	return failed, nil
+}
+
+// snapshotSpace returns the exclusive space of a snapshot, including the snapshots nested in
+// it for multi-subvolume targets. Snapshots pending in dry-run mode take no space.
+func (bm *Manager) snapshotSpace(ctx context.Context, snapshotName string) (int64, error) {
+	snapshotPath := filepath.Join(bm.config.SnapshotDir, snapshotName)
+	if bm.isPendingSnapshot(snapshotPath) {
+		return 0, nil
+	}
+
+	var total int64
+	for _, subvolume := range append(bm.nestedSubvolumes(snapshotPath), snapshotPath) {
+		size, err := bm.btrfs.ExclusiveSize(ctx, subvolume)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// SnapshotInfo describes a local BTRFS snapshot belonging to a target.
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// ListSnapshots returns the local snapshots of the target, newest first.
+// The creation time is taken from the timestamp in the snapshot name and the size is
+// the apparent size of the files it contains. Entries that cannot be read are skipped,
+// so the size is a lower bound when running without sufficient privileges.
+func (bm *Manager) ListSnapshots(target *config.TargetConfig) ([]SnapshotInfo, error) {
+	snapshots, err := bm.findSnapshots(target)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]SnapshotInfo, 0, len(snapshots))
+	for _, s := range snapshots {
+		snapshotPath := filepath.Join(bm.config.SnapshotDir, s.name)
+		result = append(result, SnapshotInfo{
+			Name:    s.name,
+			Path:    snapshotPath,
+			Created: s.created,
+			Size:    bm.snapshotStats(snapshotPath).bytes,
+		})
+	}
+
+	return result, nil
+}
+
+type contentStats struct {
+	files int
+	bytes int64
+}
+
+// snapshotStats counts the regular files below snapshotPath and their apparent size.
+// Entries that cannot be read are skipped.
+func (bm *Manager) snapshotStats(snapshotPath string) contentStats {
+	var stats contentStats
+	_ = bm.fs.WalkDir(snapshotPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		stats.files++
+		stats.bytes += info.Size()
+		return nil
+	})
+	return stats
+}
+
+type snapshotEntry struct {
+	name    string
+	created time.Time // timestamp in the name
+	mtime   time.Time
+}
+
+func (bm *Manager) getSnapshotNames(target *config.TargetConfig) ([]string, error) {
+	snapshots, err := bm.findSnapshots(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, s := range snapshots {
+		result = append(result, s.name)
+	}
+
+	return result, nil
+}
+
+// findSnapshots returns the entries of the snapshot directory whose names follow the
+// target's name template, including snapshots pending in dry-run mode.
+func (bm *Manager) findSnapshots(target *config.TargetConfig) ([]snapshotEntry, error) {
+	naming, err := target.SnapshotNaming()
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot name template: %w", err)
+	}
+
+	_, err = bm.fs.Stat(bm.config.SnapshotDir)
 	if os.IsNotExist(err) {
-		return []string{}, nil
+		return []snapshotEntry{}, nil
 	}
 
 	entries, err := bm.fs.ReadDir(bm.config.SnapshotDir)
@@ -247,48 +1955,76 @@ func (bm *Manager) getSnapshotsByPrefix(prefix string) ([]string, error) {
 		return nil, fmt.Errorf("could not list snapshots directory: %w", err)
 	}
 
-	type snapshotInfo struct {
-		name  string
-		mtime time.Time
-	}
+	var snapshots []snapshotEntry
 
-	var snapshots []snapshotInfo
-	searchPrefix := prefix + "-"
+	for _, pending := range bm.pendingSnapshots {
+		if created, ok := naming.Parse(pending.name); ok {
+			pending.created = created
+			snapshots = append(snapshots, pending)
+		}
+	}
 
 	for _, entry := range entries {
-		if strings.HasPrefix(entry.Name(), searchPrefix) {
+		if created, ok := naming.Parse(entry.Name()); ok {
 			info, err := entry.Info()
 			if err != nil {
 				continue
 			}
-			snapshots = append(snapshots, snapshotInfo{
-				name:  entry.Name(),
-				mtime: info.ModTime(),
+			snapshots = append(snapshots, snapshotEntry{
+				name:    entry.Name(),
+				created: created,
+				mtime:   info.ModTime(),
 			})
 		}
 	}
 
-	// Sort by modification time, newest first
+	// Sort by the timestamp in the name, newest first. The modification time only breaks
+	// ties of timestamps too coarse to tell snapshots apart.
 	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].created.Equal(snapshots[j].created) {
+			return snapshots[i].created.After(snapshots[j].created)
+		}
 		return snapshots[i].mtime.After(snapshots[j].mtime)
 	})
 
-	var result []string
-	for _, s := range snapshots {
-		result = append(result, s.name)
-	}
+	return snapshots, nil
+}
 
-	return result, nil
+func (bm *Manager) isPendingSnapshot(snapshotPath string) bool {
+	for _, pending := range bm.pendingSnapshots {
+		if filepath.Join(bm.config.SnapshotDir, pending.name) == snapshotPath {
+			return true
+		}
+	}
+	return false
 }
 
-func (bm *Manager) deleteSnapshot(snapshotName string) error {
+func (bm *Manager) deleteSnapshot(ctx context.Context, snapshotName string) error {
 	snapshotPath := filepath.Join(bm.config.SnapshotDir, snapshotName)
 
-	err := bm.btrfs.DeleteSubvolume(snapshotPath)
+	err := bm.deleteSubvolume(ctx, snapshotName, snapshotPath)
+	bm.emit(events.Event{Type: events.SnapshotDeleted, Snapshot: snapshotPath}, err)
+	return err
+}
+
+func (bm *Manager) deleteSubvolume(ctx context.Context, snapshotName, snapshotPath string) error {
+	// The snapshots of a multi-subvolume target must go before the subvolume holding them
+	for _, nested := range bm.nestedSubvolumes(snapshotPath) {
+		err := bm.btrfs.DeleteSubvolume(ctx, nested)
+		if err != nil {
+			return fmt.Errorf("BTRFS delete command failed for snapshot %s: %w", snapshotName, err)
+		}
+	}
+
+	err := bm.btrfs.DeleteSubvolume(ctx, snapshotPath)
 	if err != nil {
 		return fmt.Errorf("BTRFS delete command failed for snapshot %s: %w", snapshotName, err)
 	}
 
+	if bm.dryRun {
+		return nil
+	}
+
 	_, err = bm.fs.Stat(snapshotPath)
 	if err == nil {
 		return fmt.Errorf("snapshot still exists after deletion: %s", snapshotPath)
@@ -296,3 +2032,31 @@ func (bm *Manager) deleteSnapshot(snapshotName string) error {
 
 	return nil
 }
+
+// subvolumeRootInode is the inode number of the root directory of every BTRFS subvolume.
+const subvolumeRootInode = 256
+
+// nestedSubvolumes returns the subvolumes directly below snapshotPath. The placeholders
+// BTRFS leaves for subvolumes nested in a snapshotted subvolume are not subvolumes and
+// are not returned. Entries that cannot be read are skipped.
+func (bm *Manager) nestedSubvolumes(snapshotPath string) []string {
+	entries, err := bm.fs.ReadDir(snapshotPath)
+	if err != nil {
+		return nil
+	}
+
+	var nested []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Ino == subvolumeRootInode {
+			nested = append(nested, filepath.Join(snapshotPath, entry.Name()))
+		}
+	}
+	return nested
+}
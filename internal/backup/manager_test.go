@@ -1,15 +1,30 @@
 package backup
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
 	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"btrfs-backup/internal/btrfs"
+	"btrfs-backup/internal/command"
 	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/events"
+	"btrfs-backup/internal/restic"
+	"btrfs-backup/internal/state"
+	"btrfs-backup/progress"
 )
 
 // Mock implementations for testing
@@ -44,7 +59,7 @@ import (
 //
 //     // Test the functionality
 //     mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-//     err := mgr.RunBackup("test", &config.TargetConfig{
+//     err := mgr.RunBackup(context.Background(), "test", &config.TargetConfig{
 //       Subvolume: "/mnt/data", Repository: "backup-repo", Prefix: "test",
 //     })
 //     assert.NoError(t, err)
@@ -70,6 +85,8 @@ type MockFileSystem struct {
 	files    map[string][]byte
 	dirs     map[string][]MockDirEntry
 	statErrs map[string]error
+	removed  []string    // paths passed to RemoveAll
+	renamed  [][2]string // old and new paths passed to Rename
 }
 
 // MockDirEntry represents a directory entry for testing.
@@ -84,9 +101,11 @@ type MockFileSystem struct {
 //	}
 //	mockFS.AddDir("/path", entries)
 type MockDirEntry struct {
-	name    string
-	isDir   bool
-	modTime time.Time
+	name      string
+	isDir     bool
+	modTime   time.Time
+	size      int64
+	subvolume bool // the directory is the root of a BTRFS subvolume
 }
 
 func (m MockDirEntry) Name() string {
@@ -105,21 +124,27 @@ func (m MockDirEntry) Type() os.FileMode {
 }
 
 func (m MockDirEntry) Info() (os.FileInfo, error) {
-	return &MockFileInfo{name: m.name, modTime: m.modTime, isDir: m.isDir}, nil
+	info := &MockFileInfo{name: m.name, modTime: m.modTime, isDir: m.isDir, size: m.size}
+	if m.subvolume {
+		info.sys = &syscall.Stat_t{Ino: subvolumeRootInode}
+	}
+	return info, nil
 }
 
 type MockFileInfo struct {
 	name    string
 	modTime time.Time
 	isDir   bool
+	size    int64
+	sys     any
 }
 
 func (m *MockFileInfo) Name() string       { return m.name }
-func (m *MockFileInfo) Size() int64        { return 0 }
+func (m *MockFileInfo) Size() int64        { return m.size }
 func (m *MockFileInfo) Mode() os.FileMode  { return 0 }
 func (m *MockFileInfo) ModTime() time.Time { return m.modTime }
 func (m *MockFileInfo) IsDir() bool        { return m.isDir }
-func (m *MockFileInfo) Sys() any           { return nil }
+func (m *MockFileInfo) Sys() any           { return m.sys }
 
 func NewMockFileSystem() *MockFileSystem {
 	return &MockFileSystem{
@@ -178,6 +203,82 @@ func (m *MockFileSystem) ReadFile(filename string) ([]byte, error) {
 	return nil, os.ErrNotExist
 }
 
+func (m *MockFileSystem) Open(name string) (io.ReadCloser, error) {
+	if content, exists := m.files[name]; exists {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// MkdirTemp adds an empty directory named after pattern below dir, or /tmp if dir is empty.
+func (m *MockFileSystem) MkdirTemp(dir, pattern string) (string, error) {
+	if dir == "" {
+		dir = "/tmp"
+	}
+	path := filepath.Join(dir, pattern+"1")
+	m.dirs[path] = nil
+	return path, nil
+}
+
+// RemoveAll removes path and every file added below it.
+func (m *MockFileSystem) RemoveAll(path string) error {
+	m.removed = append(m.removed, path)
+	delete(m.dirs, path)
+	delete(m.files, path)
+	for file := range m.files {
+		if strings.HasPrefix(file, path+"/") {
+			delete(m.files, file)
+		}
+	}
+	return nil
+}
+
+// Rename moves oldpath, and every file added below it, to newpath.
+func (m *MockFileSystem) Rename(oldpath, newpath string) error {
+	if _, err := m.Stat(oldpath); err != nil {
+		return err
+	}
+	m.renamed = append(m.renamed, [2]string{oldpath, newpath})
+	if entries, exists := m.dirs[oldpath]; exists {
+		delete(m.dirs, oldpath)
+		m.dirs[newpath] = entries
+	}
+	for file, content := range m.files {
+		if file == oldpath || strings.HasPrefix(file, oldpath+"/") {
+			delete(m.files, file)
+			m.files[newpath+strings.TrimPrefix(file, oldpath)] = content
+		}
+	}
+	return nil
+}
+
+// WalkDir visits root followed by every file added below it, in lexical order.
+// File sizes reported by the visited entries match the length of their content.
+func (m *MockFileSystem) WalkDir(root string, fn fs.WalkDirFunc) error {
+	if _, err := m.Stat(root); err != nil {
+		return fn(root, nil, err)
+	}
+	if err := fn(root, MockDirEntry{name: filepath.Base(root), isDir: true}, nil); err != nil {
+		return err
+	}
+
+	var paths []string
+	for path := range m.files {
+		if strings.HasPrefix(path, root+"/") {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+
+	for _, path := range paths {
+		entry := MockDirEntry{name: filepath.Base(path), size: int64(len(m.files[path]))}
+		if err := fn(path, entry, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // MockBtrfsClient implements BtrfsClient interface for testing.
 //
 // It allows tests to verify that the correct BTRFS commands are executed
@@ -196,16 +297,20 @@ func (m *MockFileSystem) ReadFile(filename string) ([]byte, error) {
 //
 //	// Now calls to ShowSubvolume() and CreateSnapshot() will be verified
 type MockBtrfsClient struct {
-	expectedCommands []ExpectedBtrfsCommand
-	index            int
-	t                *testing.T
-	onCreateSnapshot func(subvolume, snapshotPath string) // callback for successful snapshot creation
+	expectedCommands  []ExpectedBtrfsCommand
+	index             int
+	t                 *testing.T
+	onCreateSnapshot  func(subvolume, snapshotPath string) // callback for successful snapshot creation
+	onCreateSubvolume func(subvolumePath string)           // callback for successful subvolume creation
+	onDeleteSubvolume func(subvolumePath string)           // callback for successful subvolume deletion
 }
 
 type ExpectedBtrfsCommand struct {
 	operation string
 	args      []string
 	exitCode  int
+	output    string
+	stats     []btrfs.DeviceStat
 }
 
 func NewMockBtrfsClient(t *testing.T) *MockBtrfsClient {
@@ -222,6 +327,16 @@ func (m *MockBtrfsClient) ExpectShowSubvolume(subvolume string, exitCode int) {
 	})
 }
 
+// ExpectShowSnapshot sets up expectation for a 'btrfs subvolume show' command reporting
+// a read-only snapshot.
+func (m *MockBtrfsClient) ExpectShowSnapshot(subvolume string) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedBtrfsCommand{
+		operation: "show",
+		args:      []string{subvolume},
+		output:    "readonly",
+	})
+}
+
 // ExpectCreateSnapshot sets up expectation for a 'btrfs subvolume snapshot' command.
 // Use empty strings for subvolume and snapshotPath to accept any arguments.
 // Set onCreateSnapshot callback to simulate filesystem effects of successful creation.
@@ -238,6 +353,32 @@ func (m *MockBtrfsClient) ExpectCreateSnapshot(subvolume, snapshotPath string, r
 	})
 }
 
+// ExpectCreateSubvolume sets up expectation for a 'btrfs subvolume create' command.
+// Use an empty subvolumePath to accept any path.
+func (m *MockBtrfsClient) ExpectCreateSubvolume(subvolumePath string, exitCode int) {
+	args := []string{subvolumePath}
+	if subvolumePath == "" {
+		args = []string{}
+	}
+	m.expectedCommands = append(m.expectedCommands, ExpectedBtrfsCommand{
+		operation: "create",
+		args:      args,
+		exitCode:  exitCode,
+	})
+}
+
+// ExpectSend sets up expectation for a 'btrfs send' command that writes data.
+// Use an empty parentPath for a full send. A non-zero exitCode fails the command
+// after the data was written.
+func (m *MockBtrfsClient) ExpectSend(snapshotPath, parentPath string, data []byte, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedBtrfsCommand{
+		operation: "send",
+		args:      []string{snapshotPath, parentPath},
+		exitCode:  exitCode,
+		output:    string(data),
+	})
+}
+
 // ExpectDeleteSubvolume sets up expectation for a 'btrfs subvolume delete' command.
 func (m *MockBtrfsClient) ExpectDeleteSubvolume(subvolumePath string, exitCode int) {
 	m.expectedCommands = append(m.expectedCommands, ExpectedBtrfsCommand{
@@ -247,7 +388,38 @@ func (m *MockBtrfsClient) ExpectDeleteSubvolume(subvolumePath string, exitCode i
 	})
 }
 
-func (m *MockBtrfsClient) ShowSubvolume(subvolume string) error {
+// ExpectFilesystemUUID sets up expectation for a 'btrfs filesystem show' command
+// that reports the given UUID for path.
+func (m *MockBtrfsClient) ExpectFilesystemUUID(path, uuid string, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedBtrfsCommand{
+		operation: "uuid",
+		args:      []string{path},
+		exitCode:  exitCode,
+		output:    uuid,
+	})
+}
+
+// ExpectExclusiveSize sets up expectation for a 'btrfs qgroup show' command reporting size.
+func (m *MockBtrfsClient) ExpectExclusiveSize(subvolumePath string, size int64, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedBtrfsCommand{
+		operation: "size",
+		args:      []string{subvolumePath},
+		exitCode:  exitCode,
+		output:    strconv.FormatInt(size, 10),
+	})
+}
+
+// ExpectDeviceStats sets up expectation for a 'btrfs device stats' command reporting stats.
+func (m *MockBtrfsClient) ExpectDeviceStats(path string, stats []btrfs.DeviceStat, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedBtrfsCommand{
+		operation: "stats",
+		args:      []string{path},
+		exitCode:  exitCode,
+		stats:     stats,
+	})
+}
+
+func (m *MockBtrfsClient) ShowSubvolume(ctx context.Context, subvolume string) (btrfs.Subvolume, error) {
 	if m.index >= len(m.expectedCommands) {
 		m.t.Fatalf("Unexpected btrfs show command for subvolume: %s", subvolume)
 	}
@@ -260,12 +432,12 @@ func (m *MockBtrfsClient) ShowSubvolume(subvolume string) error {
 	}
 
 	if expected.exitCode != 0 {
-		return fmt.Errorf("btrfs command failed with exit code %d", expected.exitCode)
+		return btrfs.Subvolume{}, fmt.Errorf("btrfs command failed with exit code %d", expected.exitCode)
 	}
-	return nil
+	return btrfs.Subvolume{ReadOnly: expected.output == "readonly"}, nil
 }
 
-func (m *MockBtrfsClient) CreateSnapshot(subvolume, snapshotPath string, readonly bool) error {
+func (m *MockBtrfsClient) CreateSnapshot(ctx context.Context, subvolume, snapshotPath string, readonly bool) error {
 	if m.index >= len(m.expectedCommands) {
 		m.t.Fatalf("Unexpected btrfs snapshot command: %s -> %s", subvolume, snapshotPath)
 	}
@@ -296,7 +468,49 @@ func (m *MockBtrfsClient) CreateSnapshot(subvolume, snapshotPath string, readonl
 	return nil
 }
 
-func (m *MockBtrfsClient) DeleteSubvolume(subvolumePath string) error {
+func (m *MockBtrfsClient) CreateSubvolume(ctx context.Context, subvolumePath string) error {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected btrfs create command for: %s", subvolumePath)
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "create" || (len(expected.args) > 0 && expected.args[0] != subvolumePath) {
+		m.t.Fatalf("Expected btrfs %s %v, got create %s", expected.operation, expected.args, subvolumePath)
+	}
+
+	if expected.exitCode != 0 {
+		return fmt.Errorf("btrfs command failed with exit code %d", expected.exitCode)
+	}
+	if m.onCreateSubvolume != nil {
+		m.onCreateSubvolume(subvolumePath)
+	}
+	return nil
+}
+
+func (m *MockBtrfsClient) Send(ctx context.Context, snapshotPath, parentPath string, w io.Writer) error {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected btrfs send command for: %s", snapshotPath)
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "send" || expected.args[0] != snapshotPath || expected.args[1] != parentPath {
+		m.t.Fatalf("Expected btrfs %s %v, got send %s with parent %q", expected.operation, expected.args, snapshotPath, parentPath)
+	}
+
+	if _, err := io.WriteString(w, expected.output); err != nil {
+		return err
+	}
+	if expected.exitCode != 0 {
+		return fmt.Errorf("btrfs command failed with exit code %d", expected.exitCode)
+	}
+	return nil
+}
+
+func (m *MockBtrfsClient) DeleteSubvolume(ctx context.Context, subvolumePath string) error {
 	if m.index >= len(m.expectedCommands) {
 		m.t.Fatalf("Unexpected btrfs delete command for: %s", subvolumePath)
 	}
@@ -308,12 +522,73 @@ func (m *MockBtrfsClient) DeleteSubvolume(subvolumePath string) error {
 		m.t.Fatalf("Expected btrfs delete %s, got delete %s", expected.args[0], subvolumePath)
 	}
 
+	// Like a real command, a deletion started with a done context fails
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if expected.exitCode != 0 {
 		return fmt.Errorf("btrfs command failed with exit code %d", expected.exitCode)
 	}
+	if m.onDeleteSubvolume != nil {
+		m.onDeleteSubvolume(subvolumePath)
+	}
 	return nil
 }
 
+func (m *MockBtrfsClient) FilesystemUUID(ctx context.Context, path string) (string, error) {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected btrfs filesystem show command for: %s", path)
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "uuid" || len(expected.args) != 1 || expected.args[0] != path {
+		m.t.Fatalf("Expected btrfs %s %v, got filesystem show %s", expected.operation, expected.args, path)
+	}
+
+	if expected.exitCode != 0 {
+		return "", fmt.Errorf("btrfs command failed with exit code %d", expected.exitCode)
+	}
+	return expected.output, nil
+}
+
+func (m *MockBtrfsClient) ExclusiveSize(ctx context.Context, subvolumePath string) (int64, error) {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected btrfs qgroup show command for: %s", subvolumePath)
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "size" || len(expected.args) != 1 || expected.args[0] != subvolumePath {
+		m.t.Fatalf("Expected btrfs %s %v, got qgroup show %s", expected.operation, expected.args, subvolumePath)
+	}
+
+	if expected.exitCode != 0 {
+		return 0, fmt.Errorf("btrfs command failed with exit code %d", expected.exitCode)
+	}
+	return strconv.ParseInt(expected.output, 10, 64)
+}
+
+func (m *MockBtrfsClient) DeviceStats(ctx context.Context, path string) ([]btrfs.DeviceStat, error) {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected btrfs device stats command for: %s", path)
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "stats" || len(expected.args) != 1 || expected.args[0] != path {
+		m.t.Fatalf("Expected btrfs %s %v, got device stats %s", expected.operation, expected.args, path)
+	}
+
+	if expected.exitCode != 0 {
+		return nil, fmt.Errorf("btrfs command failed with exit code %d", expected.exitCode)
+	}
+	return expected.stats, nil
+}
+
 // MockResticClient implements ResticClient interface for testing.
 //
 // It allows tests to verify that the correct Restic commands are executed
@@ -331,6 +606,13 @@ type MockResticClient struct {
 	expectedCommands []ExpectedResticCommand
 	index            int
 	t                *testing.T
+	lastEnv          []string               // environment of the most recent command
+	lastBackup       restic.BackupOptions   // options of the most recent backup
+	lastNoLock       bool                   // whether the most recent snapshots listing skipped locking
+	lastStdin        string                 // data read by the most recent stdin backup
+	lastFilename     string                 // file name of the most recent stdin backup
+	onRestore        func(targetDir string) // called on successful restores, e.g. to add the restored files
+	dumpOutput       string                 // written by successful dumps instead of a placeholder
 }
 
 type ExpectedResticCommand struct {
@@ -339,6 +621,14 @@ type ExpectedResticCommand struct {
 	tags           []string
 	exitCode       int
 	readDataSubset string
+	snapshots      []restic.Snapshot
+	policy         restic.ForgetPolicy
+	prune          bool
+	err            error
+	summary        *restic.Summary
+	snapshotID     string
+	removeTags     []string
+	maxUnused      string
 }
 
 func NewMockResticClient(t *testing.T) *MockResticClient {
@@ -356,6 +646,23 @@ func (m *MockResticClient) ExpectBackup(snapshotPath string, tags []string, excl
 	})
 }
 
+// ExpectBackupError sets up expectation for a 'restic backup' command of any path that fails with err.
+func (m *MockResticClient) ExpectBackupError(err error) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation: "backup",
+		err:       err,
+	})
+}
+
+// ExpectBackupSummary sets up expectation for a successful 'restic backup' command of any path
+// that reports summary.
+func (m *MockResticClient) ExpectBackupSummary(summary *restic.Summary) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation: "backup",
+		summary:   summary,
+	})
+}
+
 // ExpectCheck sets up expectation for a 'restic check' command.
 // readDataSubset specifies the percentage of data to verify (e.g., "5%").
 func (m *MockResticClient) ExpectCheck(readDataSubset string, exitCode int) {
@@ -366,7 +673,60 @@ func (m *MockResticClient) ExpectCheck(readDataSubset string, exitCode int) {
 	})
 }
 
-func (m *MockResticClient) Backup(repositoryEnv []string, snapshotPath string, tags []string, excludeCaches bool, force bool) error {
+// ExpectSnapshots sets up expectation for a 'restic snapshots' command filtered by tags.
+// The given snapshots are returned when exitCode is 0.
+func (m *MockResticClient) ExpectSnapshots(tags []string, snapshots []restic.Snapshot, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation: "snapshots",
+		tags:      tags,
+		snapshots: snapshots,
+		exitCode:  exitCode,
+	})
+}
+
+// ExpectForget sets up expectation for a 'restic forget' command with the given tags and policy.
+func (m *MockResticClient) ExpectForget(tags []string, policy restic.ForgetPolicy, prune bool, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation: "forget",
+		tags:      tags,
+		policy:    policy,
+		prune:     prune,
+		exitCode:  exitCode,
+	})
+}
+
+// ExpectPrune sets up expectation for a 'restic prune' command with the given --max-unused.
+func (m *MockResticClient) ExpectPrune(maxUnused string, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation: "prune",
+		maxUnused: maxUnused,
+		exitCode:  exitCode,
+	})
+}
+
+// ExpectTag sets up expectation for a 'restic tag' command of the snapshot.
+func (m *MockResticClient) ExpectTag(snapshotID string, add, remove []string, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation:  "tag",
+		snapshotID: snapshotID,
+		tags:       add,
+		removeTags: remove,
+		exitCode:   exitCode,
+	})
+}
+
+// ExpectInit sets up expectation for a 'restic init' command.
+// If err is non-nil it is returned instead of a generic exit code failure.
+func (m *MockResticClient) ExpectInit(exitCode int, err error) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation: "init",
+		exitCode:  exitCode,
+		err:       err,
+	})
+}
+
+func (m *MockResticClient) Backup(ctx context.Context, repositoryEnv []string, snapshotPath string, options restic.BackupOptions) (*restic.Summary, error) {
+	m.lastBackup = options
 	if m.index >= len(m.expectedCommands) {
 		m.t.Fatalf("Unexpected restic backup command for: %s", snapshotPath)
 	}
@@ -382,13 +742,47 @@ func (m *MockResticClient) Backup(repositoryEnv []string, snapshotPath string, t
 		m.t.Fatalf("Expected restic backup %s, got backup %s", expected.snapshotPath, snapshotPath)
 	}
 
+	if expected.err != nil {
+		return nil, expected.err
+	}
 	if expected.exitCode != 0 {
-		return fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
+		return nil, fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
 	}
-	return nil
+	return expected.summary, nil
+}
+
+// BackupStdin reads all data from r and is verified against expectations set up
+// with ExpectBackup, like Backup.
+func (m *MockResticClient) BackupStdin(ctx context.Context, repositoryEnv []string, r io.Reader, filename string, options restic.BackupOptions) (*restic.Summary, error) {
+	m.lastBackup = options
+	m.lastFilename = filename
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected restic stdin backup command for: %s", filename)
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "backup" {
+		m.t.Fatalf("Expected restic %s, got stdin backup", expected.operation)
+	}
+
+	data, err := io.ReadAll(r)
+	m.lastStdin = string(data)
+	if err != nil {
+		return nil, err
+	}
+	if expected.err != nil {
+		return nil, expected.err
+	}
+	if expected.exitCode != 0 {
+		return nil, fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
+	}
+	return expected.summary, nil
 }
 
-func (m *MockResticClient) Check(repositoryEnv []string, readDataSubset string) error {
+func (m *MockResticClient) Check(ctx context.Context, repositoryEnv []string, readDataSubset string) error {
+	m.lastEnv = repositoryEnv
 	if m.index >= len(m.expectedCommands) {
 		m.t.Fatalf("Unexpected restic check command")
 	}
@@ -406,58 +800,222 @@ func (m *MockResticClient) Check(repositoryEnv []string, readDataSubset string)
 	return nil
 }
 
-func TestNewManager(t *testing.T) {
-	cfg := &config.Config{
-		TargetDir:     "/tmp/targets",
-		SnapshotDir:   "/tmp/snapshots",
-		ResticRepoDir: "/tmp/repos",
-		ResticBin:     "/usr/bin/restic",
-	}
+// ExpectRestore sets up expectation for a 'restic restore' command of path in the snapshot.
+func (m *MockResticClient) ExpectRestore(snapshotID, path string, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation:    "restore",
+		snapshotID:   snapshotID,
+		snapshotPath: path,
+		exitCode:     exitCode,
+	})
+}
 
-	mgr := NewManager(cfg, true)
-	if mgr.config != cfg {
-		t.Error("Manager config not set correctly")
-	}
-	if !mgr.verbose {
-		t.Error("Manager verbose flag not set correctly")
+func (m *MockResticClient) Restore(ctx context.Context, repositoryEnv []string, snapshotID, path, targetDir string) error {
+	m.lastEnv = repositoryEnv
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected restic restore command")
 	}
 
-	// Test that real implementations are used by default
-	if mgr.fs == nil {
-		t.Error("FileSystem not initialized")
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "restore" || expected.snapshotID != snapshotID || expected.snapshotPath != path {
+		m.t.Fatalf("Expected restic %s of %s:%s, got restore of %s:%s", expected.operation, expected.snapshotID, expected.snapshotPath, snapshotID, path)
 	}
-	if mgr.btrfs == nil {
-		t.Error("BtrfsClient not initialized")
+
+	if expected.exitCode != 0 {
+		return fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
 	}
-	if mgr.restic == nil {
-		t.Error("ResticClient not initialized")
+	if m.onRestore != nil {
+		m.onRestore(targetDir)
 	}
+	return nil
 }
 
-func TestNewManagerWithDeps(t *testing.T) {
-	cfg := &config.Config{
-		TargetDir:     "/tmp/targets",
-		SnapshotDir:   "/tmp/snapshots",
-		ResticRepoDir: "/tmp/repos",
-		ResticBin:     "/usr/bin/restic",
+// ExpectDump sets up expectation for a 'restic dump' command of path in the snapshot.
+func (m *MockResticClient) ExpectDump(snapshotID, path string, exitCode int) {
+	m.expectedCommands = append(m.expectedCommands, ExpectedResticCommand{
+		operation:    "dump",
+		snapshotID:   snapshotID,
+		snapshotPath: path,
+		exitCode:     exitCode,
+	})
+}
+
+func (m *MockResticClient) Dump(ctx context.Context, repositoryEnv []string, snapshotID, path string, w io.Writer) error {
+	m.lastEnv = repositoryEnv
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected restic dump command")
 	}
 
-	mockFS := NewMockFileSystem()
-	mockBtrfs := NewMockBtrfsClient(t)
-	mockRestic := NewMockResticClient(t)
+	expected := m.expectedCommands[m.index]
+	m.index++
 
-	mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+	if expected.operation != "dump" || expected.snapshotID != snapshotID || expected.snapshotPath != path {
+		m.t.Fatalf("Expected restic %s of %s:%s, got dump of %s:%s", expected.operation, expected.snapshotID, expected.snapshotPath, snapshotID, path)
+	}
 
-	if mgr.config != cfg {
-		t.Error("Manager config not set correctly")
+	if expected.exitCode != 0 {
+		return fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
 	}
-	if mgr.verbose {
-		t.Error("Manager verbose flag should be false")
+	output := m.dumpOutput
+	if output == "" {
+		output = "archive of " + snapshotID
 	}
-	if mgr.fs != mockFS {
-		t.Error("FileSystem dependency not set correctly")
+	_, err := w.Write([]byte(output))
+	return err
+}
+
+func (m *MockResticClient) Snapshots(ctx context.Context, repositoryEnv []string, tags []string, noLock bool) ([]restic.Snapshot, error) {
+	m.lastEnv = repositoryEnv
+	m.lastNoLock = noLock
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected restic snapshots command")
 	}
-	if mgr.btrfs != mockBtrfs {
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "snapshots" || !slices.Equal(expected.tags, tags) {
+		m.t.Fatalf("Expected restic snapshots with tags %v, got %s with tags %v", expected.tags, expected.operation, tags)
+	}
+
+	if expected.exitCode != 0 {
+		return nil, fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
+	}
+	return expected.snapshots, nil
+}
+
+func (m *MockResticClient) Forget(ctx context.Context, repositoryEnv []string, tags []string, policy restic.ForgetPolicy, prune bool) error {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected restic forget command")
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "forget" || !slices.Equal(expected.tags, tags) || !reflect.DeepEqual(expected.policy, policy) || expected.prune != prune {
+		m.t.Fatalf("Expected restic forget with tags %v policy %+v prune %t, got %s with tags %v policy %+v prune %t",
+			expected.tags, expected.policy, expected.prune, expected.operation, tags, policy, prune)
+	}
+
+	if expected.exitCode != 0 {
+		return fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
+	}
+	return nil
+}
+
+func (m *MockResticClient) Prune(ctx context.Context, repositoryEnv []string, maxUnused string) error {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected restic prune command")
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	m.lastEnv = repositoryEnv
+	if expected.operation != "prune" || expected.maxUnused != maxUnused {
+		m.t.Fatalf("Expected restic %s, got prune with max unused %q", expected.operation, maxUnused)
+	}
+
+	if expected.exitCode != 0 {
+		return fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
+	}
+	return nil
+}
+
+func (m *MockResticClient) Tag(ctx context.Context, repositoryEnv []string, snapshotID string, add, remove []string) error {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected restic tag command")
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "tag" || expected.snapshotID != snapshotID || !slices.Equal(expected.tags, add) || !slices.Equal(expected.removeTags, remove) {
+		m.t.Fatalf("Expected restic tag of %s adding %v removing %v, got %s of %s adding %v removing %v",
+			expected.snapshotID, expected.tags, expected.removeTags, expected.operation, snapshotID, add, remove)
+	}
+
+	if expected.exitCode != 0 {
+		return fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
+	}
+	return nil
+}
+
+func (m *MockResticClient) Init(ctx context.Context, repositoryEnv []string) error {
+	if m.index >= len(m.expectedCommands) {
+		m.t.Fatalf("Unexpected restic init command")
+	}
+
+	expected := m.expectedCommands[m.index]
+	m.index++
+
+	if expected.operation != "init" {
+		m.t.Fatalf("Expected restic %s, got init", expected.operation)
+	}
+
+	if expected.err != nil {
+		return expected.err
+	}
+	if expected.exitCode != 0 {
+		return fmt.Errorf("restic command failed with exit code %d", expected.exitCode)
+	}
+	return nil
+}
+
+func TestNewManager(t *testing.T) {
+	cfg := &config.Config{
+		TargetDir:     "/tmp/targets",
+		SnapshotDir:   "/tmp/snapshots",
+		ResticRepoDir: "/tmp/repos",
+		ResticBin:     "/usr/bin/restic",
+	}
+
+	mgr := NewManager(cfg, true)
+	if mgr.config != cfg {
+		t.Error("Manager config not set correctly")
+	}
+	if !mgr.verbose {
+		t.Error("Manager verbose flag not set correctly")
+	}
+
+	// Test that real implementations are used by default
+	if mgr.fs == nil {
+		t.Error("FileSystem not initialized")
+	}
+	if mgr.btrfs == nil {
+		t.Error("BtrfsClient not initialized")
+	}
+	if mgr.restic == nil {
+		t.Error("ResticClient not initialized")
+	}
+}
+
+func TestNewManagerWithDeps(t *testing.T) {
+	cfg := &config.Config{
+		TargetDir:     "/tmp/targets",
+		SnapshotDir:   "/tmp/snapshots",
+		ResticRepoDir: "/tmp/repos",
+		ResticBin:     "/usr/bin/restic",
+	}
+
+	mockFS := NewMockFileSystem()
+	mockBtrfs := NewMockBtrfsClient(t)
+	mockRestic := NewMockResticClient(t)
+
+	mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+
+	if mgr.config != cfg {
+		t.Error("Manager config not set correctly")
+	}
+	if mgr.verbose {
+		t.Error("Manager verbose flag should be false")
+	}
+	if mgr.fs != mockFS {
+		t.Error("FileSystem dependency not set correctly")
+	}
+	if mgr.btrfs != mockBtrfs {
 		t.Error("BtrfsClient dependency not set correctly")
 	}
 	if mgr.restic != mockRestic {
@@ -475,6 +1033,8 @@ func TestValidateEnvironment(t *testing.T) {
 		subvolume      string
 		snapshotDirErr error
 		btrfsExitCode  int
+		readOnly       bool
+		skipShow       bool
 		expectError    bool
 		errorContains  string
 	}{
@@ -485,6 +1045,25 @@ func TestValidateEnvironment(t *testing.T) {
 			btrfsExitCode:  0,
 			expectError:    false,
 		},
+		{
+			name:          "subvolume_is_read_only_snapshot",
+			subvolume:     "/mnt/btrfs/home-frozen",
+			readOnly:      true,
+			expectError:   true,
+			errorContains: "is a read-only snapshot",
+		},
+		{
+			name:          "subvolume_inside_snapshot_dir",
+			subvolume:     "/snapshots/home-20230101-120000",
+			skipShow:      true,
+			expectError:   true,
+			errorContains: "is inside the snapshots directory",
+		},
+		{
+			name:        "subvolume_next_to_snapshot_dir",
+			subvolume:   "/snapshots-old/home",
+			expectError: false,
+		},
 		{
 			name:           "snapshot_dir_missing",
 			subvolume:      "/mnt/btrfs/home",
@@ -531,12 +1110,105 @@ func TestValidateEnvironment(t *testing.T) {
 			}
 
 			// Setup btrfs mock - only skip if snapshot dir doesn't exist
-			if tt.snapshotDirErr != os.ErrNotExist {
+			if tt.readOnly {
+				mockBtrfs.ExpectShowSnapshot(tt.subvolume)
+			} else if tt.snapshotDirErr != os.ErrNotExist && !tt.skipShow {
 				mockBtrfs.ExpectShowSubvolume(tt.subvolume, tt.btrfsExitCode)
 			}
 
 			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-			err := mgr.ValidateEnvironment(tt.subvolume)
+			err := mgr.ValidateEnvironment(context.Background(), tt.subvolume)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				} else if tt.errorContains != "" && !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got '%s'", tt.errorContains, err.Error())
+				}
+			} else {
+				if err != nil {
+					t.Errorf("Expected no error but got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateFilesystems(t *testing.T) {
+	cfg := &config.Config{
+		SnapshotDir: "/snapshots",
+	}
+
+	const (
+		dataUUID  = "5d2b7f0e-8c1a-4b52-9d3e-2f6a1c0b9e77"
+		otherUUID = "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+	)
+
+	tests := []struct {
+		name          string
+		subvolumeUUID string
+		snapshotUUID  string
+		setup         func(m *MockBtrfsClient)
+		expectError   bool
+		errorContains string
+	}{
+		{
+			name:  "nothing_pinned",
+			setup: func(m *MockBtrfsClient) {},
+		},
+		{
+			name:          "both_match",
+			subvolumeUUID: dataUUID,
+			snapshotUUID:  strings.ToUpper(dataUUID),
+			setup: func(m *MockBtrfsClient) {
+				m.ExpectFilesystemUUID("/mnt/btrfs/home", dataUUID, 0)
+				m.ExpectFilesystemUUID("/snapshots", dataUUID, 0)
+			},
+		},
+		{
+			name:          "subvolume_on_other_filesystem",
+			subvolumeUUID: dataUUID,
+			setup: func(m *MockBtrfsClient) {
+				m.ExpectFilesystemUUID("/mnt/btrfs/home", otherUUID, 0)
+			},
+			expectError:   true,
+			errorContains: "subvolume /mnt/btrfs/home is on filesystem " + otherUUID,
+		},
+		{
+			name:         "snapshot_dir_on_other_filesystem",
+			snapshotUUID: dataUUID,
+			setup: func(m *MockBtrfsClient) {
+				m.ExpectFilesystemUUID("/snapshots", otherUUID, 0)
+			},
+			expectError:   true,
+			errorContains: "snapshots directory /snapshots is on filesystem",
+		},
+		{
+			name:          "uuid_lookup_fails",
+			subvolumeUUID: dataUUID,
+			setup: func(m *MockBtrfsClient) {
+				m.ExpectFilesystemUUID("/mnt/btrfs/home", "", 1)
+			},
+			expectError:   true,
+			errorContains: "could not determine filesystem UUID",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFS := NewMockFileSystem()
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockRestic := NewMockResticClient(t)
+			tt.setup(mockBtrfs)
+
+			target := &config.TargetConfig{
+				Subvolume:       "/mnt/btrfs/home",
+				SubvolumeUUID:   tt.subvolumeUUID,
+				SnapshotDirUUID: tt.snapshotUUID,
+			}
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+			err := mgr.ValidateFilesystems(context.Background(), target)
 
 			if tt.expectError {
 				if err == nil {
@@ -553,6 +1225,64 @@ func TestValidateEnvironment(t *testing.T) {
 	}
 }
 
+func TestCheckDeviceErrors(t *testing.T) {
+	stats := func(corruption int64) []btrfs.DeviceStat {
+		return []btrfs.DeviceStat{
+			{Device: "/dev/sda1", Counter: "read_io_errs", Value: 0},
+			{Device: "/dev/sda1", Counter: "corruption_errs", Value: corruption},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		mode          string
+		previous      int64
+		current       int64
+		exitCode      int
+		errorContains string
+		recorded      int64
+	}{
+		{name: "clean", mode: config.DeviceErrorsFail, recorded: 0},
+		{name: "unchanged_errors", mode: config.DeviceErrorsFail, previous: 3, current: 3, recorded: 3},
+		{name: "counters_reset", mode: config.DeviceErrorsFail, previous: 3, current: 0, recorded: 0},
+		{name: "rising_fails", mode: config.DeviceErrorsFail, previous: 3, current: 5, errorContains: "/dev/sda1 corruption_errs 3 -> 5", recorded: 3},
+		{name: "rising_warns", mode: config.DeviceErrorsWarn, previous: 3, current: 5, recorded: 5},
+		{name: "stats_fail", mode: config.DeviceErrorsFail, previous: 2, exitCode: 1, errorContains: "could not read btrfs device stats", recorded: 2},
+		{name: "stats_warn", mode: config.DeviceErrorsWarn, previous: 2, exitCode: 1, recorded: 2},
+		{name: "ignored", mode: config.DeviceErrorsIgnore, previous: 2, recorded: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{SnapshotDir: "/snapshots", StateDir: t.TempDir()}
+			if err := state.Save(cfg.StateDir, "home", &state.Target{DeviceErrors: map[string]int64{"/dev/sda1 corruption_errs": tt.previous}}); err != nil {
+				t.Fatal(err)
+			}
+			mockBtrfs := NewMockBtrfsClient(t)
+			if tt.mode != config.DeviceErrorsIgnore {
+				mockBtrfs.ExpectDeviceStats("/mnt/btrfs/home", stats(tt.current), tt.exitCode)
+			}
+
+			mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), mockBtrfs, NewMockResticClient(t))
+			err := mgr.CheckDeviceErrors(context.Background(), "home", &config.TargetConfig{Subvolume: "/mnt/btrfs/home", DeviceErrors: tt.mode})
+			if tt.errorContains == "" && err != nil {
+				t.Errorf("Expected no error but got: %v", err)
+			}
+			if tt.errorContains != "" && (err == nil || !strings.Contains(err.Error(), tt.errorContains)) {
+				t.Errorf("Expected error containing '%s', got %v", tt.errorContains, err)
+			}
+
+			st, err := state.Load(cfg.StateDir, "home")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorded := st.DeviceErrors["/dev/sda1 corruption_errs"]; recorded != tt.recorded {
+				t.Errorf("Expected recorded corruption_errs %d, got %d", tt.recorded, recorded)
+			}
+		})
+	}
+}
+
 func TestCreateSnapshot(t *testing.T) {
 	cfg := &config.Config{
 		SnapshotDir: "/snapshots",
@@ -570,7 +1300,7 @@ func TestCreateSnapshot(t *testing.T) {
 		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
 
 		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-		snapshotPath, err := mgr.CreateSnapshot("/mnt/btrfs/home", "home-backup")
+		snapshotPath, err := mgr.CreateSnapshot(context.Background(), &config.TargetConfig{Subvolume: "/mnt/btrfs/home", Prefix: "home-backup"})
 
 		if err != nil {
 			t.Errorf("Expected no error but got: %v", err)
@@ -587,7 +1317,7 @@ func TestCreateSnapshot(t *testing.T) {
 		mockBtrfs.ExpectCreateSnapshot("", "", true, 1)
 
 		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-		_, err := mgr.CreateSnapshot("/mnt/btrfs/home", "home-backup")
+		_, err := mgr.CreateSnapshot(context.Background(), &config.TargetConfig{Subvolume: "/mnt/btrfs/home", Prefix: "home-backup"})
 
 		if err == nil {
 			t.Error("Expected error but got none")
@@ -597,6 +1327,62 @@ func TestCreateSnapshot(t *testing.T) {
 		}
 	})
 
+	t.Run("multiple_subvolumes", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		var created []string
+		mockBtrfs.onCreateSubvolume = func(subvolumePath string) {
+			mockFS.AddDir(subvolumePath, []MockDirEntry{})
+		}
+		mockBtrfs.onCreateSnapshot = func(subvolume, snapshotPath string) {
+			created = append(created, subvolume+" -> "+filepath.Base(snapshotPath))
+		}
+		mockBtrfs.ExpectCreateSubvolume("", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		snapshotPath, err := mgr.CreateSnapshot(context.Background(), &config.TargetConfig{Subvolumes: []string{"/mnt/btrfs/@home", "/mnt/btrfs/@var"}, Prefix: "system"})
+
+		if err != nil {
+			t.Fatalf("Expected no error but got: %v", err)
+		}
+		if !strings.HasPrefix(snapshotPath, "/snapshots/system-") {
+			t.Errorf("Expected snapshot path to start with '/snapshots/system-', got '%s'", snapshotPath)
+		}
+		expected := []string{"/mnt/btrfs/@home -> @home", "/mnt/btrfs/@var -> @var"}
+		if !slices.Equal(created, expected) {
+			t.Errorf("Expected snapshots %v, got %v", expected, created)
+		}
+	})
+
+	t.Run("multiple_subvolumes_second_fails", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		mockBtrfs.ExpectCreateSubvolume("", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 1)
+		// The set is named after the time of the run, the partial set is deleted again
+		mockBtrfs.onCreateSubvolume = func(subvolumePath string) {
+			mockBtrfs.ExpectDeleteSubvolume(filepath.Join(subvolumePath, "@home"), 0)
+			mockBtrfs.ExpectDeleteSubvolume(subvolumePath, 0)
+		}
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		_, err := mgr.CreateSnapshot(context.Background(), &config.TargetConfig{Subvolumes: []string{"/mnt/btrfs/@home", "/mnt/btrfs/@var"}, Prefix: "system"})
+
+		if err == nil || !strings.Contains(err.Error(), "BTRFS snapshot command failed") {
+			t.Errorf("Expected the snapshot error, got %v", err)
+		}
+		if mockBtrfs.index != len(mockBtrfs.expectedCommands) {
+			t.Errorf("Expected the partial snapshot set to be deleted, ran %d of %d commands", mockBtrfs.index, len(mockBtrfs.expectedCommands))
+		}
+	})
+
 	t.Run("snapshot_not_found_after_creation", func(t *testing.T) {
 		mockFS := NewMockFileSystem()
 		mockBtrfs := NewMockBtrfsClient(t)
@@ -606,7 +1392,7 @@ func TestCreateSnapshot(t *testing.T) {
 		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
 
 		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-		snapshotPath, err := mgr.CreateSnapshot("/mnt/btrfs/home", "home-backup")
+		snapshotPath, err := mgr.CreateSnapshot(context.Background(), &config.TargetConfig{Subvolume: "/mnt/btrfs/home", Prefix: "home-backup"})
 
 		if err == nil {
 			t.Error("Expected error when snapshot not found after creation")
@@ -620,40 +1406,132 @@ func TestCreateSnapshot(t *testing.T) {
 	})
 }
 
-func TestPerformBackup(t *testing.T) {
+func TestCheckSnapshotContents(t *testing.T) {
 	cfg := &config.Config{
-		SnapshotDir:   "/snapshots",
-		ResticRepoDir: "/repos",
-		ResticBin:     "/usr/bin/restic",
+		SnapshotDir: "/snapshots",
 	}
 
+	baseTime := time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC)
+	current := "/snapshots/home-20230102-120000"
+	previous := "/snapshots/home-20230101-120000"
+
 	tests := []struct {
-		name              string
-		snapshotPath      string
-		repository        string
-		backupType        string
-		snapshotExists    bool
-		repoConfigExists  bool
-		repoConfigContent string
-		resticExitCode    int
-		expectError       bool
-		errorContains     string
+		name          string
+		guard         config.EmptyGuardConfig
+		currentFiles  map[string]string
+		previousFiles map[string]string
+		expectError   bool
+		errorContains string
 	}{
 		{
-			name:              "successful_incremental_backup",
-			snapshotPath:      "/snapshots/home-20230101-120000",
-			repository:        "b2-home",
-			backupType:        "incremental",
-			snapshotExists:    true,
-			repoConfigExists:  true,
-			repoConfigContent: "RESTIC_REPOSITORY: b2:bucket/path\nRESTC_PASSWORD: secret123",
-			resticExitCode:    0,
-			expectError:       false,
+			name:         "guard_disabled",
+			currentFiles: map[string]string{},
 		},
 		{
-			name:           "snapshot_path_missing",
-			snapshotPath:   "/snapshots/nonexistent",
-			repository:     "b2-home",
+			name:         "enough_files",
+			guard:        config.EmptyGuardConfig{MinFiles: 2},
+			currentFiles: map[string]string{"a": "1", "b/c": "2"},
+		},
+		{
+			name:          "too_few_files",
+			guard:         config.EmptyGuardConfig{MinFiles: 3},
+			currentFiles:  map[string]string{"a": "1", "b/c": "2"},
+			expectError:   true,
+			errorContains: "2 files, expected at least 3",
+		},
+		{
+			name:          "size_comparable_to_previous",
+			guard:         config.EmptyGuardConfig{MinSizeRatio: 0.5},
+			currentFiles:  map[string]string{"a": "123456"},
+			previousFiles: map[string]string{"a": "1234567890"},
+		},
+		{
+			name:          "much_smaller_than_previous",
+			guard:         config.EmptyGuardConfig{MinSizeRatio: 0.5},
+			currentFiles:  map[string]string{"a": "1"},
+			previousFiles: map[string]string{"a": "1234567890", "b": "1234567890"},
+			expectError:   true,
+			errorContains: "previous snapshot home-20230101-120000 has 20 bytes in 2 files",
+		},
+		{
+			name:         "no_previous_snapshot",
+			guard:        config.EmptyGuardConfig{MinSizeRatio: 0.5},
+			currentFiles: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFS := NewMockFileSystem()
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockRestic := NewMockResticClient(t)
+
+			entries := []MockDirEntry{{name: filepath.Base(current), isDir: true, modTime: baseTime}}
+			mockFS.AddDir(current, []MockDirEntry{})
+			for name, content := range tt.currentFiles {
+				mockFS.AddFile(filepath.Join(current, name), []byte(content))
+			}
+			if tt.previousFiles != nil {
+				entries = append(entries, MockDirEntry{name: filepath.Base(previous), isDir: true, modTime: baseTime.Add(-24 * time.Hour)})
+				mockFS.AddDir(previous, []MockDirEntry{})
+				for name, content := range tt.previousFiles {
+					mockFS.AddFile(filepath.Join(previous, name), []byte(content))
+				}
+			}
+			mockFS.AddDir("/snapshots", entries)
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+			err := mgr.CheckSnapshotContents(current, &config.TargetConfig{Prefix: "home", EmptyGuard: tt.guard})
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				} else if tt.errorContains != "" && !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got '%s'", tt.errorContains, err.Error())
+				}
+			} else {
+				if err != nil {
+					t.Errorf("Expected no error but got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestPerformBackup(t *testing.T) {
+	cfg := &config.Config{
+		SnapshotDir:   "/snapshots",
+		ResticRepoDir: "/repos",
+		ResticBin:     "/usr/bin/restic",
+	}
+
+	tests := []struct {
+		name              string
+		snapshotPath      string
+		repository        string
+		backupType        string
+		snapshotExists    bool
+		repoConfigExists  bool
+		repoConfigContent string
+		resticExitCode    int
+		expectError       bool
+		errorContains     string
+	}{
+		{
+			name:              "successful_incremental_backup",
+			snapshotPath:      "/snapshots/home-20230101-120000",
+			repository:        "b2-home",
+			backupType:        "incremental",
+			snapshotExists:    true,
+			repoConfigExists:  true,
+			repoConfigContent: "RESTIC_REPOSITORY: b2:bucket/path\nRESTC_PASSWORD: secret123",
+			resticExitCode:    0,
+			expectError:       false,
+		},
+		{
+			name:           "snapshot_path_missing",
+			snapshotPath:   "/snapshots/nonexistent",
+			repository:     "b2-home",
 			backupType:     "incremental",
 			snapshotExists: false,
 			expectError:    true,
@@ -713,9 +1591,11 @@ func TestPerformBackup(t *testing.T) {
 			mockRestic := NewMockResticClient(t)
 
 			target := &config.TargetConfig{
-				Repository: tt.repository,
-				Prefix:     "test-backup",
-				Type:       tt.backupType,
+				Repository:  tt.repository,
+				Prefix:      "test-backup",
+				Type:        tt.backupType,
+				Excludes:    []string{"node_modules", "/.cache"},
+				UploadLimit: 512,
 			}
 
 			// Setup snapshot existence
@@ -741,7 +1621,7 @@ func TestPerformBackup(t *testing.T) {
 			}
 
 			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-			err := mgr.PerformBackup(tt.snapshotPath, target)
+			_, err := mgr.PerformBackup(context.Background(), tt.snapshotPath, target)
 
 			if tt.expectError {
 				if err == nil {
@@ -753,11 +1633,346 @@ func TestPerformBackup(t *testing.T) {
 				if err != nil {
 					t.Errorf("Expected no error but got: %v", err)
 				}
+				if mockRestic.lastBackup.Limit != (restic.BandwidthLimit{Upload: 512}) {
+					t.Errorf("Expected upload limit 512, got %+v", mockRestic.lastBackup.Limit)
+				}
+				expectedExcludes := []string{"node_modules", filepath.Join(tt.snapshotPath, ".cache")}
+				if !slices.Equal(mockRestic.lastBackup.Excludes, expectedExcludes) {
+					t.Errorf("Expected excludes %v, got %v", expectedExcludes, mockRestic.lastBackup.Excludes)
+				}
+			}
+		})
+	}
+}
+
+func TestPerformBackupRunIDTag(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos"}
+	target := &config.TargetConfig{Repository: "b2-home", Prefix: "home"}
+	snapshotPath := "/snapshots/home-20230101-120000"
+
+	for _, tag := range []bool{false, true} {
+		mockFS := NewMockFileSystem()
+		mockFS.AddFile(snapshotPath, []byte{})
+		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/home\n"))
+		mockRestic := NewMockResticClient(t)
+		mockRestic.ExpectBackupSummary(&restic.Summary{SnapshotID: "aaa111"})
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+		mgr.SetRunID("0123456789abcdef", tag)
+		if _, err := mgr.PerformBackup(context.Background(), snapshotPath, target); err != nil {
+			t.Fatalf("PerformBackup failed: %v", err)
+		}
+		if got := slices.Contains(mockRestic.lastBackup.Tags, "run-id:0123456789abcdef"); got != tag {
+			t.Errorf("Expected run ID tag %v with tagging %v, got tags %v", tag, tag, mockRestic.lastBackup.Tags)
+		}
+	}
+}
+
+func TestPerformBackupSendMode(t *testing.T) {
+	snapshotPath := "/snapshots/home-20230101-120000"
+
+	tests := []struct {
+		name          string
+		sendExitCode  int
+		resticErr     error
+		expectError   bool
+		errorContains []string
+	}{
+		{
+			name: "streams_send_into_restic",
+		},
+		{
+			name:          "send_failure",
+			sendExitCode:  1,
+			expectError:   true,
+			errorContains: []string{"btrfs send failed", "exit code 1"},
+		},
+		{
+			name:          "restic_failure",
+			resticErr:     errors.New("Fatal: unable to save snapshot"),
+			expectError:   true,
+			errorContains: []string{"restic backup command failed", "unable to save snapshot"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos"}
+			mockFS := NewMockFileSystem()
+			mockFS.AddFile(snapshotPath, []byte{})
+			mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockBtrfs.ExpectSend(snapshotPath, "", []byte("btrfs-stream"), tt.sendExitCode)
+			mockRestic := NewMockResticClient(t)
+			if tt.resticErr != nil {
+				mockRestic.ExpectBackupError(tt.resticErr)
+			} else {
+				mockRestic.ExpectBackup("", nil, false, false, 0)
+			}
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+			target := &config.TargetConfig{Repository: "b2-home", Prefix: "home", Type: "full", BackupMode: config.BackupModeSend}
+			_, err := mgr.PerformBackup(context.Background(), snapshotPath, target)
+
+			if !tt.expectError {
+				if err != nil {
+					t.Fatalf("Expected no error but got: %v", err)
+				}
+				if mockRestic.lastStdin != "btrfs-stream" || mockRestic.lastFilename != "home-20230101-120000.btrfs" {
+					t.Errorf("Unexpected stdin backup %q of %q", mockRestic.lastStdin, mockRestic.lastFilename)
+				}
+				if mockRestic.lastBackup.Force || mockRestic.lastBackup.ExcludeCaches {
+					t.Errorf("Unexpected file options for stdin backup: %+v", mockRestic.lastBackup)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected error but got none")
+			}
+			for _, want := range tt.errorContains {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected error containing '%s', got '%s'", want, err.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestPerformBackupSendModeParent(t *testing.T) {
+	snapshotPath := "/snapshots/home-20230102-120000"
+	parentPath := "/snapshots/home-20230101-120000"
+	parentTags := []string{"btrfs-backup", "home", "home-20230101-120000"}
+
+	tests := []struct {
+		name           string
+		targetType     string
+		uploaded       []restic.Snapshot
+		snapshotsExit  int
+		expectParent   string
+		expectSnapshot bool
+	}{
+		{
+			name:           "incremental_to_uploaded_parent",
+			targetType:     "incremental",
+			uploaded:       []restic.Snapshot{{ID: "abc123", Tags: parentTags}},
+			expectParent:   parentPath,
+			expectSnapshot: true,
+		},
+		{
+			name:           "parent_not_in_repository",
+			targetType:     "incremental",
+			expectSnapshot: true,
+		},
+		{
+			name:           "repository_check_fails",
+			targetType:     "incremental",
+			snapshotsExit:  1,
+			expectSnapshot: true,
+		},
+		{
+			name:       "full_type_ignores_parent",
+			targetType: "full",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos"}
+			mockFS := NewMockFileSystem()
+			mockFS.AddFile(snapshotPath, []byte{})
+			mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+			mockFS.AddDir("/snapshots", []MockDirEntry{
+				{name: "home-20230101-120000", isDir: true},
+				{name: "home-20230102-120000", isDir: true},
+			})
+
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockBtrfs.ExpectSend(snapshotPath, tt.expectParent, []byte("btrfs-stream"), 0)
+			mockRestic := NewMockResticClient(t)
+			if tt.expectSnapshot {
+				mockRestic.ExpectSnapshots(parentTags, tt.uploaded, tt.snapshotsExit)
+			}
+			mockRestic.ExpectBackup("", nil, false, false, 0)
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+			target := &config.TargetConfig{Repository: "b2-home", Prefix: "home", Type: tt.targetType, BackupMode: config.BackupModeSend}
+			if _, err := mgr.PerformBackup(context.Background(), snapshotPath, target); err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+
+			hasParentTag := slices.Contains(mockRestic.lastBackup.Tags, "parent:home-20230101-120000")
+			if hasParentTag != (tt.expectParent != "") {
+				t.Errorf("Unexpected tags %v for parent %q", mockRestic.lastBackup.Tags, tt.expectParent)
+			}
+		})
+	}
+}
+
+func TestCheckSuccessCriteria(t *testing.T) {
+	summary := &restic.Summary{TotalFilesProcessed: 500, TotalBytesProcessed: 2e9, TotalDuration: 5400}
+
+	tests := []struct {
+		name          string
+		criteria      config.SuccessCriteriaConfig
+		summary       *restic.Summary
+		expectError   bool
+		errorContains []string
+	}{
+		{
+			name:     "met",
+			criteria: config.SuccessCriteriaConfig{MinFiles: 100, MinBytes: "1GB", MaxDuration: 2 * time.Hour},
+			summary:  summary,
+		},
+		{
+			name:          "too_few_files",
+			criteria:      config.SuccessCriteriaConfig{MinFiles: 1000},
+			summary:       summary,
+			expectError:   true,
+			errorContains: []string{"500 files processed, expected at least 1000"},
+		},
+		{
+			name:          "several_violations",
+			criteria:      config.SuccessCriteriaConfig{MinBytes: "5GB", MaxDuration: time.Hour},
+			summary:       summary,
+			expectError:   true,
+			errorContains: []string{"expected at least 5GB", "backup took 1h30m0s, expected at most 1h0m0s"},
+		},
+		{
+			name:     "no_summary_in_dry_run",
+			criteria: config.SuccessCriteriaConfig{MinFiles: 1000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := NewManagerWithDeps(&config.Config{}, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+			err := mgr.CheckSuccessCriteria(tt.summary, &config.TargetConfig{SuccessCriteria: tt.criteria})
+
+			if !tt.expectError {
+				if err != nil {
+					t.Errorf("Expected no error but got: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected error but got none")
+			}
+			for _, want := range tt.errorContains {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected error containing '%s', got '%s'", want, err.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestPerformBackupRetries(t *testing.T) {
+	networkErr := &command.Error{Err: errors.New("exit status 1"), Stderr: "Fatal: unable to save snapshot: read tcp: connection reset by peer"}
+	passwordErr := &command.Error{Err: errors.New("exit status 1"), Stderr: "Fatal: wrong password or no key found"}
+
+	tests := []struct {
+		name           string
+		retries        int
+		results        []error
+		expectError    bool
+		expectedSleeps []time.Duration
+	}{
+		{
+			name:           "recovers_after_transient_errors",
+			retries:        3,
+			results:        []error{networkErr, networkErr, nil},
+			expectedSleeps: []time.Duration{10 * time.Second, 20 * time.Second},
+		},
+		{
+			name:           "gives_up_after_retries",
+			retries:        2,
+			results:        []error{networkErr, networkErr, networkErr},
+			expectError:    true,
+			expectedSleeps: []time.Duration{10 * time.Second, 20 * time.Second},
+		},
+		{
+			name:        "permanent_error_not_retried",
+			retries:     3,
+			results:     []error{passwordErr},
+			expectError: true,
+		},
+		{
+			name:        "retries_disabled",
+			retries:     0,
+			results:     []error{networkErr},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos"}
+			mockFS := NewMockFileSystem()
+			mockFS.AddFile("/snapshots/home-20230101-120000", []byte{})
+			mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+
+			mockRestic := NewMockResticClient(t)
+			for _, result := range tt.results {
+				if result == nil {
+					mockRestic.ExpectBackup("", nil, true, false, 0)
+				} else {
+					mockRestic.ExpectBackupError(result)
+				}
+			}
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+			var sleeps []time.Duration
+			mgr.sleep = func(ctx context.Context, d time.Duration) error {
+				sleeps = append(sleeps, d)
+				return nil
+			}
+
+			target := &config.TargetConfig{Repository: "b2-home", Prefix: "home", Retries: tt.retries, RetryDelay: 10 * time.Second}
+			_, err := mgr.PerformBackup(context.Background(), "/snapshots/home-20230101-120000", target)
+
+			if tt.expectError && err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !tt.expectError && err != nil {
+				t.Errorf("Expected no error but got: %v", err)
+			}
+			if mockRestic.index != len(tt.results) {
+				t.Errorf("Expected %d backup attempts, got %d", len(tt.results), mockRestic.index)
+			}
+			if !slices.Equal(sleeps, tt.expectedSleeps) {
+				t.Errorf("Expected sleeps %v, got %v", tt.expectedSleeps, sleeps)
 			}
 		})
 	}
 }
 
+func TestWithTimeout(t *testing.T) {
+	err := WithTimeout(context.Background(), 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return fmt.Errorf("restic check command failed: %w", ctx.Err())
+	})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms") {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+
+	err = WithTimeout(context.Background(), 0, func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); ok {
+			return fmt.Errorf("unexpected deadline")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected no deadline without a timeout, got %v", err)
+	}
+
+	err = WithTimeout(context.Background(), time.Minute, func(ctx context.Context) error {
+		return fmt.Errorf("restic check command failed")
+	})
+	if err == nil || strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected failure without timeout, got %v", err)
+	}
+}
+
 func TestVerifyRepository(t *testing.T) {
 	cfg := &config.Config{
 		ResticRepoDir: "/repos",
@@ -767,6 +1982,7 @@ func TestVerifyRepository(t *testing.T) {
 	tests := []struct {
 		name              string
 		repository        string
+		subset            string
 		repoConfigExists  bool
 		repoConfigContent string
 		resticExitCode    int
@@ -776,11 +1992,19 @@ func TestVerifyRepository(t *testing.T) {
 		{
 			name:              "successful_verification",
 			repository:        "b2-home",
+			subset:            "5%",
 			repoConfigExists:  true,
 			repoConfigContent: "RESTIC_REPOSITORY: b2:bucket/path\nRESTC_PASSWORD: secret123",
 			resticExitCode:    0,
 			expectError:       false,
 		},
+		{
+			name:              "full_verification",
+			repository:        "b2-home",
+			subset:            config.VerifyFull,
+			repoConfigExists:  true,
+			repoConfigContent: "RESTIC_REPOSITORY: b2:bucket/path",
+		},
 		{
 			name:             "repository_config_missing",
 			repository:       "nonexistent-repo",
@@ -824,11 +2048,11 @@ func TestVerifyRepository(t *testing.T) {
 
 			// Setup restic check mock
 			if tt.repoConfigExists {
-				mockRestic.ExpectCheck("5%", tt.resticExitCode)
+				mockRestic.ExpectCheck(tt.subset, tt.resticExitCode)
 			}
 
 			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-			err := mgr.VerifyRepository(tt.repository)
+			err := mgr.VerifyRepository(context.Background(), tt.repository, tt.subset, nil)
 
 			if tt.expectError {
 				if err == nil {
@@ -845,43 +2069,470 @@ func TestVerifyRepository(t *testing.T) {
 	}
 }
 
-func TestCleanupOldSnapshots(t *testing.T) {
-	cfg := &config.Config{
-		SnapshotDir: "/snapshots",
+func TestVerifyRepositoryExtraArgs(t *testing.T) {
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: s3:bucket/home\nrestic_extra_args: --pack-size  64\n"))
+	mockRestic := NewMockResticClient(t)
+	mockRestic.ExpectCheck("5%", 0)
+
+	mgr := NewManagerWithDeps(&config.Config{ResticRepoDir: "/repos"}, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+	if err := mgr.VerifyRepository(context.Background(), "b2-home", "5%", []string{"--retry-lock", "5m"}); err != nil {
+		t.Fatalf("VerifyRepository failed: %v", err)
 	}
 
-	baseTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	// The arguments of the repository come first, those of the target after them
+	expected := []string{"--pack-size", "64", "--retry-lock", "5m"}
+	if args := restic.ExtraArgs(mockRestic.lastEnv); !slices.Equal(args, expected) {
+		t.Errorf("Expected extra args %v, got %v", expected, args)
+	}
+
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: s3:bucket/home\nrestic_extra_args: 64 --pack-size\n"))
+	if err := mgr.VerifyRepository(context.Background(), "b2-home", "5%", nil); err == nil || !strings.Contains(err.Error(), "must start with a flag") {
+		t.Errorf("Expected error for extra args starting with a value, got %v", err)
+	}
+}
+
+func TestVerifyRepositoryReadOnlyCredentials(t *testing.T) {
+	cfg := &config.Config{ResticRepoDir: "/repos"}
 
 	tests := []struct {
-		name              string
-		prefix            string
-		retention         int
-		existingSnapshots []MockDirEntry
-		deleteFailures    []string
-		expectError       bool
-		errorContains     string
-		expectedDeletes   []string
+		name             string
+		readOnlyConfig   bool
+		expectedPassword string
 	}{
+		{name: "prefers_read_only_credentials", readOnlyConfig: true, expectedPassword: "RESTIC_PASSWORD=reader"},
+		{name: "falls_back_to_repository_credentials", readOnlyConfig: false, expectedPassword: "RESTIC_PASSWORD=writer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFS := NewMockFileSystem()
+			mockRestic := NewMockResticClient(t)
+
+			mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: s3:bucket/home\nRESTIC_PASSWORD: writer"))
+			if tt.readOnlyConfig {
+				mockFS.AddFile("/repos/b2-home.readonly", []byte("RESTIC_REPOSITORY: s3:bucket/home\nRESTIC_PASSWORD: reader"))
+			}
+			mockRestic.ExpectCheck("5%", 0)
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+			if err := mgr.VerifyRepository(context.Background(), "b2-home", "5%", nil); err != nil {
+				t.Fatalf("VerifyRepository failed: %v", err)
+			}
+
+			if !slices.Contains(mockRestic.lastEnv, tt.expectedPassword) {
+				t.Errorf("Expected %s in restic environment", tt.expectedPassword)
+			}
+		})
+	}
+}
+
+func TestVerificationSchedule(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	target := &config.TargetConfig{Prefix: "home", Verify: true, VerifyEvery: 3}
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	// The first two backups since the last verification skip it, the third is verified.
+	// A failed verification is retried after the next backup.
+	var due []bool
+	for _, verifyOK := range []bool{true, true, false, true, true} {
+		isDue := mgr.VerificationDue("home", target)
+		due = append(due, isDue)
+		if err := mgr.RecordVerification("home", "5%", isDue && verifyOK, nil); err != nil {
+			t.Fatalf("RecordVerification failed: %v", err)
+		}
+	}
+	if !slices.Equal(due, []bool{false, false, true, true, false}) {
+		t.Errorf("Expected verification due [false false true true false], got %v", due)
+	}
+
+	st, err := state.Load(cfg.StateDir, "home")
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if st.BackupsSinceVerify != 1 || st.LastVerify.IsZero() {
+		t.Errorf("Expected one backup since a recorded verification, got %+v", st)
+	}
+
+	if !mgr.VerificationDue("docs", &config.TargetConfig{Prefix: "docs", Verify: true}) {
+		t.Error("Expected verification to be due for every backup without verify_every")
+	}
+}
+
+func TestFullBackupSchedule(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	target := &config.TargetConfig{Prefix: "home", Type: "incremental", FullEvery: "30d"}
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	// Without a recorded full backup the first run is promoted
+	if scheduled := mgr.ScheduledTarget("home", target); scheduled.Type != "full" || target.Type != "incremental" {
+		t.Errorf("Expected a promoted copy of the target, got type %s (target %s)", scheduled.Type, target.Type)
+	}
+
+	for _, tt := range []struct {
+		lastFull   time.Duration
+		expectType string
+	}{
+		{lastFull: 29 * 24 * time.Hour, expectType: "incremental"},
+		{lastFull: 31 * 24 * time.Hour, expectType: "full"},
+	} {
+		if err := mgr.RecordFullBackup("home", time.Now().Add(-tt.lastFull)); err != nil {
+			t.Fatalf("RecordFullBackup failed: %v", err)
+		}
+		if scheduled := mgr.ScheduledTarget("home", target); scheduled.Type != tt.expectType {
+			t.Errorf("Expected %s backup %s after the last full one, got %s", tt.expectType, tt.lastFull, scheduled.Type)
+		}
+	}
+
+	if scheduled := mgr.ScheduledTarget("docs", &config.TargetConfig{Prefix: "docs", Type: "incremental"}); scheduled.Type != "incremental" {
+		t.Error("Expected a target without full_every never to be promoted")
+	}
+}
+
+func TestFullVerificationSchedule(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	target := &config.TargetConfig{Prefix: "home", Repository: "b2-home", Verify: true, VerifySubset: "5%", VerifyFullEvery: "90d"}
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	// Without a recorded full verification the first one reads all data
+	if scheduled := mgr.ScheduledTarget("home", target); scheduled.VerifySubset != config.VerifyFull || target.VerifySubset != "5%" {
+		t.Errorf("Expected an escalated copy of the target, got verify_subset %s (target %s)", scheduled.VerifySubset, target.VerifySubset)
+	}
+
+	// A partial verification doesn't count as full
+	if err := mgr.RecordVerification("home", "5%", true, nil); err != nil {
+		t.Fatalf("RecordVerification failed: %v", err)
+	}
+	if scheduled := mgr.ScheduledTarget("home", target); scheduled.VerifySubset != config.VerifyFull {
+		t.Errorf("Expected full verification after a partial one, got %s", scheduled.VerifySubset)
+	}
+
+	if err := mgr.RecordVerification("home", config.VerifyFull, true, nil); err != nil {
+		t.Fatalf("RecordVerification failed: %v", err)
+	}
+	if scheduled := mgr.ScheduledTarget("home", target); scheduled.VerifySubset != "5%" {
+		t.Errorf("Expected verify_subset after a full verification, got %s", scheduled.VerifySubset)
+	}
+
+	// Repository settings override those of the target
+	cfg.Repositories = map[string]config.RepositoryConfig{"b2-home": {VerifySubset: "1G", VerifyFullEvery: "1h"}}
+	if err := state.Update(cfg.StateDir, "home", func(st *state.Target) { st.LastFullVerify = time.Now().Add(-2 * time.Hour) }); err != nil {
+		t.Fatalf("Failed to update state: %v", err)
+	}
+	if scheduled := mgr.ScheduledTarget("home", target); scheduled.VerifySubset != config.VerifyFull || scheduled.VerifyFullEvery != "1h" {
+		t.Errorf("Expected the repository's verify_full_every to apply, got %+v", scheduled)
+	}
+	if err := mgr.RecordVerification("home", config.VerifyFull, true, nil); err != nil {
+		t.Fatalf("RecordVerification failed: %v", err)
+	}
+	if scheduled := mgr.ScheduledTarget("home", target); scheduled.VerifySubset != "1G" {
+		t.Errorf("Expected the repository's verify_subset, got %s", scheduled.VerifySubset)
+	}
+}
+
+func TestRecordVerificationError(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	lastVerifyError := func() string {
+		st, err := state.Load(cfg.StateDir, "home")
+		if err != nil {
+			t.Fatalf("Failed to load state: %v", err)
+		}
+		return st.LastVerifyError
+	}
+	if err := mgr.RecordVerification("home", "5%", false, errors.New("repository verification failed")); err != nil {
+		t.Fatalf("RecordVerification failed: %v", err)
+	}
+	if lastVerifyError() != "repository verification failed" {
+		t.Errorf("Expected the verification error in the state, got %q", lastVerifyError())
+	}
+	// Backups without a verification keep the error of the last one
+	if err := mgr.RecordVerification("home", "5%", false, nil); err != nil {
+		t.Fatalf("RecordVerification failed: %v", err)
+	}
+	if lastVerifyError() == "" {
+		t.Error("Expected the verification error to be kept until a verification succeeds")
+	}
+	if err := mgr.RecordVerification("home", "5%", true, nil); err != nil {
+		t.Fatalf("RecordVerification failed: %v", err)
+	}
+	if lastVerifyError() != "" {
+		t.Errorf("Expected a successful verification to clear the error, got %q", lastVerifyError())
+	}
+}
+
+func TestRecordRun(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+	mgr.SetRunID("0123456789abcdef", false)
+	first := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+
+	err := mgr.RecordRun("home", first, "/snapshots/home-20230101-120000", &restic.Summary{SnapshotID: "aaa111", TotalFilesProcessed: 12}, nil)
+	if err != nil {
+		t.Fatalf("RecordRun failed: %v", err)
+	}
+	err = mgr.RecordRun("home", second, "", nil, errors.New("environment validation failed"))
+	if err != nil {
+		t.Fatalf("RecordRun failed: %v", err)
+	}
+
+	st, err := state.Load(cfg.StateDir, "home")
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if !st.LastAttempt.Equal(second) || !st.LastSuccess.Equal(first) || st.LastError != "environment validation failed" {
+		t.Errorf("Expected failed attempt after a success, got %+v", st)
+	}
+	if st.LastSnapshot != "/snapshots/home-20230101-120000" || st.LastResticSnapshot != "aaa111" {
+		t.Errorf("Expected snapshots of the successful run to be kept, got %+v", st)
+	}
+	if st.LastRunID != "0123456789abcdef" {
+		t.Errorf("Expected run ID in the state, got %q", st.LastRunID)
+	}
+	if len(st.Uploads) != 1 || !st.Uploads[0].Time.Equal(first) || st.Uploads[0].FilesProcessed != 12 {
+		t.Errorf("Expected the upload of the successful run in the history, got %+v", st.Uploads)
+	}
+	if st.ConsecutiveFailures != 1 {
+		t.Errorf("Expected 1 consecutive failure, got %d", st.ConsecutiveFailures)
+	}
+	if err := mgr.RecordRun("home", second.Add(time.Hour), "", nil, nil); err != nil {
+		t.Fatalf("RecordRun failed: %v", err)
+	}
+	if st, _ := state.Load(cfg.StateDir, "home"); st.ConsecutiveFailures != 0 {
+		t.Errorf("Expected a successful run to reset the consecutive failures, got %d", st.ConsecutiveFailures)
+	}
+
+	var out bytes.Buffer
+	mgr.SetDryRun(&out)
+	if err := mgr.RecordRun("home", second.Add(2*time.Hour), "", nil, nil); err != nil {
+		t.Fatalf("RecordRun failed: %v", err)
+	}
+	if st, _ := state.Load(cfg.StateDir, "home"); !st.LastAttempt.Equal(second.Add(time.Hour)) {
+		t.Errorf("Expected dry runs not to be recorded, got last attempt %v", st.LastAttempt)
+	}
+}
+
+func TestForgetSnapshots(t *testing.T) {
+	cfg := &config.Config{
+		ResticRepoDir: "/repos",
+	}
+
+	keep := config.ResticKeepConfig{KeepLast: 1, KeepDaily: 7, KeepMonthly: 6}
+	policy := restic.ForgetPolicy{KeepLast: 1, KeepDaily: 7, KeepMonthly: 6}
+
+	tests := []struct {
+		name             string
+		keep             config.ResticKeepConfig
+		repoConfigExists bool
+		metadata         bool
+		checksums        bool
+		expectForget     bool
+		resticExitCode   int
+		expectError      bool
+		errorContains    string
+	}{
+		{
+			name:             "successful_forget",
+			keep:             keep,
+			repoConfigExists: true,
+			expectForget:     true,
+		},
+		{
+			name:             "metadata_manifests_forgotten",
+			keep:             keep,
+			repoConfigExists: true,
+			metadata:         true,
+			expectForget:     true,
+		},
+		{
+			name:             "checksum_manifests_forgotten",
+			keep:             keep,
+			repoConfigExists: true,
+			checksums:        true,
+			expectForget:     true,
+		},
+		{
+			name:          "no_policy_configured",
+			expectError:   true,
+			errorContains: "no restic_keep retention policy configured",
+		},
+		{
+			name:             "repository_config_missing",
+			keep:             keep,
+			repoConfigExists: false,
+			expectError:      true,
+			errorContains:    "repository configuration failed for retention",
+		},
+		{
+			name:             "restic_forget_failure",
+			keep:             keep,
+			repoConfigExists: true,
+			expectForget:     true,
+			resticExitCode:   1,
+			expectError:      true,
+			errorContains:    "restic forget command failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFS := NewMockFileSystem()
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockRestic := NewMockResticClient(t)
+
+			target := &config.TargetConfig{
+				Prefix:     "home",
+				Repository: "b2-home",
+				ResticKeep: tt.keep,
+				Metadata:   tt.metadata,
+			}
+			if tt.checksums {
+				target.ChecksumManifest = config.ChecksumFull
+			}
+
+			if tt.repoConfigExists {
+				mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+			}
+			if tt.metadata {
+				mockRestic.ExpectForget([]string{metadataTag, "home"}, policy, false, 0)
+			}
+			if tt.checksums {
+				mockRestic.ExpectForget([]string{checksumTag, "home"}, policy, false, 0)
+			}
+			if tt.expectForget {
+				mockRestic.ExpectForget([]string{"btrfs-backup", "home"}, policy, true, tt.resticExitCode)
+			}
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+			err := mgr.ForgetSnapshots(context.Background(), target)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				} else if tt.errorContains != "" && !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got '%s'", tt.errorContains, err.Error())
+				}
+			} else {
+				if err != nil {
+					t.Errorf("Expected no error but got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestInitRepository(t *testing.T) {
+	cfg := &config.Config{
+		ResticRepoDir: "/repos",
+	}
+
+	tests := []struct {
+		name             string
+		repoConfigExists bool
+		initExitCode     int
+		initErr          error
+		expectError      bool
+		expectExists     bool
+		errorContains    string
+	}{
+		{
+			name:             "successful_init",
+			repoConfigExists: true,
+		},
+		{
+			name:             "repository_config_missing",
+			repoConfigExists: false,
+			expectError:      true,
+			errorContains:    "repository configuration failed for initialization",
+		},
+		{
+			name:             "repository_already_exists",
+			repoConfigExists: true,
+			initErr:          restic.ErrRepositoryExists,
+			expectError:      true,
+			expectExists:     true,
+			errorContains:    "repository already initialized",
+		},
+		{
+			name:             "restic_init_failure",
+			repoConfigExists: true,
+			initExitCode:     1,
+			expectError:      true,
+			errorContains:    "repository initialization failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFS := NewMockFileSystem()
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockRestic := NewMockResticClient(t)
+
+			if tt.repoConfigExists {
+				mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+				mockRestic.ExpectInit(tt.initExitCode, tt.initErr)
+			}
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+			err := mgr.InitRepository(context.Background(), "b2-home")
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				} else if tt.errorContains != "" && !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got '%s'", tt.errorContains, err.Error())
+				}
+			} else {
+				if err != nil {
+					t.Errorf("Expected no error but got: %v", err)
+				}
+			}
+			if errors.Is(err, restic.ErrRepositoryExists) != tt.expectExists {
+				t.Errorf("Expected errors.Is(err, ErrRepositoryExists) to be %t, got error %v", tt.expectExists, err)
+			}
+		})
+	}
+}
+
+func TestCleanupOldSnapshots(t *testing.T) {
+	cfg := &config.Config{
+		SnapshotDir: "/snapshots",
+	}
+
+	baseTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name              string
+		prefix            string
+		retention         int
+		existingSnapshots []MockDirEntry
+		deleteFailures    []string
+		expectError       bool
+		errorContains     string
+		expectedDeletes   []string
+	}{
+		{
+			name:      "successful_cleanup",
+			prefix:    "backup",
+			retention: 2,
+			existingSnapshots: []MockDirEntry{
+				{name: "backup-20230104-120000", modTime: baseTime.Add(0 * time.Hour)},
+				{name: "backup-20230103-120000", modTime: baseTime.Add(-1 * time.Hour)},
+				{name: "backup-20230102-120000", modTime: baseTime.Add(-2 * time.Hour)},
+				{name: "backup-20230101-120000", modTime: baseTime.Add(-3 * time.Hour)},
+			},
+			expectedDeletes: []string{"backup-20230102-120000", "backup-20230101-120000"},
+			expectError:     false,
+		},
 		{
-			name:      "successful_cleanup",
-			prefix:    "backup",
-			retention: 2,
-			existingSnapshots: []MockDirEntry{
-				{name: "backup-20230101-120000", modTime: baseTime.Add(0 * time.Hour)},
-				{name: "backup-20230102-120000", modTime: baseTime.Add(-1 * time.Hour)},
-				{name: "backup-20230103-120000", modTime: baseTime.Add(-2 * time.Hour)},
-				{name: "backup-20230104-120000", modTime: baseTime.Add(-3 * time.Hour)},
-			},
-			expectedDeletes: []string{"backup-20230103-120000", "backup-20230104-120000"},
-			expectError:     false,
-		},
-		{
 			name:      "no_cleanup_needed",
 			prefix:    "backup",
 			retention: 3,
 			existingSnapshots: []MockDirEntry{
-				{name: "backup-20230101-120000", modTime: baseTime},
-				{name: "backup-20230102-120000", modTime: baseTime.Add(-1 * time.Hour)},
+				{name: "backup-20230104-120000", modTime: baseTime},
+				{name: "backup-20230103-120000", modTime: baseTime.Add(-1 * time.Hour)},
 			},
 			expectedDeletes: []string{},
 			expectError:     false,
@@ -891,12 +2542,12 @@ func TestCleanupOldSnapshots(t *testing.T) {
 			prefix:    "backup",
 			retention: 1,
 			existingSnapshots: []MockDirEntry{
-				{name: "backup-20230101-120000", modTime: baseTime},
-				{name: "backup-20230102-120000", modTime: baseTime.Add(-1 * time.Hour)},
-				{name: "backup-20230103-120000", modTime: baseTime.Add(-2 * time.Hour)},
+				{name: "backup-20230104-120000", modTime: baseTime},
+				{name: "backup-20230103-120000", modTime: baseTime.Add(-1 * time.Hour)},
+				{name: "backup-20230102-120000", modTime: baseTime.Add(-2 * time.Hour)},
 			},
-			deleteFailures:  []string{"backup-20230103-120000"},
-			expectedDeletes: []string{"backup-20230102-120000", "backup-20230103-120000"},
+			deleteFailures:  []string{"backup-20230102-120000"},
+			expectedDeletes: []string{"backup-20230103-120000", "backup-20230102-120000"},
 			expectError:     true,
 			errorContains:   "failed to delete some snapshots",
 		},
@@ -904,8 +2555,19 @@ func TestCleanupOldSnapshots(t *testing.T) {
 			name:      "zero_retention",
 			prefix:    "backup",
 			retention: 0,
+			existingSnapshots: []MockDirEntry{
+				{name: "backup-20230104-120000", modTime: baseTime},
+			},
+			expectedDeletes: []string{"backup-20230104-120000"},
+			expectError:     false,
+		},
+		{
+			name:      "sorted_by_name_not_mtime",
+			prefix:    "backup",
+			retention: 1,
 			existingSnapshots: []MockDirEntry{
 				{name: "backup-20230101-120000", modTime: baseTime},
+				{name: "backup-20230102-120000", modTime: baseTime.Add(-24 * time.Hour)},
 			},
 			expectedDeletes: []string{"backup-20230101-120000"},
 			expectError:     false,
@@ -915,11 +2577,11 @@ func TestCleanupOldSnapshots(t *testing.T) {
 			prefix:    "home",
 			retention: 1,
 			existingSnapshots: []MockDirEntry{
-				{name: "home-20230101-120000", modTime: baseTime},
+				{name: "home-20230102-120000", modTime: baseTime},
 				{name: "other-20230101-120000", modTime: baseTime.Add(-1 * time.Hour)},
-				{name: "home-20230102-120000", modTime: baseTime.Add(-2 * time.Hour)},
+				{name: "home-20230101-120000", modTime: baseTime.Add(-2 * time.Hour)},
 			},
-			expectedDeletes: []string{"home-20230102-120000"},
+			expectedDeletes: []string{"home-20230101-120000"},
 			expectError:     false,
 		},
 	}
@@ -951,7 +2613,7 @@ func TestCleanupOldSnapshots(t *testing.T) {
 			}
 
 			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-			err := mgr.CleanupOldSnapshots(tt.prefix, tt.retention)
+			err := mgr.CleanupOldSnapshots(context.Background(), &config.TargetConfig{Prefix: tt.prefix}, tt.retention)
 
 			if tt.expectError {
 				if err == nil {
@@ -968,6 +2630,238 @@ func TestCleanupOldSnapshots(t *testing.T) {
 	}
 }
 
+func TestCleanupOldSnapshotsNestedSubvolumes(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots"}
+	baseTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	mockFS := NewMockFileSystem()
+	mockBtrfs := NewMockBtrfsClient(t)
+	mockRestic := NewMockResticClient(t)
+
+	mockFS.AddDir("/snapshots", []MockDirEntry{
+		{name: "system-20230101-120000", modTime: baseTime},
+		{name: "system-20221231-120000", modTime: baseTime.Add(-24 * time.Hour)},
+	})
+	// Snapshots of a multi-subvolume target, next to a regular directory and file
+	mockFS.AddDir("/snapshots/system-20221231-120000", []MockDirEntry{
+		{name: "@home", isDir: true, subvolume: true},
+		{name: "@var", isDir: true, subvolume: true},
+		{name: "lost+found", isDir: true},
+		{name: "README", isDir: false},
+	})
+	mockBtrfs.ExpectDeleteSubvolume("/snapshots/system-20221231-120000/@home", 0)
+	mockBtrfs.ExpectDeleteSubvolume("/snapshots/system-20221231-120000/@var", 0)
+	mockBtrfs.ExpectDeleteSubvolume("/snapshots/system-20221231-120000", 0)
+	mockFS.SetStatError("/snapshots/system-20221231-120000", os.ErrNotExist)
+
+	mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+	if err := mgr.CleanupOldSnapshots(context.Background(), &config.TargetConfig{Prefix: "system"}, 1); err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+	if mockBtrfs.index != len(mockBtrfs.expectedCommands) {
+		t.Errorf("Expected %d btrfs commands, got %d", len(mockBtrfs.expectedCommands), mockBtrfs.index)
+	}
+}
+
+func TestCleanupOldSnapshotsSpaceLimit(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots"}
+	baseTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	names := []string{"home-20230101-120000", "home-20221231-120000", "home-20221230-120000", "home-20221229-120000"}
+	const gib = 1 << 30
+
+	tests := []struct {
+		name          string
+		maxSpace      string
+		minKeep       int
+		sizeExitCode  int
+		expectDeleted []string
+		expectError   bool
+	}{
+		{name: "within_limit", maxSpace: "10GiB", minKeep: 1},
+		{name: "oldest_deleted", maxSpace: "4GiB", minKeep: 1, expectDeleted: names[1:3]},
+		{name: "min_keep_protected", maxSpace: "1GiB", minKeep: 2, expectDeleted: names[2:3]},
+		{name: "quotas_disabled", maxSpace: "5GiB", minKeep: 1, sizeExitCode: 1, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFS := NewMockFileSystem()
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockRestic := NewMockResticClient(t)
+
+			var entries []MockDirEntry
+			for i, name := range names {
+				entries = append(entries, MockDirEntry{name: name, modTime: baseTime.Add(-time.Duration(i) * 24 * time.Hour)})
+			}
+			mockFS.AddDir("/snapshots", entries)
+
+			// keep_snapshots 3 deletes the oldest, the others take 2, 3 and 4 GiB
+			mockBtrfs.ExpectDeleteSubvolume("/snapshots/"+names[3], 0)
+			mockFS.SetStatError("/snapshots/"+names[3], os.ErrNotExist)
+			mockBtrfs.ExpectExclusiveSize("/snapshots/"+names[0], 2*gib, tt.sizeExitCode)
+			if tt.sizeExitCode == 0 {
+				mockBtrfs.ExpectExclusiveSize("/snapshots/"+names[1], 3*gib, 0)
+				mockBtrfs.ExpectExclusiveSize("/snapshots/"+names[2], 4*gib, 0)
+			}
+			for i := len(tt.expectDeleted) - 1; i >= 0; i-- {
+				mockBtrfs.ExpectDeleteSubvolume("/snapshots/"+tt.expectDeleted[i], 0)
+				mockFS.SetStatError("/snapshots/"+tt.expectDeleted[i], os.ErrNotExist)
+			}
+
+			target := &config.TargetConfig{Prefix: "home", MaxSnapshotSpace: tt.maxSpace, MinKeepSnapshots: tt.minKeep}
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+			err := mgr.CleanupOldSnapshots(context.Background(), target, 3)
+
+			if tt.expectError {
+				if err == nil || !strings.Contains(err.Error(), "failed to check snapshot space") {
+					t.Errorf("Expected snapshot space error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			if mockBtrfs.index != len(mockBtrfs.expectedCommands) {
+				t.Errorf("Expected %d btrfs commands, got %d", len(mockBtrfs.expectedCommands), mockBtrfs.index)
+			}
+		})
+	}
+}
+
+func TestCleanupOldSnapshotsEventLog(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots"}
+	baseTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	mockFS := NewMockFileSystem()
+	mockBtrfs := NewMockBtrfsClient(t)
+	mockRestic := NewMockResticClient(t)
+
+	mockFS.AddDir("/snapshots", []MockDirEntry{
+		{name: "home-20230102-120000", modTime: baseTime},
+		{name: "home-20230101-120000", modTime: baseTime.Add(-1 * time.Hour)},
+	})
+	mockBtrfs.ExpectDeleteSubvolume("/snapshots/home-20230102-120000", 0)
+	mockFS.SetStatError("/snapshots/home-20230102-120000", os.ErrNotExist)
+	mockBtrfs.ExpectDeleteSubvolume("/snapshots/home-20230101-120000", 1)
+
+	var buf bytes.Buffer
+	mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+	mgr.SetEventLog(events.New(&buf).ForTarget("home"))
+
+	if err := mgr.CleanupOldSnapshots(context.Background(), &config.TargetConfig{Prefix: "home"}, 0); err == nil {
+		t.Fatal("Expected error for failed deletion but got none")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events, got %d:\n%s", len(lines), buf.String())
+	}
+
+	var deleted, failed events.Event
+	if err := json.Unmarshal([]byte(lines[0]), &deleted); err != nil {
+		t.Fatalf("Invalid event: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &failed); err != nil {
+		t.Fatalf("Invalid event: %v", err)
+	}
+
+	if deleted.Type != events.SnapshotDeleted || deleted.Outcome != events.OutcomeSuccess ||
+		deleted.Snapshot != "/snapshots/home-20230102-120000" || deleted.Target != "home" {
+		t.Errorf("Unexpected deletion event: %+v", deleted)
+	}
+	if failed.Type != events.SnapshotDeleted || failed.Outcome != events.OutcomeFailure || failed.Error == "" {
+		t.Errorf("Unexpected failed deletion event: %+v", failed)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	metricsDir := t.TempDir()
+	cfg := &config.Config{SnapshotDir: "/snapshots", MetricsDir: metricsDir}
+	target := &config.TargetConfig{Prefix: "home"}
+	baseTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	mockFS := NewMockFileSystem()
+	mockFS.AddDir("/snapshots", []MockDirEntry{
+		{name: "home-20230101-120000", modTime: baseTime},
+		{name: "home-20230102-120000", modTime: baseTime.Add(time.Hour)},
+		{name: "root-20230102-120000", modTime: baseTime.Add(time.Hour)},
+	})
+
+	mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), NewMockResticClient(t))
+	err := mgr.WriteMetrics("home", target, 42*time.Second, errors.New("upload failed"))
+	if err != nil {
+		t.Fatalf("WriteMetrics failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(metricsDir, "btrfs_backup_home.prom"))
+	if err != nil {
+		t.Fatalf("Failed to read metrics file: %v", err)
+	}
+	for _, expected := range []string{
+		`btrfs_backup_duration_seconds{target="home"} 42`,
+		`btrfs_backup_snapshot_count{target="home"} 2`,
+		`btrfs_backup_result{target="home"} 0`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, data)
+		}
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots"}
+	baseTime := time.Now()
+	existing := []MockDirEntry{
+		{name: "home-20230102-120000", modTime: baseTime.Add(-24 * time.Hour)},
+		{name: "home-20230101-120000", modTime: baseTime.Add(-48 * time.Hour)},
+	}
+
+	for _, prune := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prune_%v", prune), func(t *testing.T) {
+			mockFS := NewMockFileSystem()
+			mockBtrfs := NewMockBtrfsClient(t)
+			hookLog := filepath.Join(t.TempDir(), "hooks.log")
+			target := &config.TargetConfig{
+				Subvolume:     "/mnt/btrfs/home",
+				Prefix:        "home",
+				Repository:    "b2-home",
+				KeepSnapshots: 2,
+				PreSnapshot:   []string{"echo pre >> " + hookLog},
+				PostSnapshot:  []string{"echo post >> " + hookLog},
+				HookTimeout:   time.Minute,
+			}
+
+			mockFS.AddDir("/snapshots", existing)
+			mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+			mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+			mockBtrfs.onCreateSnapshot = func(subvolume, snapshotPath string) {
+				mockFS.AddFile(snapshotPath, []byte{})
+				mockFS.AddDir("/snapshots", append([]MockDirEntry{{name: filepath.Base(snapshotPath), modTime: baseTime}}, existing...))
+			}
+			if prune {
+				mockBtrfs.ExpectDeleteSubvolume("/snapshots/home-20230101-120000", 0)
+				mockFS.SetStatError("/snapshots/home-20230101-120000", os.ErrNotExist)
+			}
+
+			// No restic expectations: any restic command fails the test
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, NewMockResticClient(t))
+			snapshotPath, err := mgr.TakeSnapshot(context.Background(), "home", target, prune)
+			if err != nil {
+				t.Fatalf("TakeSnapshot failed: %v", err)
+			}
+			if !strings.HasPrefix(snapshotPath, "/snapshots/home-") {
+				t.Errorf("Unexpected snapshot path %s", snapshotPath)
+			}
+			if data, _ := os.ReadFile(hookLog); string(data) != "pre\npost\n" {
+				t.Errorf("Expected snapshot hooks to run, got %q", data)
+			}
+			if mockBtrfs.index != len(mockBtrfs.expectedCommands) {
+				t.Errorf("Expected %d btrfs commands, got %d", len(mockBtrfs.expectedCommands), mockBtrfs.index)
+			}
+		})
+	}
+}
+
 func TestRunBackup(t *testing.T) {
 	cfg := &config.Config{
 		SnapshotDir:   "/snapshots",
@@ -975,7 +2869,263 @@ func TestRunBackup(t *testing.T) {
 		ResticBin:     "/usr/bin/restic",
 	}
 
-	t.Run("successful_workflow", func(t *testing.T) {
+	t.Run("successful_workflow", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		target := &config.TargetConfig{
+			Subvolume:     "/mnt/btrfs/home",
+			Prefix:        "home-backup",
+			Repository:    "b2-home",
+			Type:          "incremental",
+			Verify:        false,
+			KeepSnapshots: 3,
+		}
+
+		// Setup successful workflow mocks
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.onCreateSnapshot = func(subvolume, snapshotPath string) {
+			mockFS.AddFile(snapshotPath, []byte{})
+		}
+		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockRestic.ExpectBackup("", []string{}, true, false, 0)
+
+		// Mock cleanup
+		baseTime := time.Now()
+		snapshots := []MockDirEntry{
+			{name: "home-backup-20230101-120000", modTime: baseTime.Add(-24 * time.Hour)},
+			{name: "home-backup-20221231-120000", modTime: baseTime.Add(-48 * time.Hour)},
+			{name: "home-backup-20221230-120000", modTime: baseTime.Add(-72 * time.Hour)},
+			{name: "home-backup-20221229-120000", modTime: baseTime.Add(-96 * time.Hour)},
+		}
+		mockFS.AddDir("/snapshots", snapshots)
+		mockBtrfs.ExpectDeleteSubvolume("/snapshots/home-backup-20221229-120000", 0)
+		mockFS.SetStatError("/snapshots/home-backup-20221229-120000", os.ErrNotExist)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		err := mgr.RunBackup(context.Background(), "home", target)
+
+		if err != nil {
+			t.Errorf("Expected no error but got: %v", err)
+		}
+	})
+
+	t.Run("workflow_with_restic_retention", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		target := &config.TargetConfig{
+			Subvolume:     "/mnt/btrfs/home",
+			Prefix:        "home-backup",
+			Repository:    "b2-home",
+			Type:          "incremental",
+			KeepSnapshots: 3,
+			ResticKeep:    config.ResticKeepConfig{KeepDaily: 7},
+		}
+
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.onCreateSnapshot = func(subvolume, snapshotPath string) {
+			mockFS.AddFile(snapshotPath, []byte{})
+		}
+		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockRestic.ExpectBackup("", []string{}, true, false, 0)
+		mockRestic.ExpectForget([]string{"btrfs-backup", "home-backup"}, restic.ForgetPolicy{KeepDaily: 7}, true, 0)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		err := mgr.RunBackup(context.Background(), "home", target)
+
+		if err != nil {
+			t.Errorf("Expected no error but got: %v", err)
+		}
+		if mockRestic.index != len(mockRestic.expectedCommands) {
+			t.Errorf("Expected %d restic commands, got %d", len(mockRestic.expectedCommands), mockRestic.index)
+		}
+	})
+
+	t.Run("retention_and_verification_failures_warn", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		target := &config.TargetConfig{
+			Subvolume:     "/mnt/btrfs/home",
+			Prefix:        "home-backup",
+			Repository:    "b2-home",
+			Type:          "incremental",
+			KeepSnapshots: 3,
+			ResticKeep:    config.ResticKeepConfig{KeepDaily: 7},
+			Verify:        true,
+		}
+
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.onCreateSnapshot = func(subvolume, snapshotPath string) {
+			mockFS.AddFile(snapshotPath, []byte{})
+		}
+		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockRestic.ExpectBackup("", []string{}, true, false, 0)
+		mockRestic.ExpectForget([]string{"btrfs-backup", "home-backup"}, restic.ForgetPolicy{KeepDaily: 7}, true, 1)
+		mockRestic.ExpectCheck("", 1)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		ch := mgr.Events()
+		if err := mgr.RunBackup(context.Background(), "home", target); err != nil {
+			t.Fatalf("Expected retention and verification failures to only warn, got: %v", err)
+		}
+		if mockRestic.index != len(mockRestic.expectedCommands) {
+			t.Errorf("Expected %d restic commands, got %d", len(mockRestic.expectedCommands), mockRestic.index)
+		}
+
+		var warnings []string
+		for len(ch) > 0 {
+			if e := <-ch; e.Kind == progress.EventWarning {
+				warnings = append(warnings, e.Message)
+			}
+		}
+		expected := []string{"Restic retention failed", "Repository verification failed"}
+		if !slices.Equal(warnings, expected) {
+			t.Errorf("Expected warnings %v, got %v", expected, warnings)
+		}
+	})
+
+	t.Run("post_hook_failures_warn", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		marker := filepath.Join(t.TempDir(), "failed")
+		target := &config.TargetConfig{
+			Subvolume:    "/mnt/btrfs/db",
+			Prefix:       "db",
+			Repository:   "b2-db",
+			PostSnapshot: []string{"exit 1"},
+			PostBackup:   []string{"exit 2"},
+			PostFailure:  []string{"touch " + marker},
+			HookTimeout:  time.Minute,
+		}
+
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/db", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+			mockFS.AddFile(path, []byte{})
+		}
+		mockFS.AddFile("/repos/b2-db", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockRestic.ExpectBackup("", []string{}, true, false, 0)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		ch := mgr.Events()
+		if err := mgr.RunBackup(context.Background(), "db", target); err != nil {
+			t.Fatalf("Expected failing post hooks to only warn, got: %v", err)
+		}
+		if mockRestic.index != 1 {
+			t.Error("Expected the upload to run after a failing post-snapshot hook")
+		}
+		if _, statErr := os.Stat(marker); !os.IsNotExist(statErr) {
+			t.Errorf("Expected no post-failure hook after failing post hooks, got %v", statErr)
+		}
+
+		var warnings []string
+		for len(ch) > 0 {
+			if e := <-ch; e.Kind == progress.EventWarning {
+				warnings = append(warnings, e.Message)
+			}
+		}
+		expected := []string{"Post-snapshot hook failed", "Post-backup hook failed"}
+		if !slices.Equal(warnings, expected) {
+			t.Errorf("Expected warnings %v, got %v", expected, warnings)
+		}
+	})
+
+	t.Run("run_finished_reports_result", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		target := &config.TargetConfig{
+			Subvolume:  "/mnt/btrfs/home",
+			Prefix:     "home",
+			Repository: "b2-home",
+		}
+
+		var snapshotPath string
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+			snapshotPath = path
+			mockFS.AddFile(path, []byte{})
+		}
+		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockRestic.ExpectBackupError(errors.New("repository unreachable"))
+
+		var results []RunResult
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		mgr.SetRunFinished(func(result RunResult) { results = append(results, result) })
+		err := mgr.RunBackup(context.Background(), "home", target)
+		if err == nil {
+			t.Fatal("Expected backup failure")
+		}
+
+		if len(results) != 1 {
+			t.Fatalf("Expected one reported run, got %d", len(results))
+		}
+		result := results[0]
+		if result.Snapshot != snapshotPath || !result.UploadStarted || result.Uploaded || result.Err != err || result.Started.IsZero() {
+			t.Errorf("Unexpected run result %+v", result)
+		}
+	})
+
+	t.Run("upload_waits_for_limit", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		target := &config.TargetConfig{
+			Subvolume:  "/mnt/btrfs/home",
+			Prefix:     "home",
+			Repository: "b2-home",
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+			mockFS.AddFile(path, []byte{})
+		}
+
+		// Another target holds the only upload slot until the run is interrupted
+		limit := NewPhaseLimit(1)
+		if _, err := limit.Acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		mgr.SetUploadLimit(limit)
+		mgr.SetRunFinished(func(result RunResult) {
+			if result.UploadStarted {
+				t.Error("Expected no upload while waiting for the limit")
+			}
+		})
+		time.AfterFunc(10*time.Millisecond, cancel)
+		err := mgr.RunBackup(ctx, "home", target)
+		if err == nil || !strings.Contains(err.Error(), "waiting for other uploads") {
+			t.Errorf("Expected the run to wait for the upload limit, got %v", err)
+		}
+		if mockRestic.index != 0 {
+			t.Error("Expected no restic command while waiting for the upload limit")
+		}
+	})
+
+	t.Run("dry_run_executes_nothing_destructive", func(t *testing.T) {
 		mockFS := NewMockFileSystem()
 		mockBtrfs := NewMockBtrfsClient(t)
 		mockRestic := NewMockResticClient(t)
@@ -985,37 +3135,221 @@ func TestRunBackup(t *testing.T) {
 			Prefix:        "home-backup",
 			Repository:    "b2-home",
 			Type:          "incremental",
-			Verify:        false,
+			KeepSnapshots: 2,
+		}
+
+		baseTime := time.Now()
+		mockFS.AddDir("/snapshots", []MockDirEntry{
+			{name: "home-backup-20230101-120000", modTime: baseTime.Add(-24 * time.Hour)},
+			{name: "home-backup-20221231-120000", modTime: baseTime.Add(-48 * time.Hour)},
+		})
+		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+
+		// Only the read-only subvolume check reaches the real clients
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+
+		var out strings.Builder
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		mgr.SetDryRun(&out)
+		err := mgr.RunBackup(context.Background(), "home", target)
+
+		if err != nil {
+			t.Fatalf("Expected no error but got: %v", err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("Expected 3 dry-run commands, got %d:\n%s", len(lines), out.String())
+		}
+		if !strings.HasPrefix(lines[0], "[dry-run] btrfs subvolume snapshot -r /mnt/btrfs/home /snapshots/home-backup-") {
+			t.Errorf("Unexpected snapshot command: %s", lines[0])
+		}
+		if !strings.HasPrefix(lines[1], "[dry-run] /usr/bin/restic backup /snapshots/home-backup-") {
+			t.Errorf("Unexpected backup command: %s", lines[1])
+		}
+		if lines[2] != "[dry-run] btrfs subvolume delete /snapshots/home-backup-20221231-120000" {
+			t.Errorf("Unexpected delete command: %s", lines[2])
+		}
+	})
+
+	t.Run("hooks_run_around_snapshot_and_backup", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		hookLog := filepath.Join(t.TempDir(), "hooks.log")
+		record := func(name string) string {
+			return fmt.Sprintf(`echo "%s $TARGET_NAME $SNAPSHOT_PATH" >> %s`, name, hookLog)
+		}
+
+		target := &config.TargetConfig{
+			Subvolume:     "/mnt/btrfs/db",
+			Prefix:        "db",
+			Repository:    "b2-db",
+			Type:          "incremental",
 			KeepSnapshots: 3,
+			PreSnapshot:   []string{record("pre_snapshot")},
+			PostSnapshot:  []string{record("post_snapshot")},
+			PreBackup:     []string{record("pre_backup")},
+			PostBackup:    []string{record("post_backup")},
+			HookTimeout:   time.Minute,
 		}
 
-		// Setup successful workflow mocks
+		var snapshotPath string
 		mockFS.AddDir("/snapshots", []MockDirEntry{})
-		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/db", 0)
 		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
-		mockBtrfs.onCreateSnapshot = func(subvolume, snapshotPath string) {
-			mockFS.AddFile(snapshotPath, []byte{})
+		mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+			snapshotPath = path
+			mockFS.AddFile(path, []byte{})
 		}
-		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockFS.AddFile("/repos/b2-db", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
 		mockRestic.ExpectBackup("", []string{}, true, false, 0)
 
-		// Mock cleanup
-		baseTime := time.Now()
-		snapshots := []MockDirEntry{
-			{name: "home-backup-old1", modTime: baseTime.Add(-24 * time.Hour)},
-			{name: "home-backup-old2", modTime: baseTime.Add(-48 * time.Hour)},
-			{name: "home-backup-old3", modTime: baseTime.Add(-72 * time.Hour)},
-			{name: "home-backup-old4", modTime: baseTime.Add(-96 * time.Hour)},
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		err := mgr.RunBackup(context.Background(), "db", target)
+		if err != nil {
+			t.Fatalf("Expected no error but got: %v", err)
+		}
+
+		data, err := os.ReadFile(hookLog)
+		if err != nil {
+			t.Fatalf("Failed to read hook log: %v", err)
+		}
+		expected := fmt.Sprintf("pre_snapshot db \npost_snapshot db %[1]s\npre_backup db %[1]s\npost_backup db %[1]s\n", snapshotPath)
+		if string(data) != expected {
+			t.Errorf("Expected hook log:\n%s\ngot:\n%s", expected, string(data))
+		}
+	})
+
+	t.Run("failing_pre_snapshot_hook_aborts", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		target := &config.TargetConfig{
+			Subvolume:   "/mnt/btrfs/db",
+			Prefix:      "db",
+			Repository:  "b2-db",
+			PreSnapshot: []string{"exit 1"},
+			HookTimeout: time.Minute,
 		}
-		mockFS.AddDir("/snapshots", snapshots)
-		mockBtrfs.ExpectDeleteSubvolume("/snapshots/home-backup-old4", 0)
-		mockFS.SetStatError("/snapshots/home-backup-old4", os.ErrNotExist)
+
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/db", 0)
 
 		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-		err := mgr.RunBackup("home", target)
+		err := mgr.RunBackup(context.Background(), "db", target)
 
-		if err != nil {
-			t.Errorf("Expected no error but got: %v", err)
+		if err == nil || !strings.Contains(err.Error(), "pre-snapshot hook failed") {
+			t.Errorf("Expected pre-snapshot hook failure, got %v", err)
+		}
+		if mockBtrfs.index != 1 {
+			t.Errorf("Expected no snapshot to be created after failing pre-snapshot hook")
+		}
+	})
+
+	t.Run("post_snapshot_hook_runs_when_snapshot_fails", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		marker := filepath.Join(t.TempDir(), "restarted")
+		target := &config.TargetConfig{
+			Subvolume:    "/mnt/btrfs/db",
+			Prefix:       "db",
+			Repository:   "b2-db",
+			PostSnapshot: []string{"touch " + marker},
+			HookTimeout:  time.Minute,
+		}
+
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/db", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 1)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		err := mgr.RunBackup(context.Background(), "db", target)
+
+		if err == nil || !strings.Contains(err.Error(), "snapshot creation failed") {
+			t.Errorf("Expected snapshot creation failure, got %v", err)
+		}
+		if _, statErr := os.Stat(marker); statErr != nil {
+			t.Errorf("Expected post-snapshot hook to run after failed snapshot: %v", statErr)
+		}
+	})
+
+	t.Run("failure_hooks_run_when_backup_fails", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		hookLog := filepath.Join(t.TempDir(), "hooks.log")
+		target := &config.TargetConfig{
+			Subvolume:      "/mnt/btrfs/db",
+			Prefix:         "db",
+			Repository:     "b2-db",
+			PostBackup:     []string{fmt.Sprintf(`echo "post_backup" >> %s`, hookLog)},
+			PostBackupWhen: config.HookWhenAlways,
+			PostFailure:    []string{fmt.Sprintf(`echo "$HOOK_PHASE $ERROR_STEP $SNAPSHOT_PATH $ERROR_MESSAGE" >> %s`, hookLog)},
+			HookTimeout:    time.Minute,
+		}
+
+		var snapshotPath string
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/db", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+			snapshotPath = path
+			mockFS.AddFile(path, []byte{})
+		}
+		mockFS.AddFile("/repos/b2-db", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockRestic.ExpectBackupError(errors.New("repository unreachable"))
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		err := mgr.RunBackup(context.Background(), "db", target)
+		if err == nil {
+			t.Fatal("Expected backup failure")
+		}
+
+		data, readErr := os.ReadFile(hookLog)
+		if readErr != nil {
+			t.Fatalf("Failed to read hook log: %v", readErr)
+		}
+		expected := fmt.Sprintf("post_backup\npost_failure backup %s %s\n", snapshotPath, err)
+		if string(data) != expected {
+			t.Errorf("Expected hook log:\n%s\ngot:\n%s", expected, string(data))
+		}
+	})
+
+	t.Run("failure_hooks_skipped_on_success", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		marker := filepath.Join(t.TempDir(), "failed")
+		target := &config.TargetConfig{
+			Subvolume:   "/mnt/btrfs/db",
+			Prefix:      "db",
+			Repository:  "b2-db",
+			PostFailure: []string{"touch " + marker},
+			HookTimeout: time.Minute,
+		}
+
+		mockFS.AddDir("/snapshots", []MockDirEntry{})
+		mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/db", 0)
+		mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+		mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+			mockFS.AddFile(path, []byte{})
+		}
+		mockFS.AddFile("/repos/b2-db", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockRestic.ExpectBackup("", []string{}, true, false, 0)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		if err := mgr.RunBackup(context.Background(), "db", target); err != nil {
+			t.Fatalf("Expected no error but got: %v", err)
+		}
+		if _, statErr := os.Stat(marker); !os.IsNotExist(statErr) {
+			t.Errorf("Expected no post-failure hook after a successful run, got %v", statErr)
 		}
 	})
 
@@ -1036,7 +3370,7 @@ func TestRunBackup(t *testing.T) {
 		mockFS.SetStatError("/snapshots", os.ErrNotExist)
 
 		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
-		err := mgr.RunBackup("home", target)
+		err := mgr.RunBackup(context.Background(), "home", target)
 
 		if err == nil {
 			t.Error("Expected error but got none")
@@ -1047,6 +3381,166 @@ func TestRunBackup(t *testing.T) {
 	})
 }
 
+func TestPostSnapshotHooksRunWhenInterrupted(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos"}
+
+	for _, run := range []string{"backup", "snapshot"} {
+		t.Run(run, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			marker := filepath.Join(t.TempDir(), "restarted")
+			target := &config.TargetConfig{
+				Subvolume:    "/mnt/btrfs/db",
+				Prefix:       "db",
+				Repository:   "b2-db",
+				PostSnapshot: []string{"touch " + marker},
+				HookTimeout:  time.Minute,
+			}
+
+			mockFS := NewMockFileSystem()
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockFS.AddDir("/snapshots", []MockDirEntry{})
+			mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/db", 0)
+			mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+			mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+				mockFS.AddFile(path, []byte{})
+				cancel()
+			}
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, NewMockResticClient(t))
+			var err error
+			if run == "backup" {
+				err = mgr.RunBackup(ctx, "db", target)
+			} else {
+				_, err = mgr.TakeSnapshot(ctx, "db", target, false)
+			}
+			if run == "backup" && err == nil {
+				t.Error("Expected the interrupted backup to fail")
+			}
+			if _, statErr := os.Stat(marker); statErr != nil {
+				t.Errorf("Expected post-snapshot hook to run after the interrupt: %v", statErr)
+			}
+		})
+	}
+}
+
+func TestRunBackupInterrupted(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos"}
+
+	tests := []struct {
+		name                      string
+		deleteInterruptedSnapshot bool
+		interrupt                 bool
+		expectDeleted             bool
+	}{
+		{name: "snapshot_deleted", deleteInterruptedSnapshot: true, interrupt: true, expectDeleted: true},
+		{name: "snapshot_kept_by_default", interrupt: true},
+		{name: "snapshot_kept_on_failure", deleteInterruptedSnapshot: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			mockFS := NewMockFileSystem()
+			mockBtrfs := NewMockBtrfsClient(t)
+			mockRestic := NewMockResticClient(t)
+
+			target := &config.TargetConfig{
+				Subvolume:                 "/mnt/btrfs/home",
+				Prefix:                    "home",
+				Repository:                "b2-home",
+				DeleteInterruptedSnapshot: tt.deleteInterruptedSnapshot,
+			}
+
+			var snapshotPath, deleted string
+			mockFS.AddDir("/snapshots", []MockDirEntry{})
+			mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+			mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+			mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+			mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+				snapshotPath = path
+				mockFS.AddFile(path, []byte{})
+				if tt.expectDeleted {
+					mockBtrfs.ExpectDeleteSubvolume(path, 0)
+				}
+				if tt.interrupt {
+					cancel()
+				}
+			}
+			mockBtrfs.onDeleteSubvolume = func(path string) {
+				deleted = path
+				delete(mockFS.files, path)
+			}
+			mockRestic.ExpectBackup("", []string{}, true, false, 1)
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+			err := mgr.RunBackup(ctx, "home", target)
+
+			if err == nil || !strings.Contains(err.Error(), "backup operation failed") {
+				t.Errorf("Expected backup failure, got %v", err)
+			}
+			if tt.expectDeleted && deleted != snapshotPath {
+				t.Errorf("Expected snapshot %s to be deleted, deleted %q", snapshotPath, deleted)
+			}
+			if !tt.expectDeleted && deleted != "" {
+				t.Errorf("Expected snapshot to be kept, deleted %s", deleted)
+			}
+		})
+	}
+}
+
+func TestRunBackupInterruptedHooksBeforeDiscard(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hookLog := filepath.Join(t.TempDir(), "hooks.log")
+	target := &config.TargetConfig{
+		Subvolume:                 "/mnt/btrfs/home",
+		Prefix:                    "home",
+		Repository:                "b2-home",
+		DeleteInterruptedSnapshot: true,
+		PostBackup:                []string{fmt.Sprintf(`echo "post_backup $SNAPSHOT_PATH" >> %s`, hookLog)},
+		PostBackupWhen:            config.HookWhenAlways,
+		PostFailure:               []string{fmt.Sprintf(`echo "post_failure $SNAPSHOT_PATH" >> %s`, hookLog)},
+		HookTimeout:               time.Minute,
+	}
+
+	mockFS := NewMockFileSystem()
+	mockBtrfs := NewMockBtrfsClient(t)
+	mockRestic := NewMockResticClient(t)
+	var snapshotPath, hooksBeforeDelete string
+	mockFS.AddDir("/snapshots", []MockDirEntry{})
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+	mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+	mockBtrfs.onCreateSnapshot = func(subvolume, path string) {
+		snapshotPath = path
+		mockFS.AddFile(path, []byte{})
+		mockBtrfs.ExpectDeleteSubvolume(path, 0)
+		cancel()
+	}
+	mockBtrfs.onDeleteSubvolume = func(path string) {
+		data, _ := os.ReadFile(hookLog)
+		hooksBeforeDelete = string(data)
+		delete(mockFS.files, path)
+	}
+	mockRestic.ExpectBackup("", []string{}, true, false, 1)
+
+	mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+	if err := mgr.RunBackup(ctx, "home", target); err == nil {
+		t.Fatal("Expected the interrupted backup to fail")
+	}
+
+	expected := fmt.Sprintf("post_backup %[1]s\npost_failure %[1]s\n", snapshotPath)
+	if hooksBeforeDelete != expected {
+		t.Errorf("Expected the hooks to run before the snapshot is deleted, hook log at deletion:\n%s", hooksBeforeDelete)
+	}
+}
+
 func TestLoadRepositoryEnv(t *testing.T) {
 	// Create temporary directory and config file
 	tmpDir, err := os.MkdirTemp("", "btrfs-backup-test")
@@ -1108,7 +3602,27 @@ B2_ACCOUNT_KEY: key123
 	}
 }
 
-func TestGetSnapshotsByPrefix(t *testing.T) {
+func TestRepositoryVariablesPasswordCommand(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/home\npassword_command: 'bw get password \"restic home\"'\n"))
+	fs.AddFile("/repos/conflict", []byte("RESTIC_PASSWORD: secret\npassword_command: pass show restic\n"))
+	mgr := NewManagerWithDeps(&config.Config{ResticRepoDir: "/repos"}, false, fs, NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	vars, err := mgr.RepositoryVariables("b2-home")
+	if err != nil {
+		t.Fatalf("RepositoryVariables failed: %v", err)
+	}
+	expected := []string{"RESTIC_REPOSITORY=b2:bucket/home", `RESTIC_PASSWORD_COMMAND=bw get password "restic home"`}
+	if !slices.Equal(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+
+	if _, err := mgr.RepositoryVariables("conflict"); err == nil || !strings.Contains(err.Error(), "both RESTIC_PASSWORD and password_command") {
+		t.Errorf("Expected error for password and password_command, got %v", err)
+	}
+}
+
+func TestGetSnapshotNames(t *testing.T) {
 	// Create temporary directory
 	tmpDir, err := os.MkdirTemp("", "btrfs-backup-test")
 	if err != nil {
@@ -1127,6 +3641,8 @@ func TestGetSnapshotsByPrefix(t *testing.T) {
 		"test-backup-20230102-120000",
 		"other-backup-20230101-120000",
 		"test-backup-20230103-120000",
+		"test-backup-daily-20230101-120000",
+		"test-backup-manual",
 	}
 
 	for i, snapshot := range snapshots {
@@ -1145,16 +3661,17 @@ func TestGetSnapshotsByPrefix(t *testing.T) {
 	}
 
 	// Test getting snapshots by prefix
-	result, err := mgr.getSnapshotsByPrefix("test-backup")
+	result, err := mgr.getSnapshotNames(&config.TargetConfig{Prefix: "test-backup"})
 	if err != nil {
-		t.Fatalf("getSnapshotsByPrefix failed: %v", err)
+		t.Fatalf("getSnapshotNames failed: %v", err)
 	}
 
-	// Should return 3 snapshots matching "test-backup" prefix, sorted by newest first
+	// Should return 3 snapshots matching "test-backup" prefix, sorted by the timestamp
+	// in their names, newest first, regardless of their modification times
 	expected := []string{
-		"test-backup-20230101-120000", // newest (i=0, least subtracted time)
+		"test-backup-20230103-120000",
 		"test-backup-20230102-120000",
-		"test-backup-20230103-120000", // oldest (i=3, most subtracted time)
+		"test-backup-20230101-120000",
 	}
 
 	if len(result) != len(expected) {
@@ -1170,11 +3687,152 @@ func TestGetSnapshotsByPrefix(t *testing.T) {
 	// Test with nonexistent snapshot dir
 	cfg.SnapshotDir = "/nonexistent"
 	mgr = NewManager(cfg, false)
-	result, err = mgr.getSnapshotsByPrefix("test-backup")
+	result, err = mgr.getSnapshotNames(&config.TargetConfig{Prefix: "test-backup"})
 	if err != nil {
-		t.Fatalf("getSnapshotsByPrefix should not fail for nonexistent dir: %v", err)
+		t.Fatalf("getSnapshotNames should not fail for nonexistent dir: %v", err)
 	}
 	if len(result) != 0 {
 		t.Errorf("Expected empty result for nonexistent dir, got %d snapshots", len(result))
 	}
 }
+
+func TestListSnapshots(t *testing.T) {
+	cfg := &config.Config{
+		SnapshotDir: "/snapshots",
+	}
+
+	baseTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	mockFS := NewMockFileSystem()
+	mockBtrfs := NewMockBtrfsClient(t)
+	mockRestic := NewMockResticClient(t)
+
+	mockFS.AddDir("/snapshots", []MockDirEntry{
+		{name: "home-20230101-120000", isDir: true, modTime: baseTime.Add(-1 * time.Hour)},
+		{name: "home-20230102-120000", isDir: true, modTime: baseTime},
+		{name: "other-20230101-120000", isDir: true, modTime: baseTime},
+	})
+	mockFS.AddDir("/snapshots/home-20230101-120000", []MockDirEntry{})
+	mockFS.AddDir("/snapshots/home-20230102-120000", []MockDirEntry{})
+	mockFS.AddFile("/snapshots/home-20230102-120000/a.txt", []byte("hello"))
+	mockFS.AddFile("/snapshots/home-20230102-120000/dir/b.txt", []byte("world!"))
+	mockFS.AddFile("/snapshots/other-20230101-120000/c.txt", []byte("ignored"))
+
+	mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+	snapshots, err := mgr.ListSnapshots(&config.TargetConfig{Prefix: "home"})
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+
+	expected := []SnapshotInfo{
+		{Name: "home-20230102-120000", Path: "/snapshots/home-20230102-120000", Created: baseTime.Add(24 * time.Hour), Size: 11},
+		{Name: "home-20230101-120000", Path: "/snapshots/home-20230101-120000", Created: baseTime, Size: 0},
+	}
+
+	if len(snapshots) != len(expected) {
+		t.Fatalf("Expected %d snapshots, got %d", len(expected), len(snapshots))
+	}
+	for i, want := range expected {
+		got := snapshots[i]
+		if got.Name != want.Name || got.Path != want.Path || !got.Created.Equal(want.Created) || got.Size != want.Size {
+			t.Errorf("Snapshot %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+
+	// Missing snapshot directory yields an empty, non-nil list
+	mockFS.SetStatError("/snapshots", os.ErrNotExist)
+	snapshots, err = mgr.ListSnapshots(&config.TargetConfig{Prefix: "home"})
+	if err != nil {
+		t.Fatalf("ListSnapshots should not fail for missing dir: %v", err)
+	}
+	if snapshots == nil || len(snapshots) != 0 {
+		t.Errorf("Expected empty snapshot list, got %v", snapshots)
+	}
+}
+
+func TestListRepositorySnapshots(t *testing.T) {
+	cfg := &config.Config{
+		SnapshotDir:   "/snapshots",
+		ResticRepoDir: "/repos",
+	}
+
+	target := &config.TargetConfig{
+		Prefix:     "home",
+		Repository: "b2-home",
+		NoLock:     true,
+	}
+
+	baseTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("matches_local_snapshots", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockFS.AddDir("/snapshots", []MockDirEntry{
+			{name: "home-20230102-120000", isDir: true, modTime: baseTime},
+		})
+		mockRestic.ExpectSnapshots([]string{"btrfs-backup", "home"}, []restic.Snapshot{
+			{ID: "bbbb", Time: baseTime.Add(24 * time.Hour), Tags: []string{"btrfs-backup", "home", "home-20230102-120000"}},
+			{ID: "aaaa", Time: baseTime, Tags: []string{"btrfs-backup", "home", "home-20230101-120000"}},
+			{ID: "cccc", Time: baseTime.Add(48 * time.Hour), Tags: []string{"btrfs-backup", "home"}},
+		}, 0)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		snapshots, err := mgr.ListRepositorySnapshots(context.Background(), target)
+		if err != nil {
+			t.Fatalf("ListRepositorySnapshots failed: %v", err)
+		}
+		if !mockRestic.lastNoLock {
+			t.Error("Expected snapshots to be listed without locking the repository")
+		}
+
+		expected := []struct {
+			id          string
+			local       string
+			localExists bool
+		}{
+			{"aaaa", "home-20230101-120000", false},
+			{"bbbb", "home-20230102-120000", true},
+			{"cccc", "", false},
+		}
+
+		if len(snapshots) != len(expected) {
+			t.Fatalf("Expected %d snapshots, got %d", len(expected), len(snapshots))
+		}
+		for i, want := range expected {
+			got := snapshots[i]
+			if got.ID != want.id || got.LocalSnapshot != want.local || got.LocalExists != want.localExists {
+				t.Errorf("Snapshot %d: expected %+v, got %+v", i, want, got)
+			}
+		}
+	})
+
+	t.Run("restic_failure", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+		mockRestic.ExpectSnapshots([]string{"btrfs-backup", "home"}, nil, 1)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		_, err := mgr.ListRepositorySnapshots(context.Background(), target)
+		if err == nil || !strings.Contains(err.Error(), "restic snapshots command failed") {
+			t.Errorf("Expected restic snapshots failure, got %v", err)
+		}
+	})
+
+	t.Run("repository_config_missing", func(t *testing.T) {
+		mockFS := NewMockFileSystem()
+		mockBtrfs := NewMockBtrfsClient(t)
+		mockRestic := NewMockResticClient(t)
+
+		mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+		_, err := mgr.ListRepositorySnapshots(context.Background(), target)
+		if err == nil || !strings.Contains(err.Error(), "repository configuration failed") {
+			t.Errorf("Expected repository configuration failure, got %v", err)
+		}
+	})
+}
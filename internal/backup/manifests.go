@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/restic"
+)
+
+// uploadManifest uploads the manifest written by capture for a snapshot of the target
+// with 'restic backup --stdin' as filename, in a restic snapshot tagged with tag, the
+// target's prefix and the snapshot name. kind names the manifest in errors.
+// In dry-run mode only the restic command is printed.
+func (bm *Manager) uploadManifest(ctx context.Context, target *config.TargetConfig, snapshotName, tag, filename, kind string, capture func(w io.Writer) error) error {
+	env, err := bm.loadRepositoryEnv(target.Repository)
+	if err != nil {
+		return fmt.Errorf("repository configuration failed: %w", err)
+	}
+	env = withExtraArgs(env, target.ResticExtraArgs)
+
+	options := restic.BackupOptions{
+		Tags:  []string{tag, target.Prefix, snapshotName},
+		Limit: restic.BandwidthLimit{Upload: target.UploadLimit, Download: target.DownloadLimit},
+	}
+	if bm.dryRun {
+		_, err = bm.resticFor(target.Repository, target.Prefix).BackupStdin(ctx, env, strings.NewReader(""), filename, options)
+		return err
+	}
+
+	unlock, err := bm.lockUpload(ctx, target.Repository)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	reader, writer := io.Pipe()
+	captured := make(chan error, 1)
+	go func() {
+		err := capture(writer)
+		_ = writer.CloseWithError(err)
+		captured <- err
+	}()
+
+	_, err = bm.resticFor(target.Repository, target.Prefix).BackupStdin(ctx, env, reader, filename, options)
+	// Unblock the capture if restic stopped reading early
+	_ = reader.CloseWithError(io.ErrClosedPipe)
+
+	captureErr := <-captured
+	switch {
+	case captureErr != nil:
+		return errors.Join(err, captureErr)
+	case err != nil:
+		return fmt.Errorf("restic backup of the %s failed: %w", kind, err)
+	}
+	return nil
+}
+
+// readManifest selects the manifest uploaded by uploadManifest with tag for a snapshot of
+// the target, by local snapshot name, or the newest one if snapshot is empty, and passes
+// it to apply while it is read with 'restic dump', using the read-only credentials of the
+// repository if configured. file returns the file name of the manifest of a snapshot and
+// kind names the manifest in errors. Returns the name of the snapshot of the manifest.
+func (bm *Manager) readManifest(ctx context.Context, target *config.TargetConfig, snapshot, tag, kind string, file func(snapshotName string) string, apply func(r io.Reader) error) (string, error) {
+	env, err := bm.loadReadOnlyRepositoryEnv(target.Repository)
+	if err != nil {
+		return "", fmt.Errorf("repository configuration failed: %w", err)
+	}
+
+	manifests, err := bm.resticFor(target.Repository, target.Prefix).Snapshots(ctx, env, []string{tag, target.Prefix}, target.NoLock)
+	if err != nil {
+		return "", fmt.Errorf("restic snapshots command failed: %w", err)
+	}
+	naming, err := target.SnapshotNaming()
+	if err != nil {
+		return "", fmt.Errorf("invalid snapshot name template: %w", err)
+	}
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return manifests[i].Time.After(manifests[j].Time)
+	})
+
+	var selected *restic.Snapshot
+	var snapshotName string
+	for i := range manifests {
+		name := localSnapshotTag(manifests[i].Tags, naming)
+		if name != "" && (snapshot == "" || name == snapshot) {
+			selected, snapshotName = &manifests[i], name
+			break
+		}
+	}
+	if selected == nil {
+		if snapshot == "" {
+			return "", fmt.Errorf("repository has no %ss of %s", kind, target.Prefix)
+		}
+		return "", fmt.Errorf("%s of snapshot %s not found", kind, snapshot)
+	}
+
+	slog.Info("Reading manifest", "kind", kind, "snapshot", snapshotName, "manifest", selected.ShortID)
+	reader, writer := io.Pipe()
+	dumped := make(chan error, 1)
+	go func() {
+		err := bm.resticFor(target.Repository, target.Prefix).Dump(ctx, env, selected.ID, "/"+file(snapshotName), writer)
+		_ = writer.CloseWithError(err)
+		dumped <- err
+	}()
+
+	err = apply(reader)
+	_ = reader.CloseWithError(io.ErrClosedPipe)
+
+	if dumpErr := <-dumped; dumpErr != nil {
+		return "", errors.Join(fmt.Errorf("restic dump of the %s failed: %w", kind, dumpErr), err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return snapshotName, nil
+}
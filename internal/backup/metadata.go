@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+
+	"btrfs-backup/internal/config"
+)
+
+// metadataTag replaces the "btrfs-backup" tag on the restic snapshots holding metadata
+// manifests, so they are listed, forgotten and verified apart from the backups.
+const metadataTag = "btrfs-backup-metadata"
+
+// metadataFile returns the name of the metadata manifest of a local snapshot in the
+// repository.
+func metadataFile(snapshotName string) string {
+	return snapshotName + ".metadata"
+}
+
+// BackupMetadata uploads the metadata manifest of a snapshot, see metadata.Tools.Capture,
+// with 'restic backup --stdin' as a file named after the snapshot, in a restic snapshot
+// tagged with metadataTag, the target's prefix and the snapshot name.
+// In dry-run mode only the restic command is printed.
+func (bm *Manager) BackupMetadata(ctx context.Context, snapshotPath string, target *config.TargetConfig) error {
+	snapshotName := filepath.Base(snapshotPath)
+	return bm.uploadManifest(ctx, target, snapshotName, metadataTag, metadataFile(snapshotName), "metadata manifest", func(w io.Writer) error {
+		if err := bm.metadata.Capture(ctx, snapshotPath, w); err != nil {
+			return fmt.Errorf("metadata capture failed: %w", err)
+		}
+		return nil
+	})
+}
+
+// RestoreMetadata applies the metadata manifest uploaded by BackupMetadata for a snapshot
+// of the target to the tree restored at dir, see metadata.Tools.Apply. The manifest is
+// selected by local snapshot name, or the newest one if snapshot is empty, and read with
+// 'restic dump' using the read-only credentials of the repository if configured.
+// Returns the name of the snapshot whose manifest was applied.
+func (bm *Manager) RestoreMetadata(ctx context.Context, target *config.TargetConfig, snapshot, dir string) (string, error) {
+	return bm.readManifest(ctx, target, snapshot, metadataTag, "metadata manifest", metadataFile, func(r io.Reader) error {
+		slog.Info("Applying metadata manifest", "target", target.Prefix, "path", dir)
+		return bm.metadata.Apply(ctx, dir, r)
+	})
+}
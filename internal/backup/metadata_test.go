@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/metadata"
+	"btrfs-backup/internal/restic"
+)
+
+// fakeMetadataTools writes stand-ins for the acl and attr tools to dir. The get tools
+// print a line naming themselves, the set tools save their input next to them.
+func fakeMetadataTools(t *testing.T, dir string) metadata.Tools {
+	tools := metadata.Tools{}
+	for name, bin := range map[string]*string{"getfacl": &tools.Getfacl, "getfattr": &tools.Getfattr, "setfacl": &tools.Setfacl, "setfattr": &tools.Setfattr} {
+		script := "#!/bin/sh\necho '# file: ." + name + "'\n"
+		if strings.HasPrefix(name, "set") {
+			script = "#!/bin/sh\ncat > \"$0.in\"\n"
+		}
+		*bin = filepath.Join(dir, name)
+		if err := os.WriteFile(*bin, []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tools
+}
+
+func TestBackupMetadata(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "home-20230102-120000")
+	if err := os.Mkdir(snapshotPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockRestic := NewMockResticClient(t)
+	mgr := NewManagerWithDeps(&config.Config{ResticRepoDir: "/repos"}, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+	mgr.metadata = fakeMetadataTools(t, t.TempDir())
+	target := &config.TargetConfig{Prefix: "home", Repository: "b2-home", Metadata: true}
+
+	mockRestic.ExpectBackupSummary(&restic.Summary{})
+	if err := mgr.BackupMetadata(context.Background(), snapshotPath, target); err != nil {
+		t.Fatalf("BackupMetadata failed: %v", err)
+	}
+	if mockRestic.lastFilename != "home-20230102-120000.metadata" ||
+		!slices.Equal(mockRestic.lastBackup.Tags, []string{metadataTag, "home", "home-20230102-120000"}) {
+		t.Errorf("Unexpected manifest upload %s with tags %v", mockRestic.lastFilename, mockRestic.lastBackup.Tags)
+	}
+	expected := "# btrfs-backup: acl\n# file: .getfacl\n# btrfs-backup: xattr\n# file: .getfattr\n"
+	if mockRestic.lastStdin != expected {
+		t.Errorf("Expected manifest:\n%s\ngot:\n%s", expected, mockRestic.lastStdin)
+	}
+
+	mgr.metadata.Getfacl = "/nonexistent/getfacl"
+	mockRestic.ExpectBackupSummary(&restic.Summary{})
+	if err := mgr.BackupMetadata(context.Background(), snapshotPath, target); err == nil || !strings.Contains(err.Error(), "metadata capture failed") {
+		t.Errorf("Expected capture error, got %v", err)
+	}
+}
+
+func TestRestoreMetadata(t *testing.T) {
+	binDir, dir := t.TempDir(), t.TempDir()
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockRestic := NewMockResticClient(t)
+	mockRestic.dumpOutput = "# btrfs-backup: acl\n# file: .\nuser::rwx\n# btrfs-backup: xattr\n"
+	mgr := NewManagerWithDeps(&config.Config{ResticRepoDir: "/repos"}, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+	mgr.metadata = fakeMetadataTools(t, binDir)
+	target := &config.TargetConfig{Prefix: "home", Repository: "b2-home", Metadata: true}
+	manifests := []restic.Snapshot{
+		{ID: "aaa111", ShortID: "aaa111", Time: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC), Tags: []string{metadataTag, "home", "home-20230101-120000"}},
+		{ID: "bbb222", ShortID: "bbb222", Time: time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC), Tags: []string{metadataTag, "home", "home-20230102-120000"}},
+	}
+
+	// The newest manifest by default
+	mockRestic.ExpectSnapshots([]string{metadataTag, "home"}, manifests, 0)
+	mockRestic.ExpectDump("bbb222", "/home-20230102-120000.metadata", 0)
+	applied, err := mgr.RestoreMetadata(context.Background(), target, "", dir)
+	if err != nil || applied != "home-20230102-120000" {
+		t.Fatalf("Expected the newest manifest applied, got %s (%v)", applied, err)
+	}
+	data, err := os.ReadFile(filepath.Join(binDir, "setfacl.in"))
+	if err != nil || string(data) != "# file: .\nuser::rwx\n" {
+		t.Errorf("Expected ACLs passed to setfacl, got %q (%v)", data, err)
+	}
+
+	mockRestic.ExpectSnapshots([]string{metadataTag, "home"}, manifests, 0)
+	mockRestic.ExpectDump("aaa111", "/home-20230101-120000.metadata", 0)
+	if applied, err = mgr.RestoreMetadata(context.Background(), target, "home-20230101-120000", dir); err != nil || applied != "home-20230101-120000" {
+		t.Errorf("Expected the selected manifest applied, got %s (%v)", applied, err)
+	}
+
+	mockRestic.ExpectSnapshots([]string{metadataTag, "home"}, manifests, 0)
+	if _, err = mgr.RestoreMetadata(context.Background(), target, "home-20230103-120000", dir); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected missing manifest error, got %v", err)
+	}
+
+	mockRestic.ExpectSnapshots([]string{metadataTag, "home"}, manifests, 0)
+	mockRestic.ExpectDump("bbb222", "/home-20230102-120000.metadata", 1)
+	if _, err = mgr.RestoreMetadata(context.Background(), target, "", dir); err == nil || !strings.Contains(err.Error(), "restic dump of the metadata manifest failed") {
+		t.Errorf("Expected dump error, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"log/slog"
+	"time"
+
+	"btrfs-backup/progress"
+)
+
+// eventBuffer is the capacity of the Events channel.
+const eventBuffer = 256
+
+// Events returns a channel receiving the progress of the backup runs of the manager: the
+// start and end of each run, the workflow steps it enters, the progress of the restic
+// upload and the warnings it logs, so a frontend can follow runs without reading logs,
+// e.g. the backup command reporting the steps to systemd. Host applications receive it
+// through package btrfsbackup. Events are sent without ever blocking a backup, so they
+// are dropped while the buffer of the channel is full. The channel is never closed,
+// RunBackup returns after sending its EventRunFinished, and runs are cancelled with the
+// context passed to RunBackup.
+func (bm *Manager) Events() <-chan progress.Event {
+	ch := make(chan progress.Event, eventBuffer)
+	if bm.progress.CompareAndSwap(nil, &ch) {
+		return ch
+	}
+	return *bm.progress.Load()
+}
+
+// notify sends e to the Events channel, if any, unless its buffer is full.
+func (bm *Manager) notify(e progress.Event) {
+	ch := bm.progress.Load()
+	if ch == nil {
+		return
+	}
+	e.Time = time.Now()
+	select {
+	case *ch <- e:
+	default:
+	}
+}
+
+// warn logs a warning of the run of targetName with logger and sends it to the Events
+// channel.
+func (bm *Manager) warn(logger *slog.Logger, targetName, msg string, err error, args ...any) {
+	logger.Warn(msg, append([]any{"error", err}, args...)...)
+	bm.notify(progress.Event{Kind: progress.EventWarning, Target: targetName, Message: msg, Err: err})
+}
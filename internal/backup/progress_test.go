@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/progress"
+)
+
+func TestEvents(t *testing.T) {
+	cfg := &config.Config{
+		SnapshotDir:   "/snapshots",
+		ResticRepoDir: "/repos",
+		ResticBin:     "/usr/bin/restic",
+	}
+	target := &config.TargetConfig{
+		Subvolume:     "/mnt/btrfs/home",
+		Prefix:        "home-backup",
+		Repository:    "b2-home",
+		Type:          "incremental",
+		KeepSnapshots: 3,
+	}
+
+	mockFS := NewMockFileSystem()
+	mockBtrfs := NewMockBtrfsClient(t)
+	mockRestic := NewMockResticClient(t)
+	mockFS.AddDir("/snapshots", []MockDirEntry{})
+	mockBtrfs.ExpectShowSubvolume("/mnt/btrfs/home", 0)
+	mockBtrfs.ExpectCreateSnapshot("", "", true, 0)
+	mockBtrfs.onCreateSnapshot = func(subvolume, snapshotPath string) {
+		mockFS.AddFile(snapshotPath, []byte{})
+	}
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockRestic.ExpectBackup("", []string{}, true, false, 0)
+
+	mgr := NewManagerWithDeps(cfg, false, mockFS, mockBtrfs, mockRestic)
+	ch := mgr.Events()
+	if mgr.Events() != ch {
+		t.Error("Expected Events to return the same channel on every call")
+	}
+	if err := mgr.RunBackup(context.Background(), "home", target); err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+
+	var kinds []progress.EventKind
+	var steps []string
+	for len(ch) > 0 {
+		e := <-ch
+		if e.Target != "home" || e.Time.IsZero() {
+			t.Errorf("Expected event of target home with a time, got %+v", e)
+		}
+		kinds = append(kinds, e.Kind)
+		if e.Kind == progress.EventStepStarted {
+			steps = append(steps, e.Step)
+		}
+		if e.Kind == progress.EventRunFinished && e.Err != nil {
+			t.Errorf("Expected successful run, got %v", e.Err)
+		}
+	}
+	if kinds[0] != progress.EventRunStarted || kinds[len(kinds)-1] != progress.EventRunFinished {
+		t.Errorf("Expected events between run_started and run_finished, got %v", kinds)
+	}
+	expected := []string{"validate", HookPreSnapshot, "snapshot", "empty_guard", HookPreBackup,
+		"backup", "success_criteria", HookPostBackup, "cleanup"}
+	if !slices.Equal(steps, expected) {
+		t.Errorf("Expected steps %v, got %v", expected, steps)
+	}
+}
+
+func TestEventsDroppedWhenFull(t *testing.T) {
+	mgr := NewManagerWithDeps(&config.Config{}, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+	mgr.notify(progress.Event{Kind: progress.EventWarning}) // no channel yet
+	ch := mgr.Events()
+	for range eventBuffer + 10 {
+		mgr.notify(progress.Event{Kind: progress.EventWarning, Message: "full"})
+	}
+	if len(ch) != eventBuffer {
+		t.Errorf("Expected %d buffered events, got %d", eventBuffer, len(ch))
+	}
+}
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"btrfs-backup/internal/events"
+	"btrfs-backup/internal/state"
+)
+
+// ErrRepositoryBusy is returned by PruneRepository while a backup uploads to the repository
+// or another prune runs.
+var ErrRepositoryBusy = errors.New("repository busy")
+
+// lockRetryInterval is the time between attempts of a backup to take the lock of a
+// repository while it is being pruned.
+const lockRetryInterval = 10 * time.Second
+
+// repositoryLocked reports whether the backups and prunes of repository coordinate through
+// the lock in state_dir, which is the case if its prunes are scheduled by prune_every.
+func (bm *Manager) repositoryLocked(repository string) bool {
+	return bm.config.Repository(repository).PruneEvery != "" && bm.config.StateDir != "" && !bm.dryRun
+}
+
+// lockUpload takes the shared lock of repository for an upload, waiting while a scheduled
+// prune holds it, and returns a function releasing it. Repositories without prune_every
+// are not locked.
+func (bm *Manager) lockUpload(ctx context.Context, repository string) (unlock func(), err error) {
+	if !bm.repositoryLocked(repository) {
+		return func() {}, nil
+	}
+	for waiting := false; ; waiting = true {
+		unlock, err = state.LockRepository(bm.config.StateDir, repository, false)
+		if !errors.Is(err, state.ErrLocked) {
+			return unlock, err
+		}
+		if !waiting {
+			slog.Info("Waiting for the prune of the repository to finish", "repository", repository)
+		}
+		if err := bm.sleep(ctx, lockRetryInterval); err != nil {
+			return nil, fmt.Errorf("waiting for the prune of repository %s: %w", repository, err)
+		}
+	}
+}
+
+// PruneDue reports whether the scheduled prune of repository is due: once its prune_every
+// interval passed since the last prune recorded by PruneRepository in the repository's
+// state file. Repositories without prune_every are pruned by 'restic forget --prune'
+// instead and never due. Without a state_dir, or if the state can't be read, the prune is
+// always due.
+func (bm *Manager) PruneDue(repository string) bool {
+	settings := bm.config.Repository(repository)
+	if settings.PruneEvery == "" {
+		return false
+	}
+	if bm.config.StateDir == "" {
+		return true
+	}
+
+	st, err := state.LoadRepository(bm.config.StateDir, repository)
+	if err != nil {
+		slog.Warn("Failed to read repository state, pruning repository", "repository", repository, "error", err)
+		return true
+	}
+	if !intervalPassed(settings.PruneEvery, st.LastPrune) {
+		slog.Info("Repository prune not due yet", "repository", repository, "last_prune", formatLast(st.LastPrune),
+			"prune_every", settings.PruneEvery)
+		return false
+	}
+	slog.Info("Repository prune due", "repository", repository, "last_prune", formatLast(st.LastPrune),
+		"prune_every", settings.PruneEvery)
+	return true
+}
+
+// PruneRepository runs 'restic prune' on repository, keeping the unused space its
+// max_unused allows, and records the
+// time of the prune in the repository's state file. With prune_every, it holds the
+// exclusive lock of the repository in state_dir and returns an error wrapping
+// ErrRepositoryBusy without pruning while a backup uploads to it. Nothing is locked or
+// recorded in dry-run mode or if no state_dir is configured. The prune covers the
+// snapshots of every target backed up to repository, so only the restic_extra_args of
+// the repository configuration are passed, not those of a target, which are meant for
+// its backup, check and forget commands.
+func (bm *Manager) PruneRepository(ctx context.Context, repository string) error {
+	env, err := bm.loadRepositoryEnv(repository)
+	if err != nil {
+		return fmt.Errorf("repository configuration failed for prune: %w", err)
+	}
+
+	if bm.repositoryLocked(repository) {
+		unlock, err := state.LockRepository(bm.config.StateDir, repository, true)
+		if errors.Is(err, state.ErrLocked) {
+			return fmt.Errorf("%w: %s", ErrRepositoryBusy, repository)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock repository %s: %w", repository, err)
+		}
+		defer unlock()
+	}
+
+	err = bm.resticFor(repository, "").Prune(ctx, env, bm.config.Repository(repository).MaxUnused)
+	bm.emit(events.Event{Type: events.ResticPruned, Repository: repository}, err)
+	if err != nil {
+		return fmt.Errorf("restic prune command failed: %w", err)
+	}
+
+	if bm.config.StateDir == "" || bm.dryRun {
+		return nil
+	}
+	if err := state.UpdateRepository(bm.config.StateDir, repository, func(st *state.Repository) {
+		st.LastPrune = time.Now()
+	}); err != nil {
+		return fmt.Errorf("failed to record prune in repository state: %w", err)
+	}
+	return nil
+}
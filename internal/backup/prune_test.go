@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/restic"
+	"btrfs-backup/internal/state"
+)
+
+func TestForgetSnapshotsScheduledPrune(t *testing.T) {
+	cfg := &config.Config{
+		ResticRepoDir: "/repos",
+		StateDir:      t.TempDir(),
+		Repositories:  map[string]config.RepositoryConfig{"b2-home": {PruneEvery: "7d", MaxUnused: "5%"}},
+	}
+	target := &config.TargetConfig{
+		Prefix:     "home",
+		Repository: "b2-home",
+		ResticKeep: config.ResticKeepConfig{KeepDaily: 7},
+		// Backup flags that restic prune rejects
+		ResticExtraArgs: []string{"--exclude-caches"},
+	}
+	policy := restic.ForgetPolicy{KeepDaily: 7}
+	tags := []string{"btrfs-backup", "home"}
+
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockRestic := NewMockResticClient(t)
+	mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+
+	// Never pruned: forget without --prune, then the scheduled prune
+	mockRestic.ExpectForget(tags, policy, false, 0)
+	mockRestic.ExpectPrune("5%", 0)
+	if err := mgr.ForgetSnapshots(context.Background(), target); err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+	if mockRestic.index != 2 {
+		t.Fatalf("Expected forget and prune, ran %d commands", mockRestic.index)
+	}
+	if args := restic.ExtraArgs(mockRestic.lastEnv); len(args) != 0 {
+		t.Errorf("Expected the prune without the target's extra args, got %v", args)
+	}
+	st, err := state.LoadRepository(cfg.StateDir, "b2-home")
+	if err != nil || time.Since(st.LastPrune) > time.Minute {
+		t.Fatalf("Expected the prune recorded in the repository state, got %+v (%v)", st, err)
+	}
+
+	// Pruned just now: forget only
+	mockRestic.ExpectForget(tags, policy, false, 0)
+	if err := mgr.ForgetSnapshots(context.Background(), target); err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+	if mockRestic.index != 3 {
+		t.Fatalf("Expected forget only, ran %d commands", mockRestic.index-2)
+	}
+
+	// Due again while another target uploads: the prune is postponed
+	if err := state.UpdateRepository(cfg.StateDir, "b2-home", func(st *state.Repository) {
+		st.LastPrune = time.Now().Add(-8 * 24 * time.Hour)
+	}); err != nil {
+		t.Fatalf("UpdateRepository failed: %v", err)
+	}
+	unlock, err := mgr.lockUpload(context.Background(), "b2-home")
+	if err != nil {
+		t.Fatalf("lockUpload failed: %v", err)
+	}
+	mockRestic.ExpectForget(tags, policy, false, 0)
+	if err := mgr.ForgetSnapshots(context.Background(), target); err != nil {
+		t.Fatalf("Expected the busy repository to be skipped, got: %v", err)
+	}
+	unlock()
+	if mockRestic.index != 4 {
+		t.Fatalf("Expected forget only while the repository is in use, ran %d commands", mockRestic.index-3)
+	}
+	if !mgr.PruneDue("b2-home") {
+		t.Error("Expected the postponed prune to stay due")
+	}
+
+	// Prune failure
+	mockRestic.ExpectForget(tags, policy, false, 0)
+	mockRestic.ExpectPrune("5%", 1)
+	if err := mgr.ForgetSnapshots(context.Background(), target); err == nil {
+		t.Error("Expected error for a failed prune")
+	}
+	if !mgr.PruneDue("b2-home") {
+		t.Error("Expected a failed prune to stay due")
+	}
+}
+
+func TestLockUploadWaitsForPrune(t *testing.T) {
+	cfg := &config.Config{
+		StateDir:     t.TempDir(),
+		Repositories: map[string]config.RepositoryConfig{"b2-home": {PruneEvery: "7d"}},
+	}
+	mgr := NewManagerWithDeps(cfg, false, NewMockFileSystem(), NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	unlockPrune, err := state.LockRepository(cfg.StateDir, "b2-home", true)
+	if err != nil {
+		t.Fatalf("LockRepository failed: %v", err)
+	}
+	waits := 0
+	mgr.sleep = func(ctx context.Context, d time.Duration) error {
+		if waits++; waits == 2 {
+			unlockPrune()
+		}
+		return nil
+	}
+	unlock, err := mgr.lockUpload(context.Background(), "b2-home")
+	if err != nil {
+		t.Fatalf("Expected the upload to wait for the prune, got: %v", err)
+	}
+	unlock()
+	if waits != 2 {
+		t.Errorf("Expected 2 waits for the prune, got %d", waits)
+	}
+
+	// A cancelled run stops waiting
+	unlockPrune, err = state.LockRepository(cfg.StateDir, "b2-home", true)
+	if err != nil {
+		t.Fatalf("LockRepository failed: %v", err)
+	}
+	defer unlockPrune()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mgr.sleep = sleepContext
+	if _, err := mgr.lockUpload(ctx, "b2-home"); err == nil {
+		t.Error("Expected error when the run is cancelled while waiting")
+	}
+
+	// Repositories without prune_every are not locked
+	unlock, err = mgr.lockUpload(ctx, "nas")
+	if err != nil {
+		t.Errorf("Expected no lock without prune_every, got: %v", err)
+	} else {
+		unlock()
+	}
+}
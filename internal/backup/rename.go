@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/state"
+)
+
+// RenamedSnapshot is a local snapshot name before and after a prefix rename.
+type RenamedSnapshot struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// PrefixRenameReport lists what RenamePrefix changed, or would change in dry-run mode.
+type PrefixRenameReport struct {
+	Local      []RenamedSnapshot `json:"local"`      // renamed local snapshots, oldest first
+	Repository []string          `json:"repository"` // IDs of the re-tagged restic snapshots
+}
+
+// RenamePrefix moves the snapshots of a target to a new prefix: the restic snapshots
+// tagged with the old prefix are re-tagged with the new prefix and the renamed local
+// snapshot names, including the parent tags of send streams, and the local snapshots are
+// renamed to the names the target's template produces with the new prefix.
+// The repository is updated first so that an interrupted rename leaves local snapshots
+// that are still found under the old prefix; running the rename again finishes it.
+// The last snapshot recorded in the state file of targetName is updated to its new name.
+// The target's prefix setting is not changed, the caller's configuration has to be
+// updated afterwards. Returns an error before changing anything if a renamed local
+// snapshot would overwrite an existing one.
+func (bm *Manager) RenamePrefix(ctx context.Context, targetName string, target *config.TargetConfig, newPrefix string) (*PrefixRenameReport, error) {
+	if newPrefix == "" || strings.ContainsRune(newPrefix, '/') {
+		return nil, fmt.Errorf("invalid prefix '%s'", newPrefix)
+	}
+	if newPrefix == target.Prefix {
+		return nil, fmt.Errorf("target already uses prefix '%s'", newPrefix)
+	}
+
+	oldNaming, err := target.SnapshotNaming()
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot name template: %w", err)
+	}
+	renamed := *target
+	renamed.Prefix = newPrefix
+	newNaming, err := renamed.SnapshotNaming()
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot name template: %w", err)
+	}
+	rename := func(name string) string {
+		created, ok := oldNaming.Parse(name)
+		if !ok {
+			return name
+		}
+		return newNaming.Name(created)
+	}
+
+	local, err := bm.findSnapshots(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local snapshots: %w", err)
+	}
+	var planned []RenamedSnapshot
+	for _, s := range slices.Backward(local) {
+		newName := rename(s.name)
+		if newName == s.name {
+			continue
+		}
+		if _, err := bm.fs.Stat(filepath.Join(bm.config.SnapshotDir, newName)); err == nil {
+			return nil, fmt.Errorf("snapshot %s already exists", newName)
+		}
+		planned = append(planned, RenamedSnapshot{Old: s.name, New: newName})
+	}
+
+	env, err := bm.loadRepositoryEnv(target.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("repository configuration failed: %w", err)
+	}
+	snapshots, err := bm.resticFor(target.Repository, target.Prefix).Snapshots(ctx, env, []string{"btrfs-backup", target.Prefix}, target.NoLock)
+	if err != nil {
+		return nil, fmt.Errorf("restic snapshots command failed: %w", err)
+	}
+
+	report := &PrefixRenameReport{}
+	for _, s := range snapshots {
+		add, remove := []string{newPrefix}, []string{target.Prefix}
+		for _, tag := range s.Tags {
+			name, isParent := strings.CutPrefix(tag, sendParentTag)
+			newName := rename(name)
+			if newName == name {
+				continue
+			}
+			if isParent {
+				add = append(add, sendParentTag+newName)
+			} else {
+				add = append(add, newName)
+			}
+			remove = append(remove, tag)
+		}
+
+		slog.Info("Re-tagging restic snapshot", "snapshot", s.ShortID, "add", add, "remove", remove)
+		err = bm.resticFor(target.Repository, target.Prefix).Tag(ctx, env, s.ID, add, remove)
+		if err != nil {
+			return report, fmt.Errorf("restic tag command failed for snapshot %s: %w", s.ShortID, err)
+		}
+		report.Repository = append(report.Repository, s.ID)
+	}
+
+	for _, r := range planned {
+		oldPath := filepath.Join(bm.config.SnapshotDir, r.Old)
+		newPath := filepath.Join(bm.config.SnapshotDir, r.New)
+		if bm.dryRun {
+			if _, err := fmt.Fprintf(bm.dryRunOut, "[dry-run] rename %s %s\n", oldPath, newPath); err != nil {
+				return report, err
+			}
+		} else {
+			slog.Info("Renaming snapshot", "from", oldPath, "to", newPath)
+			err = bm.fs.Rename(oldPath, newPath)
+			if err != nil {
+				return report, fmt.Errorf("failed to rename snapshot %s: %w", r.Old, err)
+			}
+		}
+		report.Local = append(report.Local, r)
+	}
+
+	if err := bm.renameStateSnapshot(targetName, report.Local); err != nil {
+		return report, fmt.Errorf("failed to update target state: %w", err)
+	}
+	return report, nil
+}
+
+// renameStateSnapshot updates the last snapshot recorded in the state file of targetName
+// if it is one of the renamed local snapshots. Nothing is updated in dry-run mode or if no
+// state_dir is configured.
+func (bm *Manager) renameStateSnapshot(targetName string, renamed []RenamedSnapshot) error {
+	if bm.config.StateDir == "" || bm.dryRun || len(renamed) == 0 {
+		return nil
+	}
+	return state.Update(bm.config.StateDir, targetName, func(st *state.Target) {
+		for _, r := range renamed {
+			oldPath := filepath.Join(bm.config.SnapshotDir, r.Old)
+			if rest, ok := strings.CutPrefix(st.LastSnapshot, oldPath); ok && (rest == "" || rest[0] == '/') {
+				st.LastSnapshot = filepath.Join(bm.config.SnapshotDir, r.New) + rest
+				return
+			}
+		}
+	})
+}
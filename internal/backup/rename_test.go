@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/restic"
+	"btrfs-backup/internal/state"
+)
+
+func TestRenamePrefix(t *testing.T) {
+	tests := []struct {
+		name          string
+		newPrefix     string
+		dryRun        bool
+		existing      string
+		tagExitCode   int
+		expectTags    bool
+		expectRenamed [][2]string
+		expectOutput  string
+		expectError   bool
+		errorContains string
+	}{
+		{
+			name:       "renamed",
+			newPrefix:  "user",
+			expectTags: true,
+			expectRenamed: [][2]string{
+				{"/snapshots/home-20230101-120000", "/snapshots/user-20230101-120000"},
+				{"/snapshots/home-20230102-120000", "/snapshots/user-20230102-120000"},
+			},
+		},
+		{
+			name:         "dry_run",
+			newPrefix:    "user",
+			dryRun:       true,
+			expectOutput: "[dry-run] rename /snapshots/home-20230102-120000 /snapshots/user-20230102-120000",
+		},
+		{
+			name:          "tag_failure",
+			newPrefix:     "user",
+			tagExitCode:   1,
+			expectTags:    true,
+			expectError:   true,
+			errorContains: "restic tag command failed",
+		},
+		{
+			name:          "name_taken",
+			newPrefix:     "user",
+			existing:      "user-20230102-120000",
+			expectError:   true,
+			errorContains: "snapshot user-20230102-120000 already exists",
+		},
+		{
+			name:          "same_prefix",
+			newPrefix:     "home",
+			expectError:   true,
+			errorContains: "already uses prefix",
+		},
+		{
+			name:          "invalid_prefix",
+			newPrefix:     "a/b",
+			expectError:   true,
+			errorContains: "invalid prefix",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos", StateDir: t.TempDir()}
+			if err := state.Update(cfg.StateDir, "home", func(st *state.Target) {
+				st.LastSnapshot = "/snapshots/home-20230102-120000"
+			}); err != nil {
+				t.Fatalf("state.Update failed: %v", err)
+			}
+			mockFS := NewMockFileSystem()
+			mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+			mockFS.AddDir("/snapshots", []MockDirEntry{
+				{name: "home-20230101-120000", isDir: true},
+				{name: "home-20230102-120000", isDir: true},
+				{name: "other-20230102-120000", isDir: true},
+			})
+			mockFS.AddDir("/snapshots/home-20230101-120000", nil)
+			mockFS.AddDir("/snapshots/home-20230102-120000", nil)
+			if tt.existing != "" {
+				mockFS.AddDir("/snapshots/"+tt.existing, nil)
+			}
+
+			mockRestic := NewMockResticClient(t)
+			if tt.expectTags || tt.dryRun {
+				mockRestic.ExpectSnapshots([]string{"btrfs-backup", "home"}, []restic.Snapshot{
+					{ID: "aaa111", ShortID: "aaa111", Tags: []string{"btrfs-backup", "home", "home-20230101-120000"}},
+					{ID: "bbb222", ShortID: "bbb222", Tags: []string{"btrfs-backup", "home", "home-20230102-120000", "parent:home-20230101-120000"}},
+				}, 0)
+			}
+			if tt.expectTags {
+				mockRestic.ExpectTag("aaa111", []string{"user", "user-20230101-120000"}, []string{"home", "home-20230101-120000"}, tt.tagExitCode)
+			}
+			if tt.expectTags && tt.tagExitCode == 0 {
+				mockRestic.ExpectTag("bbb222", []string{"user", "user-20230102-120000", "parent:user-20230101-120000"},
+					[]string{"home", "home-20230102-120000", "parent:home-20230101-120000"}, 0)
+			}
+
+			var out bytes.Buffer
+			mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+			if tt.dryRun {
+				mgr.SetDryRun(&out)
+			}
+			target := &config.TargetConfig{Prefix: "home", Repository: "b2-home"}
+			report, err := mgr.RenamePrefix(context.Background(), "home", target, tt.newPrefix)
+
+			if !slices.Equal(mockFS.renamed, tt.expectRenamed) {
+				t.Errorf("Expected renames %v, got %v", tt.expectRenamed, mockFS.renamed)
+			}
+			expectLast := "/snapshots/home-20230102-120000"
+			if len(tt.expectRenamed) > 0 {
+				expectLast = "/snapshots/user-20230102-120000"
+			}
+			if st, err := state.Load(cfg.StateDir, "home"); err != nil || st.LastSnapshot != expectLast {
+				t.Errorf("Expected last snapshot %s in the state, got %+v (%v)", expectLast, st, err)
+			}
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				} else if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got '%s'", tt.errorContains, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+
+			if !strings.Contains(out.String(), tt.expectOutput) {
+				t.Errorf("Expected output containing '%s', got '%s'", tt.expectOutput, out.String())
+			}
+			if len(report.Local) != 2 || report.Local[0].Old != "home-20230101-120000" || report.Local[0].New != "user-20230101-120000" {
+				t.Errorf("Unexpected local renames %+v", report.Local)
+			}
+			if !slices.Equal(report.Repository, []string{"aaa111", "bbb222"}) {
+				t.Errorf("Expected re-tagged snapshots [aaa111 bbb222], got %v", report.Repository)
+			}
+		})
+	}
+}
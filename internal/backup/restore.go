@@ -0,0 +1,268 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"btrfs-backup/internal/config"
+)
+
+// RestoreVerifyOptions controls how VerifyRestore restores and compares a snapshot.
+type RestoreVerifyOptions struct {
+	Dir           string  // directory the temporary restore directory is created in, empty for the system default
+	Sample        float64 // percentage of the files whose contents are compared, 100 compares every file
+	IgnoreMissing bool    // report entries missing from the restore, e.g. excluded ones, without failing
+}
+
+// RestoreReport is the result of restoring a restic snapshot and comparing it with the
+// local snapshot it was taken from. Paths are relative to the snapshot root.
+type RestoreReport struct {
+	Target             string    `json:"target"`
+	Repository         string    `json:"repository"`
+	RepositorySnapshot string    `json:"repository_snapshot"`
+	LocalSnapshot      string    `json:"local_snapshot"`
+	Verified           time.Time `json:"verified"`
+	Success            bool      `json:"success"`
+	Entries            int       `json:"entries"`              // entries of the local snapshot
+	HashedFiles        int       `json:"hashed_files"`         // files whose contents were compared
+	Missing            []string  `json:"missing,omitempty"`    // local entries absent from the restore
+	Extra              []string  `json:"extra,omitempty"`      // restored entries absent locally
+	Mismatched         []string  `json:"mismatched,omitempty"` // entries differing in type, size or contents
+}
+
+// cacheDirTag marks directories restic skips with --exclude-caches.
+const cacheDirTag = "CACHEDIR.TAG"
+
+// VerifyRestore restores a restic snapshot of the target into a temporary directory and
+// compares the restored tree with the local snapshot it was taken from: every path, its
+// type and the size of regular files, plus the SHA-256 hashes of a sample of the files.
+// The restic snapshot is selected by ID, short ID or local snapshot name; if snapshot is
+// empty, the newest restic snapshot whose local snapshot still exists is used.
+// The temporary directory is removed afterwards. Returns the report, or an error if the
+// snapshot can't be found, restored or read. A restore that doesn't match is not an error,
+// see RestoreReport.Success.
+func (bm *Manager) VerifyRestore(ctx context.Context, targetName string, target *config.TargetConfig, snapshot string, options RestoreVerifyOptions) (*RestoreReport, error) {
+	if target.BackupMode == config.BackupModeSend {
+		return nil, fmt.Errorf("restores of backup_mode '%s' can't be compared with the local snapshot", config.BackupModeSend)
+	}
+	if options.Sample <= 0 || options.Sample > 100 {
+		return nil, fmt.Errorf("sample must be between 0 and 100 percent, got %g", options.Sample)
+	}
+
+	selected, err := bm.selectRestoreSnapshot(ctx, target, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	localPath := filepath.Join(bm.config.SnapshotDir, selected.LocalSnapshot)
+
+	env, err := bm.loadReadOnlyRepositoryEnv(target.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("repository configuration failed: %w", err)
+	}
+
+	restoreDir, err := bm.fs.MkdirTemp(options.Dir, "btrfs-backup-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	defer func() {
+		if err := bm.fs.RemoveAll(restoreDir); err != nil {
+			slog.Warn("Failed to remove restore directory", "path", restoreDir, "error", err)
+		}
+	}()
+
+	// The snapshot was backed up from its path at the time, which differs from the
+	// local path once the snapshot is renamed
+	backupPath := localPath
+	if len(selected.Paths) == 1 {
+		backupPath = selected.Paths[0]
+	}
+
+	slog.Info("Restoring snapshot", "target", targetName, "snapshot", selected.ShortID, "path", restoreDir)
+	err = bm.resticFor(target.Repository, target.Prefix).Restore(ctx, env, selected.ID, backupPath, restoreDir)
+	if err != nil {
+		return nil, fmt.Errorf("restic restore command failed: %w", err)
+	}
+
+	report := &RestoreReport{
+		Target:             targetName,
+		Repository:         target.Repository,
+		RepositorySnapshot: selected.ID,
+		LocalSnapshot:      selected.LocalSnapshot,
+	}
+	err = bm.compareTrees(ctx, localPath, restoreDir, options.Sample, report)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Verified = time.Now()
+	report.Success = len(report.Extra) == 0 && len(report.Mismatched) == 0 &&
+		(options.IgnoreMissing || len(report.Missing) == 0)
+	return report, nil
+}
+
+// selectRestoreSnapshot returns the restic snapshot of the target matching snapshot, which
+// must have been taken from a local snapshot that still exists.
+func (bm *Manager) selectRestoreSnapshot(ctx context.Context, target *config.TargetConfig, snapshot string) (*RepositorySnapshot, error) {
+	snapshots, err := bm.ListRepositorySnapshots(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first, so that the default is the most recent backup
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := &snapshots[i]
+		if snapshot == "" && !s.LocalExists {
+			continue
+		}
+		if snapshot != "" && s.LocalSnapshot != snapshot && !strings.HasPrefix(s.ID, snapshot) {
+			continue
+		}
+		if !s.LocalExists {
+			return nil, fmt.Errorf("local snapshot of restic snapshot %s no longer exists", s.ShortID)
+		}
+		return s, nil
+	}
+
+	if snapshot == "" {
+		return nil, fmt.Errorf("no restic snapshot of %s has a local snapshot to compare with", target.Prefix)
+	}
+	return nil, fmt.Errorf("restic snapshot %s not found", snapshot)
+}
+
+type treeEntry struct {
+	mode fs.FileMode // type bits only
+	size int64       // size of regular files
+}
+
+// compareTrees compares the restored tree with the local one and records the differences
+// in the report. Hashing stops once ctx is done.
+func (bm *Manager) compareTrees(ctx context.Context, localPath, restoredPath string, sample float64, report *RestoreReport) error {
+	local, err := bm.readTree(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to read local snapshot: %w", err)
+	}
+	restored, err := bm.readTree(restoredPath)
+	if err != nil {
+		return fmt.Errorf("failed to read restored snapshot: %w", err)
+	}
+
+	var files []string
+	for _, path := range slices.Sorted(maps.Keys(local)) {
+		r, ok := restored[path]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, path)
+		case r != local[path]:
+			report.Mismatched = append(report.Mismatched, path)
+		case r.mode.IsRegular():
+			files = append(files, path)
+		}
+	}
+	for _, path := range slices.Sorted(maps.Keys(restored)) {
+		if _, ok := local[path]; !ok {
+			report.Extra = append(report.Extra, path)
+		}
+	}
+	report.Entries = len(local)
+
+	if sample < 100 {
+		count := int(math.Ceil(float64(len(files)) * sample / 100))
+		rand.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+		files = files[:count]
+		slices.Sort(files)
+	}
+
+	for _, path := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		same, err := bm.sameContents(filepath.Join(localPath, path), filepath.Join(restoredPath, path))
+		if err != nil {
+			return err
+		}
+		if !same {
+			report.Mismatched = append(report.Mismatched, path)
+		}
+	}
+	report.HashedFiles = len(files)
+	slices.Sort(report.Mismatched)
+
+	return nil
+}
+
+// readTree returns the entries below root by path relative to root. The contents of
+// directories tagged as caches are left out, as restic doesn't back them up.
+func (bm *Manager) readTree(root string) (map[string]treeEntry, error) {
+	tree := make(map[string]treeEntry)
+	err := bm.fs.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entry := treeEntry{mode: d.Type()}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			entry.size = info.Size()
+		}
+		tree[rel] = entry
+
+		if d.IsDir() {
+			if _, err := bm.fs.Stat(filepath.Join(path, cacheDirTag)); err == nil {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+	return tree, err
+}
+
+// sameContents reports whether two files have the same SHA-256 hash.
+func (bm *Manager) sameContents(a, b string) (bool, error) {
+	hashA, err := bm.hashFile(a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := bm.hashFile(b)
+	if err != nil {
+		return false, err
+	}
+	return hashA == hashB, nil
+}
+
+func (bm *Manager) hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	f, err := bm.fs.Open(path)
+	if err != nil {
+		return sum, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
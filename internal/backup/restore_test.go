@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/restic"
+)
+
+func TestVerifyRestore(t *testing.T) {
+	localPath := "/snapshots/home-20230102-120000"
+	localFiles := map[string]string{
+		"a.txt":     "hello",
+		"dir/b.txt": "world!",
+	}
+
+	tests := []struct {
+		name            string
+		snapshot        string
+		backupMode      string
+		options         RestoreVerifyOptions
+		restored        map[string]string
+		restoreExitCode int
+		expectRestore   bool
+		expectSuccess   bool
+		expectMissing   []string
+		expectExtra     []string
+		expectMismatch  []string
+		expectHashed    int
+		expectError     bool
+		errorContains   string
+	}{
+		{
+			name:          "identical",
+			options:       RestoreVerifyOptions{Sample: 100},
+			restored:      localFiles,
+			expectRestore: true,
+			expectSuccess: true,
+			expectHashed:  2,
+		},
+		{
+			name:           "corrupted_contents",
+			options:        RestoreVerifyOptions{Sample: 100},
+			restored:       map[string]string{"a.txt": "hellp", "dir/b.txt": "world!"},
+			expectRestore:  true,
+			expectMismatch: []string{"a.txt"},
+			expectHashed:   2,
+		},
+		{
+			name:           "size_differs",
+			options:        RestoreVerifyOptions{Sample: 100},
+			restored:       map[string]string{"a.txt": "hello", "dir/b.txt": "world"},
+			expectRestore:  true,
+			expectMismatch: []string{"dir/b.txt"},
+			expectHashed:   1,
+		},
+		{
+			name:          "missing_and_extra",
+			options:       RestoreVerifyOptions{Sample: 100},
+			restored:      map[string]string{"a.txt": "hello", "c.txt": "new"},
+			expectRestore: true,
+			expectMissing: []string{"dir/b.txt"},
+			expectExtra:   []string{"c.txt"},
+			expectHashed:  1,
+		},
+		{
+			name:          "missing_ignored",
+			options:       RestoreVerifyOptions{Sample: 100, IgnoreMissing: true},
+			restored:      map[string]string{"a.txt": "hello"},
+			expectRestore: true,
+			expectSuccess: true,
+			expectMissing: []string{"dir/b.txt"},
+			expectHashed:  1,
+		},
+		{
+			name:          "sampled",
+			options:       RestoreVerifyOptions{Sample: 50},
+			restored:      localFiles,
+			expectRestore: true,
+			expectSuccess: true,
+			expectHashed:  1,
+		},
+		{
+			name:          "selected_by_local_name",
+			snapshot:      "home-20230102-120000",
+			options:       RestoreVerifyOptions{Sample: 100},
+			restored:      localFiles,
+			expectRestore: true,
+			expectSuccess: true,
+			expectHashed:  2,
+		},
+		{
+			name:          "local_snapshot_removed",
+			snapshot:      "aaa111",
+			options:       RestoreVerifyOptions{Sample: 100},
+			expectError:   true,
+			errorContains: "no longer exists",
+		},
+		{
+			name:          "unknown_snapshot",
+			snapshot:      "ccc333",
+			options:       RestoreVerifyOptions{Sample: 100},
+			expectError:   true,
+			errorContains: "restic snapshot ccc333 not found",
+		},
+		{
+			name:            "restore_failure",
+			options:         RestoreVerifyOptions{Sample: 100},
+			restoreExitCode: 1,
+			expectRestore:   true,
+			expectError:     true,
+			errorContains:   "restic restore command failed",
+		},
+		{
+			name:          "send_mode",
+			backupMode:    config.BackupModeSend,
+			options:       RestoreVerifyOptions{Sample: 100},
+			expectError:   true,
+			errorContains: "can't be compared",
+		},
+		{
+			name:          "invalid_sample",
+			options:       RestoreVerifyOptions{Sample: 0},
+			expectError:   true,
+			errorContains: "sample must be between 0 and 100",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos"}
+			mockFS := NewMockFileSystem()
+			mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+			mockFS.AddDir("/snapshots", []MockDirEntry{{name: "home-20230102-120000", isDir: true}})
+			mockFS.AddDir(localPath, nil)
+			for path, content := range localFiles {
+				mockFS.AddFile(localPath+"/"+path, []byte(content))
+			}
+
+			mockRestic := NewMockResticClient(t)
+			mockRestic.ExpectSnapshots([]string{"btrfs-backup", "home"}, []restic.Snapshot{
+				{ID: "aaa111", ShortID: "aaa111", Tags: []string{"btrfs-backup", "home", "home-20230101-120000"}},
+				{ID: "bbb222", ShortID: "bbb222", Tags: []string{"btrfs-backup", "home", "home-20230102-120000"}},
+			}, 0)
+			if tt.expectRestore {
+				mockRestic.ExpectRestore("bbb222", localPath, tt.restoreExitCode)
+			}
+			mockRestic.onRestore = func(targetDir string) {
+				for path, content := range tt.restored {
+					mockFS.AddFile(targetDir+"/"+path, []byte(content))
+				}
+			}
+
+			mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+			target := &config.TargetConfig{Prefix: "home", Repository: "b2-home", BackupMode: tt.backupMode}
+			report, err := mgr.VerifyRestore(context.Background(), "home", target, tt.snapshot, tt.options)
+
+			if tt.expectRestore && !slices.Equal(mockFS.removed, []string{"/tmp/btrfs-backup-restore-1"}) {
+				t.Errorf("Expected restore directory to be removed, removed %v", mockFS.removed)
+			}
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				} else if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got '%s'", tt.errorContains, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+
+			if report.Success != tt.expectSuccess {
+				t.Errorf("Expected success %v, got report %+v", tt.expectSuccess, report)
+			}
+			if report.RepositorySnapshot != "bbb222" || report.LocalSnapshot != "home-20230102-120000" || report.Entries != 2 {
+				t.Errorf("Unexpected report %+v", report)
+			}
+			if !slices.Equal(report.Missing, tt.expectMissing) || !slices.Equal(report.Extra, tt.expectExtra) || !slices.Equal(report.Mismatched, tt.expectMismatch) {
+				t.Errorf("Expected missing %v, extra %v, mismatched %v, got %v, %v, %v",
+					tt.expectMissing, tt.expectExtra, tt.expectMismatch, report.Missing, report.Extra, report.Mismatched)
+			}
+			if report.HashedFiles != tt.expectHashed {
+				t.Errorf("Expected %d hashed files, got %d", tt.expectHashed, report.HashedFiles)
+			}
+		})
+	}
+}
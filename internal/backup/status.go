@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/schedule"
+	"btrfs-backup/internal/state"
+)
+
+// TargetStatus summarizes the state of a target for monitoring: the results of its last
+// run as recorded in the state file and its local snapshots.
+type TargetStatus struct {
+	Target         string    `json:"target"`
+	Repository     string    `json:"repository"`
+	LastAttempt    time.Time `json:"last_attempt,omitzero"`
+	LastSuccess    time.Time `json:"last_success,omitzero"`
+	LastError      string    `json:"last_error,omitempty"`
+	NextRun        time.Time `json:"next_run,omitzero"` // next run of the schedule, unknown for plain OnCalendar expressions
+	Snapshots      int       `json:"snapshots"`         // local snapshots of the target
+	CleanupPending []string  `json:"cleanup_pending"`   // local snapshots the cleanup of the next run deletes
+	Error          string    `json:"error,omitempty"`   // why the status could not be determined
+	Health         *Health   `json:"health,omitempty"`  // health of the backup chain, nil without a state_dir
+
+	Maintenance *state.Maintenance `json:"maintenance,omitempty"` // maintenance mode skipping the backups, nil while it is off
+
+	PasswordRotationDue time.Time `json:"password_rotation_due,omitzero"` // when the repository password is due for rotation, see rotate_every
+	RotationReminder    string    `json:"rotation_reminder,omitempty"`    // reminder to rotate the repository password once it is due
+}
+
+// TargetStatus returns the status of a target. The snapshots the next cleanup deletes
+// are those beyond keep_snapshots once the next run added its snapshot; deletions
+// enforcing max_snapshot_space depend on sizes only known after that run and are not
+// included.
+func (bm *Manager) TargetStatus(targetName string, target *config.TargetConfig) (*TargetStatus, error) {
+	status := &TargetStatus{Target: targetName, Repository: target.Repository, CleanupPending: []string{}}
+
+	if bm.config.StateDir != "" {
+		st, err := state.Load(bm.config.StateDir, targetName)
+		if err != nil {
+			return nil, err
+		}
+		status.LastAttempt = st.LastAttempt
+		status.LastSuccess = st.LastSuccess
+		status.LastError = st.LastError
+		health := TargetHealth(target, st, time.Now())
+		status.Health = &health
+
+		if status.Maintenance, err = bm.Maintenance(); err != nil {
+			return nil, err
+		}
+	}
+	status.PasswordRotationDue = bm.config.Repository(target.Repository).PasswordRotationDue()
+	status.RotationReminder = bm.config.RotationReminder(target.Repository, time.Now())
+	if s, err := schedule.Parse(target.Schedule); err == nil {
+		status.NextRun = s.Next(time.Now())
+	}
+
+	snapshots, err := bm.getSnapshotNames(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	status.Snapshots = len(snapshots)
+	// The next run's snapshot takes one of the kept slots
+	kept := min(max(target.KeepSnapshots-1, 0), len(snapshots))
+	status.CleanupPending = append(status.CleanupPending, snapshots[kept:]...)
+
+	return status, nil
+}
@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/state"
+)
+
+func TestTargetStatus(t *testing.T) {
+	cfg := &config.Config{SnapshotDir: "/snapshots", StateDir: t.TempDir()}
+	lastSuccess := time.Date(2023, 1, 3, 12, 0, 0, 0, time.UTC)
+	err := state.Save(cfg.StateDir, "home", &state.Target{LastAttempt: lastSuccess, LastSuccess: lastSuccess})
+	if err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	mockFS := NewMockFileSystem()
+	mockFS.AddDir("/snapshots", []MockDirEntry{
+		{name: "home-20230101-120000", isDir: true},
+		{name: "home-20230102-120000", isDir: true},
+		{name: "home-20230103-120000", isDir: true},
+	})
+	mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), NewMockResticClient(t))
+
+	tests := []struct {
+		name          string
+		target        string
+		keep          int
+		expectPending []string
+	}{
+		{name: "oldest_deleted", target: "home", keep: 3, expectPending: []string{"home-20230101-120000"}},
+		{name: "nothing_deleted", target: "home", keep: 4, expectPending: []string{}},
+		{name: "all_deleted", target: "home", keep: 0, expectPending: []string{"home-20230103-120000", "home-20230102-120000", "home-20230101-120000"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := mgr.TargetStatus(tt.target, &config.TargetConfig{Prefix: "home", Repository: "b2-home", KeepSnapshots: tt.keep})
+			if err != nil {
+				t.Fatalf("TargetStatus failed: %v", err)
+			}
+			if status.Snapshots != 3 || !status.LastSuccess.Equal(lastSuccess) || status.Repository != "b2-home" {
+				t.Errorf("Unexpected status %+v", status)
+			}
+			if !slices.Equal(status.CleanupPending, tt.expectPending) {
+				t.Errorf("Expected pending cleanup %v, got %v", tt.expectPending, status.CleanupPending)
+			}
+		})
+	}
+
+	status, err := mgr.TargetStatus("docs", &config.TargetConfig{Prefix: "docs", KeepSnapshots: 3})
+	if err != nil {
+		t.Fatalf("TargetStatus failed: %v", err)
+	}
+	if !status.LastSuccess.IsZero() || status.Snapshots != 0 {
+		t.Errorf("Expected a target that never ran to have no history, got %+v", status)
+	}
+	if status.Maintenance != nil {
+		t.Errorf("Expected maintenance mode to be off, got %+v", status.Maintenance)
+	}
+	if status.Health == nil || status.Health.Score != 60 || !slices.Contains(status.Health.Issues, "never backed up successfully") {
+		t.Errorf("Expected the health of a target that never ran, got %+v", status.Health)
+	}
+
+	if err := state.SaveMaintenance(cfg.StateDir, &state.Maintenance{Reason: "RAID rebuild", Since: time.Now()}); err != nil {
+		t.Fatalf("SaveMaintenance failed: %v", err)
+	}
+	status, err = mgr.TargetStatus("docs", &config.TargetConfig{Prefix: "docs", KeepSnapshots: 3})
+	if err != nil {
+		t.Fatalf("TargetStatus failed: %v", err)
+	}
+	if status.Maintenance == nil || status.Maintenance.Reason != "RAID rebuild" {
+		t.Errorf("Expected the status to show maintenance mode, got %+v", status.Maintenance)
+	}
+	if !status.NextRun.IsZero() {
+		t.Errorf("Expected no next run without schedule, got %v", status.NextRun)
+	}
+
+	status, err = mgr.TargetStatus("docs", &config.TargetConfig{Prefix: "docs", Schedule: "every 6h"})
+	if err != nil {
+		t.Fatalf("TargetStatus failed: %v", err)
+	}
+	if until := time.Until(status.NextRun); until <= 0 || until > 6*time.Hour || status.NextRun.Minute() != 0 {
+		t.Errorf("Expected the next run within 6 hours on the hour, got %v", status.NextRun)
+	}
+	if !status.PasswordRotationDue.IsZero() || status.RotationReminder != "" {
+		t.Errorf("Expected no rotation reminder without rotate_every, got %+v", status)
+	}
+
+	cfg.Repositories = map[string]config.RepositoryConfig{"b2-home": {PasswordRotatedAt: "2023-01-01", RotateEvery: "90d"}}
+	status, err = mgr.TargetStatus("home", &config.TargetConfig{Prefix: "home", Repository: "b2-home"})
+	if err != nil {
+		t.Fatalf("TargetStatus failed: %v", err)
+	}
+	if status.PasswordRotationDue.Format(time.DateOnly) != "2023-04-01" || !strings.Contains(status.RotationReminder, "'b2-home' is due for rotation since 2023-04-01") {
+		t.Errorf("Expected a rotation reminder, got due %v, %q", status.PasswordRotationDue, status.RotationReminder)
+	}
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"btrfs-backup/internal/config"
+)
+
+// RunFunc runs the backup workflow for a single, already loaded target.
+type RunFunc func(ctx context.Context, targetName string, target *config.TargetConfig) error
+
+// TargetResult is the outcome of running the backup workflow for one target.
+type TargetResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// RunTargets loads and backs up each target using run, up to parallel targets at the
+// same time, or one after another if parallel is 1 or less.
+// A target that fails to load or back up is recorded in its result and does not
+// stop the remaining targets. Once ctx is done, the remaining targets are not started and
+// fail with the context's error. Results are returned in the order of targets.
+func RunTargets(ctx context.Context, targets []config.TargetFile, parallel int, run RunFunc) []TargetResult {
+	results := make([]TargetResult, len(targets))
+	slots := NewPhaseLimit(max(parallel, 1))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		// Started in order, so with one slot the targets run one after another
+		release, err := slots.Acquire(ctx)
+		if err != nil {
+			results[i] = TargetResult{Name: t.Name, Err: fmt.Errorf("target not started: %w", err)}
+			continue
+		}
+		wg.Go(func() {
+			defer release()
+			results[i] = runTarget(ctx, t, run)
+		})
+	}
+	wg.Wait()
+
+	return results
+}
+
+// runTarget loads and backs up a single target using run.
+func runTarget(ctx context.Context, t config.TargetFile, run RunFunc) TargetResult {
+	start := time.Now()
+
+	var err error
+	target, loadErr := config.LoadTargetConfig(t.Path)
+	switch {
+	case ctx.Err() != nil:
+		err = fmt.Errorf("target not started: %w", ctx.Err())
+	case loadErr != nil:
+		err = fmt.Errorf("failed to load target configuration: %w", loadErr)
+	default:
+		err = run(ctx, t.Name, target)
+	}
+
+	return TargetResult{
+		Name:     t.Name,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+}
+
+// PhaseLimit bounds how many targets run a phase of the backup workflow at the same
+// time, e.g. the restic phases while targets run in parallel, so that the snapshot of
+// one target is taken while another one uploads. A nil PhaseLimit doesn't limit.
+type PhaseLimit chan struct{}
+
+// NewPhaseLimit returns a PhaseLimit letting n targets run the phase at the same time.
+func NewPhaseLimit(n int) PhaseLimit {
+	return make(PhaseLimit, n)
+}
+
+// Acquire waits until the phase may run, or returns the context's error once ctx is
+// done. The returned function ends the phase; calling it again has no effect.
+func (l PhaseLimit) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l <- struct{}{}:
+		return sync.OnceFunc(func() { <-l }), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// FailedTargets returns the results of the targets that did not complete successfully.
+func FailedTargets(results []TargetResult) []TargetResult {
+	var failed []TargetResult
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+)
+
+func TestRunTargets(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "btrfs-backup-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	files := map[string]string{
+		"home.yaml":   "subvolume: /mnt/btrfs/home\nprefix: home\nrepository: b2-home\n",
+		"broken.yaml": "prefix: broken\nrepository: b2-home\n",
+		"root.yaml":   "subvolume: /mnt/btrfs/root\nprefix: root\nrepository: b2-root\n",
+	}
+	for name, content := range files {
+		err = os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write target file: %v", err)
+		}
+	}
+
+	targets, err := config.DiscoverTargets(tmpDir)
+	if err != nil {
+		t.Fatalf("DiscoverTargets failed: %v", err)
+	}
+
+	var ran []string
+	results := RunTargets(context.Background(), targets, 1, func(ctx context.Context, targetName string, target *config.TargetConfig) error {
+		ran = append(ran, targetName)
+		if targetName == "root" {
+			return fmt.Errorf("restic backup command failed")
+		}
+		return nil
+	})
+
+	if strings.Join(ran, ",") != "home,root" {
+		t.Errorf("Expected targets home,root to run, got %v", ran)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+	if results[0].Name != "broken" || results[0].Err == nil ||
+		!strings.Contains(results[0].Err.Error(), "failed to load target configuration") {
+		t.Errorf("Expected load failure for broken target, got %+v", results[0])
+	}
+	if results[1].Name != "home" || results[1].Err != nil {
+		t.Errorf("Expected success for home target, got %+v", results[1])
+	}
+	if results[2].Name != "root" || results[2].Err == nil {
+		t.Errorf("Expected failure for root target, got %+v", results[2])
+	}
+
+	failed := FailedTargets(results)
+	if len(failed) != 2 || failed[0].Name != "broken" || failed[1].Name != "root" {
+		t.Errorf("Expected broken and root to fail, got %+v", failed)
+	}
+}
+
+func TestRunTargetsInterrupted(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"home", "root"} {
+		content := fmt.Sprintf("subvolume: /mnt/btrfs/%s\nprefix: %s\nrepository: b2-%s\n", name, name, name)
+		if err := os.WriteFile(filepath.Join(tmpDir, name+".yaml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write target file: %v", err)
+		}
+	}
+
+	targets, err := config.DiscoverTargets(tmpDir)
+	if err != nil {
+		t.Fatalf("DiscoverTargets failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ran []string
+	results := RunTargets(ctx, targets, 1, func(ctx context.Context, targetName string, target *config.TargetConfig) error {
+		ran = append(ran, targetName)
+		cancel()
+		return ctx.Err()
+	})
+
+	if strings.Join(ran, ",") != "home" {
+		t.Errorf("Expected only target home to run, got %v", ran)
+	}
+	if len(results) != 2 || !errors.Is(results[1].Err, context.Canceled) {
+		t.Errorf("Expected root target to be skipped, got %+v", results)
+	}
+}
+
+func TestRunTargetsParallel(t *testing.T) {
+	tmpDir := t.TempDir()
+	names := []string{"home", "media", "root", "var"}
+	for _, name := range names {
+		content := fmt.Sprintf("subvolume: /mnt/btrfs/%s\nprefix: %s\nrepository: b2-%s\n", name, name, name)
+		if err := os.WriteFile(filepath.Join(tmpDir, name+".yaml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write target file: %v", err)
+		}
+	}
+	targets, err := config.DiscoverTargets(tmpDir)
+	if err != nil {
+		t.Fatalf("DiscoverTargets failed: %v", err)
+	}
+
+	// Two targets run at a time, of which one uploads
+	uploads := NewPhaseLimit(1)
+	var mu sync.Mutex
+	running, maxRunning, uploading := 0, 0, 0
+	results := RunTargets(context.Background(), targets, 2, func(ctx context.Context, targetName string, target *config.TargetConfig) error {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		release, err := uploads.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		mu.Lock()
+		uploading++
+		concurrent := uploading
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		uploading--
+		mu.Unlock()
+
+		if concurrent > 1 {
+			return fmt.Errorf("%d targets uploading at the same time", concurrent)
+		}
+		if targetName == "root" {
+			return fmt.Errorf("restic backup command failed")
+		}
+		return nil
+	})
+
+	if maxRunning != 2 {
+		t.Errorf("Expected 2 targets running at the same time, got %d", maxRunning)
+	}
+	for i, r := range results {
+		if r.Name != names[i] || (r.Err != nil) != (r.Name == "root") {
+			t.Errorf("Unexpected result %d: %+v", i, r)
+		}
+	}
+}
+
+func TestPhaseLimit(t *testing.T) {
+	limit := NewPhaseLimit(1)
+	release, err := limit.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limit.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Acquire to wait until the context is done, got %v", err)
+	}
+
+	release()
+	release()
+	if release, err = limit.Acquire(context.Background()); err != nil {
+		t.Errorf("Expected Acquire to succeed after release, got %v", err)
+	}
+	release()
+
+	var unlimited PhaseLimit
+	if _, err := unlimited.Acquire(ctx); err != nil {
+		t.Errorf("Expected nil PhaseLimit not to limit, got %v", err)
+	}
+}
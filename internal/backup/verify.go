@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/state"
+)
+
+// SnapshotVerification is the result of reading a restic snapshot of a target back in
+// full with VerifySnapshot.
+type SnapshotVerification struct {
+	Target             string        `json:"target"`
+	Repository         string        `json:"repository"`
+	RepositorySnapshot string        `json:"repository_snapshot"`
+	SnapshotTime       time.Time     `json:"snapshot_time"`
+	LastVerified       time.Time     `json:"last_verified"` // previous successful read of the snapshot, zero if never
+	Verified           time.Time     `json:"verified"`
+	Duration           time.Duration `json:"duration"`
+	Bytes              int64         `json:"bytes"` // size of the archive read
+}
+
+// VerifySnapshot reads a restic snapshot of the target back in full with 'restic dump',
+// discarding the data, so that every blob it references is downloaded, decrypted and
+// checked, as a restore would. The snapshot is selected by ID, short ID or local
+// snapshot name; if snapshot is empty, an older snapshot is picked at random, see
+// pickSnapshot, so that snapshots nobody reads are still validated over time.
+// A successful read is recorded in the target's state file, unless in dry-run mode or
+// without a state_dir. Returns an error if the snapshot can't be found or read.
+func (bm *Manager) VerifySnapshot(ctx context.Context, targetName string, target *config.TargetConfig, snapshot string) (*SnapshotVerification, error) {
+	snapshots, err := bm.ListRepositorySnapshots(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("repository has no restic snapshots of %s", target.Prefix)
+	}
+
+	verified := map[string]time.Time{}
+	if bm.config.StateDir != "" {
+		st, err := state.Load(bm.config.StateDir, targetName)
+		if err != nil {
+			slog.Warn("Failed to read target state, treating all snapshots as never verified", "target", targetName, "error", err)
+		} else if st.SnapshotVerifications != nil {
+			verified = st.SnapshotVerifications
+		}
+	}
+
+	var selected *RepositorySnapshot
+	if snapshot == "" {
+		selected = pickSnapshot(snapshots, verified, time.Now(), rand.Float64())
+	} else {
+		for i := range snapshots {
+			s := &snapshots[i]
+			if s.LocalSnapshot == snapshot || strings.HasPrefix(s.ID, snapshot) {
+				selected = s
+			}
+		}
+		if selected == nil {
+			return nil, fmt.Errorf("restic snapshot %s not found", snapshot)
+		}
+	}
+
+	env, err := bm.loadReadOnlyRepositoryEnv(target.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("repository configuration failed: %w", err)
+	}
+
+	slog.Info("Reading restic snapshot", "target", targetName, "snapshot", selected.ShortID,
+		"snapshot_time", selected.Time.Format(time.RFC3339), "last_verified", formatLast(verified[selected.ID]))
+	start := time.Now()
+	counter := &countingWriter{}
+	err = bm.resticFor(target.Repository, target.Prefix).Dump(ctx, env, selected.ID, "/", counter)
+	if err != nil {
+		return nil, fmt.Errorf("restic dump of snapshot %s failed: %w", selected.ShortID, err)
+	}
+
+	result := &SnapshotVerification{
+		Target:             targetName,
+		Repository:         target.Repository,
+		RepositorySnapshot: selected.ID,
+		SnapshotTime:       selected.Time,
+		LastVerified:       verified[selected.ID],
+		Verified:           time.Now(),
+		Duration:           time.Since(start),
+		Bytes:              counter.n,
+	}
+	if stateErr := bm.recordSnapshotVerification(targetName, snapshots, result); stateErr != nil {
+		slog.Warn("Failed to record snapshot verification in target state", "target", targetName, "error", stateErr)
+	}
+	return result, nil
+}
+
+// pickSnapshot picks a snapshot, given oldest first, at random with r in [0, 1),
+// weighted by how long ago it was last read back in full, or taken if it never was, so
+// that snapshots unread the longest are the most likely. The newest snapshot is left
+// out, unless it is the only one, since it is what regular verification and restores
+// read anyway.
+func pickSnapshot(snapshots []RepositorySnapshot, verified map[string]time.Time, now time.Time, r float64) *RepositorySnapshot {
+	candidates := snapshots
+	if len(candidates) > 1 {
+		candidates = candidates[:len(candidates)-1]
+	}
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, s := range candidates {
+		last := s.Time
+		if t, ok := verified[s.ID]; ok {
+			last = t
+		}
+		// At least an hour, so snapshots just taken or read can still be picked
+		weights[i] = max(now.Sub(last).Hours(), 1)
+		total += weights[i]
+	}
+
+	target := r * total
+	for i, weight := range weights {
+		if target < weight {
+			return &candidates[i]
+		}
+		target -= weight
+	}
+	return &candidates[len(candidates)-1]
+}
+
+// OldSnapshotVerificationDue reports whether an older restic snapshot of the target is
+// to be read back after the current backup, see VerifySnapshot: once its verify_old_every
+// interval passed since the last successful one. Without verify_old_every or a
+// state_dir, or if the state can't be read, it is never due.
+func (bm *Manager) OldSnapshotVerificationDue(targetName string, target *config.TargetConfig) bool {
+	if target.VerifyOldEvery == "" || bm.config.StateDir == "" {
+		return false
+	}
+
+	st, err := state.Load(bm.config.StateDir, targetName)
+	if err != nil {
+		slog.Warn("Failed to read target state, skipping verification of an older snapshot", "target", targetName, "error", err)
+		return false
+	}
+
+	due := intervalPassed(target.VerifyOldEvery, st.LastSnapshotVerify)
+	if due {
+		slog.Info("Verification of an older snapshot due", "target", targetName,
+			"last_snapshot_verify", formatLast(st.LastSnapshotVerify), "verify_old_every", target.VerifyOldEvery)
+	}
+	return due
+}
+
+// recordSnapshotVerification records a successful read of a restic snapshot in the
+// target's state file, dropping the records of snapshots no longer in the repository.
+func (bm *Manager) recordSnapshotVerification(targetName string, snapshots []RepositorySnapshot, result *SnapshotVerification) error {
+	if bm.config.StateDir == "" || bm.dryRun {
+		return nil
+	}
+
+	return state.Update(bm.config.StateDir, targetName, func(st *state.Target) {
+		verifications := map[string]time.Time{result.RepositorySnapshot: result.Verified}
+		for _, s := range snapshots {
+			if t, ok := st.SnapshotVerifications[s.ID]; ok && s.ID != result.RepositorySnapshot {
+				verifications[s.ID] = t
+			}
+		}
+		st.SnapshotVerifications = verifications
+		st.LastSnapshotVerify = result.Verified
+	})
+}
+
+// countingWriter discards what is written to it, counting the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/restic"
+	"btrfs-backup/internal/state"
+)
+
+func TestPickSnapshot(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	snapshots := []RepositorySnapshot{
+		{ID: "old", Time: now.Add(-300 * time.Hour)},
+		{ID: "read", Time: now.Add(-200 * time.Hour)},
+		{ID: "recent", Time: now.Add(-100 * time.Hour)},
+		{ID: "newest", Time: now.Add(-time.Hour)},
+	}
+	verified := map[string]time.Time{"read": now.Add(-time.Minute)}
+
+	// Weights are 300 (old), 1 (read, just verified) and 100 (recent); newest is left out
+	tests := []struct {
+		r        float64
+		expected string
+	}{
+		{0, "old"},
+		{0.74, "old"},
+		{300.5 / 401, "read"},
+		{0.76, "recent"},
+		{0.999, "recent"},
+	}
+	for _, tt := range tests {
+		if got := pickSnapshot(snapshots, verified, now, tt.r); got.ID != tt.expected {
+			t.Errorf("Expected %s for r %g, got %s", tt.expected, tt.r, got.ID)
+		}
+	}
+
+	if got := pickSnapshot(snapshots[3:], nil, now, 0.5); got.ID != "newest" {
+		t.Errorf("Expected the only snapshot to be picked, got %s", got.ID)
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	stateDir := t.TempDir()
+	err := state.Save(stateDir, "home", &state.Target{SnapshotVerifications: map[string]time.Time{"forgotten": time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{SnapshotDir: "/snapshots", ResticRepoDir: "/repos", StateDir: stateDir}
+	target := &config.TargetConfig{Prefix: "home", Repository: "b2-home", VerifyOldEvery: "30d"}
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("/repos/b2-home", []byte("RESTIC_REPOSITORY: b2:bucket/path"))
+	mockFS.AddDir("/snapshots", nil)
+	snapshots := []restic.Snapshot{
+		{ID: "aaa111", ShortID: "aaa111", Tags: []string{"btrfs-backup", "home", "home-20230101-120000"}},
+		{ID: "bbb222", ShortID: "bbb222", Tags: []string{"btrfs-backup", "home", "home-20230102-120000"}},
+	}
+	mockRestic := NewMockResticClient(t)
+	mgr := NewManagerWithDeps(cfg, false, mockFS, NewMockBtrfsClient(t), mockRestic)
+
+	if !mgr.OldSnapshotVerificationDue("home", target) {
+		t.Error("Expected verification due without a previous one")
+	}
+
+	// Only the older of two snapshots is a candidate
+	mockRestic.ExpectSnapshots([]string{"btrfs-backup", "home"}, snapshots, 0)
+	mockRestic.ExpectDump("aaa111", "/", 0)
+	result, err := mgr.VerifySnapshot(context.Background(), "home", target, "")
+	if err != nil {
+		t.Fatalf("VerifySnapshot failed: %v", err)
+	}
+	if result.RepositorySnapshot != "aaa111" || !result.LastVerified.IsZero() || result.Bytes != int64(len("archive of aaa111")) {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	st, err := state.Load(stateDir, "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.SnapshotVerifications) != 1 || !st.SnapshotVerifications["aaa111"].Equal(result.Verified) || !st.LastSnapshotVerify.Equal(result.Verified) {
+		t.Errorf("Expected only the verified snapshot recorded, got %+v", st)
+	}
+	if mgr.OldSnapshotVerificationDue("home", target) {
+		t.Error("Expected verification not due right after one")
+	}
+
+	// Selected by local snapshot name
+	mockRestic.ExpectSnapshots([]string{"btrfs-backup", "home"}, snapshots, 0)
+	mockRestic.ExpectDump("bbb222", "/", 0)
+	if result, err = mgr.VerifySnapshot(context.Background(), "home", target, "home-20230102-120000"); err != nil || result.RepositorySnapshot != "bbb222" {
+		t.Errorf("Expected bbb222 verified, got %+v (%v)", result, err)
+	}
+
+	mockRestic.ExpectSnapshots([]string{"btrfs-backup", "home"}, snapshots, 0)
+	mockRestic.ExpectDump("aaa111", "/", 1)
+	if _, err = mgr.VerifySnapshot(context.Background(), "home", target, "aaa"); err == nil || !strings.Contains(err.Error(), "restic dump of snapshot aaa111 failed") {
+		t.Errorf("Expected dump error, got %v", err)
+	}
+
+	mockRestic.ExpectSnapshots([]string{"btrfs-backup", "home"}, snapshots, 0)
+	if _, err = mgr.VerifySnapshot(context.Background(), "home", target, "ccc333"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected unknown snapshot error, got %v", err)
+	}
+}
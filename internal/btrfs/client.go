@@ -2,77 +2,326 @@
 package btrfs
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"btrfs-backup/internal/command"
 )
 
 // Client interface abstracts BTRFS operations for dependency injection and testing.
 type Client interface {
-	ShowSubvolume(subvolume string) error
-	CreateSnapshot(subvolume, snapshotPath string, readonly bool) error
-	DeleteSubvolume(subvolumePath string) error
+	ShowSubvolume(ctx context.Context, subvolume string) (Subvolume, error)
+	CreateSnapshot(ctx context.Context, subvolume, snapshotPath string, readonly bool) error
+	CreateSubvolume(ctx context.Context, subvolumePath string) error
+	DeleteSubvolume(ctx context.Context, subvolumePath string) error
+	FilesystemUUID(ctx context.Context, path string) (string, error)
+	ExclusiveSize(ctx context.Context, subvolumePath string) (int64, error)
+	DeviceStats(ctx context.Context, path string) ([]DeviceStat, error)
+	Send(ctx context.Context, snapshotPath, parentPath string, w io.Writer) error
+}
+
+// Subvolume holds the properties of a subvolume reported by 'btrfs subvolume show'.
+type Subvolume struct {
+	ReadOnly bool // the readonly flag is set, as on snapshots created with -r
+}
+
+// DeviceStat is an error counter of a device of a filesystem reported by 'btrfs device stats'.
+type DeviceStat struct {
+	Device  string // device path, e.g. /dev/sda1
+	Counter string // counter name, e.g. corruption_errs
+	Value   int64  // errors since the counters were last reset
 }
 
 type BtrfsCommand struct {
-	Name      string
-	Args      []string
-	RunAsSudo bool
+	Name   string
+	Args   []string
+	Prefix []string // command running btrfs with privileges, e.g. sudo -n
 }
 
-func (c *BtrfsCommand) Exec(args ...string) error {
-	commandToRun := []string{}
-	if c.RunAsSudo {
-		commandToRun = append(commandToRun, "sudo")
-	}
+// Exec runs the command until it finishes or ctx is done. On failure the returned error
+// carries the command's error output.
+func (c *BtrfsCommand) Exec(ctx context.Context) error {
+	return command.Run(c.command(ctx))
+}
+
+// Output runs the command and returns its standard output.
+func (c *BtrfsCommand) Output(ctx context.Context) ([]byte, error) {
+	return command.Output(c.command(ctx))
+}
+
+// Stream runs the command with its standard output written to w.
+func (c *BtrfsCommand) Stream(ctx context.Context, w io.Writer) error {
+	cmd := c.command(ctx)
+	cmd.Stdout = w
+	return command.Run(cmd)
+}
+
+func (c *BtrfsCommand) command(ctx context.Context) *exec.Cmd {
+	commandToRun := slices.Clone(c.Prefix)
 	commandToRun = append(commandToRun, c.Name)
 	commandToRun = append(commandToRun, c.Args...)
-	cmd := exec.Command(commandToRun[0], commandToRun[1:]...)
-	return cmd.Run()
+	return command.Command(ctx, commandToRun[0], commandToRun[1:]...)
 }
 
 // DefaultClient is the production implementation of the Client interface
-// that executes actual BTRFS commands using sudo.
+// that executes actual BTRFS commands using sudo. When sudo requires a password, as
+// in a desktop session of a user without sudo rules, commands run through pkexec
+// instead, so that polkit asks for authorization, see PolkitPolicy. Without pkexec, sudo
+// asks for the password itself when run from a terminal.
 type DefaultClient struct {
 	btrfsBin  string
 	runAsSudo bool
+	sudoBin   string
+	pkexecBin string
+	terminal  bool        // standard input is a terminal sudo can ask for a password on
+	usePkexec atomic.Bool // sudo required a password before
+}
+
+// Exec runs a btrfs command and returns an error carrying its error output on failure.
+func (c *DefaultClient) Exec(ctx context.Context, args ...string) error {
+	return c.run(args, func(command *BtrfsCommand) error {
+		return command.Exec(ctx)
+	})
+}
+
+// Output runs a btrfs command and returns its standard output.
+func (c *DefaultClient) Output(ctx context.Context, args ...string) ([]byte, error) {
+	var output []byte
+	err := c.run(args, func(command *BtrfsCommand) error {
+		var err error
+		output, err = command.Output(ctx)
+		return err
+	})
+	return output, err
+}
+
+// Stream runs a btrfs command with its standard output written to w.
+func (c *DefaultClient) Stream(ctx context.Context, w io.Writer, args ...string) error {
+	return c.run(args, func(command *BtrfsCommand) error {
+		return command.Stream(ctx, w)
+	})
 }
 
-func (c *DefaultClient) Exec(args ...string) error {
-	command := &BtrfsCommand{
-		Name:      c.btrfsBin,
-		Args:      args,
-		RunAsSudo: c.runAsSudo,
+// run runs the btrfs command with args through sudo, without letting sudo prompt for a
+// password. If sudo fails because it requires one and pkexec is installed, the command
+// and every later one run through pkexec. Without pkexec, the command is retried with
+// plain sudo, prompting for the password, if standard input is a terminal. sudo fails
+// before btrfs starts, so nothing has been written to the output of a stream yet when
+// it is retried.
+func (c *DefaultClient) run(args []string, run func(*BtrfsCommand) error) error {
+	if !c.runAsSudo {
+		return run(&BtrfsCommand{Name: c.btrfsBin, Args: args})
+	}
+	if !c.usePkexec.Load() {
+		err := run(&BtrfsCommand{Name: c.btrfsBin, Args: args, Prefix: []string{c.sudoBin, "-n"}})
+		if !sudoNeedsPassword(err) {
+			return err
+		}
+		if _, lookErr := exec.LookPath(c.pkexecBin); lookErr != nil {
+			if !c.terminal {
+				return err
+			}
+			return run(&BtrfsCommand{Name: c.btrfsBin, Args: args, Prefix: []string{c.sudoBin}})
+		}
+		if c.usePkexec.CompareAndSwap(false, true) {
+			slog.Info("sudo requires a password, running btrfs through pkexec")
+		}
+	}
+
+	// pkexec requires an absolute path, which the polkit policy names
+	btrfsPath, err := exec.LookPath(c.btrfsBin)
+	if err != nil {
+		return err
 	}
-	return command.Exec()
+	if btrfsPath, err = filepath.Abs(btrfsPath); err != nil {
+		return err
+	}
+	return run(&BtrfsCommand{Name: btrfsPath, Args: args, Prefix: []string{c.pkexecBin}})
+}
+
+// sudoNeedsPassword reports whether err is sudo refusing to run a command because it
+// would have to ask for a password.
+func sudoNeedsPassword(err error) bool {
+	var commandErr *command.Error
+	return errors.As(err, &commandErr) && strings.Contains(commandErr.Stderr, "a password is required")
 }
 
 // NewDefaultClient creates a new DefaultClient instance.
 func NewDefaultClient() *DefaultClient {
+	info, err := os.Stdin.Stat()
 	return &DefaultClient{
 		btrfsBin:  "btrfs",
 		runAsSudo: true,
+		sudoBin:   "sudo",
+		pkexecBin: "pkexec",
+		terminal:  err == nil && info.Mode()&os.ModeCharDevice != 0,
 	}
 }
 
-// ShowSubvolume verifies that the specified path is a valid BTRFS subvolume.
-// It runs 'sudo btrfs subvolume show <subvolume>' and returns an error if the command fails.
-func (c *DefaultClient) ShowSubvolume(subvolume string) error {
-	return c.Exec([]string{"subvolume", "show", subvolume}...)
+// ShowSubvolume verifies that the specified path is a valid BTRFS subvolume and returns
+// its properties. It runs 'sudo btrfs subvolume show <subvolume>' and returns an error if
+// the command fails.
+func (c *DefaultClient) ShowSubvolume(ctx context.Context, subvolume string) (Subvolume, error) {
+	output, err := c.Output(ctx, "subvolume", "show", subvolume)
+	if err != nil {
+		return Subvolume{}, err
+	}
+	return parseSubvolume(string(output)), nil
+}
+
+// parseSubvolume reads the flags of 'btrfs subvolume show' output.
+func parseSubvolume(output string) Subvolume {
+	var info Subvolume
+	for _, line := range strings.Split(output, "\n") {
+		name, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found && name == "Flags" {
+			info.ReadOnly = slices.Contains(strings.Fields(value), "readonly")
+		}
+	}
+	return info
 }
 
 // CreateSnapshot creates a BTRFS snapshot of the specified subvolume.
 // If readonly is true, the snapshot will be created as read-only using the -r flag.
 // It runs 'sudo btrfs subvolume snapshot [-r] <subvolume> <snapshotPath>'.
-func (c *DefaultClient) CreateSnapshot(subvolume, snapshotPath string, readonly bool) error {
+func (c *DefaultClient) CreateSnapshot(ctx context.Context, subvolume, snapshotPath string, readonly bool) error {
+	return c.Exec(ctx, buildSnapshotArgs(subvolume, snapshotPath, readonly)...)
+}
+
+func buildSnapshotArgs(subvolume, snapshotPath string, readonly bool) []string {
 	args := []string{"subvolume", "snapshot"}
 	if readonly {
 		args = append(args, "-r")
 	}
-	args = append(args, subvolume, snapshotPath)
-	return c.Exec(args...)
+	return append(args, subvolume, snapshotPath)
+}
+
+// CreateSubvolume creates an empty BTRFS subvolume.
+// It runs 'sudo btrfs subvolume create <subvolumePath>'.
+func (c *DefaultClient) CreateSubvolume(ctx context.Context, subvolumePath string) error {
+	return c.Exec(ctx, buildCreateArgs(subvolumePath)...)
+}
+
+func buildCreateArgs(subvolumePath string) []string {
+	return []string{"subvolume", "create", subvolumePath}
 }
 
 // DeleteSubvolume removes a BTRFS subvolume or snapshot.
 // It runs 'sudo btrfs subvolume delete <subvolumePath>'.
-func (c *DefaultClient) DeleteSubvolume(subvolumePath string) error {
-	return c.Exec([]string{"subvolume", "delete", subvolumePath}...)
+func (c *DefaultClient) DeleteSubvolume(ctx context.Context, subvolumePath string) error {
+	return c.Exec(ctx, buildDeleteArgs(subvolumePath)...)
+}
+
+func buildDeleteArgs(subvolumePath string) []string {
+	return []string{"subvolume", "delete", subvolumePath}
+}
+
+// Send writes a send stream of the read-only snapshot to w, which 'btrfs receive' turns
+// back into a subvolume. If parentPath is set, the stream only holds the changes since that
+// snapshot and can only be received where the parent was received before.
+// It runs 'sudo btrfs send [-p <parentPath>] <snapshotPath>'.
+func (c *DefaultClient) Send(ctx context.Context, snapshotPath, parentPath string, w io.Writer) error {
+	return c.Stream(ctx, w, buildSendArgs(snapshotPath, parentPath)...)
+}
+
+func buildSendArgs(snapshotPath, parentPath string) []string {
+	args := []string{"send"}
+	if parentPath != "" {
+		args = append(args, "-p", parentPath)
+	}
+	return append(args, snapshotPath)
+}
+
+// FilesystemUUID returns the UUID of the BTRFS filesystem containing path.
+// It runs 'sudo btrfs filesystem show <path>' and parses the uuid field of its output.
+func (c *DefaultClient) FilesystemUUID(ctx context.Context, path string) (string, error) {
+	output, err := c.Output(ctx, "filesystem", "show", path)
+	if err != nil {
+		return "", err
+	}
+	return parseFilesystemUUID(string(output))
+}
+
+func parseFilesystemUUID(output string) (string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		_, uuid, found := strings.Cut(line, "uuid:")
+		if found {
+			return strings.TrimSpace(uuid), nil
+		}
+	}
+	return "", fmt.Errorf("no filesystem uuid in btrfs output")
+}
+
+// ExclusiveSize returns the bytes used only by the subvolume, which deleting it frees.
+// It runs 'sudo btrfs qgroup show -f --raw <subvolumePath>' and therefore requires quotas
+// to be enabled on the filesystem ('btrfs quota enable').
+func (c *DefaultClient) ExclusiveSize(ctx context.Context, subvolumePath string) (int64, error) {
+	output, err := c.Output(ctx, "qgroup", "show", "-f", "--raw", subvolumePath)
+	if err != nil {
+		return 0, err
+	}
+	return parseExclusiveSize(string(output))
+}
+
+// parseExclusiveSize reads the exclusive column of the level 0 qgroup, the subvolume's own,
+// from 'btrfs qgroup show' output.
+func parseExclusiveSize(output string) (int64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "0/") {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid exclusive size '%s' in btrfs output", fields[2])
+		}
+		return size, nil
+	}
+	return 0, fmt.Errorf("no qgroup in btrfs output")
+}
+
+// DeviceStats returns the error counters of the devices of the filesystem containing path:
+// read, write and flush I/O errors, checksum and generation mismatches. The counters
+// persist across reboots until reset with 'btrfs device stats -z'.
+// It runs 'sudo btrfs device stats <path>'.
+func (c *DefaultClient) DeviceStats(ctx context.Context, path string) ([]DeviceStat, error) {
+	output, err := c.Output(ctx, "device", "stats", path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceStats(string(output))
+}
+
+// parseDeviceStats reads the '[<device>].<counter> <value>' lines of 'btrfs device stats' output.
+func parseDeviceStats(output string) ([]DeviceStat, error) {
+	var stats []DeviceStat
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "[") {
+			continue
+		}
+		device, counter, found := strings.Cut(strings.TrimPrefix(fields[0], "["), "].")
+		if !found {
+			return nil, fmt.Errorf("invalid device stats line '%s' in btrfs output", line)
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value '%s' in btrfs output", counter, fields[1])
+		}
+		stats = append(stats, DeviceStat{Device: device, Counter: counter, Value: value})
+	}
+	if len(stats) == 0 {
+		return nil, fmt.Errorf("no device stats in btrfs output")
+	}
+	return stats, nil
 }
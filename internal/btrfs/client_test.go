@@ -1,6 +1,15 @@
 package btrfs
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -16,6 +25,295 @@ func TestNewDefaultClient(t *testing.T) {
 // and basic construction. Actual BTRFS command testing is done through the mock
 // implementations in the backup package tests.
 
+func TestBtrfsCommandStream(t *testing.T) {
+	var out bytes.Buffer
+	cmd := &BtrfsCommand{Name: "sh", Args: []string{"-c", "printf stream"}}
+	if err := cmd.Stream(context.Background(), &out); err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	if out.String() != "stream" {
+		t.Errorf("Expected output 'stream', got %q", out.String())
+	}
+}
+
 func TestDefaultClientImplementsInterface(t *testing.T) {
 	var _ Client = (*DefaultClient)(nil)
 }
+
+// writeScript writes an executable shell script to dir and returns its path.
+func writeScript(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultClientPkexecFallback(t *testing.T) {
+	dir := t.TempDir()
+	btrfs := writeScript(t, dir, "btrfs", `echo "Flags: readonly $*"`)
+	calls := filepath.Join(dir, "calls")
+	passwordSudo := writeScript(t, dir, "sudo", `echo sudo >> `+calls+`; echo "sudo: a password is required" >&2; exit 1`)
+	pkexec := writeScript(t, dir, "pkexec", `echo "pkexec $1" >> `+calls+`; exec "$@"`)
+	ctx := context.Background()
+
+	client := &DefaultClient{btrfsBin: btrfs, runAsSudo: true, sudoBin: passwordSudo, pkexecBin: pkexec}
+	for range 2 {
+		subvolume, err := client.ShowSubvolume(ctx, "/data")
+		if err != nil || !subvolume.ReadOnly {
+			t.Fatalf("Expected the command to run through pkexec, got %+v (%v)", subvolume, err)
+		}
+	}
+	var out bytes.Buffer
+	if err := client.Stream(ctx, &out, "send", "/snapshots/a"); err != nil || out.String() != "Flags: readonly send /snapshots/a\n" {
+		t.Errorf("Unexpected stream %q (%v)", out.String(), err)
+	}
+	recorded, _ := os.ReadFile(calls)
+	// sudo is tried once, later commands go to pkexec directly
+	expected := "sudo\npkexec " + btrfs + "\npkexec " + btrfs + "\npkexec " + btrfs + "\n"
+	if string(recorded) != expected {
+		t.Errorf("Expected calls %q, got %q", expected, recorded)
+	}
+
+	client = &DefaultClient{btrfsBin: btrfs, runAsSudo: true, sudoBin: passwordSudo, pkexecBin: filepath.Join(dir, "missing")}
+	if _, err := client.ShowSubvolume(ctx, "/data"); err == nil || !strings.Contains(err.Error(), "a password is required") {
+		t.Errorf("Expected the sudo error without pkexec, got %v", err)
+	}
+
+	// From a terminal, plain sudo asks for the password instead
+	promptingSudo := writeScript(t, dir, "prompting-sudo", `if [ "$1" = -n ]; then echo "sudo: a password is required" >&2; exit 1; fi; exec "$@"`)
+	client = &DefaultClient{btrfsBin: btrfs, runAsSudo: true, sudoBin: promptingSudo, pkexecBin: filepath.Join(dir, "missing"), terminal: true}
+	if subvolume, err := client.ShowSubvolume(ctx, "/data"); err != nil || !subvolume.ReadOnly {
+		t.Errorf("Expected the command to run through plain sudo, got %+v (%v)", subvolume, err)
+	}
+
+	failingSudo := writeScript(t, dir, "failing-sudo", `echo "btrfs: not a subvolume" >&2; exit 1`)
+	client = &DefaultClient{btrfsBin: btrfs, runAsSudo: true, sudoBin: failingSudo, pkexecBin: pkexec}
+	if _, err := client.ShowSubvolume(ctx, "/data"); err == nil || !strings.Contains(err.Error(), "not a subvolume") || client.usePkexec.Load() {
+		t.Errorf("Expected other failures not to fall back to pkexec, got %v", err)
+	}
+}
+
+func TestPolkitPolicy(t *testing.T) {
+	policy, err := PolkitPolicy("/usr/bin/btrfs")
+	if err != nil {
+		t.Fatalf("PolkitPolicy failed: %v", err)
+	}
+	for _, expected := range []string{`<action id="org.btrfs-backup.btrfs">`, "<allow_active>auth_admin_keep</allow_active>",
+		`<annotate key="org.freedesktop.policykit.exec.path">/usr/bin/btrfs</annotate>`} {
+		if !strings.Contains(policy, expected) {
+			t.Errorf("Expected policy to contain %q:\n%s", expected, policy)
+		}
+	}
+	if _, err := PolkitPolicy("btrfs"); err == nil {
+		t.Error("Expected error for a relative path")
+	}
+}
+
+type recordingClient struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *recordingClient) record(call string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+func (c *recordingClient) recorded() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.calls)
+}
+
+func (c *recordingClient) ShowSubvolume(ctx context.Context, subvolume string) (Subvolume, error) {
+	c.record("show " + subvolume)
+	return Subvolume{}, nil
+}
+
+func (c *recordingClient) CreateSnapshot(ctx context.Context, subvolume, snapshotPath string, readonly bool) error {
+	c.record("snapshot " + subvolume)
+	return nil
+}
+
+func (c *recordingClient) CreateSubvolume(ctx context.Context, subvolumePath string) error {
+	c.record("create " + subvolumePath)
+	return nil
+}
+
+func (c *recordingClient) Send(ctx context.Context, snapshotPath, parentPath string, w io.Writer) error {
+	c.record("send " + snapshotPath)
+	return nil
+}
+
+func (c *recordingClient) DeleteSubvolume(ctx context.Context, subvolumePath string) error {
+	c.record("delete " + subvolumePath)
+	return nil
+}
+
+func (c *recordingClient) FilesystemUUID(ctx context.Context, path string) (string, error) {
+	c.record("uuid " + path)
+	return "", nil
+}
+
+func (c *recordingClient) ExclusiveSize(ctx context.Context, subvolumePath string) (int64, error) {
+	c.record("size " + subvolumePath)
+	return 0, nil
+}
+
+func (c *recordingClient) DeviceStats(ctx context.Context, path string) ([]DeviceStat, error) {
+	c.record("stats " + path)
+	return nil, nil
+}
+
+func TestDryRunClient(t *testing.T) {
+	var out bytes.Buffer
+	inner := &recordingClient{}
+	client := NewDryRunClient(inner, &out)
+	ctx := context.Background()
+
+	if _, err := client.ShowSubvolume(ctx, "/mnt/btrfs/home"); err != nil {
+		t.Fatalf("ShowSubvolume failed: %v", err)
+	}
+	if err := client.CreateSnapshot(ctx, "/mnt/btrfs/home", "/snapshots/home-20230101-120000", true); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if err := client.CreateSubvolume(ctx, "/snapshots/system-20230101-120000"); err != nil {
+		t.Fatalf("CreateSubvolume failed: %v", err)
+	}
+	if err := client.Send(ctx, "/snapshots/home-20230101-120000", "/snapshots/home-20221231-120000", io.Discard); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := client.DeleteSubvolume(ctx, "/snapshots/home-20221231-120000"); err != nil {
+		t.Fatalf("DeleteSubvolume failed: %v", err)
+	}
+
+	if len(inner.calls) != 1 || inner.calls[0] != "show /mnt/btrfs/home" {
+		t.Errorf("Expected only ShowSubvolume to reach the wrapped client, got %v", inner.calls)
+	}
+
+	expected := "[dry-run] btrfs subvolume snapshot -r /mnt/btrfs/home /snapshots/home-20230101-120000\n" +
+		"[dry-run] btrfs subvolume create /snapshots/system-20230101-120000\n" +
+		"[dry-run] btrfs send -p /snapshots/home-20221231-120000 /snapshots/home-20230101-120000\n" +
+		"[dry-run] btrfs subvolume delete /snapshots/home-20221231-120000\n"
+	if out.String() != expected {
+		t.Errorf("Expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestDryRunClientImplementsInterface(t *testing.T) {
+	var _ Client = (*DryRunClient)(nil)
+}
+
+func TestParseFilesystemUUID(t *testing.T) {
+	output := `Label: 'data'  uuid: 5d2b7f0e-8c1a-4b52-9d3e-2f6a1c0b9e77
+	Total devices 1 FS bytes used 1.20TiB
+	devid    1 size 3.64TiB used 1.22TiB path /dev/sda1
+
+`
+	uuid, err := parseFilesystemUUID(output)
+	if err != nil {
+		t.Fatalf("parseFilesystemUUID failed: %v", err)
+	}
+	if uuid != "5d2b7f0e-8c1a-4b52-9d3e-2f6a1c0b9e77" {
+		t.Errorf("Unexpected uuid '%s'", uuid)
+	}
+
+	_, err = parseFilesystemUUID("ERROR: not a btrfs filesystem\n")
+	if err == nil {
+		t.Error("parseFilesystemUUID should fail without a uuid field")
+	}
+}
+
+func TestParseSubvolume(t *testing.T) {
+	output := "home\n" +
+		"\tName: \t\t\thome\n" +
+		"\tUUID: \t\t\t9d3e2f6a-1c0b-4e77-8c1a-5d2b7f0e4b52\n" +
+		"\tFlags: \t\t\t%s\n" +
+		"\tSnapshot(s):\n"
+
+	if info := parseSubvolume(fmt.Sprintf(output, "readonly")); !info.ReadOnly {
+		t.Error("Expected readonly flag to be parsed")
+	}
+	if info := parseSubvolume(fmt.Sprintf(output, "-")); info.ReadOnly {
+		t.Error("Expected writable subvolume without flags")
+	}
+}
+
+func TestParseExclusiveSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      string
+		expected    int64
+		expectError bool
+	}{
+		{
+			name: "current_format",
+			output: "Qgroupid    Referenced    Exclusive   Path \n" +
+				"--------    ----------    ---------   ---- \n" +
+				"0/261       5368709120    1073741824  snapshots/home-20230101-120000\n",
+			expected: 1073741824,
+		},
+		{
+			name: "legacy_format",
+			output: "qgroupid         rfer         excl \n" +
+				"--------         ----         ---- \n" +
+				"0/261      5368709120    104857600 \n",
+			expected: 104857600,
+		},
+		{
+			name:        "quotas_disabled",
+			output:      "ERROR: can't list qgroups: quotas not enabled\n",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := parseExclusiveSize(tt.output)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got size %d", size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExclusiveSize failed: %v", err)
+			}
+			if size != tt.expected {
+				t.Errorf("Expected size %d, got %d", tt.expected, size)
+			}
+		})
+	}
+}
+
+func TestParseDeviceStats(t *testing.T) {
+	output := `[/dev/sda1].write_io_errs    0
+[/dev/sda1].read_io_errs     2
+[/dev/sda1].flush_io_errs    0
+[/dev/sda1].corruption_errs  14
+[/dev/sda1].generation_errs  0
+[/dev/mapper/luks-b].write_io_errs    0
+`
+	stats, err := parseDeviceStats(output)
+	if err != nil {
+		t.Fatalf("parseDeviceStats failed: %v", err)
+	}
+	if len(stats) != 6 {
+		t.Fatalf("Expected 6 counters, got %v", stats)
+	}
+	if stats[3] != (DeviceStat{Device: "/dev/sda1", Counter: "corruption_errs", Value: 14}) {
+		t.Errorf("Unexpected corruption counter %+v", stats[3])
+	}
+	if stats[5].Device != "/dev/mapper/luks-b" {
+		t.Errorf("Unexpected device %s", stats[5].Device)
+	}
+
+	for _, invalid := range []string{"", "ERROR: not a btrfs filesystem\n", "[/dev/sda1].read_io_errs many\n"} {
+		if _, err := parseDeviceStats(invalid); err == nil {
+			t.Errorf("Expected error for output %q", invalid)
+		}
+	}
+}
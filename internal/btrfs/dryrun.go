@@ -0,0 +1,65 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DryRunClient wraps a Client so that read-only operations are passed through
+// while operations that modify subvolumes are only printed.
+type DryRunClient struct {
+	client Client
+	out    io.Writer
+}
+
+// NewDryRunClient creates a DryRunClient that prints skipped commands to out.
+func NewDryRunClient(client Client, out io.Writer) *DryRunClient {
+	return &DryRunClient{client: client, out: out}
+}
+
+// ShowSubvolume is read-only and delegates to the wrapped client.
+func (c *DryRunClient) ShowSubvolume(ctx context.Context, subvolume string) (Subvolume, error) {
+	return c.client.ShowSubvolume(ctx, subvolume)
+}
+
+// FilesystemUUID is read-only and delegates to the wrapped client.
+func (c *DryRunClient) FilesystemUUID(ctx context.Context, path string) (string, error) {
+	return c.client.FilesystemUUID(ctx, path)
+}
+
+// ExclusiveSize is read-only and delegates to the wrapped client.
+func (c *DryRunClient) ExclusiveSize(ctx context.Context, subvolumePath string) (int64, error) {
+	return c.client.ExclusiveSize(ctx, subvolumePath)
+}
+
+// DeviceStats is read-only and delegates to the wrapped client.
+func (c *DryRunClient) DeviceStats(ctx context.Context, path string) ([]DeviceStat, error) {
+	return c.client.DeviceStats(ctx, path)
+}
+
+// CreateSnapshot prints the 'btrfs subvolume snapshot' command instead of running it.
+func (c *DryRunClient) CreateSnapshot(ctx context.Context, subvolume, snapshotPath string, readonly bool) error {
+	return c.print(buildSnapshotArgs(subvolume, snapshotPath, readonly))
+}
+
+// CreateSubvolume prints the 'btrfs subvolume create' command instead of running it.
+func (c *DryRunClient) CreateSubvolume(ctx context.Context, subvolumePath string) error {
+	return c.print(buildCreateArgs(subvolumePath))
+}
+
+// DeleteSubvolume prints the 'btrfs subvolume delete' command instead of running it.
+func (c *DryRunClient) DeleteSubvolume(ctx context.Context, subvolumePath string) error {
+	return c.print(buildDeleteArgs(subvolumePath))
+}
+
+// Send prints the 'btrfs send' command instead of running it. Nothing is written to w.
+func (c *DryRunClient) Send(ctx context.Context, snapshotPath, parentPath string, w io.Writer) error {
+	return c.print(buildSendArgs(snapshotPath, parentPath))
+}
+
+func (c *DryRunClient) print(args []string) error {
+	_, err := fmt.Fprintf(c.out, "[dry-run] btrfs %s\n", strings.Join(args, " "))
+	return err
+}
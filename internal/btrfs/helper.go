@@ -0,0 +1,284 @@
+package btrfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// helperRequest is a request of HelperClient to the helper, one JSON object per connection.
+type helperRequest struct {
+	Op        string `json:"op"`
+	Path      string `json:"path"`
+	Subvolume string `json:"subvolume,omitempty"` // source of snapshots
+	ReadOnly  bool   `json:"readonly,omitempty"`
+}
+
+// helperResponse is the answer of the helper to a helperRequest.
+type helperResponse struct {
+	Error     string       `json:"error,omitempty"`
+	Subvolume Subvolume    `json:"subvolume"`
+	UUID      string       `json:"uuid,omitempty"`
+	Size      int64        `json:"size,omitempty"`
+	Stats     []DeviceStat `json:"stats,omitempty"`
+}
+
+// Operations of the helper protocol.
+const (
+	helperShow          = "show"
+	helperSnapshot      = "snapshot"
+	helperCreate        = "create"
+	helperDelete        = "delete"
+	helperUUID          = "uuid"
+	helperExclusiveSize = "exclusive_size"
+	helperDeviceStats   = "device_stats"
+)
+
+// ErrHelperUnsupported is returned by HelperClient for operations the helper doesn't
+// perform.
+var ErrHelperUnsupported = errors.New("not supported through the btrfs helper")
+
+// Helper performs whitelisted btrfs operations for unprivileged clients connecting to a
+// unix socket, so that the backups don't need sudo rules for btrfs. It only creates
+// read-only snapshots of its source subvolumes and creates or deletes subvolumes inside
+// its snapshot directory; showing subvolumes and reading the filesystem UUID, qgroup sizes
+// and device error counters is allowed anywhere. Send streams are not served.
+type Helper struct {
+	client      Client
+	snapshotDir string
+	sources     []string
+}
+
+// NewHelper creates a Helper running the operations with client, confined to snapshotDir
+// and to snapshots of the subvolumes in sources.
+func NewHelper(client Client, snapshotDir string, sources []string) *Helper {
+	h := &Helper{client: client, snapshotDir: filepath.Clean(snapshotDir)}
+	for _, source := range sources {
+		h.sources = append(h.sources, filepath.Clean(source))
+	}
+	return h
+}
+
+// Serve answers the requests of the connections accepted on l until ctx is done, each in
+// its own goroutine. Access is controlled by the permissions of the socket.
+func (h *Helper) Serve(ctx context.Context, l net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go h.serveConn(ctx, conn)
+	}
+}
+
+func (h *Helper) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	var request helperRequest
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		slog.Warn("Invalid btrfs helper request", "error", err)
+		return
+	}
+
+	response := h.handle(ctx, request)
+	if response.Error != "" {
+		slog.Warn("btrfs helper request failed", "op", request.Op, "path", request.Path, "error", response.Error)
+	} else {
+		slog.Info("btrfs helper request served", "op", request.Op, "path", request.Path)
+	}
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		slog.Warn("Failed to answer btrfs helper request", "op", request.Op, "error", err)
+	}
+}
+
+// handle checks a request against the whitelist and runs it.
+func (h *Helper) handle(ctx context.Context, request helperRequest) helperResponse {
+	var response helperResponse
+	if !filepath.IsAbs(request.Path) {
+		response.Error = fmt.Sprintf("path must be absolute, got '%s'", request.Path)
+		return response
+	}
+
+	var err error
+	switch request.Op {
+	case helperShow:
+		response.Subvolume, err = h.client.ShowSubvolume(ctx, request.Path)
+	case helperUUID:
+		response.UUID, err = h.client.FilesystemUUID(ctx, request.Path)
+	case helperExclusiveSize:
+		response.Size, err = h.client.ExclusiveSize(ctx, request.Path)
+	case helperDeviceStats:
+		response.Stats, err = h.client.DeviceStats(ctx, request.Path)
+	case helperSnapshot:
+		if !request.ReadOnly {
+			err = fmt.Errorf("only read-only snapshots can be created")
+		} else if !slices.Contains(h.sources, filepath.Clean(request.Subvolume)) {
+			err = fmt.Errorf("%s is not the subvolume of a target", request.Subvolume)
+		} else {
+			err = h.inSnapshotDir(request.Path, func(path string) error {
+				return h.client.CreateSnapshot(ctx, request.Subvolume, path, true)
+			})
+		}
+	case helperCreate:
+		err = h.inSnapshotDir(request.Path, func(path string) error {
+			return h.client.CreateSubvolume(ctx, path)
+		})
+	case helperDelete:
+		err = h.inSnapshotDir(request.Path, func(path string) error {
+			return h.client.DeleteSubvolume(ctx, path)
+		})
+	default:
+		err = fmt.Errorf("unknown operation '%s'", request.Op)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response
+}
+
+// inSnapshotDir runs op on path, which must lie below the snapshot directory. The
+// directories leading to path are opened one at a time without following symlinks, and op
+// gets path through the open directory containing it, /proc/<pid>/fd/<fd>/<name>, so that
+// a client can't redirect the operation by swapping a directory for a symlink.
+func (h *Helper) inSnapshotDir(path string, op func(path string) error) error {
+	rel, err := filepath.Rel(h.snapshotDir, filepath.Clean(path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("%s is outside the snapshot directory %s", path, h.snapshotDir)
+	}
+
+	dir, err := os.Open(h.snapshotDir)
+	if err != nil {
+		return err
+	}
+	defer func() { dir.Close() }()
+	components := strings.Split(rel, "/")
+	for _, name := range components[:len(components)-1] {
+		fd, err := syscall.Openat(int(dir.Fd()), name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("%s is outside the snapshot directory %s: %w", path, h.snapshotDir, &os.PathError{Op: "open", Path: name, Err: err})
+		}
+		dir.Close()
+		dir = os.NewFile(uintptr(fd), name)
+	}
+
+	path = fmt.Sprintf("/proc/%d/fd/%d/%s", os.Getpid(), dir.Fd(), components[len(components)-1])
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symlink", filepath.Join(h.snapshotDir, rel))
+	}
+	return op(path)
+}
+
+// HelperClient is a Client that has a Helper listening on a unix socket perform the
+// operations, for running without privileges. Send is not supported.
+type HelperClient struct {
+	socket string
+}
+
+// NewHelperClient creates a HelperClient connecting to the helper at socket.
+func NewHelperClient(socket string) *HelperClient {
+	return &HelperClient{socket: socket}
+}
+
+// call sends a request to the helper and returns its response, or an error with the
+// helper's error message if the operation failed.
+func (c *HelperClient) call(ctx context.Context, request helperRequest) (*helperResponse, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", c.socket)
+	if err != nil {
+		return nil, fmt.Errorf("btrfs helper unavailable: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, fmt.Errorf("btrfs helper request failed: %w", err)
+	}
+	var response helperResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("btrfs helper response failed: %w", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("btrfs helper: %s", response.Error)
+	}
+	return &response, nil
+}
+
+// ShowSubvolume returns the properties of a subvolume, see DefaultClient.ShowSubvolume.
+func (c *HelperClient) ShowSubvolume(ctx context.Context, subvolume string) (Subvolume, error) {
+	response, err := c.call(ctx, helperRequest{Op: helperShow, Path: subvolume})
+	if err != nil {
+		return Subvolume{}, err
+	}
+	return response.Subvolume, nil
+}
+
+// CreateSnapshot creates a snapshot inside the helper's snapshot directory. The helper
+// refuses writable snapshots.
+func (c *HelperClient) CreateSnapshot(ctx context.Context, subvolume, snapshotPath string, readonly bool) error {
+	_, err := c.call(ctx, helperRequest{Op: helperSnapshot, Path: snapshotPath, Subvolume: subvolume, ReadOnly: readonly})
+	return err
+}
+
+// CreateSubvolume creates an empty subvolume inside the helper's snapshot directory.
+func (c *HelperClient) CreateSubvolume(ctx context.Context, subvolumePath string) error {
+	_, err := c.call(ctx, helperRequest{Op: helperCreate, Path: subvolumePath})
+	return err
+}
+
+// DeleteSubvolume deletes a subvolume inside the helper's snapshot directory.
+func (c *HelperClient) DeleteSubvolume(ctx context.Context, subvolumePath string) error {
+	_, err := c.call(ctx, helperRequest{Op: helperDelete, Path: subvolumePath})
+	return err
+}
+
+// FilesystemUUID returns the UUID of the filesystem containing path, see
+// DefaultClient.FilesystemUUID.
+func (c *HelperClient) FilesystemUUID(ctx context.Context, path string) (string, error) {
+	response, err := c.call(ctx, helperRequest{Op: helperUUID, Path: path})
+	if err != nil {
+		return "", err
+	}
+	return response.UUID, nil
+}
+
+// ExclusiveSize returns the bytes used only by the subvolume, see
+// DefaultClient.ExclusiveSize.
+func (c *HelperClient) ExclusiveSize(ctx context.Context, subvolumePath string) (int64, error) {
+	response, err := c.call(ctx, helperRequest{Op: helperExclusiveSize, Path: subvolumePath})
+	if err != nil {
+		return 0, err
+	}
+	return response.Size, nil
+}
+
+// DeviceStats returns the error counters of the devices of the filesystem containing
+// path, see DefaultClient.DeviceStats.
+func (c *HelperClient) DeviceStats(ctx context.Context, path string) ([]DeviceStat, error) {
+	response, err := c.call(ctx, helperRequest{Op: helperDeviceStats, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return response.Stats, nil
+}
+
+// Send is not supported: the helper doesn't hand out the contents of snapshots.
+func (c *HelperClient) Send(ctx context.Context, snapshotPath, parentPath string, w io.Writer) error {
+	return fmt.Errorf("btrfs send: %w", ErrHelperUnsupported)
+}
@@ -0,0 +1,184 @@
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// resolvingClient is a recordingClient recording the paths of the operations inside the
+// snapshot directory with symlinks resolved, after running before, e.g. to swap a symlink
+// in.
+type resolvingClient struct {
+	*recordingClient
+	before func()
+}
+
+func (c *resolvingClient) resolve(path string) string {
+	if c.before != nil {
+		c.before()
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return path
+	}
+	return filepath.Join(dir, filepath.Base(path))
+}
+
+func (c *resolvingClient) CreateSnapshot(ctx context.Context, subvolume, snapshotPath string, readonly bool) error {
+	c.record("snapshot " + subvolume + " " + c.resolve(snapshotPath))
+	return nil
+}
+
+func (c *resolvingClient) CreateSubvolume(ctx context.Context, subvolumePath string) error {
+	c.record("create " + c.resolve(subvolumePath))
+	return nil
+}
+
+func (c *resolvingClient) DeleteSubvolume(ctx context.Context, subvolumePath string) error {
+	c.record("delete " + c.resolve(subvolumePath))
+	return nil
+}
+
+// startHelper serves a Helper confined to a temporary snapshot directory and snapshots of
+// /mnt/btrfs/home on a socket and returns a client of it, the directory and the client the
+// helper runs operations with.
+func startHelper(t *testing.T) (*HelperClient, string, *resolvingClient) {
+	dir := t.TempDir()
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotDir := filepath.Join(dir, "snapshots")
+	if err := os.Mkdir(snapshotDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "helper.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	inner := &resolvingClient{recordingClient: &recordingClient{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- NewHelper(inner, snapshotDir, []string{"/mnt/btrfs/home/"}).Serve(ctx, l) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("Serve failed: %v", err)
+		}
+	})
+	return NewHelperClient(socket), snapshotDir, inner
+}
+
+func TestHelper(t *testing.T) {
+	client, snapshotDir, inner := startHelper(t)
+	ctx := context.Background()
+	snapshot := filepath.Join(snapshotDir, "home-20230101-120000")
+
+	if _, err := client.ShowSubvolume(ctx, "/mnt/btrfs/home"); err != nil {
+		t.Errorf("ShowSubvolume failed: %v", err)
+	}
+	if err := client.CreateSnapshot(ctx, "/mnt/btrfs/home", snapshot, true); err != nil {
+		t.Errorf("CreateSnapshot failed: %v", err)
+	}
+	if err := client.DeleteSubvolume(ctx, snapshot); err != nil {
+		t.Errorf("DeleteSubvolume failed: %v", err)
+	}
+	if _, err := client.DeviceStats(ctx, "/mnt/btrfs"); err != nil {
+		t.Errorf("DeviceStats failed: %v", err)
+	}
+
+	expected := []string{"show /mnt/btrfs/home", "snapshot /mnt/btrfs/home " + snapshot, "delete " + snapshot, "stats /mnt/btrfs"}
+	if calls := inner.recorded(); !slices.Equal(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestHelperRefusals(t *testing.T) {
+	client, snapshotDir, inner := startHelper(t)
+	ctx := context.Background()
+	if err := os.Symlink("/", filepath.Join(snapshotDir, "root")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, call := range map[string]func() error{
+		"snapshot_other_subvolume": func() error {
+			return client.CreateSnapshot(ctx, "/root", filepath.Join(snapshotDir, "root-copy"), true)
+		},
+		"writable_snapshot": func() error {
+			return client.CreateSnapshot(ctx, "/mnt/btrfs/home", filepath.Join(snapshotDir, "home"), false)
+		},
+		"snapshot_outside": func() error {
+			return client.CreateSnapshot(ctx, "/mnt/btrfs/home", "/mnt/btrfs/home-copy", true)
+		},
+		"delete_outside":        func() error { return client.DeleteSubvolume(ctx, "/mnt/btrfs/home") },
+		"delete_snapshot_dir":   func() error { return client.DeleteSubvolume(ctx, snapshotDir) },
+		"delete_through_parent": func() error { return client.DeleteSubvolume(ctx, snapshotDir+"/../home") },
+		"delete_through_link":   func() error { return client.DeleteSubvolume(ctx, filepath.Join(snapshotDir, "root", "home")) },
+		"delete_link":           func() error { return client.DeleteSubvolume(ctx, filepath.Join(snapshotDir, "root")) },
+		"relative_path":         func() error { return client.CreateSubvolume(ctx, "snapshots/home") },
+	} {
+		if err := call(); err == nil || !strings.Contains(err.Error(), "btrfs helper:") {
+			t.Errorf("%s: expected the helper to refuse, got %v", name, err)
+		}
+	}
+	if err := client.Send(ctx, filepath.Join(snapshotDir, "home"), "", io.Discard); !errors.Is(err, ErrHelperUnsupported) {
+		t.Errorf("Expected send to be unsupported, got %v", err)
+	}
+	if calls := inner.recorded(); len(calls) != 0 {
+		t.Errorf("Expected no operation to run, got %v", calls)
+	}
+}
+
+func TestHelperSymlinkSwap(t *testing.T) {
+	client, snapshotDir, inner := startHelper(t)
+	ctx := context.Background()
+	set := filepath.Join(snapshotDir, "system-20230101-120000")
+	if err := os.Mkdir(set, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the helper checked the path, the directory is replaced by a symlink leading
+	// out of the snapshot directory
+	outside := t.TempDir()
+	inner.before = func() {
+		if err := os.Rename(set, set+".old"); err != nil {
+			t.Error(err)
+		}
+		if err := os.Symlink(outside, set); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := client.DeleteSubvolume(ctx, filepath.Join(set, "home")); err != nil {
+		t.Fatalf("DeleteSubvolume failed: %v", err)
+	}
+	expected := []string{"delete " + filepath.Join(set+".old", "home")}
+	if calls := inner.recorded(); !slices.Equal(calls, expected) {
+		t.Errorf("Expected the operation in the checked directory %v, got %v", expected, calls)
+	}
+
+	// The symlink is refused from then on
+	inner.before = nil
+	if err := client.DeleteSubvolume(ctx, filepath.Join(set, "home")); err == nil {
+		t.Error("Expected the helper to refuse a path through the swapped in symlink")
+	}
+}
+
+func TestHelperUnavailable(t *testing.T) {
+	client := NewHelperClient(filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := client.ShowSubvolume(context.Background(), "/mnt/btrfs/home"); err == nil || !strings.Contains(err.Error(), "btrfs helper unavailable") {
+		t.Errorf("Expected unavailable helper error, got %v", err)
+	}
+}
+
+func TestHelperClientImplementsInterface(t *testing.T) {
+	var _ Client = (*HelperClient)(nil)
+}
@@ -0,0 +1,274 @@
+package btrfs
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// Kernel ABI of the btrfs ioctls used by IoctlClient, see include/uapi/linux/btrfs.h.
+const (
+	btrfsSuperMagic    = 0x9123683e // f_type of btrfs filesystems in statfs
+	btrfsFirstObjectID = 256        // inode number of the root directory of every subvolume
+	btrfsSubvolRDOnly  = 1 << 1     // BTRFS_SUBVOL_RDONLY
+	btrfsPathNameMax   = 4087
+	btrfsSubvolNameMax = 4039
+)
+
+// btrfsVolArgs is struct btrfs_ioctl_vol_args.
+type btrfsVolArgs struct {
+	fd   int64
+	name [btrfsPathNameMax + 1]byte
+}
+
+// btrfsVolArgsV2 is struct btrfs_ioctl_vol_args_v2, without qgroup inheritance.
+type btrfsVolArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	unused  [4]uint64
+	name    [btrfsSubvolNameMax + 1]byte
+}
+
+// btrfsFsInfoArgs is struct btrfs_ioctl_fs_info_args.
+type btrfsFsInfoArgs struct {
+	maxID          uint64
+	numDevices     uint64
+	fsid           [16]byte
+	nodesize       uint32
+	sectorsize     uint32
+	cloneAlignment uint32
+	csumType       uint16
+	csumSize       uint16
+	flags          uint64
+	generation     uint64
+	metadataUUID   [16]byte
+	reserved       [944]byte
+}
+
+// ioctl request numbers, encoded like the _IOR and _IOW macros.
+var (
+	iocSubvolCreate   = iow(14, unsafe.Sizeof(btrfsVolArgs{}))
+	iocSnapDestroy    = iow(15, unsafe.Sizeof(btrfsVolArgs{}))
+	iocSnapCreateV2   = iow(23, unsafe.Sizeof(btrfsVolArgsV2{}))
+	iocSubvolGetflags = ior(25, unsafe.Sizeof(uint64(0)))
+	iocFsInfo         = ior(31, unsafe.Sizeof(btrfsFsInfoArgs{}))
+)
+
+const btrfsIoctlMagic = 0x94
+
+func iow(nr, size uintptr) uintptr {
+	return 1<<30 | size<<16 | btrfsIoctlMagic<<8 | nr
+}
+
+func ior(nr, size uintptr) uintptr {
+	return 2<<30 | size<<16 | btrfsIoctlMagic<<8 | nr
+}
+
+// ErrNotBtrfs is returned by IoctlClient for paths that are not on a btrfs filesystem.
+var ErrNotBtrfs = errors.New("not a btrfs filesystem")
+
+// ErrNotSubvolume is returned by IoctlClient.ShowSubvolume for directories that are not
+// the root of a subvolume.
+var ErrNotSubvolume = errors.New("not a btrfs subvolume")
+
+// IoctlClient is a Client performing snapshots, subvolume creation and deletion and
+// reading subvolume flags and the filesystem UUID with btrfs ioctls directly, rather than
+// running the btrfs CLI, so it doesn't depend on the output of a btrfs-progs version.
+// Failures are returned as *os.PathError carrying the errno, e.g. syscall.EEXIST.
+// Operations lacking privileges, as for a backup running as a user with sudo rules, and
+// the operations without an ioctl implementation (send, qgroup sizes and device stats)
+// are passed to the fallback client.
+type IoctlClient struct {
+	fallback Client
+}
+
+// NewIoctlClient creates an IoctlClient passing what it can't do to fallback.
+func NewIoctlClient(fallback Client) *IoctlClient {
+	return &IoctlClient{fallback: fallback}
+}
+
+// ioctl runs an ioctl on the open file f with arg pointing to its argument.
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openDir opens the directory at path, after checking that it is on a btrfs filesystem.
+func openDir(path string) (*os.File, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	if uint32(stat.Type) != btrfsSuperMagic {
+		return nil, &os.PathError{Op: "open", Path: path, Err: ErrNotBtrfs}
+	}
+	return os.Open(path)
+}
+
+// privileged reports whether err is the kernel refusing an ioctl for lack of privileges,
+// so that the fallback client, which runs btrfs through sudo, may succeed.
+func privileged(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES)
+}
+
+// ShowSubvolume returns the properties of the subvolume at path, read with the
+// BTRFS_IOC_SUBVOL_GETFLAGS ioctl. Returns ErrNotSubvolume for other directories.
+func (c *IoctlClient) ShowSubvolume(ctx context.Context, subvolume string) (Subvolume, error) {
+	f, err := openDir(subvolume)
+	if privileged(err) {
+		return c.fallback.ShowSubvolume(ctx, subvolume)
+	}
+	if err != nil {
+		return Subvolume{}, err
+	}
+	defer f.Close()
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &stat); err != nil {
+		return Subvolume{}, &os.PathError{Op: "stat", Path: subvolume, Err: err}
+	}
+	if stat.Ino != btrfsFirstObjectID || stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return Subvolume{}, &os.PathError{Op: "btrfs subvolume show", Path: subvolume, Err: ErrNotSubvolume}
+	}
+	var flags uint64
+	if err := ioctl(f, iocSubvolGetflags, unsafe.Pointer(&flags)); err != nil {
+		if privileged(err) {
+			return c.fallback.ShowSubvolume(ctx, subvolume)
+		}
+		return Subvolume{}, &os.PathError{Op: "btrfs subvolume show", Path: subvolume, Err: err}
+	}
+	return Subvolume{ReadOnly: flags&btrfsSubvolRDOnly != 0}, nil
+}
+
+// CreateSnapshot creates a snapshot of subvolume at snapshotPath with the
+// BTRFS_IOC_SNAP_CREATE_V2 ioctl on the directory containing it.
+func (c *IoctlClient) CreateSnapshot(ctx context.Context, subvolume, snapshotPath string, readonly bool) error {
+	err := c.createSnapshot(subvolume, snapshotPath, readonly)
+	if privileged(err) {
+		return c.fallback.CreateSnapshot(ctx, subvolume, snapshotPath, readonly)
+	}
+	return err
+}
+
+func (c *IoctlClient) createSnapshot(subvolume, snapshotPath string, readonly bool) error {
+	var args btrfsVolArgsV2
+	name := filepath.Base(snapshotPath)
+	if len(name) > btrfsSubvolNameMax {
+		return &os.PathError{Op: "btrfs subvolume snapshot", Path: snapshotPath, Err: syscall.ENAMETOOLONG}
+	}
+	copy(args.name[:], name)
+	if readonly {
+		args.flags = btrfsSubvolRDOnly
+	}
+
+	source, err := openDir(subvolume)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	parent, err := openDir(filepath.Dir(snapshotPath))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	args.fd = int64(source.Fd())
+	if err := ioctl(parent, iocSnapCreateV2, unsafe.Pointer(&args)); err != nil {
+		return &os.PathError{Op: "btrfs subvolume snapshot", Path: snapshotPath, Err: err}
+	}
+	return nil
+}
+
+// CreateSubvolume creates an empty subvolume at subvolumePath with the
+// BTRFS_IOC_SUBVOL_CREATE ioctl on the directory containing it.
+func (c *IoctlClient) CreateSubvolume(ctx context.Context, subvolumePath string) error {
+	err := c.volIoctl(iocSubvolCreate, "btrfs subvolume create", subvolumePath)
+	if privileged(err) {
+		return c.fallback.CreateSubvolume(ctx, subvolumePath)
+	}
+	return err
+}
+
+// DeleteSubvolume deletes the subvolume or snapshot at subvolumePath with the
+// BTRFS_IOC_SNAP_DESTROY ioctl on the directory containing it.
+func (c *IoctlClient) DeleteSubvolume(ctx context.Context, subvolumePath string) error {
+	err := c.volIoctl(iocSnapDestroy, "btrfs subvolume delete", subvolumePath)
+	if privileged(err) {
+		return c.fallback.DeleteSubvolume(ctx, subvolumePath)
+	}
+	return err
+}
+
+// volIoctl runs an ioctl taking struct btrfs_ioctl_vol_args with the name of path on the
+// directory containing it.
+func (c *IoctlClient) volIoctl(request uintptr, op, path string) error {
+	var args btrfsVolArgs
+	name := filepath.Base(path)
+	if len(name) > btrfsPathNameMax {
+		return &os.PathError{Op: op, Path: path, Err: syscall.ENAMETOOLONG}
+	}
+	copy(args.name[:], name)
+
+	parent, err := openDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	if err := ioctl(parent, request, unsafe.Pointer(&args)); err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return nil
+}
+
+// FilesystemUUID returns the UUID of the filesystem containing path, read with the
+// BTRFS_IOC_FS_INFO ioctl.
+func (c *IoctlClient) FilesystemUUID(ctx context.Context, path string) (string, error) {
+	f, err := openDir(path)
+	if privileged(err) {
+		return c.fallback.FilesystemUUID(ctx, path)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var args btrfsFsInfoArgs
+	if err := ioctl(f, iocFsInfo, unsafe.Pointer(&args)); err != nil {
+		if privileged(err) {
+			return c.fallback.FilesystemUUID(ctx, path)
+		}
+		return "", &os.PathError{Op: "btrfs filesystem show", Path: path, Err: err}
+	}
+	return formatUUID(args.fsid), nil
+}
+
+// formatUUID formats a UUID like btrfs-progs, e.g. 5b2f7e1c-8a4d-4c3e-9f10-2d6b8e4a7c91.
+func formatUUID(uuid [16]byte) string {
+	s := hex.EncodeToString(uuid[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", s[0:8], s[8:12], s[12:16], s[16:20], s[20:32])
+}
+
+// ExclusiveSize returns the bytes used only by the subvolume from the fallback client.
+func (c *IoctlClient) ExclusiveSize(ctx context.Context, subvolumePath string) (int64, error) {
+	return c.fallback.ExclusiveSize(ctx, subvolumePath)
+}
+
+// DeviceStats returns the error counters of the devices from the fallback client.
+func (c *IoctlClient) DeviceStats(ctx context.Context, path string) ([]DeviceStat, error) {
+	return c.fallback.DeviceStats(ctx, path)
+}
+
+// Send writes a send stream of the snapshot to w with the fallback client.
+func (c *IoctlClient) Send(ctx context.Context, snapshotPath, parentPath string, w io.Writer) error {
+	return c.fallback.Send(ctx, snapshotPath, parentPath, w)
+}
@@ -0,0 +1,78 @@
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestIoctlNumbers(t *testing.T) {
+	// Values of the macros in include/uapi/linux/btrfs.h
+	tests := []struct {
+		name     string
+		request  uintptr
+		expected uintptr
+	}{
+		{"BTRFS_IOC_SUBVOL_CREATE", iocSubvolCreate, 0x5000940e},
+		{"BTRFS_IOC_SNAP_DESTROY", iocSnapDestroy, 0x5000940f},
+		{"BTRFS_IOC_SNAP_CREATE_V2", iocSnapCreateV2, 0x50009417},
+		{"BTRFS_IOC_SUBVOL_GETFLAGS", iocSubvolGetflags, 0x80089419},
+		{"BTRFS_IOC_FS_INFO", iocFsInfo, 0x8400941f},
+	}
+	for _, tt := range tests {
+		if tt.request != tt.expected {
+			t.Errorf("Expected %s to be %#x, got %#x", tt.name, tt.expected, tt.request)
+		}
+	}
+	if size := unsafe.Sizeof(btrfsVolArgsV2{}); size != 4096 {
+		t.Errorf("Expected struct btrfs_ioctl_vol_args_v2 to take 4096 bytes, got %d", size)
+	}
+}
+
+func TestFormatUUID(t *testing.T) {
+	uuid := [16]byte{0x5b, 0x2f, 0x7e, 0x1c, 0x8a, 0x4d, 0x4c, 0x3e, 0x9f, 0x10, 0x2d, 0x6b, 0x8e, 0x4a, 0x7c, 0x91}
+	if got := formatUUID(uuid); got != "5b2f7e1c-8a4d-4c3e-9f10-2d6b8e4a7c91" {
+		t.Errorf("Unexpected UUID %s", got)
+	}
+}
+
+func TestIoctlClientNotBtrfs(t *testing.T) {
+	dir := t.TempDir()
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil || uint32(stat.Type) == btrfsSuperMagic {
+		t.Skip("temporary directory is on btrfs")
+	}
+	fallback := &recordingClient{}
+	client := NewIoctlClient(fallback)
+	ctx := context.Background()
+
+	if _, err := client.ShowSubvolume(ctx, dir); !errors.Is(err, ErrNotBtrfs) {
+		t.Errorf("Expected ErrNotBtrfs from show, got %v", err)
+	}
+	if err := client.CreateSnapshot(ctx, dir, dir+"/snapshot", true); !errors.Is(err, ErrNotBtrfs) {
+		t.Errorf("Expected ErrNotBtrfs from snapshot, got %v", err)
+	}
+	if err := client.DeleteSubvolume(ctx, dir+"/snapshot"); !errors.Is(err, ErrNotBtrfs) {
+		t.Errorf("Expected ErrNotBtrfs from delete, got %v", err)
+	}
+	if _, err := client.ShowSubvolume(ctx, dir+"/missing"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Expected ENOENT for a missing path, got %v", err)
+	}
+
+	// Operations without ioctls go to the fallback client
+	_, _ = client.ExclusiveSize(ctx, dir)
+	_, _ = client.DeviceStats(ctx, dir)
+	_ = client.Send(ctx, dir, "", io.Discard)
+	expected := []string{"size " + dir, "stats " + dir, "send " + dir}
+	if calls := fallback.recorded(); !slices.Equal(calls, expected) {
+		t.Errorf("Expected fallback calls %v, got %v", expected, calls)
+	}
+}
+
+func TestIoctlClientImplementsInterface(t *testing.T) {
+	var _ Client = (*IoctlClient)(nil)
+}
@@ -0,0 +1,36 @@
+package btrfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// PolkitAction is the polkit action of running btrfs through pkexec for backups.
+const PolkitAction = "org.btrfs-backup.btrfs"
+
+// PolkitPolicy returns a polkit policy allowing active local sessions to run the btrfs
+// executable at btrfsPath through pkexec after authenticating as an administrator. The
+// authorization is kept for a few minutes, so a backup asks once rather than for every
+// command. Install it to /usr/share/polkit-1/actions/<PolkitAction>.policy.
+func PolkitPolicy(btrfsPath string) (string, error) {
+	if !filepath.IsAbs(btrfsPath) || strings.ContainsAny(btrfsPath, "<>&\"\n") {
+		return "", fmt.Errorf("invalid btrfs path '%s', must be absolute", btrfsPath)
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE policyconfig PUBLIC "-//freedesktop//DTD PolicyKit Policy Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/PolicyKit/1/policyconfig.dtd">
+<policyconfig>
+  <action id="%[1]s">
+    <description>Run btrfs for btrfs-backup</description>
+    <message>Authentication is required to create and delete btrfs snapshots for backups</message>
+    <defaults>
+      <allow_any>no</allow_any>
+      <allow_inactive>no</allow_inactive>
+      <allow_active>auth_admin_keep</allow_active>
+    </defaults>
+    <annotate key="org.freedesktop.policykit.exec.path">%[2]s</annotate>
+  </action>
+</policyconfig>
+`, PolkitAction, btrfsPath), nil
+}
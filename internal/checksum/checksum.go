@@ -0,0 +1,145 @@
+// Package checksum writes SHA-256 manifests of the regular files of a directory tree and
+// verifies trees against them, independently of restic and its integrity checks.
+// Manifests use the format of sha256sum, so they can also be checked with 'sha256sum -c'.
+package checksum
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Sampled reports whether the file at path belongs to a sample of percent percent of the
+// files of a tree. The choice depends on the path only, so the same files are sampled by
+// every backup and the sample of a snapshot can be compared with the one of the next.
+func Sampled(path string, percent int) bool {
+	if percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return int(h.Sum32()%100) < percent
+}
+
+// Write writes the manifest of the regular files of fsys, or of a sample of percent
+// percent of them, see Sampled, to w, one "<sha256>  <path>" line per file. Symlinks,
+// directories and special files are skipped. Returns the number of files listed.
+func Write(ctx context.Context, fsys fs.FS, w io.Writer, percent int) (int, error) {
+	files := 0
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !Sampled(path, percent) {
+			return nil
+		}
+		sum, err := fileSum(fsys, path)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, formatLine(sum, path)); err != nil {
+			return err
+		}
+		files++
+		return nil
+	})
+	return files, err
+}
+
+// Result is the outcome of verifying a tree against a manifest.
+type Result struct {
+	Checked    int      `json:"checked"`    // files of the manifest that were read
+	Mismatched []string `json:"mismatched"` // files whose contents differ from the manifest
+	Missing    []string `json:"missing"`    // files of the manifest that don't exist in the tree
+}
+
+// OK reports whether every file of the manifest exists with the recorded contents.
+func (r *Result) OK() bool {
+	return len(r.Mismatched) == 0 && len(r.Missing) == 0
+}
+
+// Verify checks the files of the manifest read from r against the tree fsys. Files of
+// the tree that aren't in the manifest are ignored, so a tree can be checked against a
+// sampled manifest, or a partial restore against a full one. Returns an error if the
+// manifest is malformed or a file can't be read for another reason than not existing.
+func Verify(ctx context.Context, fsys fs.FS, r io.Reader) (*Result, error) {
+	result := &Result{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		expected, path, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("manifest line %d: %w", line, err)
+		}
+
+		sum, err := fileSum(fsys, path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			result.Missing = append(result.Missing, path)
+			continue
+		case err != nil:
+			return nil, err
+		}
+		result.Checked++
+		if sum != expected {
+			result.Mismatched = append(result.Mismatched, path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading manifest failed: %w", err)
+	}
+	return result, nil
+}
+
+// fileSum returns the hex encoded SHA-256 of the contents of a file.
+func fileSum(fsys fs.FS, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("reading %s failed: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// formatLine formats a manifest line like sha256sum, which escapes backslashes and
+// newlines in the path and marks such lines with a leading backslash.
+func formatLine(sum, path string) string {
+	if !strings.ContainsAny(path, "\\\n") {
+		return sum + "  " + path + "\n"
+	}
+	escaped := strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(path)
+	return "\\" + sum + "  " + escaped + "\n"
+}
+
+// parseLine parses a line written by formatLine.
+func parseLine(line string) (sum, path string, err error) {
+	line, escaped := strings.CutPrefix(line, "\\")
+	sum, path, found := strings.Cut(line, "  ")
+	if !found || len(sum) != 2*sha256.Size || path == "" {
+		return "", "", fmt.Errorf("expected '<sha256>  <path>', got '%s'", line)
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", "", fmt.Errorf("invalid checksum '%s'", sum)
+	}
+	if escaped {
+		path = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(path)
+	}
+	return sum, path, nil
+}
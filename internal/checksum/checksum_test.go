@@ -0,0 +1,94 @@
+package checksum
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestWriteVerify(t *testing.T) {
+	tree := fstest.MapFS{
+		"a.txt":          {Data: []byte("alpha")},
+		"dir/b.txt":      {Data: []byte("beta")},
+		"dir/new\nline":  {Data: []byte("gamma")},
+		"dir/empty":      {Data: nil},
+		"link":           {Data: []byte("a.txt"), Mode: fs.ModeSymlink | 0o777},
+		"dir/sub/c.conf": {Data: []byte("delta")},
+	}
+	ctx := context.Background()
+
+	var manifest bytes.Buffer
+	files, err := Write(ctx, tree, &manifest, 100)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if files != 5 {
+		t.Errorf("Expected 5 files in the manifest, got %d:\n%s", files, manifest.String())
+	}
+	expected := "8ed3f6ad685b959ead7022518e1af76cd816f8e8ec7ccdda1ed4018e8f2223f8  a.txt\n"
+	if !strings.HasPrefix(manifest.String(), expected) {
+		t.Errorf("Expected manifest to start with %q, got:\n%s", expected, manifest.String())
+	}
+	if !strings.Contains(manifest.String(), "\\") || strings.Contains(manifest.String(), "link") {
+		t.Errorf("Expected escaped newline and no symlink in manifest:\n%s", manifest.String())
+	}
+
+	restored := fstest.MapFS{
+		"a.txt":         {Data: []byte("alpha")},
+		"dir/b.txt":     {Data: []byte("BETA")},
+		"dir/new\nline": {Data: []byte("gamma")},
+		"dir/empty":     {Data: nil},
+		"dir/extra":     {Data: []byte("not in the manifest")},
+	}
+	result, err := Verify(ctx, restored, bytes.NewReader(manifest.Bytes()))
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if result.OK() || result.Checked != 4 ||
+		!slices.Equal(result.Mismatched, []string{"dir/b.txt"}) || !slices.Equal(result.Missing, []string{"dir/sub/c.conf"}) {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	result, err = Verify(ctx, tree, bytes.NewReader(manifest.Bytes()))
+	if err != nil || !result.OK() || result.Checked != 5 {
+		t.Errorf("Expected the tree to match its own manifest, got %+v (%v)", result, err)
+	}
+}
+
+func TestWriteSampled(t *testing.T) {
+	tree := fstest.MapFS{}
+	for i := range 200 {
+		tree[strings.Repeat("x", i%7)+string(rune('a'+i%26))+"/"+strings.Repeat("f", i+1)] = &fstest.MapFile{Data: []byte("data")}
+	}
+
+	var manifest bytes.Buffer
+	files, err := Write(context.Background(), tree, &manifest, 10)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if files == 0 || files > 60 {
+		t.Errorf("Expected about 20 of 200 files sampled, got %d", files)
+	}
+
+	var again bytes.Buffer
+	if _, err := Write(context.Background(), tree, &again, 10); err != nil || again.String() != manifest.String() {
+		t.Errorf("Expected the same sample on every run")
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	for _, manifest := range []string{
+		"not a manifest\n",
+		"abc  a.txt\n",
+		strings.Repeat("z", 64) + "  a.txt\n",
+		strings.Repeat("0", 64) + "  \n",
+	} {
+		if _, err := Verify(context.Background(), fstest.MapFS{}, strings.NewReader(manifest)); err == nil {
+			t.Errorf("Expected error for manifest %q", manifest)
+		}
+	}
+}
@@ -3,15 +3,46 @@
 package cli
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"btrfs-backup/internal/backup"
+	"btrfs-backup/internal/btrfs"
+	"btrfs-backup/internal/checksum"
+	"btrfs-backup/internal/command"
 	"btrfs-backup/internal/config"
+	"btrfs-backup/internal/events"
+	"btrfs-backup/internal/notify"
+	"btrfs-backup/internal/restic"
+	"btrfs-backup/internal/schedule"
+	"btrfs-backup/internal/selftest"
+	"btrfs-backup/internal/signature"
+	"btrfs-backup/internal/state"
+	"btrfs-backup/internal/systemd"
+	"btrfs-backup/progress"
 )
 
 // version is set at build time via ldflags
@@ -20,31 +51,51 @@ var version = "dev"
 var (
 	configFile string
 	verbose    bool
+	logFormat  string
 )
 
+// exitInterrupted is the exit code of commands stopped by SIGINT or SIGTERM, as a shell
+// reports a process killed by SIGINT.
+const exitInterrupted = 130
+
 // Run is the main entry point for the CLI application.
-// It initializes and executes the root Cobra command.
+// It initializes and executes the root Cobra command. The context passed to the commands
+// is cancelled by the first SIGINT or SIGTERM, which stops the running btrfs and restic
+// commands; a second signal terminates the process immediately.
 func Run() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	rootCmd := createRootCmd()
-	if err := rootCmd.Execute(); err != nil {
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		os.Exit(1)
 	}
 }
 
+// failureExitCode returns the exit code of a failed command, telling interrupted runs apart
+func failureExitCode(ctx context.Context) int {
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	return 1
+}
+
 // createRootCmd creates and configures the root Cobra command
 func createRootCmd() *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:   "btrfs-backup",
 		Short: "BTRFS Backup with Restic",
 		Long:  `A backup tool that creates BTRFS snapshots and backs them up using Restic.`,
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			if verbose {
-				log.SetFlags(log.LstdFlags | log.Lshortfile)
-				log.Println("Debug logging enabled")
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := setupLogging(logFormat, verbose); err != nil {
+				return err
 			}
-		},
-		CompletionOptions: cobra.CompletionOptions{
-			DisableDefaultCmd: true,
+			slog.Debug("Debug logging enabled")
+			return nil
 		},
 	}
 
@@ -53,6 +104,8 @@ func createRootCmd() *cobra.Command {
 		"config file path (default: $HOME/.config/btrfs-backup/config.yaml)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false,
 		"enable debug logging")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text",
+		"log output format: text or json")
 
 	// Bind flags to viper for configuration integration
 	_ = viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
@@ -61,6 +114,31 @@ func createRootCmd() *cobra.Command {
 	// Add subcommands
 	rootCmd.AddCommand(createVersionCmd())
 	rootCmd.AddCommand(createBackupCmd())
+	rootCmd.AddCommand(createSnapshotCmd())
+	rootCmd.AddCommand(createSnapshotsCmd())
+	rootCmd.AddCommand(createRepoSnapshotsCmd())
+	rootCmd.AddCommand(createVerifyRestoreCmd())
+	rootCmd.AddCommand(createVerifyReportCmd())
+	rootCmd.AddCommand(createVerifySnapshotCmd())
+	rootCmd.AddCommand(createRestoreMetadataCmd())
+	rootCmd.AddCommand(createVerifyManifestCmd())
+	rootCmd.AddCommand(createPruneCmd())
+	rootCmd.AddCommand(createInitCmd())
+	rootCmd.AddCommand(createRunCmd())
+	rootCmd.AddCommand(createTargetCmd())
+	rootCmd.AddCommand(createSecretCmd())
+	rootCmd.AddCommand(createMaintenanceCmd())
+	rootCmd.AddCommand(createRepoCmd())
+	rootCmd.AddCommand(createStatusCmd())
+	rootCmd.AddCommand(createReportCmd())
+	rootCmd.AddCommand(createConfigCmd())
+	rootCmd.AddCommand(createInstallSkeletonCmd())
+	rootCmd.AddCommand(createSystemdCmd())
+	rootCmd.AddCommand(createSelftestCmd())
+	rootCmd.AddCommand(createBtrfsHelperCmd())
+	rootCmd.AddCommand(createPolkitPolicyCmd())
+	rootCmd.AddCommand(createManCmd())
+	addCompletionInstallCmd(rootCmd)
 
 	return rootCmd
 }
@@ -79,145 +157,2170 @@ func createVersionCmd() *cobra.Command {
 // createBackupCmd creates the backup subcommand
 func createBackupCmd() *cobra.Command {
 	var targetConfigPath string
+	var allTargets bool
+	var options backupOptions
 
 	backupCmd := &cobra.Command{
-		Use:   "backup <target-name>",
+		Use:   "backup [<target-name> | --all]",
 		Short: "Perform backup operation",
 		Long: `Perform a complete backup workflow including:
 - Environment validation
 - BTRFS snapshot creation  
 - Restic backup to repository
+- Optional restic retention (forget --prune)
 - Optional repository verification
-- Cleanup of old snapshots`,
-		Args: cobra.ExactArgs(1),
+- Cleanup of old snapshots
+
+With --all, every target configuration in target_dir is backed up in turn, or
+parallel_targets at a time, of which upload_concurrency upload, forget and verify
+at the same time.
+With --dry-run, the workflow is walked without creating, uploading or deleting
+anything, and each command that would modify data is printed instead.
+
+Every invocation gets a run ID, added to its log lines, events, notifications
+and target state; --tag-run-id also tags the restic snapshots with run-id:<id>.
+
+SIGINT or SIGTERM stops the running btrfs or restic command and exits with
+status 130, deleting the new snapshot if delete_interrupted_snapshot is set
+and it wasn't uploaded yet.`,
+		ValidArgsFunction: completeTargets,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if allTargets {
+				if len(args) > 0 {
+					return fmt.Errorf("a target name cannot be combined with --all")
+				}
+				if targetConfigPath != "" {
+					return fmt.Errorf("--target-config cannot be combined with --all")
+				}
+				return nil
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
+			stopWatchdog := systemd.StartWatchdog()
+			defer stopWatchdog()
+			if err := systemd.Ready(); err != nil {
+				slog.Debug("Failed to notify systemd", "error", err)
+			}
+
+			options.runID = events.NewRunID()
+			slog.SetDefault(slog.Default().With("run_id", options.runID))
+
+			if allTargets {
+				runAllBackups(cmd.Context(), options)
+				return
+			}
+
 			targetName := args[0]
 
-			// Determine config path
-			finalConfigPath := config.GetConfigPath(configFile)
-			if verbose {
-				log.Printf("Using config file: %s", finalConfigPath)
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, targetName)
+
+			// Run backup
+			deliver := func(result notify.Result) { sendNotifications(cmd.Context(), cfg, result) }
+			err := runBackup(cmd.Context(), targetName, cfg, targetConfig, verbose, options, deliver)
+			if errors.Is(err, backup.ErrMaintenance) {
+				fmt.Fprintf(os.Stderr, "Backup skipped: %v\n", err)
+				return
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Backup failed (run %s): %v\n", options.runID, err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+
+			if options.dryRun {
+				fmt.Println("Dry run completed successfully")
+				return
 			}
+			fmt.Println("Backup completed successfully")
+		},
+	}
+
+	// Backup-specific flags
+	backupCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	backupCmd.Flags().BoolVarP(&allTargets, "all", "a", false,
+		"back up every target configured in target_dir")
+	backupCmd.Flags().BoolVar(&options.dryRun, "dry-run", false,
+		"print the commands that would modify data instead of running them")
+	backupCmd.Flags().BoolVar(&options.tagRunID, "tag-run-id", false,
+		"tag the restic snapshots with the run ID of the invocation")
+
+	return backupCmd
+}
+
+// backupOptions are the options of a backup invocation, shared by all targets it backs up
+type backupOptions struct {
+	dryRun   bool
+	runID    string            // run ID of the invocation, see events.NewRunID
+	tagRunID bool              // tag the restic snapshots with the run ID
+	uploads  backup.PhaseLimit // bounds the targets in their restic phases when targets run in parallel
+}
+
+// runAllBackups backs up every discovered target, prints a summary and
+// exits with a non-zero code if any target failed
+func runAllBackups(ctx context.Context, options backupOptions) {
+	cfg, err := loadMainConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	targets, err := config.DiscoverTargets(cfg.TargetDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error discovering targets: %v\n", err)
+		os.Exit(1)
+	}
+	if len(targets) == 0 {
+		fmt.Fprintf(os.Stderr, "No target configurations found in %s\n", cfg.TargetDir)
+		os.Exit(1)
+	}
+	if !options.dryRun {
+		if err := backup.NewManager(cfg, verbose).CheckMaintenance(); err != nil {
+			fmt.Fprintf(os.Stderr, "Backups skipped: %v\n", err)
+			return
+		}
+	}
+
+	// Notifications are sent once all targets ran, so failures sharing a root cause
+	// can be merged into a single alert
+	var notifyResults []notify.Result
+	var mu sync.Mutex
+	collect := func(result notify.Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		notifyResults = append(notifyResults, result)
+	}
+	// While targets run in parallel, the restic phases are limited separately, so the
+	// cheap snapshots of some targets proceed while others upload
+	if cfg.ParallelTargets > 1 {
+		options.uploads = backup.NewPhaseLimit(max(cfg.UploadConcurrency, 1))
+	}
+	results := backup.RunTargets(ctx, targets, cfg.ParallelTargets, func(ctx context.Context, targetName string, target *config.TargetConfig) error {
+		return runBackup(ctx, targetName, cfg, target, verbose, options, collect)
+	})
+	sendNotifications(ctx, cfg, notify.Aggregate(notifyResults, cfg.Notifications.StormThreshold)...)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tRESULT\tDURATION\tERROR")
+	for _, r := range results {
+		result, errText := "ok", ""
+		if r.Err != nil {
+			result, errText = "failed", r.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Name, result, r.Duration.Round(time.Second), errText)
+	}
+	_ = w.Flush()
+
+	failed := backup.FailedTargets(results)
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "Backup failed for %d of %d targets (run %s)\n", len(failed), len(results), options.runID)
+		os.Exit(failureExitCode(ctx))
+	}
+
+	fmt.Printf("Backup completed successfully for %d targets\n", len(results))
+}
+
+// createSnapshotCmd creates the snapshot subcommand
+func createSnapshotCmd() *cobra.Command {
+	var targetConfigPath string
+	var prune, dryRun bool
+
+	snapshotCmd := &cobra.Command{
+		Use:   "snapshot <target-name>",
+		Short: "Create a local BTRFS snapshot of a target without backing it up",
+		Long: `Create a local BTRFS snapshot of a target with its naming rules, e.g. as a
+quick rollback point before risky changes, without running restic. The pre_snapshot
+and post_snapshot hooks run around it. With --prune, snapshots beyond the target's
+keep_snapshots are removed afterwards, like after a backup.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
 
-			// Load main configuration
-			cfg, err := config.LoadConfig(finalConfigPath)
+			eventLog, err := openEventLog(cfg, args[0])
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Snapshot failed: %v\n", err)
 				os.Exit(1)
 			}
+			defer func() { _ = eventLog.Close() }()
 
-			// Determine target config path
-			finalTargetConfigPath := config.GetTargetConfigPath(targetConfigPath, cfg.TargetDir, targetName)
-			if verbose {
-				log.Printf("Using target config file: %s", finalTargetConfigPath)
+			mgr := backup.NewManager(cfg, verbose)
+			mgr.SetEventLog(eventLog)
+			if dryRun {
+				mgr.SetDryRun(os.Stdout)
+			}
+			snapshotPath, err := mgr.TakeSnapshot(cmd.Context(), args[0], targetConfig, prune)
+			if snapshotPath != "" && !dryRun {
+				fmt.Printf("Created snapshot %s\n", snapshotPath)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Snapshot failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
 			}
+		},
+	}
+
+	snapshotCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	snapshotCmd.Flags().BoolVar(&prune, "prune", false,
+		"remove snapshots beyond keep_snapshots afterwards")
+	snapshotCmd.Flags().BoolVar(&dryRun, "dry-run", false,
+		"print the btrfs commands and hooks instead of running them")
+
+	return snapshotCmd
+}
+
+// createSnapshotsCmd creates the snapshots subcommand
+func createSnapshotsCmd() *cobra.Command {
+	var targetConfigPath string
+	var jsonOutput bool
+
+	snapshotsCmd := &cobra.Command{
+		Use:   "snapshots <target-name>",
+		Short: "List local BTRFS snapshots of a target",
+		Long: `List the local BTRFS snapshots that belong to a target, newest first,
+with their creation time and size.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
 
-			// Load target configuration
-			targetConfig, err := config.LoadTargetConfig(finalTargetConfigPath)
+			mgr := backup.NewManager(cfg, verbose)
+			snapshots, err := mgr.ListSnapshots(targetConfig)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error loading target configuration: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Failed to list snapshots: %v\n", err)
 				os.Exit(1)
 			}
 
-			// Run backup
-			if err := runBackup(targetName, cfg, targetConfig, verbose); err != nil {
-				fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+			if jsonOutput {
+				err = printJSON(snapshots)
+			} else {
+				err = printSnapshotTable(snapshots)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print snapshots: %v\n", err)
 				os.Exit(1)
 			}
+		},
+	}
+
+	snapshotsCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	snapshotsCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print snapshots as JSON")
+
+	return snapshotsCmd
+}
+
+// createRepoSnapshotsCmd creates the repo-snapshots subcommand
+func createRepoSnapshotsCmd() *cobra.Command {
+	var targetConfigPath string
+	var jsonOutput bool
+
+	repoSnapshotsCmd := &cobra.Command{
+		Use:   "repo-snapshots <target-name>",
+		Short: "List restic snapshots of a target",
+		Long: `List the restic snapshots created for a target in its repository, oldest first,
+together with the local BTRFS snapshot each one was taken from.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
+
+			mgr := backup.NewManager(cfg, verbose)
+			snapshots, err := mgr.ListRepositorySnapshots(cmd.Context(), targetConfig)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to list repository snapshots: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
 
-			fmt.Println("Backup completed successfully")
+			if jsonOutput {
+				err = printJSON(snapshots)
+			} else {
+				err = printRepositorySnapshotTable(snapshots)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print repository snapshots: %v\n", err)
+				os.Exit(1)
+			}
 		},
 	}
 
-	// Backup-specific flags
-	backupCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+	repoSnapshotsCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
 		"path to target configuration file")
+	repoSnapshotsCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print repository snapshots as JSON")
 
-	return backupCmd
+	return repoSnapshotsCmd
 }
 
-func runBackup(targetName string, cfg *config.Config, target *config.TargetConfig, verbose bool) error {
-	log.Printf("=== Starting BTRFS backup process for target: %s ===", targetName)
-	log.Printf("Subvolume: %s", target.Subvolume)
-	log.Printf("Repository: %s", target.Repository)
-	log.Printf("Type: %s", target.Type)
-	log.Printf("Verify: %t", target.Verify)
-	log.Printf("Keep snapshots: %d", target.KeepSnapshots)
+// createVerifyRestoreCmd creates the verify-restore subcommand
+func createVerifyRestoreCmd() *cobra.Command {
+	var targetConfigPath string
+	var jsonOutput, sign bool
+	var options backup.RestoreVerifyOptions
+
+	verifyRestoreCmd := &cobra.Command{
+		Use:   "verify-restore <target-name> [snapshot]",
+		Short: "Restore a restic snapshot and compare it with its local snapshot",
+		Long: `Restore a restic snapshot of a target into a temporary directory and compare it with
+the local BTRFS snapshot it was taken from: paths, types and file sizes of the whole tree,
+and the SHA-256 hashes of all files or of a random sample with --sample.
 
-	mgr := backup.NewManager(cfg, verbose)
+The snapshot is selected by restic snapshot ID or local snapshot name and defaults to
+the newest restic snapshot whose local snapshot still exists. Exits with status 1 if
+the restored tree doesn't match.
 
-	// Step 1: Environment validation
-	log.Println("Validating backup environment")
-	err := validateEnvironmentWithLogging(mgr, target.Subvolume, cfg)
-	if err != nil {
-		return fmt.Errorf("environment validation failed: %w", err)
+With --sign, the report is printed as JSON signed with the Ed25519 key in
+report_signing_key, to be checked with 'verify-report'.`,
+		Args:              cobra.RangeArgs(1, 2),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
+
+			snapshot := ""
+			if len(args) > 1 {
+				snapshot = args[1]
+			}
+
+			// Load the key first, so a missing key doesn't waste a restore
+			var key ed25519.PrivateKey
+			if sign {
+				if cfg.ReportSigningKey == "" {
+					fmt.Fprintf(os.Stderr, "--sign requires report_signing_key in the configuration\n")
+					os.Exit(1)
+				}
+				var err error
+				if key, err = signature.LoadPrivateKey(cfg.ReportSigningKey); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to load report signing key: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+			mgr := backup.NewManager(cfg, verbose)
+			report, err := mgr.VerifyRestore(cmd.Context(), args[0], targetConfig, snapshot, options)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Restore verification failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+
+			switch {
+			case sign:
+				var signed *signature.Signed
+				if signed, err = signature.Sign(key, report); err == nil {
+					err = printJSON(signed)
+				}
+			case jsonOutput:
+				err = printJSON(report)
+			default:
+				err = printRestoreReport(report)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print restore report: %v\n", err)
+				os.Exit(1)
+			}
+			if !report.Success {
+				os.Exit(1)
+			}
+		},
 	}
-	log.Println("Environment validation completed successfully")
 
-	// Step 2: Create snapshot
-	log.Printf("Creating BTRFS snapshot with prefix: %s", target.Prefix)
-	snapshotPath, err := createSnapshotWithLogging(mgr, target.Subvolume, target.Prefix, verbose)
-	if err != nil {
-		return fmt.Errorf("snapshot creation failed: %w", err)
+	verifyRestoreCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	verifyRestoreCmd.Flags().StringVar(&options.Dir, "dir", "",
+		"directory to restore into a temporary subdirectory of (default: system temp directory)")
+	verifyRestoreCmd.Flags().Float64Var(&options.Sample, "sample", 100,
+		"percentage of files whose contents are compared")
+	verifyRestoreCmd.Flags().BoolVar(&options.IgnoreMissing, "ignore-missing", false,
+		"report files missing from the restore, such as excluded ones, without failing")
+	verifyRestoreCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print the report as JSON")
+	verifyRestoreCmd.Flags().BoolVar(&sign, "sign", false,
+		"print the report as JSON signed with report_signing_key")
+
+	return verifyRestoreCmd
+}
+
+// createVerifyReportCmd creates the verify-report subcommand
+func createVerifyReportCmd() *cobra.Command {
+	var keyPath string
+
+	verifyReportCmd := &cobra.Command{
+		Use:   "verify-report <file>",
+		Short: "Check the signature of a signed restore verification report",
+		Long: `Check the signature of a report written by 'verify-restore --sign' and print the
+report. The public key is read from --key, by default it is the one of
+report_signing_key. Exits with status 1 if the signature doesn't match, and with
+status 2 if it does but the restore verification failed.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if keyPath == "" {
+				cfg, err := loadMainConfig()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+					os.Exit(1)
+				}
+				if keyPath = cfg.ReportSigningKey; keyPath == "" {
+					fmt.Fprintf(os.Stderr, "No --key given and no report_signing_key configured\n")
+					os.Exit(1)
+				}
+			}
+			key, err := signature.LoadPublicKey(keyPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load public key: %v\n", err)
+				os.Exit(1)
+			}
+
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read report: %v\n", err)
+				os.Exit(1)
+			}
+			document, err := signature.Verify(key, data)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Report verification failed: %v\n", err)
+				os.Exit(1)
+			}
+			var report backup.RestoreReport
+			if err := json.Unmarshal(document, &report); err != nil {
+				fmt.Fprintf(os.Stderr, "Signed document is not a restore report: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Println("Signature valid")
+			if err := printRestoreReport(&report); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print restore report: %v\n", err)
+				os.Exit(1)
+			}
+			if !report.Success {
+				os.Exit(2)
+			}
+		},
 	}
-	log.Printf("Snapshot created successfully: %s", snapshotPath)
 
-	// Step 3: Perform backup
-	backupType := "incremental"
-	if target.Type == "full" {
-		backupType = "full"
+	verifyReportCmd.Flags().StringVar(&keyPath, "key", "",
+		"Ed25519 public key (PEM) to check the signature with (default: the one of report_signing_key)")
+
+	return verifyReportCmd
+}
+
+// createVerifySnapshotCmd creates the verify-snapshot subcommand
+func createVerifySnapshotCmd() *cobra.Command {
+	var targetConfigPath string
+	var jsonOutput bool
+
+	verifySnapshotCmd := &cobra.Command{
+		Use:   "verify-snapshot <target-name> [snapshot]",
+		Short: "Read a restic snapshot back in full to check it can be restored",
+		Long: `Read a restic snapshot of a target back in full with 'restic dump', discarding the
+data, so that every blob it references is downloaded, decrypted and checked.
+
+The snapshot is selected by restic snapshot ID or local snapshot name. Without one, an
+older snapshot is picked at random, favouring the snapshots not read for the longest
+time, as the verify_old_every setting does after backups. Successful reads are recorded
+in the target's state file.`,
+		Args:              cobra.RangeArgs(1, 2),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
+
+			snapshot := ""
+			if len(args) > 1 {
+				snapshot = args[1]
+			}
+
+			mgr := backup.NewManager(cfg, verbose)
+			result, err := mgr.VerifySnapshot(cmd.Context(), args[0], targetConfig, snapshot)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Snapshot verification failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+
+			if jsonOutput {
+				err = printJSON(result)
+			} else {
+				err = printSnapshotVerification(result)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print snapshot verification: %v\n", err)
+				os.Exit(1)
+			}
+		},
 	}
-	log.Printf("Starting Restic %s backup to repository %s", backupType, target.Repository)
-	err = performBackupWithLogging(mgr, snapshotPath, target, verbose)
-	if err != nil {
-		log.Printf("Backup failed, keeping snapshot for investigation: %s", snapshotPath)
-		return fmt.Errorf("backup operation failed: %w", err)
+
+	verifySnapshotCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	verifySnapshotCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print the result as JSON")
+
+	return verifySnapshotCmd
+}
+
+// createRestoreMetadataCmd creates the restore-metadata subcommand
+func createRestoreMetadataCmd() *cobra.Command {
+	var targetConfigPath string
+
+	restoreMetadataCmd := &cobra.Command{
+		Use:   "restore-metadata <target-name> <directory> [snapshot]",
+		Short: "Apply the metadata manifest of a snapshot to a restored tree",
+		Long: `Apply the ownership, permissions, ACLs and extended attributes recorded in the metadata
+manifest of a snapshot, uploaded by backups of targets with metadata_manifest: true, to
+a tree restored at directory, with setfacl and setfattr.
+
+The snapshot is selected by local snapshot name and defaults to the newest one with a
+manifest. Restore the same snapshot into directory first; entries missing from it are
+reported as errors after the others are updated.`,
+		Args: cobra.RangeArgs(2, 3),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 1 {
+				return nil, cobra.ShellCompDirectiveFilterDirs
+			}
+			return completeTargets(cmd, args, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
+
+			snapshot := ""
+			if len(args) > 2 {
+				snapshot = args[2]
+			}
+
+			mgr := backup.NewManager(cfg, verbose)
+			applied, err := mgr.RestoreMetadata(cmd.Context(), targetConfig, snapshot, args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Metadata restore failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+			fmt.Printf("Applied the metadata of %s to %s\n", applied, args[1])
+		},
 	}
-	log.Printf("Restic backup completed successfully")
 
-	// Step 4: Verify repository (if enabled)
-	if target.Verify {
-		log.Printf("Verifying repository integrity: %s", target.Repository)
-		err = verifyRepositoryWithLogging(mgr, target.Repository, verbose)
-		if err != nil {
-			log.Printf("Repository verification failed (warning): %v", err)
-		} else {
-			log.Printf("Repository verification completed successfully")
+	restoreMetadataCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+
+	return restoreMetadataCmd
+}
+
+// createVerifyManifestCmd creates the verify-manifest subcommand
+func createVerifyManifestCmd() *cobra.Command {
+	var targetConfigPath string
+	var jsonOutput bool
+
+	verifyManifestCmd := &cobra.Command{
+		Use:   "verify-manifest <target-name> <directory> [snapshot]",
+		Short: "Check a restored tree against the checksum manifest of a snapshot",
+		Long: `Check the files of a tree restored at directory against the SHA-256 checksums recorded in
+the checksum manifest of a snapshot, uploaded by backups of targets with checksum_manifest
+set, independently of restic's own integrity checks.
+
+The snapshot is selected by local snapshot name and defaults to the newest one with a
+manifest. Files of the tree that aren't in the manifest, e.g. because it lists a sample,
+are ignored. Exits with code 1 if a file of the manifest differs or is missing.`,
+		Args: cobra.RangeArgs(2, 3),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 1 {
+				return nil, cobra.ShellCompDirectiveFilterDirs
+			}
+			return completeTargets(cmd, args, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
+
+			snapshot := ""
+			if len(args) > 2 {
+				snapshot = args[2]
+			}
+
+			mgr := backup.NewManager(cfg, verbose)
+			verified, result, err := mgr.VerifyChecksums(cmd.Context(), targetConfig, snapshot, args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Manifest verification failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+			if jsonOutput {
+				err = printJSON(struct {
+					Snapshot string `json:"snapshot"`
+					Path     string `json:"path"`
+					*checksum.Result
+				}{verified, args[1], result})
+			} else {
+				err = printManifestVerification(verified, args[1], result)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print manifest verification: %v\n", err)
+				os.Exit(1)
+			}
+			if !result.OK() {
+				os.Exit(1)
+			}
+		},
+	}
+
+	verifyManifestCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	verifyManifestCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print the result as JSON")
+
+	return verifyManifestCmd
+}
+
+// printManifestVerification prints the result of checking a tree against the checksum
+// manifest of a snapshot
+func printManifestVerification(snapshot, dir string, result *checksum.Result) error {
+	for _, path := range result.Mismatched {
+		if _, err := fmt.Printf("MISMATCH %s\n", path); err != nil {
+			return err
+		}
+	}
+	for _, path := range result.Missing {
+		if _, err := fmt.Printf("MISSING  %s\n", path); err != nil {
+			return err
 		}
 	}
+	_, err := fmt.Printf("Checked %d files of %s against the manifest of %s: %d differ, %d missing\n",
+		result.Checked, dir, snapshot, len(result.Mismatched), len(result.Missing))
+	return err
+}
 
-	// Step 5: Clean up old snapshots
-	log.Printf("Cleaning up old snapshots, keeping last %d", target.KeepSnapshots)
-	err = cleanupSnapshotsWithLogging(mgr, target.Prefix, target.KeepSnapshots)
-	if err != nil {
-		log.Printf("Failed to cleanup old snapshots (warning): %v", err)
-	} else {
-		log.Println("Snapshot cleanup completed successfully")
+// createPruneCmd creates the prune subcommand
+func createPruneCmd() *cobra.Command {
+	var targetConfigPath string
+	var now bool
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune <target-name>",
+		Short: "Apply the restic retention policy of a target",
+		Long: `Run 'restic forget --prune' with the target's restic_keep policy, limited to
+the restic snapshots created for that target.
+
+If the target's repository has prune_every, 'restic forget' runs without --prune and
+'restic prune' only runs when due, like after a backup. With --now, the repository is
+pruned regardless, unless a backup is uploading to it.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
+
+			eventLog, err := openEventLog(cfg, args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Prune failed: %v\n", err)
+				os.Exit(1)
+			}
+			defer func() { _ = eventLog.Close() }()
+
+			mgr := backup.NewManager(cfg, verbose)
+			mgr.SetEventLog(eventLog)
+			// A due prune already runs with the forget
+			forcePrune := now && cfg.Repository(targetConfig.Repository).PruneEvery != "" && !mgr.PruneDue(targetConfig.Repository)
+			if err := forgetSnapshotsWithLogging(cmd.Context(), mgr, targetConfig); err != nil {
+				fmt.Fprintf(os.Stderr, "Prune failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+			if forcePrune {
+				err := backup.WithTimeout(cmd.Context(), targetConfig.CleanupTimeout, func(ctx context.Context) error {
+					return mgr.PruneRepository(ctx, targetConfig.Repository)
+				})
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Prune failed: %v\n", err)
+					os.Exit(failureExitCode(cmd.Context()))
+				}
+			}
+
+			fmt.Println("Prune completed successfully")
+		},
 	}
 
-	log.Println("=== Backup process completed successfully ===")
-	return nil
+	pruneCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	pruneCmd.Flags().BoolVar(&now, "now", false,
+		"prune a repository with prune_every even if its prune is not due")
+
+	return pruneCmd
 }
 
-// Helper functions that call manager methods but handle CLI-specific logging
-func validateEnvironmentWithLogging(mgr *backup.Manager, subvolume string, _ *config.Config) error {
-	// This would call individual validation steps from the manager
-	// For now, we'll use a simplified approach
-	return mgr.ValidateEnvironment(subvolume)
+// createInitCmd creates the init subcommand
+func createInitCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "init <repository>",
+		Short: "Initialize a restic repository",
+		Long: `Create a new restic repository from a repository configuration in restic_repo_dir.
+If the repository is already initialized, nothing is changed.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeRepositories,
+		Run: func(cmd *cobra.Command, args []string) {
+			repository := args[0]
+
+			cfg, err := loadMainConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+				os.Exit(1)
+			}
+
+			mgr := backup.NewManager(cfg, verbose)
+			err = mgr.InitRepository(cmd.Context(), repository)
+			if errors.Is(err, restic.ErrRepositoryExists) {
+				fmt.Printf("Repository %s is already initialized\n", repository)
+				return
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Init failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+
+			fmt.Printf("Repository %s initialized successfully\n", repository)
+		},
+	}
 }
 
-func createSnapshotWithLogging(mgr *backup.Manager, subvolume, prefix string, _ bool) (string, error) {
-	return mgr.CreateSnapshot(subvolume, prefix)
+// createTargetCmd creates the target subcommand
+func createTargetCmd() *cobra.Command {
+	targetCmd := &cobra.Command{
+		Use:   "target",
+		Short: "Manage the snapshots of a target",
+	}
+
+	targetCmd.AddCommand(createTargetRenameCmd())
+
+	return targetCmd
 }
 
-func performBackupWithLogging(mgr *backup.Manager, snapshotPath string, target *config.TargetConfig, _ bool) error {
-	return mgr.PerformBackup(snapshotPath, target)
+// createSecretCmd creates the secret subcommand
+func createSecretCmd() *cobra.Command {
+	secretCmd := &cobra.Command{
+		Use:   "secret",
+		Short: "Manage repository configurations in the system keyring",
+	}
+
+	secretCmd.AddCommand(createSecretSetCmd())
+
+	return secretCmd
 }
 
-func verifyRepositoryWithLogging(mgr *backup.Manager, repository string, _ bool) error {
-	return mgr.VerifyRepository(repository)
+// createSecretSetCmd creates the secret set subcommand
+func createSecretSetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set <repository>",
+		Short: "Store a repository configuration in the system keyring",
+		Long: `Read a repository configuration, KEY: value lines as in the files of
+restic_repo_dir, from standard input and store it in the system keyring under the
+repository's name, for secret_backend: keyring. An existing entry is replaced.
+Store read-only credentials as '<repository>.readonly'.`,
+		Example: `  btrfs-backup secret set b2-home < /tmp/b2-home
+  pass show restic/b2-home | btrfs-backup secret set b2-home`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := loadMainConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+				os.Exit(1)
+			}
+			if cfg.SecretBackend != config.SecretBackendKeyring {
+				fmt.Fprintf(os.Stderr, "Warning: secret_backend is %s, the keyring entry is only used with secret_backend: keyring\n", cfg.SecretBackend)
+			}
+
+			if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+				fmt.Fprintln(os.Stderr, "Enter the repository configuration, end with Ctrl-D:")
+			}
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read repository configuration: %v\n", err)
+				os.Exit(1)
+			}
+
+			mgr := backup.NewManager(cfg, verbose)
+			if err := mgr.StoreRepositorySecret(cmd.Context(), args[0], data); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to store repository configuration: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Repository configuration %s stored in the keyring\n", args[0])
+		},
+	}
+}
+
+// createRepoCmd creates the repo subcommand
+func createRepoCmd() *cobra.Command {
+	repoCmd := &cobra.Command{
+		Use:   "repo",
+		Short: "Inspect repositories",
+	}
+
+	repoCmd.AddCommand(createRepoHistoryCmd())
+
+	return repoCmd
+}
+
+// createRepoHistoryCmd creates the repo history subcommand
+func createRepoHistoryCmd() *cobra.Command {
+	var jsonOutput bool
+	var last int
+
+	historyCmd := &cobra.Command{
+		Use:   "history <repository>",
+		Short: "List the restic commands run against a repository",
+		Long: `List the restic commands btrfs-backup ran against a repository, oldest first,
+as recorded in state_dir: when each started, the prefix of the target it ran for,
+its duration and how it exited (success, failure, transient or interrupted), with
+the run ID matching the logs and events of its run. Commands run with
+'btrfs-backup run' or restic itself are not recorded.`,
+		Example:           `  btrfs-backup repo history b2-home --last 20`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeRepositories,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := mustLoadStateConfig("The repository history")
+			history, err := state.LoadHistory(cfg.StateDir, args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read repository history: %v\n", err)
+				os.Exit(1)
+			}
+			if last > 0 && len(history) > last {
+				history = history[len(history)-last:]
+			}
+
+			if jsonOutput {
+				if history == nil {
+					history = []state.Invocation{}
+				}
+				err = printJSON(history)
+			} else {
+				err = printHistoryTable(history)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print repository history: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	historyCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print the history as JSON")
+	historyCmd.Flags().IntVar(&last, "last", 0,
+		"only list the last n commands")
+
+	return historyCmd
+}
+
+// createMaintenanceCmd creates the maintenance subcommand
+func createMaintenanceCmd() *cobra.Command {
+	maintenanceCmd := &cobra.Command{
+		Use:   "maintenance",
+		Short: "Pause and resume the backups of all targets",
+		Long: `Turn maintenance mode on or off. While it is on, 'backup' skips every target
+without running its hooks, recording a run or sending notifications, and exits
+successfully, so the scheduled runs keep their timers. status shows the reason.
+Maintenance mode is kept in state_dir.`,
+	}
+
+	maintenanceCmd.AddCommand(createMaintenanceOnCmd())
+	maintenanceCmd.AddCommand(createMaintenanceOffCmd())
+
+	return maintenanceCmd
+}
+
+// createMaintenanceOnCmd creates the maintenance on subcommand
+func createMaintenanceOnCmd() *cobra.Command {
+	var reason, until string
+
+	onCmd := &cobra.Command{
+		Use:   "on",
+		Short: "Skip all backups until maintenance mode is turned off",
+		Long: `Turn maintenance mode on, replacing the reason and end of maintenance mode
+if it is already on. With --until, it ends by itself once the interval passed.`,
+		Example: `  btrfs-backup maintenance on --reason "RAID rebuild" --until 6h`,
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := mustLoadStateConfig("Maintenance mode")
+			m := &state.Maintenance{Reason: reason, Since: time.Now()}
+			if until != "" {
+				d, err := config.ParseInterval(until)
+				if err != nil || d == 0 {
+					fmt.Fprintf(os.Stderr, "Invalid --until '%s', expected an interval such as 6h or 2d\n", until)
+					os.Exit(1)
+				}
+				m.Until = m.Since.Add(d)
+			}
+			if err := state.SaveMaintenance(cfg.StateDir, m); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to turn maintenance mode on: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Maintenance mode on %s, backups are skipped\n", backup.DescribeMaintenance(m))
+		},
+	}
+
+	onCmd.Flags().StringVar(&reason, "reason", "",
+		"why backups are paused, shown by status")
+	onCmd.Flags().StringVar(&until, "until", "",
+		"end maintenance mode by itself after this interval, e.g. 6h or 2d")
+
+	return onCmd
+}
+
+// createMaintenanceOffCmd creates the maintenance off subcommand
+func createMaintenanceOffCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "off",
+		Short: "Resume the backups",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := mustLoadStateConfig("Maintenance mode")
+			if err := state.ClearMaintenance(cfg.StateDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to turn maintenance mode off: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("Maintenance mode off, backups resume with their next scheduled run")
+		},
+	}
+}
+
+// mustLoadStateConfig loads the main configuration and exits if it has no state_dir,
+// which feature requires
+func mustLoadStateConfig(feature string) *config.Config {
+	cfg, err := loadMainConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.StateDir == "" {
+		fmt.Fprintf(os.Stderr, "%s requires state_dir to be set\n", feature)
+		os.Exit(1)
+	}
+	return cfg
+}
+
+// createTargetRenameCmd creates the target rename subcommand
+func createTargetRenameCmd() *cobra.Command {
+	var targetConfigPath string
+	var dryRun bool
+
+	renameCmd := &cobra.Command{
+		Use:   "rename <target-name> <new-prefix>",
+		Short: "Move the snapshots of a target to a new prefix",
+		Long: `Re-tag the restic snapshots of a target with the new prefix and the new local
+snapshot names, then rename its local BTRFS snapshots accordingly. The restic
+snapshots are updated first; if the rename is interrupted, running it again with
+the old prefix still configured finishes it.
+
+The target configuration is not changed: set prefix to the new prefix afterwards.
+With --dry-run, the restic and rename commands are printed instead.`,
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, args[0])
+
+			mgr := backup.NewManager(cfg, verbose)
+			if dryRun {
+				mgr.SetDryRun(os.Stdout)
+			}
+			report, err := mgr.RenamePrefix(cmd.Context(), args[0], targetConfig, args[1])
+			if report != nil {
+				for _, r := range report.Local {
+					fmt.Printf("%s -> %s\n", r.Old, r.New)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Rename failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+
+			if dryRun {
+				fmt.Println("Dry run completed successfully")
+				return
+			}
+			fmt.Printf("Renamed %d local and %d restic snapshots, set prefix to '%s' in the target configuration\n",
+				len(report.Local), len(report.Repository), args[1])
+		},
+	}
+
+	renameCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	renameCmd.Flags().BoolVar(&dryRun, "dry-run", false,
+		"print the commands that would modify data instead of running them")
+
+	return renameCmd
+}
+
+// createReportCmd creates the report subcommand
+func createReportCmd() *cobra.Command {
+	reportCmd := &cobra.Command{
+		Use:   "report",
+		Short: "Report statistics of targets",
+	}
+
+	reportCmd.AddCommand(createReportChurnCmd())
+
+	return reportCmd
+}
+
+// createReportChurnCmd creates the report churn subcommand
+func createReportChurnCmd() *cobra.Command {
+	var targetConfigPath string
+	var window string
+	var jsonOutput, csvOutput bool
+
+	churnCmd := &cobra.Command{
+		Use:   "churn <target-name>",
+		Short: "Report the rate of change of a target",
+		Long: `Report the data the backups of a target added to its repository per day and
+week within the window, from the uploads recorded in the state directory, and
+project the growth of the repository at the daily average. The table shows weeks,
+--csv prints one line per day and --json both.`,
+		ValidArgsFunction: completeTargets,
+		Args:              cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			windowDuration, err := config.ParseInterval(window)
+			if err != nil || windowDuration == 0 {
+				fmt.Fprintf(os.Stderr, "Invalid window '%s', e.g. 30d or 12w\n", window)
+				os.Exit(1)
+			}
+			cfg, _ := mustLoadTarget(targetConfigPath, args[0])
+
+			mgr := backup.NewManager(cfg, verbose)
+			report, err := mgr.Churn(args[0], windowDuration, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to report churn: %v\n", err)
+				os.Exit(1)
+			}
+
+			switch {
+			case jsonOutput:
+				err = printJSON(report)
+			case csvOutput:
+				err = printChurnCSV(report)
+			default:
+				err = printChurnTable(report)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print report: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	churnCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	churnCmd.Flags().StringVar(&window, "window", "30d",
+		"period to report, e.g. 30d or 12w")
+	churnCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print the report as JSON")
+	churnCmd.Flags().BoolVar(&csvOutput, "csv", false,
+		"print the data added per day as CSV")
+	churnCmd.MarkFlagsMutuallyExclusive("json", "csv")
+
+	return churnCmd
+}
+
+// createConfigCmd creates the config subcommand
+func createConfigCmd() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+
+	configCmd.AddCommand(createConfigValidateCmd())
+	configCmd.AddCommand(createConfigInitCmd())
+
+	return configCmd
+}
+
+// createConfigValidateCmd creates the config validate subcommand
+func createConfigValidateCmd() *cobra.Command {
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check the main and all target configurations",
+		Long: `Load the main configuration and every target configuration in target_dir and
+report all problems found at once: unknown settings, which are otherwise ignored,
+invalid or missing settings, targets whose repository violates the classification
+policy, and repository configurations that can't be read.
+Exits with a non-zero code if any problem was found. Repository passwords due for
+rotation, see rotate_every, are reported as warnings.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			files, problems := 0, 0
+			report := func(path string, found []string) {
+				files++
+				problems += len(found)
+				if len(found) == 0 {
+					fmt.Printf("%s: OK\n", path)
+				}
+				for _, problem := range found {
+					fmt.Printf("%s: %s\n", path, problem)
+				}
+			}
+
+			configPath := config.GetConfigPath(configFile)
+			cfg, found := checkConfigFile(configPath, config.UnknownKeys, config.LoadConfig)
+			if _, err := os.Stat(configPath); err != nil && config.EnvConfigured() {
+				configPath = config.EnvPrefix + "_* (environment)"
+			}
+			report(configPath, found)
+			if cfg == nil {
+				fmt.Fprintln(os.Stderr, "Target configurations not checked, the main configuration failed to load")
+				os.Exit(1)
+			}
+
+			targets, err := config.DiscoverTargets(cfg.TargetDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error discovering targets: %v\n", err)
+				os.Exit(1)
+			}
+
+			mgr := backup.NewManager(cfg, verbose)
+			for _, t := range targets {
+				target, found := checkConfigFile(t.Path, config.UnknownTargetKeys, config.LoadTargetConfig)
+				if target != nil {
+					if err := cfg.CheckClassification(target); err != nil {
+						found = append(found, err.Error())
+					}
+					if _, err := mgr.RepositoryVariables(target.Repository); err != nil {
+						found = append(found, err.Error())
+					} else if _, err := mgr.ReadOnlyRepositoryVariables(target.Repository); err != nil {
+						found = append(found, err.Error())
+					}
+				}
+				if t.Path == "" {
+					report(config.TargetEnvPrefix+"_* ("+t.Name+")", found)
+					continue
+				}
+				report(t.Path, found)
+			}
+			for _, name := range slices.Sorted(maps.Keys(cfg.Repositories)) {
+				if reminder := cfg.RotationReminder(name, time.Now()); reminder != "" {
+					fmt.Fprintf(os.Stderr, "Warning: %s\n", reminder)
+				}
+			}
+
+			if problems > 0 {
+				fmt.Fprintf(os.Stderr, "Found %d problems in %d configuration files\n", problems, files)
+				os.Exit(1)
+			}
+			fmt.Printf("Checked %d configuration files, no problems found\n", files)
+		},
+	}
+
+	return validateCmd
+}
+
+// createConfigInitCmd creates the config init subcommand
+func createConfigInitCmd() *cobra.Command {
+	initCmd := &cobra.Command{
+		Use:   "init [directory]",
+		Short: "Write an example configuration",
+		Long: `Write a commented example configuration to the directory, by default
+$HOME/.config/btrfs-backup: config.yaml, the target targets/home.yaml and the
+repository configuration repos/example. Nothing is written if any of these files
+already exists. Edit the files, then check them with 'config validate'.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var dir string
+			if len(args) > 0 {
+				dir = args[0]
+			} else {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
+					os.Exit(1)
+				}
+				dir = filepath.Join(home, ".config", "btrfs-backup")
+			}
+
+			paths, err := config.WriteExamples(dir)
+			for _, path := range paths {
+				fmt.Printf("Wrote %s\n", path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write example configuration: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	return initCmd
+}
+
+// createInstallSkeletonCmd creates the install-skeleton subcommand
+func createInstallSkeletonCmd() *cobra.Command {
+	var root string
+	var skeleton config.Skeleton
+
+	installCmd := &cobra.Command{
+		Use:   "install-skeleton",
+		Short: "Create the system-wide directories and example configuration",
+		Long: `Create the system-wide layout below --root: the configuration directory with an
+example configuration, its targets and repos directories, the state directory,
+and snippets for systemd-tmpfiles and, for a user other than root, systemd-sysusers
+that create the directories with their ownership and modes on boot.
+
+Existing directories and files are kept, so running it again only adds what is
+missing. Packages pass their staging directory as --root and ship the result.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if skeleton.Group == "" {
+				skeleton.Group = skeleton.User
+			}
+
+			created, err := skeleton.Install(root)
+			for _, path := range created {
+				fmt.Printf("Created %s\n", path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to install skeleton: %v\n", err)
+				os.Exit(1)
+			}
+			if len(created) == 0 {
+				fmt.Println("Skeleton already installed")
+			}
+		},
+	}
+
+	installCmd.Flags().StringVar(&root, "root", "/",
+		"directory the layout is created in, e.g. a package staging directory")
+	installCmd.Flags().StringVar(&skeleton.ConfigDir, "config-dir", "/etc/btrfs-backup",
+		"configuration directory")
+	installCmd.Flags().StringVar(&skeleton.StateDir, "state-dir", config.DefaultStateDir,
+		"state directory")
+	installCmd.Flags().StringVar(&skeleton.User, "user", "root",
+		"owner of the state directory")
+	installCmd.Flags().StringVar(&skeleton.Group, "group", "",
+		"group of the configuration and state directories (default: the user)")
+
+	return installCmd
+}
+
+// createSystemdCmd creates the systemd subcommand
+func createSystemdCmd() *cobra.Command {
+	systemdCmd := &cobra.Command{
+		Use:   "systemd",
+		Short: "Manage the systemd units running scheduled backups",
+	}
+
+	systemdCmd.AddCommand(createSystemdInstallCmd())
+	systemdCmd.AddCommand(createSystemdUninstallCmd())
+
+	return systemdCmd
+}
+
+// createSystemdInstallCmd creates the systemd install subcommand
+func createSystemdInstallCmd() *cobra.Command {
+	var targetConfigPath string
+	var unitDir string
+	var noEnable bool
+
+	installCmd := &cobra.Command{
+		Use:   "install <target-name>",
+		Short: "Install a service and timer backing up a target on its schedule",
+		Long: `Generate btrfs-backup-<target>.service, running 'backup <target>' with this
+executable and the main configuration in use, and btrfs-backup-<target>.timer,
+starting it on the schedule of the target, e.g. "every 6h", "daily at 02:30",
+"Mon,Thu 04:00" or any systemd OnCalendar expression.
+
+The units are written to --dir, replacing earlier versions, then systemd is
+reloaded and the timer enabled and started unless --no-enable is given.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			_, targetConfig := mustLoadTarget(targetConfigPath, args[0])
+
+			executable, err := os.Executable()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to locate executable: %v\n", err)
+				os.Exit(1)
+			}
+			configPath, err := filepath.Abs(config.GetConfigPath(configFile))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to resolve configuration path: %v\n", err)
+				os.Exit(1)
+			}
+
+			calendar, err := schedule.Calendar(targetConfig.Schedule)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid schedule: %v\n", err)
+				os.Exit(1)
+			}
+			units, err := systemd.GenerateUnits(args[0], executable, configPath, calendar)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to generate units: %v\n", err)
+				os.Exit(1)
+			}
+			paths, err := systemd.InstallUnits(unitDir, args[0], units)
+			for _, path := range paths {
+				fmt.Printf("Installed %s\n", path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to install units: %v\n", err)
+				os.Exit(1)
+			}
+
+			if noEnable {
+				return
+			}
+			timer := systemd.UnitName(args[0], ".timer")
+			for _, systemctlArgs := range [][]string{{"daemon-reload"}, {"enable", "--now", timer}} {
+				if err := command.Run(command.Command(cmd.Context(), "systemctl", systemctlArgs...)); err != nil {
+					fmt.Fprintf(os.Stderr, "systemctl %s failed: %v\n", strings.Join(systemctlArgs, " "), err)
+					os.Exit(1)
+				}
+			}
+			fmt.Printf("Enabled %s (%s)\n", timer, calendar)
+		},
+	}
+
+	installCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	installCmd.Flags().StringVar(&unitDir, "dir", systemd.UnitDir,
+		"directory the units are written to")
+	installCmd.Flags().BoolVar(&noEnable, "no-enable", false,
+		"only write the units, without reloading systemd and enabling the timer")
+
+	return installCmd
+}
+
+// createSystemdUninstallCmd creates the systemd uninstall subcommand
+func createSystemdUninstallCmd() *cobra.Command {
+	var unitDir string
+	var noDisable bool
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall <target-name>",
+		Short: "Remove the service and timer of a target",
+		Long: `Stop and disable btrfs-backup-<target>.timer, remove the units installed by
+'systemd install' from --dir and reload systemd. With --no-disable, the units
+are only removed.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeTargets,
+		Run: func(cmd *cobra.Command, args []string) {
+			timer := systemd.UnitName(args[0], ".timer")
+			if !noDisable {
+				// The timer may never have been enabled
+				if err := command.Run(command.Command(cmd.Context(), "systemctl", "disable", "--now", timer)); err != nil {
+					slog.Warn("Failed to disable timer", "timer", timer, "error", err)
+				}
+			}
+
+			paths, err := systemd.UninstallUnits(unitDir, args[0])
+			for _, path := range paths {
+				fmt.Printf("Removed %s\n", path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to remove units: %v\n", err)
+				os.Exit(1)
+			}
+			if len(paths) == 0 {
+				fmt.Printf("No units of target '%s' installed in %s\n", args[0], unitDir)
+				return
+			}
+
+			if !noDisable {
+				if err := command.Run(command.Command(cmd.Context(), "systemctl", "daemon-reload")); err != nil {
+					fmt.Fprintf(os.Stderr, "systemctl daemon-reload failed: %v\n", err)
+					os.Exit(1)
+				}
+			}
+		},
+	}
+
+	uninstallCmd.Flags().StringVar(&unitDir, "dir", systemd.UnitDir,
+		"directory the units are removed from")
+	uninstallCmd.Flags().BoolVar(&noDisable, "no-disable", false,
+		"only remove the units, without disabling the timer and reloading systemd")
+
+	return uninstallCmd
+}
+
+// createBtrfsHelperCmd creates the btrfs-helper subcommand
+func createBtrfsHelperCmd() *cobra.Command {
+	var group string
+
+	helperCmd := &cobra.Command{
+		Use:   "btrfs-helper",
+		Short: "Perform whitelisted btrfs operations for unprivileged backups",
+		Long: `Serve the btrfs operations of backups on the unix socket btrfs_helper_socket, so
+that backups can run as an unprivileged user without sudo rules for btrfs. Run it as
+root, with the same main configuration; backups use it when btrfs_helper_socket is set.
+
+Only read-only snapshots of the subvolumes of the targets are created, and
+subvolumes are only created or deleted inside snapshot_dir. The targets are read
+when the helper starts, so restart it after adding one; target_dir must only be
+writable by root. Showing subvolumes, the filesystem UUID, qgroup sizes and device
+error counters is allowed anywhere. Send streams are not served, so targets with
+backup_mode send can't use the helper.
+
+The socket is created with mode 0660, owned by --group if given. Under systemd socket
+activation the socket passed by systemd is used instead.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := loadMainConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+				os.Exit(1)
+			}
+
+			listener, err := listenBtrfsHelper(cfg.BtrfsHelperSocket, group)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "btrfs helper failed: %v\n", err)
+				os.Exit(1)
+			}
+			defer listener.Close()
+
+			sources, err := targetSubvolumes(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "btrfs helper failed: %v\n", err)
+				os.Exit(1)
+			}
+
+			slog.Info("btrfs helper listening", "socket", listener.Addr().String(), "snapshot_dir", cfg.SnapshotDir, "subvolumes", sources)
+			_ = systemd.Ready()
+			helper := btrfs.NewHelper(btrfs.NewIoctlClient(btrfs.NewDefaultClient()), cfg.SnapshotDir, sources)
+			if err := helper.Serve(cmd.Context(), listener); err != nil {
+				fmt.Fprintf(os.Stderr, "btrfs helper failed: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	helperCmd.Flags().StringVar(&group, "group", "",
+		"group owning the socket, whose members may use the helper")
+
+	return helperCmd
+}
+
+// targetSubvolumes returns the source subvolumes of all targets, the only subvolumes the
+// btrfs helper snapshots
+func targetSubvolumes(cfg *config.Config) ([]string, error) {
+	targets, err := config.DiscoverTargets(cfg.TargetDir)
+	if err != nil {
+		return nil, err
+	}
+	var subvolumes []string
+	for _, file := range targets {
+		target, err := config.LoadTargetConfig(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("target '%s': %w", file.Name, err)
+		}
+		subvolumes = append(subvolumes, target.SourceSubvolumes()...)
+	}
+	return subvolumes, nil
+}
+
+// createPolkitPolicyCmd creates the polkit-policy subcommand
+func createPolkitPolicyCmd() *cobra.Command {
+	var btrfsPath string
+
+	policyCmd := &cobra.Command{
+		Use:   "polkit-policy",
+		Short: "Print a polkit policy allowing interactive backups through pkexec",
+		Long: `Print a polkit policy for running btrfs through pkexec, e.g.
+
+  btrfs-backup polkit-policy | sudo tee /usr/share/polkit-1/actions/` + btrfs.PolkitAction + `.policy
+
+btrfs commands run through sudo without prompting for a password. When sudo
+requires one, as in a desktop session of a user without sudo rules, they run
+through pkexec instead, which asks for administrator authentication once and
+keeps it for a few minutes. The policy names the btrfs executable found in PATH
+unless --btrfs is given.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if btrfsPath == "" {
+				var err error
+				if btrfsPath, err = exec.LookPath("btrfs"); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to locate btrfs: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			policy, err := btrfs.PolkitPolicy(btrfsPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to generate policy: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Print(policy)
+		},
+	}
+
+	policyCmd.Flags().StringVar(&btrfsPath, "btrfs", "",
+		"absolute path of the btrfs executable")
+
+	return policyCmd
+}
+
+// listenBtrfsHelper returns the socket passed by systemd socket activation, or creates
+// the unix socket at path, replacing a stale one, accessible to its owner and group
+func listenBtrfsHelper(path, group string) (net.Listener, error) {
+	listener, err := systemd.Listener()
+	if listener != nil || err != nil {
+		return listener, err
+	}
+	if path == "" {
+		return nil, fmt.Errorf("btrfs_helper_socket is not set")
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err = net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err == nil {
+			var gid int
+			gid, err = strconv.Atoi(g.Gid)
+			if err == nil {
+				err = os.Chown(path, -1, gid)
+			}
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to give the socket to group %s: %w", group, err)
+		}
+	}
+	return listener, nil
+}
+
+// createSelftestCmd creates the selftest subcommand
+func createSelftestCmd() *cobra.Command {
+	var options selftest.Options
+	var imageSize string
+	var jsonOutput bool
+
+	selftestCmd := &cobra.Command{
+		Use:   "selftest",
+		Short: "Run a complete backup and restore against a throwaway BTRFS filesystem",
+		Long: `Check that this machine can run backups: create a loopback image in a temporary
+work directory, format it BTRFS, mount it, create a subvolume with sample data
+and a local restic repository, back it up with the regular backup workflow,
+restore the restic snapshot and compare it with the local snapshot.
+
+The image is unmounted and the work directory removed afterwards, unless --keep
+is given. Requires root, btrfs-progs and restic; no configuration is needed, but
+restic_bin of the main configuration is used if it loads. Exits with status 1 if
+any step fails.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			size, err := config.ParseSize(imageSize)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid --image-size: %v\n", err)
+				os.Exit(1)
+			}
+			options.ImageSize = size
+			options.Verbose = verbose
+			if options.ResticBin == "" {
+				options.ResticBin = "restic"
+				if cfg, err := loadMainConfig(); err == nil {
+					options.ResticBin = cfg.ResticBin
+				}
+			}
+
+			report, err := selftest.Run(cmd.Context(), options)
+			if jsonOutput {
+				if printErr := printJSON(report); printErr != nil {
+					fmt.Fprintf(os.Stderr, "Failed to print self-test report: %v\n", printErr)
+				}
+			} else {
+				for _, step := range report.Steps {
+					result := "ok"
+					if step.Error != "" {
+						result = "FAILED"
+					}
+					fmt.Printf("%-35s %-6s %s\n", step.Name, result, step.Duration.Round(time.Millisecond))
+				}
+				if options.Keep && report.WorkDir != "" {
+					fmt.Printf("Work directory kept at %s\n", report.WorkDir)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Self-test failed: %v\n", err)
+				os.Exit(failureExitCode(cmd.Context()))
+			}
+			if !jsonOutput {
+				fmt.Println("Self-test passed")
+			}
+		},
+	}
+
+	selftestCmd.Flags().StringVar(&options.ResticBin, "restic-bin", "",
+		"restic binary to test (default: restic_bin of the main configuration, or restic)")
+	selftestCmd.Flags().StringVar(&options.Dir, "dir", "",
+		"directory to create the work directory in (default: system temp directory)")
+	selftestCmd.Flags().StringVar(&imageSize, "image-size", "256MiB",
+		"size of the loopback image")
+	selftestCmd.Flags().BoolVar(&options.Keep, "keep", false,
+		"keep the work directory with the image and repository for inspection")
+	selftestCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print the report as JSON")
+
+	return selftestCmd
+}
+
+// checkConfigFile loads the configuration file at path with load and returns it with the
+// problems found: its unknown settings and the error of load, in which case the returned
+// configuration is nil.
+func checkConfigFile[T any](path string, unknownKeys func(string) ([]string, error), load func(string) (*T, error)) (*T, []string) {
+	var found []string
+	if unknown, err := unknownKeys(path); err == nil {
+		for _, key := range unknown {
+			found = append(found, fmt.Sprintf("unknown setting '%s'", key))
+		}
+	}
+
+	cfg, err := load(path)
+	if err != nil {
+		found = append(found, err.Error())
+	}
+	return cfg, found
+}
+
+// createStatusCmd creates the status subcommand
+func createStatusCmd() *cobra.Command {
+	var jsonOutput bool
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Summarize the state of all targets",
+		Long: `Summarize every discovered target: the time and age of its last successful
+backup and the error of its last run as recorded in the state directory, the
+number of local snapshots and the snapshots the cleanup of the next run deletes,
+and the health score of its backup chain, from 0 to 100, combining the freshness
+of the last backup, runs failed in a row, the result of the last repository check
+and its age. --json also lists the issues lowering the score.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := loadMainConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+				os.Exit(1)
+			}
+
+			targets, err := config.DiscoverTargets(cfg.TargetDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error discovering targets: %v\n", err)
+				os.Exit(1)
+			}
+
+			mgr := backup.NewManager(cfg, verbose)
+			statuses := make([]*backup.TargetStatus, 0, len(targets))
+			for _, t := range targets {
+				var status *backup.TargetStatus
+				targetConfig, err := config.LoadTargetConfig(t.Path)
+				if err == nil {
+					status, err = mgr.TargetStatus(t.Name, targetConfig)
+				}
+				if err != nil {
+					status = &backup.TargetStatus{Target: t.Name, CleanupPending: []string{}, Error: err.Error()}
+				}
+				statuses = append(statuses, status)
+			}
+
+			if jsonOutput {
+				err = printJSON(statuses)
+			} else {
+				err = printStatusTable(statuses, time.Now())
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to print status: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	statusCmd.Flags().BoolVar(&jsonOutput, "json", false,
+		"print the status of the targets as JSON")
+
+	return statusCmd
+}
+
+// createRunCmd creates the run subcommand
+func createRunCmd() *cobra.Command {
+	var targetConfigPath string
+	var readOnly bool
+
+	runCmd := &cobra.Command{
+		Use:   "run <target-name> -- <command> [args...]",
+		Short: "Run a command with the repository environment of a target",
+		Long: `Run an arbitrary command, typically restic, with the variables of the target's
+repository configuration added to its environment, e.g.
+
+  btrfs-backup run home -- restic snapshots
+  btrfs-backup run home -- restic mount /mnt/restore
+
+A command named restic runs the configured restic_bin, with the restic options
+of the repository configuration passed as -o arguments. The exit code of the
+command is passed through. Credentials are redacted from the logged command line
+and environment. With --read-only, the read-only credentials of the repository
+are used if configured.`,
+		ValidArgsFunction: completeTargets,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if cmd.ArgsLenAtDash() != 1 || len(args) < 2 {
+				return fmt.Errorf("expected a target name, '--' and a command")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			targetName, commandArgs := args[0], args[1:]
+			cfg, targetConfig := mustLoadTarget(targetConfigPath, targetName)
+
+			mgr := backup.NewManager(cfg, verbose)
+			loadVariables := mgr.RepositoryVariables
+			if readOnly {
+				loadVariables = mgr.ReadOnlyRepositoryVariables
+			}
+			vars, err := loadVariables(targetConfig.Repository)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Run failed: %v\n", err)
+				os.Exit(1)
+			}
+
+			os.Exit(runWithRepositoryEnv(cfg, targetName, targetConfig, commandArgs, vars))
+		},
+	}
+
+	runCmd.Flags().StringVarP(&targetConfigPath, "target-config", "t", "",
+		"path to target configuration file")
+	runCmd.Flags().BoolVar(&readOnly, "read-only", false,
+		"use the read-only credentials of the repository")
+
+	return runCmd
+}
+
+// runWithRepositoryEnv runs a command with the repository variables added to the
+// environment and returns the exit code to exit with
+func runWithRepositoryEnv(cfg *config.Config, targetName string, target *config.TargetConfig, args []string, vars []string) int {
+	if args[0] == "restic" {
+		var optionArgs []string
+		vars, optionArgs = restic.SplitOptions(vars)
+		args = slices.Concat([]string{cfg.ResticBin}, args[1:], optionArgs)
+	}
+
+	slog.Info("Running command with repository environment",
+		"target", targetName,
+		"repository", target.Repository,
+		"command", strings.Join(command.RedactArgs(args, vars), " "),
+		"env", strings.Join(command.RedactEnv(vars), " "))
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), vars...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Run failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// mustLoadTarget loads the main and target configuration, exiting on failure
+func mustLoadTarget(targetConfigPath, targetName string) (*config.Config, *config.TargetConfig) {
+	cfg, err := loadMainConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	targetConfig, err := loadTargetConfig(cfg, targetConfigPath, targetName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading target configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	return cfg, targetConfig
+}
+
+// loadMainConfig resolves the main configuration path and loads it
+func loadMainConfig() (*config.Config, error) {
+	finalConfigPath := config.GetConfigPath(configFile)
+	slog.Debug("Using config file", "path", finalConfigPath)
+
+	cfg, err := config.LoadConfig(finalConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = setupLogBackend(cfg.LogBackend, verbose); err != nil {
+		return nil, fmt.Errorf("failed to set up log backend: %w", err)
+	}
+	return cfg, nil
+}
+
+// loadTargetConfig resolves the configuration path of a target and loads it
+func loadTargetConfig(cfg *config.Config, targetConfigPath, targetName string) (*config.TargetConfig, error) {
+	finalTargetConfigPath := config.GetTargetConfigPath(targetConfigPath, cfg.TargetDir, targetName)
+	slog.Debug("Using target config file", "target", targetName, "path", finalTargetConfigPath)
+
+	return config.LoadTargetConfig(finalTargetConfigPath)
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func printSnapshotTable(snapshots []backup.SnapshotInfo) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED\tSIZE")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.Created.Format(time.DateTime), formatBytes(s.Size))
+	}
+	return w.Flush()
+}
+
+func printRepositorySnapshotTable(snapshots []backup.RepositorySnapshot) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tHOST\tLOCAL SNAPSHOT")
+	for _, s := range snapshots {
+		local := s.LocalSnapshot
+		switch {
+		case local == "":
+			local = "-"
+		case !s.LocalExists:
+			local += " (removed)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.ShortID, s.Time.Local().Format(time.DateTime), s.Hostname, local)
+	}
+	return w.Flush()
+}
+
+func printRestoreReport(report *backup.RestoreReport) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Restic snapshot:\t%s\n", report.RepositorySnapshot)
+	fmt.Fprintf(w, "Local snapshot:\t%s\n", report.LocalSnapshot)
+	fmt.Fprintf(w, "Entries compared:\t%d\n", report.Entries)
+	fmt.Fprintf(w, "Files hashed:\t%d\n", report.HashedFiles)
+	for _, path := range report.Missing {
+		fmt.Fprintf(w, "Missing:\t%s\n", path)
+	}
+	for _, path := range report.Extra {
+		fmt.Fprintf(w, "Extra:\t%s\n", path)
+	}
+	for _, path := range report.Mismatched {
+		fmt.Fprintf(w, "Mismatched:\t%s\n", path)
+	}
+	result := "OK"
+	if !report.Success {
+		result = "FAILED"
+	}
+	fmt.Fprintf(w, "Result:\t%s\n", result)
+	return w.Flush()
+}
+
+func printSnapshotVerification(result *backup.SnapshotVerification) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Restic snapshot:\t%s\n", result.RepositorySnapshot)
+	fmt.Fprintf(w, "Taken:\t%s\n", result.SnapshotTime.Format(time.RFC3339))
+	lastVerified := "never"
+	if !result.LastVerified.IsZero() {
+		lastVerified = result.LastVerified.Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "Previously verified:\t%s\n", lastVerified)
+	fmt.Fprintf(w, "Data read:\t%d bytes in %s\n", result.Bytes, result.Duration.Round(time.Second))
+	fmt.Fprintf(w, "Result:\tOK\n")
+	return w.Flush()
+}
+
+func printStatusTable(statuses []*backup.TargetStatus, now time.Time) error {
+	for _, s := range statuses {
+		if s.Maintenance != nil {
+			fmt.Printf("Maintenance mode on %s, backups are skipped\n\n", backup.DescribeMaintenance(s.Maintenance))
+			break
+		}
+	}
+	reminded := make(map[string]bool)
+	for _, s := range statuses {
+		if s.RotationReminder != "" && !reminded[s.RotationReminder] {
+			reminded[s.RotationReminder] = true
+			fmt.Printf("Warning: %s\n", s.RotationReminder)
+		}
+	}
+	if len(reminded) > 0 {
+		fmt.Println()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tHEALTH\tLAST SUCCESS\tAGE\tNEXT RUN\tSNAPSHOTS\tNEXT CLEANUP\tLAST ERROR")
+	for _, s := range statuses {
+		if s.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t%s\n", s.Target, s.Error)
+			continue
+		}
+		health := "-"
+		if s.Health != nil {
+			health = strconv.Itoa(s.Health.Score)
+		}
+		lastSuccess, age := "never", "-"
+		if !s.LastSuccess.IsZero() {
+			lastSuccess = s.LastSuccess.Local().Format(time.DateTime)
+			age = now.Sub(s.LastSuccess).Round(time.Minute).String()
+		}
+		nextRun := "-"
+		if !s.NextRun.IsZero() {
+			nextRun = "in " + s.NextRun.Sub(now).Round(time.Minute).String()
+		}
+		cleanup := "-"
+		if len(s.CleanupPending) > 0 {
+			cleanup = fmt.Sprintf("%d snapshots", len(s.CleanupPending))
+		}
+		lastError := s.LastError
+		if lastError == "" {
+			lastError = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", s.Target, health, lastSuccess, age, nextRun, s.Snapshots, cleanup, lastError)
+	}
+	return w.Flush()
+}
+
+func printHistoryTable(history []state.Invocation) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCOMMAND\tPREFIX\tDURATION\tEXIT\tRUN ID\tERROR")
+	for _, i := range history {
+		prefix, runID, exit := i.Prefix, i.RunID, i.Exit
+		if prefix == "" {
+			prefix = "-"
+		}
+		if runID == "" {
+			runID = "-"
+		}
+		if i.ExitCode != 0 {
+			exit = fmt.Sprintf("%s (%d)", exit, i.ExitCode)
+		}
+		errText := i.Error
+		if errText == "" {
+			errText = "-"
+		}
+		duration := time.Duration(i.Duration * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.Time.Local().Format(time.DateTime), i.Command, prefix, duration, exit, runID, errText)
+	}
+	return w.Flush()
+}
+
+func printChurnTable(report *backup.ChurnReport) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WEEK\tUPLOADS\tDATA ADDED")
+	for _, week := range report.Weeks {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", week.Start.Format(time.DateOnly), week.Uploads, formatBytes(week.DataAdded))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Period:\t%s to %s\n", report.From.Format(time.DateTime), report.To.Format(time.DateTime))
+	fmt.Fprintf(w, "Data added:\t%s in %d uploads\n", formatBytes(report.DataAdded), report.Uploads)
+	fmt.Fprintf(w, "Average:\t%s per day, %s per week\n", formatBytes(report.DailyAverage), formatBytes(report.WeeklyAverage))
+	fmt.Fprintf(w, "Projected growth:\t%s in 30 days, %s in 365 days\n", formatBytes(report.ProjectedMonth), formatBytes(report.ProjectedYear))
+	return w.Flush()
+}
+
+func printChurnCSV(report *backup.ChurnReport) error {
+	w := csv.NewWriter(os.Stdout)
+	_ = w.Write([]string{"date", "uploads", "data_added"})
+	for _, day := range report.Days {
+		_ = w.Write([]string{day.Start.Format(time.DateOnly), strconv.Itoa(day.Uploads), strconv.FormatInt(day.DataAdded, 10)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// formatBytes renders a byte count using binary units (KiB, MiB, ...)
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// openEventLog opens the event log configured in the main configuration for a target.
+// It returns a nil log, which discards all events, if no event log is configured.
+func openEventLog(cfg *config.Config, targetName string) (*events.Log, error) {
+	if cfg.EventLog == "" {
+		return nil, nil
+	}
+
+	eventLog, err := events.Open(cfg.EventLog)
+	if err != nil {
+		return nil, err
+	}
+	return eventLog.ForTarget(targetName), nil
+}
+
+// runBackup runs the backup workflow of a target, see backup.Manager.RunBackup, reporting
+// its steps to systemd. Once it finishes, the target's healthcheck is pinged and the result
+// is handed to deliver for the configured notifications.
+// If ctx is done before the workflow completed, the run fails as interrupted.
+func runBackup(ctx context.Context, targetName string, cfg *config.Config, target *config.TargetConfig, verbose bool, options backupOptions, deliver func(notify.Result)) error {
+	logger := slog.With("target", targetName, "repository", target.Repository)
+
+	eventLog, err := openEventLog(cfg, targetName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = eventLog.Close() }()
+
+	mgr := backup.NewManager(cfg, verbose)
+	if !options.dryRun {
+		// Checked by RunBackup as well, but a skipped run must not send the healthcheck
+		// start ping either
+		if err := mgr.CheckMaintenance(); err != nil {
+			return err
+		}
+	}
+	mgr.SetEventLog(eventLog.WithRunID(options.runID))
+	mgr.SetRunID(options.runID, options.tagRunID)
+	mgr.SetUploadLimit(options.uploads)
+	if options.dryRun {
+		logger.Info("Dry run: commands that modify snapshots or repositories will only be printed")
+		mgr.SetDryRun(os.Stdout)
+	} else {
+		healthcheck := newHealthcheck(cfg, target)
+		if healthcheck != nil {
+			if pingErr := healthcheck.Start(ctx); pingErr != nil {
+				logger.Warn("Failed to send healthcheck start ping", "error", pingErr)
+			}
+		}
+		mgr.SetRunFinished(func(run backup.RunResult) {
+			result := newNotifyResult(targetName, target, run)
+			result.RunID = options.runID
+			if reminder := cfg.RotationReminder(target.Repository, time.Now()); reminder != "" {
+				result.Reminders = append(result.Reminders, reminder)
+			}
+			if healthcheck != nil {
+				if pingErr := healthcheck.Notify(notifyContext(ctx), result); pingErr != nil {
+					logger.Warn("Failed to send healthcheck ping", "error", pingErr)
+				}
+			}
+			deliver(result)
+		})
+	}
+
+	steps := mgr.Events()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case e := <-steps:
+				if status, ok := stepStatus[e.Step]; ok && e.Kind == progress.EventStepStarted {
+					notifyStatus("%s: %s", targetName, status)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := mgr.RunBackup(ctx, targetName, target); err != nil {
+		return err
+	}
+	notifyStatus("%s: backup completed", targetName)
+	return nil
+}
+
+// stepStatus describes the steps of the backup workflow reported to systemd
+var stepStatus = map[string]string{
+	"validate":             "validating environment",
+	backup.HookPreSnapshot: "snapshotting",
+	"backup":               "uploading",
+	"forget":               "applying restic retention",
+	"verify":               "verifying",
+	"verify_old":           "verifying an older snapshot",
+	"cleanup":              "cleaning up snapshots",
+}
+
+// notifyContext returns the context notifications of runs under ctx are sent with. An
+// interrupted run must still be reported, so the first signal doesn't stop the delivery
+// or its retries; a second one terminates the process.
+func notifyContext(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+// sendNotifications sends backup results to the webhooks, email recipients and MQTT
+// broker of the notifications section
+func sendNotifications(ctx context.Context, cfg *config.Config, results ...notify.Result) {
+	n := cfg.Notifications
+	var notifiers []notify.Notifier
+	for _, url := range n.Webhooks {
+		notifiers = append(notifiers, notify.NewWebhook(url, n.Timeout, n.Retries))
+	}
+	if n.Email.IsEnabled() {
+		e := n.Email
+		notifiers = append(notifiers, notify.NewEmail(e.SMTPHost, e.SMTPPort, e.Username, e.Password, e.From, e.To, n.Timeout))
+	}
+	if n.MQTT.IsEnabled() {
+		m := n.MQTT
+		mqtt, err := notify.NewMQTT(m.Broker, m.TopicPrefix, m.Username, m.Password, m.CAFile, n.Timeout, n.Retries)
+		if err != nil {
+			slog.Warn("Failed to set up MQTT notifications", "error", err)
+		} else {
+			notifiers = append(notifiers, mqtt)
+		}
+	}
+
+	for _, result := range results {
+		if err := notify.NotifyAll(notifyContext(ctx), notifiers, result); err != nil {
+			slog.Warn("Failed to send notifications", "target", result.Target, "error", err)
+		}
+	}
+}
+
+// newHealthcheck creates the healthcheck of a target, or returns nil if none is configured
+func newHealthcheck(cfg *config.Config, target *config.TargetConfig) *notify.Healthcheck {
+	if target.HealthcheckURL == "" {
+		return nil
+	}
+	return notify.NewHealthcheck(target.HealthcheckURL, cfg.Notifications.Timeout, cfg.Notifications.Retries)
+}
+
+// newNotifyResult describes a finished backup run for notifications, with the statistics of
+// its upload if restic reported a summary
+func newNotifyResult(targetName string, target *config.TargetConfig, run backup.RunResult) notify.Result {
+	host, _ := os.Hostname()
+	result := notify.Result{
+		Target:     targetName,
+		Host:       host,
+		Success:    run.Err == nil,
+		Started:    run.Started,
+		Duration:   time.Since(run.Started).Seconds(),
+		Repository: target.Repository,
+		Snapshot:   run.Snapshot,
+		Restic:     notify.ResticSkipped,
+	}
+	switch {
+	case run.Uploaded:
+		result.Restic = notify.ResticSuccess
+	case run.UploadStarted:
+		result.Restic = notify.ResticFailure
+	}
+	if run.Summary != nil {
+		result.FilesProcessed = run.Summary.TotalFilesProcessed
+		result.DataAdded = run.Summary.DataAdded
+		result.DedupRatio = run.Summary.DedupRatio()
+	}
+	if run.Err != nil {
+		result.Error = run.Err.Error()
+		result.Output = command.Stderr(run.Err)
+	}
+	return result
+}
+
+// notifyStatus reports the current phase to systemd when running as a notify service
+func notifyStatus(format string, args ...any) {
+	if err := systemd.Status(fmt.Sprintf(format, args...)); err != nil {
+		slog.Debug("Failed to notify systemd", "error", err)
+	}
 }
 
-func cleanupSnapshotsWithLogging(mgr *backup.Manager, prefix string, retention int) error {
-	return mgr.CleanupOldSnapshots(prefix, retention)
+// forgetSnapshotsWithLogging applies the target's restic retention policy within its cleanup_timeout
+func forgetSnapshotsWithLogging(ctx context.Context, mgr *backup.Manager, target *config.TargetConfig) error {
+	return backup.WithTimeout(ctx, target.CleanupTimeout, func(ctx context.Context) error {
+		return mgr.ForgetSnapshots(ctx, target)
+	})
 }
@@ -0,0 +1,235 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"btrfs-backup/internal/config"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+// completionShells are the shells completion scripts can be generated for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// addCompletionInstallCmd adds the install subcommand to cobra's default completion
+// command, whose shell subcommands print the completion scripts. root must have all
+// its other subcommands, cobra only adds the completion command to a root with some.
+func addCompletionInstallCmd(root *cobra.Command) {
+	root.InitDefaultCompletionCmd()
+	for _, cmd := range root.Commands() {
+		if cmd.Name() == "completion" {
+			cmd.AddCommand(createCompletionInstallCmd())
+		}
+	}
+}
+
+// createCompletionInstallCmd creates the completion install subcommand
+func createCompletionInstallCmd() *cobra.Command {
+	var dir string
+
+	installCmd := &cobra.Command{
+		Use:   "install [bash|zsh|fish]",
+		Short: "Install the shell completion script",
+		Long: `Install the completion script of the given shell, by default the one in $SHELL,
+where the shell loads completions from: system-wide below /usr/local/share when
+run as root, and in the user's data or config directory otherwise. Packagers can
+choose the directory with --dir.`,
+		ValidArgs: completionShells,
+		Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+		Run: func(cmd *cobra.Command, args []string) {
+			shell := filepath.Base(os.Getenv("SHELL"))
+			if len(args) > 0 {
+				shell = args[0]
+			}
+
+			path, err := installCompletion(cmd.Root(), shell, dir, os.Geteuid() == 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Completion install failed: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Installed %s completion to %s\n", shell, path)
+			if shell == "zsh" && dir == "" && os.Geteuid() != 0 {
+				fmt.Printf("Add %s to fpath in ~/.zshrc before compinit runs\n", filepath.Dir(path))
+			}
+		},
+	}
+
+	installCmd.Flags().StringVar(&dir, "dir", "",
+		"directory to install the completion script to (default: the shell's completion directory)")
+
+	return installCmd
+}
+
+// createManCmd creates the man subcommand
+func createManCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "man <directory>",
+		Short: "Generate man pages",
+		Long: `Generate a man page in section 1 for btrfs-backup and each of its subcommands in
+the directory, e.g. for packaging:
+
+  btrfs-backup man /usr/local/share/man/man1`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := os.MkdirAll(args[0], 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to create man page directory: %v\n", err)
+				os.Exit(1)
+			}
+
+			// Leave out the footer with the generation date; the date in the header follows
+			// SOURCE_DATE_EPOCH, so packaged pages can be reproducible
+			root := cmd.Root()
+			root.DisableAutoGenTag = true
+			header := &doc.GenManHeader{Title: strings.ToUpper(root.Name()), Section: "1", Source: root.Name() + " " + version}
+			if err := doc.GenManTree(root, header, args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to generate man pages: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Generated man pages in %s\n", args[0])
+		},
+	}
+}
+
+// writeCompletion writes the completion script of the shell for the root command to w
+func writeCompletion(root *cobra.Command, shell string, w io.Writer) error {
+	switch shell {
+	case "bash":
+		return root.GenBashCompletionV2(w, true)
+	case "zsh":
+		return root.GenZshCompletion(w)
+	case "fish":
+		return root.GenFishCompletion(w, true)
+	default:
+		return fmt.Errorf("unsupported shell '%s', must be bash, zsh or fish", shell)
+	}
+}
+
+// installCompletion writes the completion script of the shell to dir, or to the shell's
+// system-wide or per-user completion directory if dir is empty, and returns its path
+func installCompletion(root *cobra.Command, shell, dir string, system bool) (string, error) {
+	defaultDir, file, err := completionLocation(shell, root.Name(), system)
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		dir = defaultDir
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create completion directory: %w", err)
+	}
+	path := filepath.Join(dir, file)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create completion file: %w", err)
+	}
+	err = writeCompletion(root, shell, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write completion file: %w", err)
+	}
+	return path, nil
+}
+
+// completionLocation returns the directory the shell loads completions of the named
+// command from and the file name it expects there
+func completionLocation(shell, name string, system bool) (string, string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil && !system {
+		return "", "", fmt.Errorf("failed to determine home directory: %w", err)
+	}
+	dataHome := xdgDir("XDG_DATA_HOME", filepath.Join(home, ".local", "share"))
+	configHome := xdgDir("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+
+	switch shell {
+	case "bash":
+		if system {
+			return "/usr/local/share/bash-completion/completions", name, nil
+		}
+		return filepath.Join(dataHome, "bash-completion", "completions"), name, nil
+	case "zsh":
+		if system {
+			return "/usr/local/share/zsh/site-functions", "_" + name, nil
+		}
+		return filepath.Join(dataHome, "zsh", "site-functions"), "_" + name, nil
+	case "fish":
+		if system {
+			return "/usr/local/share/fish/vendor_completions.d", name + ".fish", nil
+		}
+		return filepath.Join(configHome, "fish", "completions"), name + ".fish", nil
+	default:
+		return "", "", fmt.Errorf("unsupported shell '%s', must be bash, zsh or fish", shell)
+	}
+}
+
+// xdgDir returns the directory set in the XDG environment variable, or fallback if unset
+func xdgDir(variable, fallback string) string {
+	if dir := os.Getenv(variable); dir != "" {
+		return dir
+	}
+	return fallback
+}
+
+// completeTargets completes the target name argument with the targets configured in
+// target_dir. Arguments after '--', the command of 'run', complete as files.
+func completeTargets(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if cmd.ArgsLenAtDash() >= 0 && len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	cfg, err := config.LoadConfig(config.GetConfigPath(configFile))
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	targets, err := config.DiscoverTargets(cfg.TargetDir)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var names []string
+	for _, t := range targets {
+		if strings.HasPrefix(t.Name, toComplete) {
+			names = append(names, t.Name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeRepositories completes the repository argument with the repository
+// configurations in restic_repo_dir, plain or encrypted, leaving out their read-only
+// variants
+func completeRepositories(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	cfg, err := config.LoadConfig(config.GetConfigPath(configFile))
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	entries, err := os.ReadDir(cfg.ResticRepoDir)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".age"), ".gpg")
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".readonly") {
+			continue
+		}
+		if strings.HasPrefix(name, toComplete) {
+			names = append(names, name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
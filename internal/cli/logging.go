@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"btrfs-backup/internal/logging"
+)
+
+// setupLogging configures the default slog logger for the selected output format.
+// The text format keeps the classic timestamped log lines with key=value fields appended,
+// while the json format emits one JSON object per line with durations in seconds.
+func setupLogging(format string, verbose bool) error {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+
+	switch format {
+	case "text":
+		if verbose {
+			log.SetFlags(log.LstdFlags | log.Lshortfile)
+		}
+		slog.SetLogLoggerLevel(level)
+	case "json":
+		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level:       level,
+			AddSource:   verbose,
+			ReplaceAttr: durationsAsSeconds,
+		})
+		slog.SetDefault(slog.New(handler))
+	default:
+		return fmt.Errorf("invalid log format '%s', must be 'text' or 'json'", format)
+	}
+
+	return nil
+}
+
+// durationsAsSeconds renders duration attributes as fractional seconds, which log
+// pipelines can aggregate directly, instead of integer nanoseconds.
+func durationsAsSeconds(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.Float64(a.Key, a.Value.Duration().Seconds())
+	}
+	return a
+}
+
+// setupLogBackend redirects logging to the log_backend of the main configuration.
+// Records sent to syslog or journald keep their attributes as structured fields, so
+// the --log-format flag only applies to the stderr backend.
+func setupLogBackend(backend string, verbose bool) error {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+
+	var handler slog.Handler
+	var err error
+	switch backend {
+	case "", "stderr":
+		return nil
+	case "syslog":
+		handler, err = logging.NewSyslogHandler(level)
+	case "journald":
+		handler, err = logging.NewJournalHandler(level)
+	default:
+		return fmt.Errorf("invalid log backend '%s'", backend)
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
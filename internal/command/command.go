@@ -0,0 +1,130 @@
+// Package command runs external programs such as btrfs and restic and keeps the tail of
+// their error output, so failures can be reported with the reason the program gave.
+package command
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stopDelay is how long a cancelled command may take to shut down, e.g. for restic to
+// remove its repository lock, before it is killed.
+const stopDelay = 30 * time.Second
+
+// maxStderr is the amount of error output kept per command. Earlier output is dropped,
+// since the final lines usually explain the failure.
+const maxStderr = 64 << 10
+
+// Error is returned when a command fails. Stderr holds the tail of its error output.
+type Error struct {
+	Args   []string
+	Stderr string
+	Err    error
+}
+
+// Error returns the underlying error followed by the last line of error output, if any.
+func (e *Error) Error() string {
+	lines := strings.Split(strings.TrimSpace(e.Stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return e.Err.Error() + ": " + last
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Command returns the exec.Cmd to run program name with args, which is stopped once ctx is
+// done. The program runs in its own process group and the whole group is sent SIGTERM, so
+// processes it started, such as the command run by sudo or the ssh backend of restic, stop
+// as well. The program is killed if it hasn't exited stopDelay later.
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = stopDelay
+	return cmd
+}
+
+// Run runs cmd and returns an *Error carrying its error output if it fails.
+// The standard output of cmd is left untouched.
+func Run(cmd *exec.Cmd) error {
+	stderr := &tailBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		logFailure(cmd, stderr.String(), err)
+		return &Error{Args: cmd.Args, Stderr: stderr.String(), Err: err}
+	}
+	return nil
+}
+
+// Output runs cmd and returns its standard output. Like Run, it returns an *Error
+// carrying the error output if the command fails.
+func Output(cmd *exec.Cmd) ([]byte, error) {
+	stderr := &tailBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		logFailure(cmd, stderr.String(), err)
+		return output, &Error{Args: cmd.Args, Stderr: stderr.String(), Err: err}
+	}
+	return output, nil
+}
+
+// logFailure logs the whole kept error output of a failed command at debug level, shown
+// with --verbose, as the returned error only carries its last line. Credentials of the
+// command's environment are redacted from the logged command line.
+func logFailure(cmd *exec.Cmd, stderr string, err error) {
+	slog.Debug("Command failed", "command", strings.Join(RedactArgs(cmd.Args, cmd.Env), " "),
+		"error", err, "stderr", strings.TrimSpace(stderr))
+}
+
+// Stderr collects the error output of every failed command in the tree of err,
+// including errors combined with errors.Join, separated by blank lines.
+func Stderr(err error) string {
+	var outputs []string
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case *Error:
+			if output := strings.TrimSpace(e.Stderr); output != "" {
+				outputs = append(outputs, output)
+			}
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+	return strings.Join(outputs, "\n\n")
+}
+
+// tailBuffer is an io.Writer keeping only the last max bytes written to it.
+type tailBuffer struct {
+	max  int
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.max {
+		b.data = b.data[len(b.data)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data)
+}
@@ -0,0 +1,110 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	err := Run(exec.Command("sh", "-c", "echo progress; echo 'Fatal: wrong password' >&2; exit 1"))
+
+	var cmdErr *Error
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if cmdErr.Stderr != "Fatal: wrong password\n" {
+		t.Errorf("Expected error output to be captured, got %q", cmdErr.Stderr)
+	}
+	if err.Error() != "exit status 1: Fatal: wrong password" {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected wrapped exit error with code 1, got %v", err)
+	}
+
+	if err := Run(exec.Command("sh", "-c", "echo ignored >&2")); err != nil {
+		t.Errorf("Expected successful command to return nil, got %v", err)
+	}
+}
+
+func TestCommandCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	// The background sleep keeps the error output open, so Run only returns early if
+	// the whole process group is stopped
+	start := time.Now()
+	err := Run(Command(ctx, "sh", "-c", "sleep 30 & wait"))
+	if err == nil {
+		t.Fatal("Expected cancelled command to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected cancelled command to stop promptly, took %s", elapsed)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	output, err := Output(exec.Command("sh", "-c", "echo data"))
+	if err != nil || string(output) != "data\n" {
+		t.Errorf("Expected output 'data', got %q and %v", output, err)
+	}
+
+	_, err = Output(exec.Command("sh", "-c", "echo broken >&2; exit 2"))
+	if Stderr(err) != "broken" {
+		t.Errorf("Expected captured error output, got %q", Stderr(err))
+	}
+}
+
+func TestRunKeepsTail(t *testing.T) {
+	err := Run(exec.Command("sh", "-c", fmt.Sprintf("yes | head -c %d >&2; echo end >&2; exit 1", 2*maxStderr)))
+
+	var cmdErr *Error
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if len(cmdErr.Stderr) != maxStderr || !strings.HasSuffix(cmdErr.Stderr, "y\nend\n") {
+		t.Errorf("Expected the last %d bytes of output, got %d bytes", maxStderr, len(cmdErr.Stderr))
+	}
+}
+
+func TestRunLogsOutput(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	cmd := exec.Command("sh", "-c", "echo 'first line' >&2; echo 'Fatal: failed' >&2; exit 1", "s3cret")
+	cmd.Env = []string{"RESTIC_PASSWORD=s3cret"}
+	err := Run(cmd)
+	if err == nil || strings.Contains(err.Error(), "first line") {
+		t.Errorf("Expected the error to carry the last line only, got %v", err)
+	}
+	output := logs.String()
+	if !strings.Contains(output, `stderr="first line\nFatal: failed"`) || strings.Contains(output, "s3cret") {
+		t.Errorf("Expected the whole error output logged with redacted arguments, got %s", output)
+	}
+}
+
+func TestStderr(t *testing.T) {
+	snapshotErr := &Error{Err: errors.New("exit status 1"), Stderr: "ERROR: cannot snapshot\n"}
+	hookErr := errors.New("hook failed")
+	uploadErr := &Error{Err: errors.New("exit status 3"), Stderr: "Fatal: repository is locked"}
+
+	err := fmt.Errorf("run failed: %w", errors.Join(fmt.Errorf("snapshot: %w", snapshotErr), hookErr, uploadErr))
+
+	expected := "ERROR: cannot snapshot\n\nFatal: repository is locked"
+	if got := Stderr(err); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if got := Stderr(hookErr); got != "" {
+		t.Errorf("Expected no output for plain errors, got %q", got)
+	}
+}
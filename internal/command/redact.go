@@ -0,0 +1,57 @@
+package command
+
+import "strings"
+
+// redacted replaces secret values in log output.
+const redacted = "***"
+
+// secretMarkers identify environment variables holding credentials, such as
+// RESTIC_PASSWORD, B2_ACCOUNT_KEY, AWS_SECRET_ACCESS_KEY or GOOGLE_ACCESS_TOKEN.
+var secretMarkers = []string{"PASSWORD", "SECRET", "KEY", "TOKEN", "CREDENTIAL"}
+
+// IsSecret reports whether the environment variable name likely holds a credential.
+func IsSecret(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, marker := range secretMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactEnv returns a copy of the KEY=VALUE pairs in env with the values of secret
+// variables replaced, for logging.
+func RedactEnv(env []string) []string {
+	result := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		if IsSecret(key) && value != "" {
+			kv = key + "=" + redacted
+		}
+		result = append(result, kv)
+	}
+	return result
+}
+
+// RedactArgs returns a copy of args with every occurrence of the value of a secret
+// variable in env replaced, for logging commands that were given a credential directly.
+func RedactArgs(args []string, env []string) []string {
+	var secrets []string
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		if IsSecret(key) && value != "" {
+			secrets = append(secrets, value, redacted)
+		}
+	}
+
+	result := append([]string(nil), args...)
+	if len(secrets) == 0 {
+		return result
+	}
+	replacer := strings.NewReplacer(secrets...)
+	for i, arg := range result {
+		result[i] = replacer.Replace(arg)
+	}
+	return result
+}
@@ -0,0 +1,45 @@
+package command
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRedactEnv(t *testing.T) {
+	env := []string{
+		"RESTIC_REPOSITORY=b2:bucket/home",
+		"RESTIC_PASSWORD=secret123",
+		"RESTIC_PASSWORD_COMMAND=pass show restic",
+		"B2_ACCOUNT_ID=account123",
+		"B2_ACCOUNT_KEY=key123",
+		"AWS_SECRET_ACCESS_KEY=",
+	}
+
+	expected := []string{
+		"RESTIC_REPOSITORY=b2:bucket/home",
+		"RESTIC_PASSWORD=***",
+		"RESTIC_PASSWORD_COMMAND=***",
+		"B2_ACCOUNT_ID=account123",
+		"B2_ACCOUNT_KEY=***",
+		"AWS_SECRET_ACCESS_KEY=",
+	}
+	if got := RedactEnv(env); !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if env[1] != "RESTIC_PASSWORD=secret123" {
+		t.Errorf("RedactEnv modified its input")
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	env := []string{"RESTIC_PASSWORD=secret123", "B2_ACCOUNT_ID=account123"}
+	args := []string{"restic", "--password-command", "echo secret123", "snapshots", "account123"}
+
+	expected := []string{"restic", "--password-command", "echo ***", "snapshots", "account123"}
+	if got := RedactArgs(args, env); !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if got := RedactArgs(args, nil); !slices.Equal(got, args) {
+		t.Errorf("Expected args unchanged without secrets, got %v", got)
+	}
+}
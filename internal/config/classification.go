@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Classifications of the data of targets, from the most to the least sensitive.
+const (
+	ClassificationConfidential = "confidential"
+	ClassificationInternal     = "internal"
+	ClassificationPublic       = "public"
+)
+
+// Classifications are the valid classification settings of targets.
+var Classifications = []string{ClassificationConfidential, ClassificationInternal, ClassificationPublic}
+
+// Properties of repositories declared in the repositories section of the main
+// configuration, which classification policies require.
+const (
+	PropertyEncrypted  = "encrypted"
+	PropertyOffsite    = "offsite"
+	PropertyAppendOnly = "append_only"
+)
+
+// repositoryProperties are the valid properties in classification policies.
+var repositoryProperties = []string{PropertyEncrypted, PropertyOffsite, PropertyAppendOnly}
+
+// DefaultClassificationPolicy is the policy of classifications not listed in
+// classification_policy: confidential data only goes to encrypted offsite repositories,
+// internal data to encrypted ones, public data anywhere.
+var DefaultClassificationPolicy = map[string][]string{
+	ClassificationConfidential: {PropertyEncrypted, PropertyOffsite},
+	ClassificationInternal:     {PropertyEncrypted},
+	ClassificationPublic:       {},
+}
+
+// Has reports whether the repository is declared to have the property.
+func (r RepositoryConfig) Has(property string) bool {
+	switch property {
+	case PropertyEncrypted:
+		return r.Encrypted
+	case PropertyOffsite:
+		return r.Offsite
+	case PropertyAppendOnly:
+		return r.AppendOnly
+	}
+	return false
+}
+
+// RequiredProperties returns the repository properties the classification policy
+// requires for targets of the classification: those of classification_policy, or of
+// DefaultClassificationPolicy if it doesn't list the classification.
+func (c *Config) RequiredProperties(classification string) []string {
+	if properties, ok := c.ClassificationPolicy[classification]; ok {
+		return properties
+	}
+	return DefaultClassificationPolicy[classification]
+}
+
+// CheckClassification returns an error if the repository of the target lacks a property
+// the classification policy requires for the target's classification. Targets without a
+// classification are not checked. Properties are declared in the repositories section,
+// not detected, so the check enforces the policy against the documented repositories.
+func (c *Config) CheckClassification(target *TargetConfig) error {
+	if target.Classification == "" {
+		return nil
+	}
+	repository := c.Repository(target.Repository)
+	var missing []string
+	for _, property := range c.RequiredProperties(target.Classification) {
+		if !repository.Has(property) {
+			missing = append(missing, property)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s targets require %s repositories, but repository '%s' is not declared %s in repositories",
+			target.Classification, strings.Join(c.RequiredProperties(target.Classification), ", "), target.Repository, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func validateClassificationPolicy(policy map[string][]string) error {
+	for classification, properties := range policy {
+		if !slices.Contains(Classifications, classification) {
+			return fmt.Errorf("invalid classification '%s' in classification_policy, must be one of %s", classification, strings.Join(Classifications, ", "))
+		}
+		for _, property := range properties {
+			if !slices.Contains(repositoryProperties, property) {
+				return fmt.Errorf("invalid repository property '%s' of classification '%s', must be one of %s",
+					property, classification, strings.Join(repositoryProperties, ", "))
+			}
+		}
+	}
+	return nil
+}
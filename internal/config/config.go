@@ -4,32 +4,500 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"btrfs-backup/internal/schedule"
+
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
 )
 
 // Config represents the main btrfs-backup configuration containing
 // paths to directories and executables needed for backup operations.
 type Config struct {
-	TargetDir     string `json:"target_dir" yaml:"target_dir" mapstructure:"target_dir"`                // Directory containing target configuration files
-	SnapshotDir   string `json:"snapshot_dir" yaml:"snapshot_dir" mapstructure:"snapshot_dir"`          // Directory where BTRFS snapshots are created
-	ResticRepoDir string `json:"restic_repo_dir" yaml:"restic_repo_dir" mapstructure:"restic_repo_dir"` // Directory containing Restic repository configurations
-	ResticBin     string `json:"restic_bin" yaml:"restic_bin" mapstructure:"restic_bin"`                // Path to the Restic binary
+	TargetDir          string `json:"target_dir" yaml:"target_dir" mapstructure:"target_dir"`                               // Directory containing target configuration files
+	SnapshotDir        string `json:"snapshot_dir" yaml:"snapshot_dir" mapstructure:"snapshot_dir"`                         // Directory where BTRFS snapshots are created
+	ResticRepoDir      string `json:"restic_repo_dir" yaml:"restic_repo_dir" mapstructure:"restic_repo_dir"`                // Directory containing Restic repository configurations
+	ResticBin          string `json:"restic_bin" yaml:"restic_bin" mapstructure:"restic_bin"`                               // Path to the Restic binary
+	AgeIdentity        string `json:"age_identity" yaml:"age_identity" mapstructure:"age_identity"`                         // age identity file decrypting repository configurations ending in .age
+	AgeBin             string `json:"age_bin" yaml:"age_bin" mapstructure:"age_bin"`                                        // Path to the age binary
+	GPGBin             string `json:"gpg_bin" yaml:"gpg_bin" mapstructure:"gpg_bin"`                                        // Path to the gpg binary decrypting repository configurations ending in .gpg
+	SecretBackend      string `json:"secret_backend" yaml:"secret_backend" mapstructure:"secret_backend"`                   // "file" for repository configurations in restic_repo_dir, "keyring" for the system keyring, "env" for environment variables
+	SecretToolBin      string `json:"secret_tool_bin" yaml:"secret_tool_bin" mapstructure:"secret_tool_bin"`                // Path to the secret-tool binary accessing the system keyring
+	EventLog           string `json:"event_log" yaml:"event_log" mapstructure:"event_log"`                                  // File path or "syslog" to record lifecycle events to
+	MetricsDir         string `json:"metrics_textfile_dir" yaml:"metrics_textfile_dir" mapstructure:"metrics_textfile_dir"` // node_exporter textfile collector directory
+	MetricsPushgateway string `json:"metrics_pushgateway" yaml:"metrics_pushgateway" mapstructure:"metrics_pushgateway"`    // Prometheus Pushgateway URL run metrics are pushed to
+	MetricsRemoteWrite string `json:"metrics_remote_write" yaml:"metrics_remote_write" mapstructure:"metrics_remote_write"` // Prometheus remote-write endpoint run metrics are sent to
+	StateDir           string `json:"state_dir" yaml:"state_dir" mapstructure:"state_dir"`                                  // Directory keeping the state of targets between runs
+	LogBackend         string `json:"log_backend" yaml:"log_backend" mapstructure:"log_backend"`                            // Log destination: "stderr", "syslog" or "journald"
+	BtrfsHelperSocket  string `json:"btrfs_helper_socket" yaml:"btrfs_helper_socket" mapstructure:"btrfs_helper_socket"`    // Unix socket of the btrfs helper performing btrfs operations instead of sudo
+	ReportSigningKey   string `json:"report_signing_key" yaml:"report_signing_key" mapstructure:"report_signing_key"`       // Ed25519 private key (PEM) signing restore verification reports
+
+	ParallelTargets   int `json:"parallel_targets" yaml:"parallel_targets" mapstructure:"parallel_targets"`       // Targets 'backup --all' runs at the same time, 1 for one after another
+	UploadConcurrency int `json:"upload_concurrency" yaml:"upload_concurrency" mapstructure:"upload_concurrency"` // Targets of parallel runs uploading, forgetting and verifying at the same time
+
+	Notifications NotificationsConfig `json:"notifications" yaml:"notifications" mapstructure:"notifications"` // Where to report backup results
+
+	Repositories map[string]RepositoryConfig `json:"repositories" yaml:"repositories" mapstructure:"repositories"` // Settings by repository name, see Repository
+
+	ClassificationPolicy map[string][]string `json:"classification_policy" yaml:"classification_policy" mapstructure:"classification_policy"` // Repository properties required by each classification, see CheckClassification
+}
+
+// RepositoryConfig represents settings of a repository that override those of the
+// targets backed up to it.
+type RepositoryConfig struct {
+	VerifySubset    string `json:"verify_subset" yaml:"verify_subset" mapstructure:"verify_subset"`             // Data read by verifications of the repository
+	VerifyFullEvery string `json:"verify_full_every" yaml:"verify_full_every" mapstructure:"verify_full_every"` // Read all data once this interval passed since the last full verification
+
+	PruneEvery string `json:"prune_every" yaml:"prune_every" mapstructure:"prune_every"` // Run 'restic prune' once this interval passed since the last prune, instead of 'forget --prune' on every run
+	MaxUnused  string `json:"max_unused" yaml:"max_unused" mapstructure:"max_unused"`    // Unused space tolerated by the prunes of prune_every: a percentage, a size such as 5G, or "unlimited"
+
+	Encrypted  bool `json:"encrypted" yaml:"encrypted" mapstructure:"encrypted"`       // The repository data is encrypted with a key kept from the storage provider
+	Offsite    bool `json:"offsite" yaml:"offsite" mapstructure:"offsite"`             // The repository is stored away from the backed up machine
+	AppendOnly bool `json:"append_only" yaml:"append_only" mapstructure:"append_only"` // The credentials used for backups can't delete data of the repository
+
+	PasswordRotatedAt string `json:"password_rotated_at" yaml:"password_rotated_at" mapstructure:"password_rotated_at"` // Date the repository password was last changed, YYYY-MM-DD
+	RotateEvery       string `json:"rotate_every" yaml:"rotate_every" mapstructure:"rotate_every"`                      // Remind to change the password once this interval passed since password_rotated_at
+}
+
+// decodeHook extends the conversions of viper's default decode hook with dates, which
+// YAML decodes as times, into strings such as password_rotated_at.
+var decodeHook = mapstructure.ComposeDecodeHookFunc(
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToWeakSliceHookFunc(","),
+	func(from, to reflect.Type, data any) (any, error) {
+		if date, ok := data.(time.Time); ok && to.Kind() == reflect.String {
+			return date.Format(time.DateOnly), nil
+		}
+		return data, nil
+	},
+)
+
+// PasswordRotationDue returns when the password of the repository is due for rotation:
+// rotate_every after password_rotated_at. Returns the zero time if rotation reminders
+// aren't configured.
+func (r RepositoryConfig) PasswordRotationDue() time.Time {
+	if r.RotateEvery == "" {
+		return time.Time{}
+	}
+	rotated, err := time.ParseInLocation(time.DateOnly, r.PasswordRotatedAt, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	every, err := ParseInterval(r.RotateEvery)
+	if err != nil {
+		return time.Time{}
+	}
+	return rotated.Add(every)
+}
+
+// Repository returns the settings of the named repository. Repository names are
+// matched case-insensitively, as the configuration keys they are read from.
+func (c *Config) Repository(name string) RepositoryConfig {
+	return c.Repositories[strings.ToLower(name)]
+}
+
+// RotationReminder returns the reminder to rotate the password of the named repository
+// if its rotate_every interval passed at now, and an empty string otherwise.
+func (c *Config) RotationReminder(name string, now time.Time) string {
+	settings := c.Repository(name)
+	due := settings.PasswordRotationDue()
+	if due.IsZero() || now.Before(due) {
+		return ""
+	}
+	return fmt.Sprintf("password of repository '%s' is due for rotation since %s (last rotated %s, rotate_every %s)",
+		name, due.Format(time.DateOnly), settings.PasswordRotatedAt, settings.RotateEvery)
+}
+
+// NotificationsConfig represents the services notified of the result of every backup run.
+type NotificationsConfig struct {
+	Webhooks []string      `json:"webhooks" yaml:"webhooks" mapstructure:"webhooks"` // URLs receiving the result as a JSON POST request
+	Timeout  time.Duration `json:"timeout" yaml:"timeout" mapstructure:"timeout"`    // Maximum duration of each delivery attempt
+	Retries  int           `json:"retries" yaml:"retries" mapstructure:"retries"`    // Number of retries of failed deliveries
+
+	StormThreshold int `json:"storm_threshold" yaml:"storm_threshold" mapstructure:"storm_threshold"` // Failures on one repository merged into a single alert
+
+	Email EmailConfig `json:"email" yaml:"email" mapstructure:"email"` // SMTP settings of failure emails
+	MQTT  MQTTConfig  `json:"mqtt" yaml:"mqtt" mapstructure:"mqtt"`    // MQTT broker receiving the status of every target
+}
+
+// MQTTConfig represents the MQTT broker the result of every backup run is published to,
+// as a retained JSON message on <topic_prefix>/<target>.
+type MQTTConfig struct {
+	Broker      string `json:"broker" yaml:"broker" mapstructure:"broker"`                   // Broker URL, mqtt://host[:port] or mqtts://host[:port] for TLS
+	TopicPrefix string `json:"topic_prefix" yaml:"topic_prefix" mapstructure:"topic_prefix"` // Prefix of the per-target topics
+	Username    string `json:"username" yaml:"username" mapstructure:"username"`             // Broker user name, empty to disable authentication
+	Password    string `json:"password" yaml:"password" mapstructure:"password"`             // Broker password
+	CAFile      string `json:"ca_file" yaml:"ca_file" mapstructure:"ca_file"`                // CA certificate verifying the broker, instead of the system roots
+}
+
+// IsEnabled reports whether an MQTT broker is configured.
+func (m MQTTConfig) IsEnabled() bool {
+	return m.Broker != ""
+}
+
+// EmailConfig represents the SMTP settings used to email failure reports.
+type EmailConfig struct {
+	SMTPHost string   `json:"smtp_host" yaml:"smtp_host" mapstructure:"smtp_host"` // SMTP server host name
+	SMTPPort int      `json:"smtp_port" yaml:"smtp_port" mapstructure:"smtp_port"` // SMTP server port, STARTTLS is used when offered
+	Username string   `json:"username" yaml:"username" mapstructure:"username"`    // SMTP user name, empty to disable authentication
+	Password string   `json:"password" yaml:"password" mapstructure:"password"`    // SMTP password
+	From     string   `json:"from" yaml:"from" mapstructure:"from"`                // Sender address
+	To       []string `json:"to" yaml:"to" mapstructure:"to"`                      // Recipient addresses
+}
+
+// IsEnabled reports whether failure emails are configured.
+func (e EmailConfig) IsEnabled() bool {
+	return e.SMTPHost != ""
 }
 
 // TargetConfig represents configuration for a specific backup target,
 // defining the source subvolume, backup settings, and retention policy.
 type TargetConfig struct {
-	Subvolume     string `json:"subvolume" yaml:"subvolume" mapstructure:"subvolume"`                // BTRFS subvolume to backup
-	Prefix        string `json:"prefix" yaml:"prefix" mapstructure:"prefix"`                         // Prefix for snapshot names
-	Repository    string `json:"repository" yaml:"repository" mapstructure:"repository"`             // Restic repository identifier
-	Type          string `json:"type" yaml:"type" mapstructure:"type"`                               // Backup type: "incremental" or "full"
-	Verify        bool   `json:"verify" yaml:"verify" mapstructure:"verify"`                         // Whether to verify repository after backup
-	KeepSnapshots int    `json:"keep_snapshots" yaml:"keep_snapshots" mapstructure:"keep_snapshots"` // Number of local snapshots to retain
+	Subvolume      string   `json:"subvolume" yaml:"subvolume" mapstructure:"subvolume"`                // BTRFS subvolume to backup
+	Subvolumes     []string `json:"subvolumes" yaml:"subvolumes" mapstructure:"subvolumes"`             // BTRFS subvolumes backed up together, instead of subvolume
+	Prefix         string   `json:"prefix" yaml:"prefix" mapstructure:"prefix"`                         // Prefix for snapshot names
+	NameTemplate   string   `json:"name_template" yaml:"name_template" mapstructure:"name_template"`    // Template for snapshot names, see NewSnapshotNaming
+	Timezone       string   `json:"timezone" yaml:"timezone" mapstructure:"timezone"`                   // Time zone of snapshot name timestamps, e.g. "UTC", "Local" or "Europe/Berlin"
+	Repository     string   `json:"repository" yaml:"repository" mapstructure:"repository"`             // Restic repository identifier
+	Classification string   `json:"classification" yaml:"classification" mapstructure:"classification"` // "confidential", "internal" or "public", see Config.CheckClassification
+	Type           string   `json:"type" yaml:"type" mapstructure:"type"`                               // Backup type: "incremental" or "full"
+	Verify         bool     `json:"verify" yaml:"verify" mapstructure:"verify"`                         // Whether to verify repository after backup
+	KeepSnapshots  int      `json:"keep_snapshots" yaml:"keep_snapshots" mapstructure:"keep_snapshots"` // Number of local snapshots to retain
+
+	VerifySubset string `json:"verify_subset" yaml:"verify_subset" mapstructure:"verify_subset"` // Data read by verification: "10%", "1/5", a size such as "2G", or "full"
+	VerifyEvery  int    `json:"verify_every" yaml:"verify_every" mapstructure:"verify_every"`    // Verify after every Nth backup only, 0 or 1 for every backup
+
+	VerifyFullEvery string `json:"verify_full_every" yaml:"verify_full_every" mapstructure:"verify_full_every"` // Verify all data, instead of verify_subset, once this interval passed since the last full verification
+	VerifyOldEvery  string `json:"verify_old_every" yaml:"verify_old_every" mapstructure:"verify_old_every"`    // Read one older restic snapshot back in full once this interval passed since the last such verification
+
+	FullEvery string `json:"full_every" yaml:"full_every" mapstructure:"full_every"` // Run an incremental target as full once this interval, e.g. "30d", passed since its last full backup
+	Schedule  string `json:"schedule" yaml:"schedule" mapstructure:"schedule"`       // when the timer installed by 'systemd install' runs, e.g. "every 6h", "Mon,Thu 04:00" or an OnCalendar expression
+
+	MaxSnapshotSpace string `json:"max_snapshot_space" yaml:"max_snapshot_space" mapstructure:"max_snapshot_space"` // Cap on the exclusive space of the local snapshots, e.g. "200GiB"
+	MinKeepSnapshots int    `json:"min_keep_snapshots" yaml:"min_keep_snapshots" mapstructure:"min_keep_snapshots"` // Newest snapshots never deleted to stay within max_snapshot_space
+
+	SubvolumeUUID   string `json:"subvolume_uuid" yaml:"subvolume_uuid" mapstructure:"subvolume_uuid"`          // Expected filesystem UUID of the subvolume
+	SnapshotDirUUID string `json:"snapshot_dir_uuid" yaml:"snapshot_dir_uuid" mapstructure:"snapshot_dir_uuid"` // Expected filesystem UUID of the snapshot directory
+	DeviceErrors    string `json:"device_errors" yaml:"device_errors" mapstructure:"device_errors"`             // "fail", "warn" or "ignore" when the btrfs device error counters rose
+
+	ResticKeep ResticKeepConfig `json:"restic_keep" yaml:"restic_keep" mapstructure:"restic_keep"`                            // Retention policy for restic snapshots
+	EmptyGuard EmptyGuardConfig `json:"empty_snapshot_guard" yaml:"empty_snapshot_guard" mapstructure:"empty_snapshot_guard"` // Abort uploads of suspiciously empty snapshots
+
+	SuccessCriteria SuccessCriteriaConfig `json:"success_criteria" yaml:"success_criteria" mapstructure:"success_criteria"` // Expectations on the restic backup summary
+
+	PreSnapshot  []string      `json:"pre_snapshot" yaml:"pre_snapshot" mapstructure:"pre_snapshot"`    // Commands run before the snapshot is created
+	PostSnapshot []string      `json:"post_snapshot" yaml:"post_snapshot" mapstructure:"post_snapshot"` // Commands run after the snapshot attempt
+	PreBackup    []string      `json:"pre_backup" yaml:"pre_backup" mapstructure:"pre_backup"`          // Commands run before the restic backup
+	PostBackup   []string      `json:"post_backup" yaml:"post_backup" mapstructure:"post_backup"`       // Commands run after a successful restic backup
+	HookTimeout  time.Duration `json:"hook_timeout" yaml:"hook_timeout" mapstructure:"hook_timeout"`    // Maximum run time of each hook command
+
+	PostBackupWhen string   `json:"post_backup_when" yaml:"post_backup_when" mapstructure:"post_backup_when"`       // "success" or "always", when the post_backup hooks run
+	PostFailure    []string `json:"post_failure_hooks" yaml:"post_failure_hooks" mapstructure:"post_failure_hooks"` // Commands run after a failed run
+
+	SnapshotTimeout time.Duration `json:"snapshot_timeout" yaml:"snapshot_timeout" mapstructure:"snapshot_timeout"` // Maximum duration of snapshot creation, 0 for unlimited
+	BackupTimeout   time.Duration `json:"backup_timeout" yaml:"backup_timeout" mapstructure:"backup_timeout"`       // Maximum duration of the upload including retries, 0 for unlimited
+	VerifyTimeout   time.Duration `json:"verify_timeout" yaml:"verify_timeout" mapstructure:"verify_timeout"`       // Maximum duration of the repository verification, 0 for unlimited
+	CleanupTimeout  time.Duration `json:"cleanup_timeout" yaml:"cleanup_timeout" mapstructure:"cleanup_timeout"`    // Maximum duration of restic retention and of snapshot cleanup each, 0 for unlimited
+
+	Excludes     []string `json:"excludes" yaml:"excludes" mapstructure:"excludes"`                // Patterns excluded from the restic backup
+	ExcludeFiles []string `json:"exclude_files" yaml:"exclude_files" mapstructure:"exclude_files"` // Files with patterns excluded from the restic backup
+
+	ResticExtraArgs []string `json:"restic_extra_args" yaml:"restic_extra_args" mapstructure:"restic_extra_args"` // Arguments appended to the restic backup, check and forget commands
+
+	BackupMode string `json:"backup_mode" yaml:"backup_mode" mapstructure:"backup_mode"` // "files" or "send"
+	NoLock     bool   `json:"no_lock" yaml:"no_lock" mapstructure:"no_lock"`             // Run read-only restic commands without locking the repository
+
+	Metadata         bool   `json:"metadata_manifest" yaml:"metadata_manifest" mapstructure:"metadata_manifest"` // Also upload a manifest of the ownership, permissions, ACLs and extended attributes of the snapshot
+	ChecksumManifest string `json:"checksum_manifest" yaml:"checksum_manifest" mapstructure:"checksum_manifest"` // "full" or a percentage of files to also upload a SHA-256 manifest of, empty for none
+
+	UploadLimit   int `json:"upload_limit" yaml:"upload_limit" mapstructure:"upload_limit"`       // Maximum upload rate of restic backups in KiB/s, 0 for unlimited
+	DownloadLimit int `json:"download_limit" yaml:"download_limit" mapstructure:"download_limit"` // Maximum download rate of restic backups in KiB/s, 0 for unlimited
+
+	Retries    int           `json:"retries" yaml:"retries" mapstructure:"retries"`             // Retries of a restic backup that failed with a transient error
+	RetryDelay time.Duration `json:"retry_delay" yaml:"retry_delay" mapstructure:"retry_delay"` // Delay before the first retry, doubled for each further retry
+
+	DeleteInterruptedSnapshot bool `json:"delete_interrupted_snapshot" yaml:"delete_interrupted_snapshot" mapstructure:"delete_interrupted_snapshot"` // Delete the snapshot of a run interrupted before its upload completed
+
+	HealthcheckURL string `json:"healthcheck_url" yaml:"healthcheck_url" mapstructure:"healthcheck_url"` // Healthchecks.io ping URL of the target
+}
+
+// SourceSubvolumes returns the subvolumes backed up by the target.
+func (t *TargetConfig) SourceSubvolumes() []string {
+	if len(t.Subvolumes) > 0 {
+		return t.Subvolumes
+	}
+	return []string{t.Subvolume}
+}
+
+// SnapshotNaming returns the naming of the target's snapshots on this host.
+func (t *TargetConfig) SnapshotNaming() (SnapshotNaming, error) {
+	location, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		return SnapshotNaming{}, fmt.Errorf("invalid timezone '%s': %w", t.Timezone, err)
+	}
+	host, _ := os.Hostname()
+	return NewSnapshotNaming(t.NameTemplate, t.Prefix, host, location)
+}
+
+// ChecksumPercent returns the percentage of the files of a snapshot listed in its
+// checksum manifest: 100 for "full", the percentage of values like "10%", and 0 if no
+// manifest is uploaded or the value is invalid.
+func (t *TargetConfig) ChecksumPercent() int {
+	if t.ChecksumManifest == ChecksumFull {
+		return 100
+	}
+	percent, ok := strings.CutSuffix(t.ChecksumManifest, "%")
+	if !ok {
+		return 0
+	}
+	value, err := strconv.Atoi(percent)
+	if err != nil || value < 0 || value > 100 {
+		return 0
+	}
+	return value
+}
+
+// DefaultNameTemplate names snapshots like home-20230101-120000.
+const DefaultNameTemplate = "{prefix}-{timestamp:" + defaultTimestampLayout + "}"
+
+const defaultTimestampLayout = "20060102-150405"
+
+// SnapshotNaming formats the names of a target's snapshots and recognizes them among
+// the other entries of the snapshot directory.
+type SnapshotNaming struct {
+	head     string         // expanded template before the timestamp
+	tail     string         // expanded template after the timestamp
+	layout   string         // Go reference time layout of the timestamp
+	location *time.Location // time zone of the timestamp
+}
+
+// NewSnapshotNaming expands the placeholders of a snapshot name template: {prefix},
+// {hostname} and {timestamp:<layout>}, where layout is a Go reference time layout such as
+// 2006-01-02T15:04:05 and defaults to 20060102-150405. The template must contain {prefix}
+// and exactly one {timestamp}. An empty template means DefaultNameTemplate.
+// Timestamps are written and read in the given location.
+func NewSnapshotNaming(template, prefix, hostname string, location *time.Location) (SnapshotNaming, error) {
+	if template == "" {
+		template = DefaultNameTemplate
+	}
+	if strings.Contains(template, "/") {
+		return SnapshotNaming{}, fmt.Errorf("template '%s' must not contain '/'", template)
+	}
+
+	naming := SnapshotNaming{location: location}
+	var expanded strings.Builder
+	hasPrefix, hasTimestamp := false, false
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			expanded.WriteString(rest)
+			break
+		}
+		length := strings.IndexByte(rest[start:], '}')
+		if length < 0 {
+			return SnapshotNaming{}, fmt.Errorf("unterminated placeholder in template '%s'", template)
+		}
+		expanded.WriteString(rest[:start])
+		name, layout, _ := strings.Cut(rest[start+1:start+length], ":")
+		rest = rest[start+length+1:]
+
+		switch name {
+		case "prefix":
+			expanded.WriteString(prefix)
+			hasPrefix = true
+		case "hostname":
+			expanded.WriteString(hostname)
+		case "timestamp":
+			if hasTimestamp {
+				return SnapshotNaming{}, fmt.Errorf("template '%s' must contain {timestamp} only once", template)
+			}
+			if layout == "" {
+				layout = defaultTimestampLayout
+			}
+			if time.Unix(0, 0).Format(layout) == layout {
+				return SnapshotNaming{}, fmt.Errorf("timestamp layout '%s' contains no date or time", layout)
+			}
+			hasTimestamp = true
+			naming.head = expanded.String()
+			naming.layout = layout
+			expanded.Reset()
+		default:
+			return SnapshotNaming{}, fmt.Errorf("unknown placeholder {%s} in template '%s'", name, template)
+		}
+	}
+
+	if !hasPrefix || !hasTimestamp {
+		return SnapshotNaming{}, fmt.Errorf("template '%s' must contain {prefix} and {timestamp}", template)
+	}
+	naming.tail = expanded.String()
+	return naming, nil
+}
+
+// Name returns the name of a snapshot created at t.
+func (n SnapshotNaming) Name(t time.Time) string {
+	return n.head + t.In(n.location).Format(n.layout) + n.tail
+}
+
+// Parse returns the creation time encoded in a snapshot name produced by Name.
+// It reports false for names that don't follow the template.
+func (n SnapshotNaming) Parse(name string) (time.Time, bool) {
+	if len(name) <= len(n.head)+len(n.tail) || !strings.HasPrefix(name, n.head) || !strings.HasSuffix(name, n.tail) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(n.layout, name[len(n.head):len(name)-len(n.tail)], n.location)
+	return t, err == nil
+}
+
+// EmptyGuardConfig represents the heuristics used to detect a (nearly) empty snapshot,
+// typically the result of snapshotting a mountpoint whose filesystem is not mounted.
+// A zero value disables the corresponding check.
+type EmptyGuardConfig struct {
+	MinFiles     int     `json:"min_files" yaml:"min_files" mapstructure:"min_files"`                // Minimum number of files the snapshot must contain
+	MinSizeRatio float64 `json:"min_size_ratio" yaml:"min_size_ratio" mapstructure:"min_size_ratio"` // Minimum size relative to the previous snapshot (0-1)
+}
+
+// IsEnabled reports whether any empty snapshot check is configured.
+func (g EmptyGuardConfig) IsEnabled() bool {
+	return g.MinFiles > 0 || g.MinSizeRatio > 0
+}
+
+// Ways of uploading a snapshot to restic.
+const (
+	BackupModeFiles = "files" // restic walks the files of the snapshot
+	BackupModeSend  = "send"  // 'btrfs send' of the snapshot is piped into 'restic backup --stdin'
+)
+
+// DefaultStateDir is the default state_dir.
+const DefaultStateDir = "/var/lib/btrfs-backup"
+
+// Backends holding the repository configurations.
+const (
+	SecretBackendFile    = "file"
+	SecretBackendKeyring = "keyring"
+	SecretBackendEnv     = "env" // environment variables, see RepositoryEnv
+)
+
+// VerifyFull is the verify_subset reading all data of the repository.
+const VerifyFull = "full"
+
+// ChecksumFull is the checksum_manifest listing every file of a snapshot.
+const ChecksumFull = "full"
+
+// Actions taken when a backup violates its success criteria.
+const (
+	ViolationFail = "fail"
+	ViolationWarn = "warn"
+)
+
+// Actions taken when the btrfs device error counters of a target's filesystem rose.
+const (
+	DeviceErrorsFail   = "fail"
+	DeviceErrorsWarn   = "warn"
+	DeviceErrorsIgnore = "ignore"
+)
+
+// When the post_backup hooks of a target run.
+const (
+	HookWhenSuccess = "success"
+	HookWhenAlways  = "always"
+)
+
+// SuccessCriteriaConfig represents expectations on the summary restic reports after a
+// backup, catching backups that succeed but are quietly broken. A zero value disables
+// the corresponding check.
+type SuccessCriteriaConfig struct {
+	MinFiles    int           `json:"min_files" yaml:"min_files" mapstructure:"min_files"`          // Minimum number of files processed
+	MinBytes    string        `json:"min_bytes" yaml:"min_bytes" mapstructure:"min_bytes"`          // Minimum amount of data processed, e.g. "1GB"
+	MaxDuration time.Duration `json:"max_duration" yaml:"max_duration" mapstructure:"max_duration"` // Maximum duration of the restic backup
+	OnViolation string        `json:"on_violation" yaml:"on_violation" mapstructure:"on_violation"` // "fail" or "warn"
+}
+
+// IsEnabled reports whether any success criterion is configured.
+func (c SuccessCriteriaConfig) IsEnabled() bool {
+	return c.MinFiles > 0 || c.MinBytes != "" || c.MaxDuration > 0
+}
+
+// sizeUnits maps size suffixes to their multipliers. Plain numbers are bytes.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a size such as "1GB", "512MiB" or "1048576" into bytes.
+// KB, MB, GB and TB are decimal units, KiB, MiB, GiB and TiB binary ones.
+func ParseSize(size string) (int64, error) {
+	number := strings.TrimSpace(size)
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// intervalUnits maps the day and week suffixes ParseInterval accepts in addition to
+// those of time.ParseDuration to their length.
+var intervalUnits = map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+
+// ParseInterval parses an interval such as "30d", "2w" or "36h". Whole days and weeks
+// are accepted in addition to everything time.ParseDuration understands.
+func ParseInterval(interval string) (time.Duration, error) {
+	for suffix, unit := range intervalUnits {
+		if number, ok := strings.CutSuffix(interval, suffix); ok {
+			n, err := strconv.Atoi(number)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid interval '%s'", interval)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+
+	d, err := time.ParseDuration(interval)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid interval '%s'", interval)
+	}
+	return d, nil
+}
+
+// ResticKeepConfig represents the retention policy applied to a target's restic snapshots
+// with 'restic forget --prune'. A zero value disables the corresponding rule and a policy
+// with all rules disabled means restic snapshots are never forgotten.
+type ResticKeepConfig struct {
+	KeepLast    int `json:"keep_last" yaml:"keep_last" mapstructure:"keep_last"`          // Number of most recent snapshots to keep
+	KeepDaily   int `json:"keep_daily" yaml:"keep_daily" mapstructure:"keep_daily"`       // Number of daily snapshots to keep
+	KeepWeekly  int `json:"keep_weekly" yaml:"keep_weekly" mapstructure:"keep_weekly"`    // Number of weekly snapshots to keep
+	KeepMonthly int `json:"keep_monthly" yaml:"keep_monthly" mapstructure:"keep_monthly"` // Number of monthly snapshots to keep
+
+	KeepTags []string `json:"keep_tags" yaml:"keep_tags" mapstructure:"keep_tags"` // Snapshots carrying any of these tags are kept regardless of age
+}
+
+// IsEnabled reports whether any retention rule is configured.
+func (k ResticKeepConfig) IsEnabled() bool {
+	return k.KeepLast > 0 || k.KeepDaily > 0 || k.KeepWeekly > 0 || k.KeepMonthly > 0 || len(k.KeepTags) > 0
 }
 
 // GetConfigPath determines the main configuration file path using the following priority:
@@ -58,6 +526,9 @@ func GetConfigPath(provided string) string {
 // 1. Provided path parameter (highest priority)
 // 2. targetDir from main config + targetName
 // 3. Default path: $HOME/.config/btrfs-backup/targets/<targetName> (lowest priority)
+// If no file is named exactly after the target, a file with an extension such as
+// <targetName>.yaml is used, the way DiscoverTargets names targets. If there is none
+// either and targetName is the inline target, see InlineTarget, the path is empty.
 func GetTargetConfigPath(provided, targetDir, targetName string) string {
 	if provided != "" {
 		return provided
@@ -74,20 +545,134 @@ func GetTargetConfigPath(provided, targetDir, targetName string) string {
 		defaultTargetDir = targetDir
 	}
 
-	return filepath.Join(defaultTargetDir, targetName)
+	path := filepath.Join(defaultTargetDir, targetName)
+	if _, err := os.Stat(path); err != nil {
+		if matches, _ := filepath.Glob(path + ".*"); len(matches) > 0 {
+			return matches[0]
+		}
+		if name, ok := InlineTarget(); ok && name == targetName {
+			return ""
+		}
+	}
+	return path
+}
+
+// TargetFile is a target configuration file found in the target directory.
+type TargetFile struct {
+	Name string // Target name, the file name without its extension
+	Path string // Full path to the target configuration file
+}
+
+// DiscoverTargets lists the target configuration files in targetDir, sorted by name.
+// Every regular, non-hidden file is treated as a target configuration and named after
+// its file name without extension. Subdirectories are ignored.
+// Without any file, or targetDir, the inline target is returned if there is one, see
+// InlineTarget, with an empty Path.
+func DiscoverTargets(targetDir string) ([]TargetFile, error) {
+	inline, hasInline := InlineTarget()
+	entries, err := os.ReadDir(targetDir)
+	if err != nil && !hasInline {
+		return nil, fmt.Errorf("failed to read target directory: %w", err)
+	}
+
+	var targets []TargetFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		targets = append(targets, TargetFile{
+			Name: strings.TrimSuffix(name, filepath.Ext(name)),
+			Path: filepath.Join(targetDir, name),
+		})
+	}
+	if len(targets) == 0 && hasInline {
+		targets = []TargetFile{{Name: inline}}
+	}
+
+	return targets, nil
+}
+
+// UnknownKeys returns the settings in the main configuration file at path that the
+// configuration doesn't define, sorted. Loading ignores them, so a misspelled setting
+// silently keeps its default.
+func UnknownKeys(path string) ([]string, error) {
+	return unknownKeys(path, reflect.TypeFor[Config]())
+}
+
+// UnknownTargetKeys returns the settings in the target configuration file at path that
+// the target configuration doesn't define, sorted, see UnknownKeys.
+func UnknownTargetKeys(path string) ([]string, error) {
+	return unknownKeys(path, reflect.TypeFor[TargetConfig]())
+}
+
+func unknownKeys(path string, config reflect.Type) ([]string, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	known := make(map[string]bool)
+	addKnownKeys(known, config, "")
+	var unknown []string
+	for _, key := range v.AllKeys() {
+		if !known[key] && !known[mapEntryKey(key)] {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown, nil
+}
+
+// addKnownKeys adds the mapstructure keys of the fields of the struct type t to known,
+// including those of nested structs as dotted keys, the way viper names them. Keys of
+// structs in maps and of other map entries have "*" in place of the map key, see
+// mapEntryKey.
+func addKnownKeys(known map[string]bool, t reflect.Type, prefix string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		key := prefix + field.Tag.Get("mapstructure")
+		known[key] = true
+		if field.Type.Kind() == reflect.Struct {
+			addKnownKeys(known, field.Type, key+".")
+		}
+		if field.Type.Kind() == reflect.Map && field.Type.Elem().Kind() == reflect.Struct {
+			addKnownKeys(known, field.Type.Elem(), key+".*.")
+		} else if field.Type.Kind() == reflect.Map {
+			known[key+".*"] = true
+		}
+	}
+}
+
+// mapEntryKey returns key with its second part, the map key of a setting in a map of
+// structs such as repositories.<name>.verify_subset or of an entry of another map such as
+// classification_policy.<classification>, replaced by "*".
+func mapEntryKey(key string) string {
+	parts := strings.SplitN(key, ".", 3)
+	switch len(parts) {
+	case 2:
+		return parts[0] + ".*"
+	case 3:
+		return parts[0] + ".*." + parts[2]
+	}
+	return key
 }
 
 // LoadConfig loads and validates the main configuration from the specified file path.
 // It uses Viper for robust parsing supporting JSON, YAML, TOML, HCL, INI formats.
-// Also supports environment variables with BTRFSBACKUP_ prefix.
+// Also supports environment variables with BTRFSBACKUP_ prefix for every setting, see
+// bindEnv. If the file doesn't exist but such variables are set, see EnvConfigured, the
+// configuration comes from the environment and the defaults alone.
 // Returns a validated Config struct or an error if loading/validation fails.
 func LoadConfig(path string) (*Config, error) {
 	v := viper.New()
 
 	// Set up environment variables
-	v.SetEnvPrefix("BTRFSBACKUP")
+	v.SetEnvPrefix(EnvPrefix)
 	v.AutomaticEnv()
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	bindEnv(v, reflect.TypeFor[Config](), "")
 
 	// Set defaults
 	setConfigDefaults(v)
@@ -110,12 +695,16 @@ func LoadConfig(path string) (*Config, error) {
 
 	// Read the configuration
 	if err := v.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		var notFound viper.ConfigFileNotFoundError
+		missing := errors.Is(err, fs.ErrNotExist) || errors.As(err, &notFound)
+		if !missing || !EnvConfigured() {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
 	}
 
 	// Unmarshal into struct
 	var config Config
-	if err := v.Unmarshal(&config); err != nil {
+	if err := v.Unmarshal(&config, viper.DecodeHook(decodeHook)); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
@@ -128,25 +717,39 @@ func LoadConfig(path string) (*Config, error) {
 }
 
 // LoadTargetConfig loads and validates a target configuration from the specified file path.
-// It uses Viper for robust parsing supporting multiple formats and environment variables.
+// It uses Viper for robust parsing supporting multiple formats and environment variables
+// with BTRFSBACKUP_TARGET_ prefix for every setting. With an empty path, the inline target
+// is loaded from the environment and the defaults alone, see InlineTarget.
 // Returns a validated TargetConfig struct or an error if loading/validation fails.
 func LoadTargetConfig(path string) (*TargetConfig, error) {
 	v := viper.New()
 
 	// Set up environment variables (target-specific ones can use TARGET_ prefix)
-	v.SetEnvPrefix("BTRFSBACKUP_TARGET")
+	v.SetEnvPrefix(TargetEnvPrefix)
 	v.AutomaticEnv()
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	bindEnv(v, reflect.TypeFor[TargetConfig](), "")
 
 	// Set defaults
 	setTargetDefaults(v)
 
-	// Configure file path
-	v.SetConfigFile(path)
+	// Configure file path, files named just after the target are YAML
+	if path != "" {
+		v.SetConfigFile(path)
+		if filepath.Ext(path) == "" {
+			v.SetConfigType("yaml")
+		}
 
-	// Read the configuration
-	if err := v.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("failed to read target config file: %w", err)
+		// Read the configuration
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read target config file: %w", err)
+		}
+	}
+
+	// verify: full is short for verify: true with verify_subset: full
+	if v.GetString("verify") == VerifyFull {
+		v.Set("verify", true)
+		v.Set("verify_subset", VerifyFull)
 	}
 
 	// Unmarshal into struct
@@ -166,50 +769,367 @@ func LoadTargetConfig(path string) (*TargetConfig, error) {
 // setConfigDefaults sets default values for main configuration using Viper
 func setConfigDefaults(v *viper.Viper) {
 	v.SetDefault("restic_bin", "/usr/bin/restic")
+	v.SetDefault("age_bin", "age")
+	v.SetDefault("gpg_bin", "gpg")
+	v.SetDefault("secret_backend", SecretBackendFile)
+	v.SetDefault("secret_tool_bin", "secret-tool")
+	v.SetDefault("log_backend", "stderr")
+	v.SetDefault("state_dir", DefaultStateDir)
+	v.SetDefault("parallel_targets", 1)
+	v.SetDefault("upload_concurrency", 1)
+	v.SetDefault("notifications.timeout", "10s")
+	v.SetDefault("notifications.retries", 3)
+	v.SetDefault("notifications.storm_threshold", 3)
+	v.SetDefault("notifications.email.smtp_port", 587)
+	v.SetDefault("notifications.mqtt.topic_prefix", "btrfs-backup")
 }
 
 // setTargetDefaults sets default values for target configuration using Viper
 func setTargetDefaults(v *viper.Viper) {
 	v.SetDefault("type", "incremental")
 	v.SetDefault("keep_snapshots", 3)
+	v.SetDefault("min_keep_snapshots", 1)
+	v.SetDefault("name_template", DefaultNameTemplate)
+	v.SetDefault("timezone", "UTC")
 	v.SetDefault("verify", false)
+	v.SetDefault("verify_subset", "5%")
+	v.SetDefault("schedule", "daily")
+	v.SetDefault("hook_timeout", "5m")
+	v.SetDefault("post_backup_when", HookWhenSuccess)
+	v.SetDefault("device_errors", DeviceErrorsWarn)
+	v.SetDefault("retry_delay", "30s")
+	v.SetDefault("delete_interrupted_snapshot", false)
+	v.SetDefault("no_lock", true)
+	v.SetDefault("backup_mode", BackupModeFiles)
+	v.SetDefault("success_criteria.on_violation", ViolationFail)
 }
 
 func validateConfig(config *Config) error {
-	if config.TargetDir == "" {
+	if _, inline := InlineTarget(); config.TargetDir == "" && !inline {
 		return fmt.Errorf("target_dir is required")
 	}
 	if config.SnapshotDir == "" {
 		return fmt.Errorf("snapshot_dir is required")
 	}
-	if config.ResticRepoDir == "" {
-		return fmt.Errorf("restic_repo_dir is required")
+	switch config.SecretBackend {
+	case "", SecretBackendFile:
+		if config.ResticRepoDir == "" {
+			return fmt.Errorf("restic_repo_dir is required")
+		}
+	case SecretBackendKeyring:
+	case SecretBackendEnv:
+		if err := CheckRepositoryEnv(slices.Collect(maps.Keys(config.Repositories))); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid secret_backend '%s', must be '%s', '%s' or '%s'", config.SecretBackend, SecretBackendFile, SecretBackendKeyring, SecretBackendEnv)
 	}
 	if config.ResticBin == "" {
 		return fmt.Errorf("restic_bin is required")
 	}
+	for _, endpoint := range [][2]string{{"metrics_pushgateway", config.MetricsPushgateway}, {"metrics_remote_write", config.MetricsRemoteWrite}} {
+		key, url := endpoint[0], endpoint[1]
+		if url != "" && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return fmt.Errorf("invalid %s '%s', must start with http:// or https://", key, url)
+		}
+	}
+	if config.BtrfsHelperSocket != "" && !filepath.IsAbs(config.BtrfsHelperSocket) {
+		return fmt.Errorf("btrfs_helper_socket must be an absolute path, got '%s'", config.BtrfsHelperSocket)
+	}
+	if config.ParallelTargets < 0 || config.UploadConcurrency < 0 {
+		return fmt.Errorf("parallel_targets and upload_concurrency must be positive")
+	}
+	switch config.LogBackend {
+	case "", "stderr", "syslog", "journald":
+	default:
+		return fmt.Errorf("invalid log_backend '%s', must be 'stderr', 'syslog' or 'journald'", config.LogBackend)
+	}
+	for name, repository := range config.Repositories {
+		if repository.VerifySubset != "" && !validVerifySubset(repository.VerifySubset) {
+			return fmt.Errorf("invalid verify_subset '%s' of repository '%s', must be a percentage, n/t, a size or '%s'", repository.VerifySubset, name, VerifyFull)
+		}
+		if err := validateInterval("verify_full_every", repository.VerifyFullEvery); err != nil {
+			return fmt.Errorf("repository '%s': %w", name, err)
+		}
+		if err := validateInterval("prune_every", repository.PruneEvery); err != nil {
+			return fmt.Errorf("repository '%s': %w", name, err)
+		}
+		if repository.MaxUnused != "" && repository.PruneEvery == "" {
+			return fmt.Errorf("repository '%s': max_unused requires prune_every", name)
+		}
+		if repository.MaxUnused != "" && !validMaxUnused(repository.MaxUnused) {
+			return fmt.Errorf("invalid max_unused '%s' of repository '%s', must be a percentage, a size or 'unlimited'", repository.MaxUnused, name)
+		}
+		if err := validateInterval("rotate_every", repository.RotateEvery); err != nil {
+			return fmt.Errorf("repository '%s': %w", name, err)
+		}
+		if repository.RotateEvery != "" && repository.PasswordRotatedAt == "" {
+			return fmt.Errorf("repository '%s': rotate_every requires password_rotated_at", name)
+		}
+		if repository.PasswordRotatedAt != "" {
+			if _, err := time.Parse(time.DateOnly, repository.PasswordRotatedAt); err != nil {
+				return fmt.Errorf("invalid password_rotated_at '%s' of repository '%s', must be a date such as 2026-01-31", repository.PasswordRotatedAt, name)
+			}
+		}
+	}
+	if err := validateClassificationPolicy(config.ClassificationPolicy); err != nil {
+		return err
+	}
+	return validateNotifications(&config.Notifications)
+}
+
+// validateInterval checks that the setting key, if set, is a positive interval, see
+// ParseInterval.
+func validateInterval(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	interval, err := ParseInterval(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if interval == 0 {
+		return fmt.Errorf("%s must be positive", key)
+	}
+	return nil
+}
+
+func validateNotifications(n *NotificationsConfig) error {
+	for _, url := range n.Webhooks {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return fmt.Errorf("invalid webhook URL '%s', must start with http:// or https://", url)
+		}
+	}
+	if n.Retries < 0 {
+		return fmt.Errorf("notifications.retries must be non-negative")
+	}
+	if n.StormThreshold < 0 {
+		return fmt.Errorf("notifications.storm_threshold must be non-negative")
+	}
+	if n.Email.IsEnabled() {
+		if n.Email.From == "" || len(n.Email.To) == 0 {
+			return fmt.Errorf("notifications.email requires from and to addresses")
+		}
+		if n.Email.SMTPPort <= 0 || n.Email.SMTPPort > 65535 {
+			return fmt.Errorf("invalid notifications.email.smtp_port %d", n.Email.SMTPPort)
+		}
+	}
+	if n.MQTT.IsEnabled() {
+		if !strings.HasPrefix(n.MQTT.Broker, "mqtt://") && !strings.HasPrefix(n.MQTT.Broker, "mqtts://") {
+			return fmt.Errorf("invalid notifications.mqtt.broker '%s', must start with mqtt:// or mqtts://", n.MQTT.Broker)
+		}
+		if n.MQTT.TopicPrefix == "" {
+			return fmt.Errorf("notifications.mqtt.topic_prefix is required")
+		}
+	}
+	if (n.Email.IsEnabled() || n.MQTT.IsEnabled() || len(n.Webhooks) > 0) && n.Timeout <= 0 {
+		return fmt.Errorf("notifications.timeout must be positive")
+	}
 	return nil
 }
 
 func validateTargetConfig(target *TargetConfig) error {
-	if target.Subvolume == "" {
+	if target.Subvolume == "" && len(target.Subvolumes) == 0 {
 		return fmt.Errorf("subvolume is required")
 	}
+	if target.Subvolume != "" && len(target.Subvolumes) > 0 {
+		return fmt.Errorf("subvolume and subvolumes are mutually exclusive")
+	}
+	names := make(map[string]string)
+	for _, subvolume := range target.Subvolumes {
+		name := filepath.Base(subvolume)
+		if name == "/" || name == "." {
+			return fmt.Errorf("invalid subvolume '%s' in subvolumes", subvolume)
+		}
+		if other, exists := names[name]; exists {
+			return fmt.Errorf("subvolumes %s and %s have the same name '%s'", other, subvolume, name)
+		}
+		names[name] = subvolume
+	}
 	if target.Prefix == "" {
 		return fmt.Errorf("prefix is required")
 	}
 	if target.Repository == "" {
 		return fmt.Errorf("repository is required")
 	}
+	if _, err := NewSnapshotNaming(target.NameTemplate, target.Prefix, "", time.UTC); err != nil {
+		return fmt.Errorf("invalid name_template: %w", err)
+	}
+	if _, err := time.LoadLocation(target.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone '%s': %w", target.Timezone, err)
+	}
 
 	validTypes := map[string]bool{"incremental": true, "full": true}
 	if target.Type != "" && !validTypes[target.Type] {
 		return fmt.Errorf("invalid backup type '%s', must be 'incremental' or 'full'", target.Type)
 	}
 
+	if target.VerifySubset != "" && !validVerifySubset(target.VerifySubset) {
+		return fmt.Errorf("invalid verify_subset '%s', must be a percentage, n/t, a size or '%s'", target.VerifySubset, VerifyFull)
+	}
+
+	if target.VerifyEvery < 0 {
+		return fmt.Errorf("verify_every must be non-negative")
+	}
+
+	if err := validateInterval("full_every", target.FullEvery); err != nil {
+		return err
+	}
+	if err := validateInterval("verify_full_every", target.VerifyFullEvery); err != nil {
+		return err
+	}
+	if err := validateInterval("verify_old_every", target.VerifyOldEvery); err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(target.Schedule, "\n\r") {
+		return fmt.Errorf("schedule must be a single line")
+	}
+	// Other OnCalendar expressions are left to systemd
+	if _, err := schedule.Parse(target.Schedule); err != nil && !errors.Is(err, schedule.ErrUnsupported) {
+		return err
+	}
+
 	if target.KeepSnapshots < 0 {
 		return fmt.Errorf("keep_snapshots must be non-negative")
 	}
+	if target.MaxSnapshotSpace != "" {
+		if _, err := ParseSize(target.MaxSnapshotSpace); err != nil {
+			return fmt.Errorf("invalid max_snapshot_space: %w", err)
+		}
+	}
+	if target.MinKeepSnapshots < 0 {
+		return fmt.Errorf("min_keep_snapshots must be non-negative")
+	}
+
+	keep := target.ResticKeep
+	if keep.KeepLast < 0 || keep.KeepDaily < 0 || keep.KeepWeekly < 0 || keep.KeepMonthly < 0 {
+		return fmt.Errorf("restic_keep values must be non-negative")
+	}
+	if slices.Contains(keep.KeepTags, "") {
+		return fmt.Errorf("restic_keep.keep_tags must not contain empty tags")
+	}
+
+	if target.EmptyGuard.MinFiles < 0 {
+		return fmt.Errorf("empty_snapshot_guard.min_files must be non-negative")
+	}
+	if target.EmptyGuard.MinSizeRatio < 0 || target.EmptyGuard.MinSizeRatio > 1 {
+		return fmt.Errorf("empty_snapshot_guard.min_size_ratio must be between 0 and 1")
+	}
+
+	criteria := target.SuccessCriteria
+	if criteria.MinFiles < 0 {
+		return fmt.Errorf("success_criteria.min_files must be non-negative")
+	}
+	if criteria.MinBytes != "" {
+		if _, err := ParseSize(criteria.MinBytes); err != nil {
+			return fmt.Errorf("invalid success_criteria.min_bytes: %w", err)
+		}
+	}
+	if criteria.MaxDuration < 0 {
+		return fmt.Errorf("success_criteria.max_duration must be non-negative")
+	}
+	if criteria.OnViolation != "" && criteria.OnViolation != ViolationFail && criteria.OnViolation != ViolationWarn {
+		return fmt.Errorf("invalid success_criteria.on_violation '%s', must be '%s' or '%s'", criteria.OnViolation, ViolationFail, ViolationWarn)
+	}
+
+	if target.HookTimeout < 0 {
+		return fmt.Errorf("hook_timeout must be non-negative")
+	}
+	switch target.DeviceErrors {
+	case "", DeviceErrorsFail, DeviceErrorsWarn, DeviceErrorsIgnore:
+	default:
+		return fmt.Errorf("invalid device_errors '%s', must be '%s', '%s' or '%s'", target.DeviceErrors, DeviceErrorsFail, DeviceErrorsWarn, DeviceErrorsIgnore)
+	}
+	if target.PostBackupWhen != "" && target.PostBackupWhen != HookWhenSuccess && target.PostBackupWhen != HookWhenAlways {
+		return fmt.Errorf("invalid post_backup_when '%s', must be '%s' or '%s'", target.PostBackupWhen, HookWhenSuccess, HookWhenAlways)
+	}
+	if target.SnapshotTimeout < 0 || target.BackupTimeout < 0 || target.VerifyTimeout < 0 || target.CleanupTimeout < 0 {
+		return fmt.Errorf("snapshot_timeout, backup_timeout, verify_timeout and cleanup_timeout must be non-negative")
+	}
+
+	if target.ChecksumManifest != "" && target.ChecksumPercent() == 0 {
+		return fmt.Errorf("invalid checksum_manifest '%s', must be '%s' or a percentage of files from 1%% to 100%%", target.ChecksumManifest, ChecksumFull)
+	}
+	if target.Classification != "" && !slices.Contains(Classifications, target.Classification) {
+		return fmt.Errorf("invalid classification '%s', must be one of %s", target.Classification, strings.Join(Classifications, ", "))
+	}
+	if len(target.ResticExtraArgs) > 0 && !strings.HasPrefix(target.ResticExtraArgs[0], "-") {
+		return fmt.Errorf("restic_extra_args must start with a flag, got '%s'", target.ResticExtraArgs[0])
+	}
+
+	switch target.BackupMode {
+	case "", BackupModeFiles:
+	case BackupModeSend:
+		if len(target.Subvolumes) > 0 {
+			return fmt.Errorf("backup_mode '%s' supports a single subvolume only", BackupModeSend)
+		}
+		if len(target.Excludes) > 0 || len(target.ExcludeFiles) > 0 {
+			return fmt.Errorf("excludes and exclude_files can't be used with backup_mode '%s'", BackupModeSend)
+		}
+		if target.Metadata {
+			return fmt.Errorf("metadata_manifest can't be used with backup_mode '%s', whose streams keep all metadata", BackupModeSend)
+		}
+	default:
+		return fmt.Errorf("invalid backup_mode '%s', must be '%s' or '%s'", target.BackupMode, BackupModeFiles, BackupModeSend)
+	}
+
+	if target.UploadLimit < 0 || target.DownloadLimit < 0 {
+		return fmt.Errorf("upload_limit and download_limit must be non-negative")
+	}
+
+	if target.Retries < 0 {
+		return fmt.Errorf("retries must be non-negative")
+	}
+	if target.RetryDelay < 0 {
+		return fmt.Errorf("retry_delay must be non-negative")
+	}
+
+	if target.HealthcheckURL != "" && !strings.HasPrefix(target.HealthcheckURL, "http://") && !strings.HasPrefix(target.HealthcheckURL, "https://") {
+		return fmt.Errorf("invalid healthcheck_url '%s', must start with http:// or https://", target.HealthcheckURL)
+	}
 
 	return nil
 }
+
+// validVerifySubset reports whether subset is "full" or a value 'restic check
+// --read-data-subset' accepts: a percentage such as "10%", a fraction n/t such as "1/5",
+// or a size with an optional K, M, G or T suffix such as "2G".
+func validVerifySubset(subset string) bool {
+	if subset == VerifyFull {
+		return true
+	}
+	if percent, ok := strings.CutSuffix(subset, "%"); ok {
+		value, err := strconv.ParseFloat(percent, 64)
+		return err == nil && value > 0 && value <= 100
+	}
+	if n, t, ok := strings.Cut(subset, "/"); ok {
+		part, err1 := strconv.Atoi(n)
+		total, err2 := strconv.Atoi(t)
+		return err1 == nil && err2 == nil && part >= 1 && part <= total
+	}
+	size := strings.TrimRight(subset, "KMGT")
+	if len(subset)-len(size) > 1 {
+		return false
+	}
+	value, err := strconv.ParseUint(size, 10, 64)
+	return err == nil && value > 0
+}
+
+// validMaxUnused reports whether value is a valid --max-unused of 'restic prune': a
+// percentage, a size with an optional K, M, G or T suffix, or "unlimited".
+func validMaxUnused(value string) bool {
+	if value == "unlimited" {
+		return true
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		number, err := strconv.ParseFloat(percent, 64)
+		return err == nil && number >= 0 && number <= 100
+	}
+	size := strings.TrimRight(value, "KMGT")
+	if len(value)-len(size) > 1 {
+		return false
+	}
+	_, err := strconv.ParseUint(size, 10, 64)
+	return err == nil
+}
@@ -3,7 +3,11 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -47,6 +51,68 @@ restic_bin: /usr/bin/restic
 	}
 }
 
+func TestLoadConfigNotifications(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	configData := `target_dir: /tmp/targets
+snapshot_dir: /tmp/snapshots
+restic_repo_dir: /tmp/repos
+notifications:
+  webhooks:
+    - https://hooks.example.com/backup
+`
+	if err := os.WriteFile(configFile, []byte(configData), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	n := config.Notifications
+	if n.MQTT.IsEnabled() || n.MQTT.TopicPrefix != "btrfs-backup" {
+		t.Errorf("Expected MQTT disabled with default topic prefix 'btrfs-backup', got %+v", n.MQTT)
+	}
+	if len(n.Webhooks) != 1 || n.Webhooks[0] != "https://hooks.example.com/backup" {
+		t.Errorf("Unexpected webhooks: %v", n.Webhooks)
+	}
+	if n.Timeout != 10*time.Second || n.Retries != 3 || n.StormThreshold != 3 {
+		t.Errorf("Expected default timeout 10s, 3 retries and storm threshold 3, got %v, %d and %d", n.Timeout, n.Retries, n.StormThreshold)
+	}
+}
+
+func TestLoadConfigRepositories(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	configData := `target_dir: /tmp/targets
+snapshot_dir: /tmp/snapshots
+restic_repo_dir: /tmp/repos
+repositories:
+  B2-Home:
+    verify_subset: 1G
+    verify_full_every: 90d
+    prune_every: 7d
+    max_unused: 10%
+    password_rotated_at: 2026-01-15
+    rotate_every: 90d
+`
+	if err := os.WriteFile(configFile, []byte(configData), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	expected := RepositoryConfig{VerifySubset: "1G", VerifyFullEvery: "90d", PruneEvery: "7d", MaxUnused: "10%",
+		PasswordRotatedAt: "2026-01-15", RotateEvery: "90d"}
+	if got := config.Repository("B2-Home"); got != expected {
+		t.Errorf("Unexpected repository settings %+v", got)
+	}
+	if got := config.Repository("local"); got != (RepositoryConfig{}) {
+		t.Errorf("Expected no settings for an unconfigured repository, got %+v", got)
+	}
+}
+
 func TestLoadConfigWithEnvironmentVariables(t *testing.T) {
 	// Set environment variables
 	_ = os.Setenv("BTRFSBACKUP_TARGET_DIR", "/env/targets")
@@ -166,6 +232,29 @@ repository: b2-home
 	if target.Verify != false {
 		t.Errorf("Expected default Verify false, got %v", target.Verify)
 	}
+	if target.VerifySubset != "5%" {
+		t.Errorf("Expected default VerifySubset '5%%', got '%s'", target.VerifySubset)
+	}
+}
+
+func TestLoadTargetConfigVerifyFull(t *testing.T) {
+	targetFile := filepath.Join(t.TempDir(), "target.yaml")
+	targetData := `subvolume: /mnt/btrfs/home
+prefix: home-backup
+repository: b2-home
+verify: full
+`
+	if err := os.WriteFile(targetFile, []byte(targetData), 0644); err != nil {
+		t.Fatalf("Failed to write target file: %v", err)
+	}
+
+	target, err := LoadTargetConfig(targetFile)
+	if err != nil {
+		t.Fatalf("LoadTargetConfig failed: %v", err)
+	}
+	if !target.Verify || target.VerifySubset != VerifyFull {
+		t.Errorf("Expected Verify true with VerifySubset '%s', got %v with '%s'", VerifyFull, target.Verify, target.VerifySubset)
+	}
 }
 
 func TestSetConfigDefaults(t *testing.T) {
@@ -175,6 +264,9 @@ func TestSetConfigDefaults(t *testing.T) {
 	if v.GetString("restic_bin") != "/usr/bin/restic" {
 		t.Errorf("Expected default restic_bin '/usr/bin/restic', got '%s'", v.GetString("restic_bin"))
 	}
+	if v.GetString("state_dir") != "/var/lib/btrfs-backup" {
+		t.Errorf("Expected default state_dir '/var/lib/btrfs-backup', got '%s'", v.GetString("state_dir"))
+	}
 }
 
 func TestSetTargetDefaults(t *testing.T) {
@@ -187,9 +279,132 @@ func TestSetTargetDefaults(t *testing.T) {
 	if v.GetInt("keep_snapshots") != 3 {
 		t.Errorf("Expected default keep_snapshots 3, got %d", v.GetInt("keep_snapshots"))
 	}
+	if v.GetInt("min_keep_snapshots") != 1 {
+		t.Errorf("Expected default min_keep_snapshots 1, got %d", v.GetInt("min_keep_snapshots"))
+	}
 	if v.GetBool("verify") != false {
 		t.Errorf("Expected default verify false, got %v", v.GetBool("verify"))
 	}
+	if v.GetDuration("hook_timeout") != 5*time.Minute {
+		t.Errorf("Expected default hook_timeout 5m, got %v", v.GetDuration("hook_timeout"))
+	}
+	if v.GetString("device_errors") != DeviceErrorsWarn {
+		t.Errorf("Expected default device_errors warn, got %s", v.GetString("device_errors"))
+	}
+	if v.GetString("post_backup_when") != HookWhenSuccess {
+		t.Errorf("Expected default post_backup_when success, got %s", v.GetString("post_backup_when"))
+	}
+	if !v.GetBool("no_lock") {
+		t.Errorf("Expected default no_lock true, got false")
+	}
+	if v.GetDuration("retry_delay") != 30*time.Second {
+		t.Errorf("Expected default retry_delay 30s, got %v", v.GetDuration("retry_delay"))
+	}
+	if v.GetString("timezone") != "UTC" {
+		t.Errorf("Expected default timezone 'UTC', got '%s'", v.GetString("timezone"))
+	}
+	if v.GetString("name_template") != DefaultNameTemplate {
+		t.Errorf("Expected default name_template '%s', got '%s'", DefaultNameTemplate, v.GetString("name_template"))
+	}
+}
+
+func TestLoadTargetConfigWithHooks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "btrfs-backup-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	targetFile := filepath.Join(tmpDir, "target.yaml")
+	targetData := `subvolume: /mnt/btrfs/db
+prefix: db
+repository: b2-db
+pre_snapshot:
+  - systemctl stop postgresql
+post_snapshot:
+  - systemctl start postgresql
+pre_backup:
+  - echo uploading
+post_backup:
+  - echo done
+  - curl -fsS https://example.com/ping
+post_backup_when: always
+post_failure_hooks:
+  - /usr/local/bin/collect-diagnostics
+hook_timeout: 90s
+`
+	err = os.WriteFile(targetFile, []byte(targetData), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write target file: %v", err)
+	}
+
+	target, err := LoadTargetConfig(targetFile)
+	if err != nil {
+		t.Fatalf("LoadTargetConfig failed: %v", err)
+	}
+
+	if len(target.PreSnapshot) != 1 || target.PreSnapshot[0] != "systemctl stop postgresql" {
+		t.Errorf("Unexpected pre_snapshot hooks: %v", target.PreSnapshot)
+	}
+	if len(target.PostSnapshot) != 1 || target.PostSnapshot[0] != "systemctl start postgresql" {
+		t.Errorf("Unexpected post_snapshot hooks: %v", target.PostSnapshot)
+	}
+	if len(target.PreBackup) != 1 || len(target.PostBackup) != 2 {
+		t.Errorf("Unexpected backup hooks: %v / %v", target.PreBackup, target.PostBackup)
+	}
+	if target.HookTimeout != 90*time.Second {
+		t.Errorf("Expected hook_timeout 90s, got %v", target.HookTimeout)
+	}
+	if target.PostBackupWhen != HookWhenAlways || len(target.PostFailure) != 1 || target.PostFailure[0] != "/usr/local/bin/collect-diagnostics" {
+		t.Errorf("Unexpected failure hooks: %s / %v", target.PostBackupWhen, target.PostFailure)
+	}
+}
+
+func TestCheckClassification(t *testing.T) {
+	cfg := &Config{
+		Repositories: map[string]RepositoryConfig{
+			"b2-home": {Encrypted: true, Offsite: true},
+			"nas":     {Encrypted: true},
+			"usb":     {},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		classification string
+		repository     string
+		policy         map[string][]string
+		errorContains  string
+	}{
+		{name: "unclassified", repository: "usb"},
+		{name: "confidential_offsite", classification: ClassificationConfidential, repository: "B2-Home"},
+		{name: "confidential_local", classification: ClassificationConfidential, repository: "nas",
+			errorContains: "confidential targets require encrypted, offsite repositories, but repository 'nas' is not declared offsite"},
+		{name: "internal_encrypted", classification: ClassificationInternal, repository: "nas"},
+		{name: "internal_undeclared", classification: ClassificationInternal, repository: "usb", errorContains: "is not declared encrypted"},
+		{name: "public_anywhere", classification: ClassificationPublic, repository: "usb"},
+		{name: "policy_overrides_default", classification: ClassificationConfidential, repository: "b2-home",
+			policy:        map[string][]string{ClassificationConfidential: {PropertyEncrypted, PropertyAppendOnly}},
+			errorContains: "is not declared append_only"},
+		{name: "policy_relaxes_default", classification: ClassificationInternal, repository: "usb",
+			policy: map[string][]string{ClassificationInternal: {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.ClassificationPolicy = tt.policy
+			err := cfg.CheckClassification(&TargetConfig{Repository: tt.repository, Classification: tt.classification})
+			if tt.errorContains == "" {
+				if err != nil {
+					t.Errorf("Expected no error but got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorContains) {
+				t.Errorf("Expected error containing '%s', got %v", tt.errorContains, err)
+			}
+		})
+	}
 }
 
 func TestValidateConfig(t *testing.T) {
@@ -205,12 +420,58 @@ func TestValidateConfig(t *testing.T) {
 		t.Errorf("validateConfig failed for valid config: %v", err)
 	}
 
+	keyringConfig := &Config{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticBin: "/usr/bin/restic", SecretBackend: SecretBackendKeyring}
+	if err := validateConfig(keyringConfig); err != nil {
+		t.Errorf("validateConfig should not require restic_repo_dir with the keyring backend: %v", err)
+	}
+
 	// Test missing fields
 	invalidConfigs := []*Config{
 		{SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic"},
 		{TargetDir: "/tmp/targets", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic"},
 		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticBin: "/usr/bin/restic"},
 		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos"},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic", LogBackend: "eventlog"},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Notifications: NotificationsConfig{Webhooks: []string{"ftp://example.com"}, Timeout: time.Second}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Notifications: NotificationsConfig{Webhooks: []string{"https://example.com"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Notifications: NotificationsConfig{Timeout: time.Second, Email: EmailConfig{SMTPHost: "smtp.example.com", SMTPPort: 587, From: "backup@example.com"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Notifications: NotificationsConfig{Timeout: time.Second, MQTT: MQTTConfig{Broker: "tcp://broker:1883", TopicPrefix: "btrfs-backup"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Notifications: NotificationsConfig{Timeout: time.Second, MQTT: MQTTConfig{Broker: "mqtts://broker"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			MetricsPushgateway: "pushgateway:9091"},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			MetricsRemoteWrite: "mimir/api/v1/push"},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {VerifySubset: "most"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {VerifyFullEvery: "0d"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {PruneEvery: "weekly"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {MaxUnused: "5%"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {PruneEvery: "7d", MaxUnused: "150%"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {PruneEvery: "7d", MaxUnused: "5GB"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {RotateEvery: "90d"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {PasswordRotatedAt: "2026-01-15", RotateEvery: "quarterly"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			Repositories: map[string]RepositoryConfig{"b2-home": {PasswordRotatedAt: "15.01.2026"}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			SecretBackend: "vault"},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			ParallelTargets: -1},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			ClassificationPolicy: map[string][]string{"secret": {PropertyEncrypted}}},
+		{TargetDir: "/tmp/targets", SnapshotDir: "/tmp/snapshots", ResticRepoDir: "/tmp/repos", ResticBin: "/usr/bin/restic",
+			ClassificationPolicy: map[string][]string{ClassificationInternal: {"immutable"}}},
 	}
 
 	for i, config := range invalidConfigs {
@@ -258,6 +519,500 @@ func TestValidateTargetConfig(t *testing.T) {
 	if err == nil {
 		t.Error("validateTargetConfig should have failed for negative keep_snapshots")
 	}
+
+	// Test snapshot space limits
+	invalidTarget.KeepSnapshots = 3
+	invalidTarget.MaxSnapshotSpace = "lots"
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for invalid max_snapshot_space")
+	}
+	invalidTarget.MaxSnapshotSpace = "200GiB"
+	invalidTarget.MinKeepSnapshots = -1
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for negative min_keep_snapshots")
+	}
+	invalidTarget.MinKeepSnapshots = 1
+	err = validateTargetConfig(invalidTarget)
+	if err != nil {
+		t.Errorf("validateTargetConfig failed for valid snapshot space limits: %v", err)
+	}
+	invalidTarget.MaxSnapshotSpace = ""
+
+	// Test negative phase timeouts
+	invalidTarget.BackupTimeout = -time.Minute
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for negative backup_timeout")
+	}
+	invalidTarget.BackupTimeout = 0
+
+	// Test negative restic_keep values
+	invalidTarget.ResticKeep = ResticKeepConfig{KeepDaily: -1}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for negative restic_keep values")
+	}
+
+	// Test out of range empty snapshot guard
+	invalidTarget.ResticKeep = ResticKeepConfig{}
+	invalidTarget.EmptyGuard = EmptyGuardConfig{MinSizeRatio: 1.5}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for min_size_ratio above 1")
+	}
+	invalidTarget.EmptyGuard = EmptyGuardConfig{MinFiles: -1}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for negative min_files")
+	}
+
+	// Test healthcheck URL without scheme
+	invalidTarget.EmptyGuard = EmptyGuardConfig{}
+	invalidTarget.HealthcheckURL = "hc-ping.com/abc"
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for healthcheck_url without scheme")
+	}
+
+	// Test invalid success criteria
+	invalidTarget.SuccessCriteria = SuccessCriteriaConfig{MinBytes: "lots"}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for invalid min_bytes")
+	}
+	invalidTarget.SuccessCriteria = SuccessCriteriaConfig{OnViolation: "ignore"}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for invalid on_violation")
+	}
+	invalidTarget.SuccessCriteria = SuccessCriteriaConfig{}
+
+	invalidTarget.DeviceErrors = "panic"
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for invalid device_errors")
+	}
+	invalidTarget.DeviceErrors = ""
+
+	invalidTarget.PostBackupWhen = "sometimes"
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for invalid post_backup_when")
+	}
+	invalidTarget.PostBackupWhen = ""
+
+	// Test subvolume lists
+	invalidTarget.HealthcheckURL = ""
+	invalidTarget.Subvolumes = []string{"/mnt/btrfs/@var"}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for both subvolume and subvolumes")
+	}
+	invalidTarget.Subvolume = ""
+	invalidTarget.Subvolumes = []string{"/mnt/a/@data", "/mnt/b/@data"}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for subvolumes with the same name")
+	}
+	invalidTarget.Subvolumes = []string{"/mnt/btrfs/@home", "/mnt/btrfs/@var"}
+	err = validateTargetConfig(invalidTarget)
+	if err != nil {
+		t.Errorf("validateTargetConfig failed for valid subvolumes: %v", err)
+	}
+	if got := invalidTarget.SourceSubvolumes(); !slices.Equal(got, invalidTarget.Subvolumes) {
+		t.Errorf("Expected source subvolumes %v, got %v", invalidTarget.Subvolumes, got)
+	}
+	invalidTarget.Subvolume = "/mnt/btrfs/home"
+	invalidTarget.Subvolumes = nil
+
+	// Test backup modes
+	invalidTarget.BackupMode = "blocks"
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for invalid backup_mode")
+	}
+	invalidTarget.BackupMode = BackupModeSend
+	invalidTarget.Excludes = []string{"node_modules"}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for excludes with backup_mode send")
+	}
+	invalidTarget.Excludes = nil
+	invalidTarget.Metadata = true
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for metadata_manifest with backup_mode send")
+	}
+	invalidTarget.Metadata = false
+	err = validateTargetConfig(invalidTarget)
+	if err != nil {
+		t.Errorf("validateTargetConfig failed for backup_mode send: %v", err)
+	}
+	invalidTarget.BackupMode = ""
+
+	// Test checksum_manifest values
+	for value, percent := range map[string]int{"full": 100, "10%": 10, "100%": 100} {
+		invalidTarget.ChecksumManifest = value
+		if err := validateTargetConfig(invalidTarget); err != nil || invalidTarget.ChecksumPercent() != percent {
+			t.Errorf("Expected checksum_manifest '%s' to list %d%% of files, got %d%% (%v)", value, percent, invalidTarget.ChecksumPercent(), err)
+		}
+	}
+	for _, value := range []string{"0%", "150%", "2.5%", "some"} {
+		invalidTarget.ChecksumManifest = value
+		if err := validateTargetConfig(invalidTarget); err == nil {
+			t.Errorf("validateTargetConfig should have failed for checksum_manifest '%s'", value)
+		}
+	}
+	invalidTarget.ChecksumManifest = ""
+
+	// Test restic_extra_args
+	invalidTarget.ResticExtraArgs = []string{"64", "--pack-size"}
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for restic_extra_args starting with a value")
+	}
+	invalidTarget.ResticExtraArgs = []string{"--pack-size", "64"}
+	err = validateTargetConfig(invalidTarget)
+	if err != nil {
+		t.Errorf("validateTargetConfig failed for valid restic_extra_args: %v", err)
+	}
+	invalidTarget.ResticExtraArgs = nil
+
+	// Test name templates
+	invalidTarget.NameTemplate = "{hostname}-{timestamp}"
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for name_template without prefix")
+	}
+	invalidTarget.NameTemplate = ""
+	invalidTarget.Timezone = "Mars/Olympus_Mons"
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for unknown timezone")
+	}
+	invalidTarget.Timezone = ""
+
+	// Test verify_subset values
+	for _, subset := range []string{"10%", "2.5%", "1/5", "500M", "2G", "1024", VerifyFull} {
+		invalidTarget.VerifySubset = subset
+		if err := validateTargetConfig(invalidTarget); err != nil {
+			t.Errorf("validateTargetConfig failed for verify_subset '%s': %v", subset, err)
+		}
+	}
+	for _, subset := range []string{"0%", "150%", "6/5", "0/5", "2GB", "10x", "all"} {
+		invalidTarget.VerifySubset = subset
+		if err := validateTargetConfig(invalidTarget); err == nil {
+			t.Errorf("validateTargetConfig should have failed for verify_subset '%s'", subset)
+		}
+	}
+	invalidTarget.VerifySubset = ""
+
+	// Test negative verify_every
+	invalidTarget.VerifyEvery = -1
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for negative verify_every")
+	}
+	invalidTarget.VerifyEvery = 0
+
+	// Test invalid full_every
+	for _, interval := range []string{"monthly", "0d"} {
+		invalidTarget.FullEvery = interval
+		if err := validateTargetConfig(invalidTarget); err == nil {
+			t.Errorf("validateTargetConfig should have failed for full_every '%s'", interval)
+		}
+	}
+	invalidTarget.FullEvery = ""
+
+	// Test invalid verify_full_every
+	invalidTarget.VerifyFullEvery = "quarterly"
+	if err := validateTargetConfig(invalidTarget); err == nil {
+		t.Error("validateTargetConfig should have failed for verify_full_every 'quarterly'")
+	}
+	invalidTarget.VerifyFullEvery = ""
+
+	// Test invalid verify_old_every
+	invalidTarget.VerifyOldEvery = "yearly"
+	if err := validateTargetConfig(invalidTarget); err == nil {
+		t.Error("validateTargetConfig should have failed for verify_old_every 'yearly'")
+	}
+	invalidTarget.VerifyOldEvery = ""
+
+	// Test unknown classification
+	invalidTarget.Classification = "secret"
+	if err := validateTargetConfig(invalidTarget); err == nil {
+		t.Error("validateTargetConfig should have failed for classification 'secret'")
+	}
+	invalidTarget.Classification = ""
+
+	// Test multi-line schedule
+	invalidTarget.Schedule = "daily\nExecStart=/bin/sh"
+	if err := validateTargetConfig(invalidTarget); err == nil {
+		t.Error("validateTargetConfig should have failed for a multi-line schedule")
+	}
+
+	// Test invalid schedule interval, and OnCalendar expressions left to systemd
+	invalidTarget.Schedule = "every 7h"
+	if err := validateTargetConfig(invalidTarget); err == nil {
+		t.Error("validateTargetConfig should have failed for schedule 'every 7h'")
+	}
+	invalidTarget.Schedule = "Mon *-*-* 03:00"
+	if err := validateTargetConfig(invalidTarget); err != nil {
+		t.Errorf("validateTargetConfig should accept OnCalendar schedules, got %v", err)
+	}
+	invalidTarget.Schedule = ""
+
+	// Test negative retries
+	invalidTarget.Retries = -1
+	err = validateTargetConfig(invalidTarget)
+	if err == nil {
+		t.Error("validateTargetConfig should have failed for negative retries")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size        string
+		expected    int64
+		expectError bool
+	}{
+		{size: "1048576", expected: 1048576},
+		{size: "1GB", expected: 1000000000},
+		{size: "1.5 GiB", expected: 3 << 29},
+		{size: "512MiB", expected: 512 << 20},
+		{size: "10KB", expected: 10000},
+		{size: "100B", expected: 100},
+		{size: "lots", expectError: true},
+		{size: "-1GB", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := ParseSize(tt.size)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error for %q, got %d", tt.size, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSize(%q) failed: %v", tt.size, err)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseSize(%q) = %d, expected %d", tt.size, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		interval    string
+		expected    time.Duration
+		expectError bool
+	}{
+		{interval: "30d", expected: 30 * 24 * time.Hour},
+		{interval: "2w", expected: 14 * 24 * time.Hour},
+		{interval: "36h", expected: 36 * time.Hour},
+		{interval: "1.5d", expectError: true},
+		{interval: "monthly", expectError: true},
+		{interval: "-1h", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.interval, func(t *testing.T) {
+			got, err := ParseInterval(tt.interval)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error for %q, got %s", tt.interval, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseInterval(%q) failed: %v", tt.interval, err)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseInterval(%q) = %s, expected %s", tt.interval, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSnapshotNaming(t *testing.T) {
+	created := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		template      string
+		expectedName  string
+		foreign       []string // names of other targets or files that must not match
+		expectError   bool
+		errorContains string
+	}{
+		{
+			name:         "default",
+			expectedName: "home-20230102-030405",
+			foreign:      []string{"home-backup-20230102-030405", "home-latest", "home-"},
+		},
+		{
+			name:         "hostname_and_layout",
+			template:     "{prefix}-{hostname}-{timestamp:2006-01-02T15:04:05}",
+			expectedName: "home-nas-2023-01-02T03:04:05",
+			foreign:      []string{"home-laptop-2023-01-02T03:04:05", "home-20230102-030405"},
+		},
+		{
+			name:         "text_after_timestamp",
+			template:     "{timestamp}.{prefix}.snap",
+			expectedName: "20230102-030405.home.snap",
+			foreign:      []string{"20230102-030405.home-backup.snap"},
+		},
+		{
+			name:          "missing_timestamp",
+			template:      "{prefix}-{hostname}",
+			expectError:   true,
+			errorContains: "must contain {prefix} and {timestamp}",
+		},
+		{
+			name:          "repeated_timestamp",
+			template:      "{prefix}-{timestamp}-{timestamp}",
+			expectError:   true,
+			errorContains: "only once",
+		},
+		{
+			name:          "unknown_placeholder",
+			template:      "{prefix}-{date}",
+			expectError:   true,
+			errorContains: "unknown placeholder {date}",
+		},
+		{
+			name:          "unterminated_placeholder",
+			template:      "{prefix}-{timestamp",
+			expectError:   true,
+			errorContains: "unterminated placeholder",
+		},
+		{
+			name:          "slash",
+			template:      "{prefix}/{timestamp:2006/01/02}",
+			expectError:   true,
+			errorContains: "must not contain '/'",
+		},
+		{
+			name:          "layout_without_time",
+			template:      "{prefix}-{timestamp:latest}",
+			expectError:   true,
+			errorContains: "contains no date or time",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			naming, err := NewSnapshotNaming(tt.template, "home", "nas", time.UTC)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				} else if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got '%s'", tt.errorContains, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+
+			name := naming.Name(created)
+			if name != tt.expectedName {
+				t.Errorf("Expected name '%s', got '%s'", tt.expectedName, name)
+			}
+			parsed, ok := naming.Parse(name)
+			if !ok || !parsed.Equal(created) {
+				t.Errorf("Parse(%q) = %v, %v, expected %v", name, parsed, ok, created)
+			}
+			for _, other := range tt.foreign {
+				if _, ok := naming.Parse(other); ok {
+					t.Errorf("Expected %q not to match", other)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotNamingTimezone(t *testing.T) {
+	created := time.Date(2023, 7, 1, 22, 30, 0, 0, time.UTC)
+
+	target := &TargetConfig{Prefix: "home", Timezone: "Asia/Tokyo"}
+	naming, err := target.SnapshotNaming()
+	if err != nil {
+		t.Fatalf("SnapshotNaming failed: %v", err)
+	}
+	name := naming.Name(created)
+	if name != "home-20230702-073000" {
+		t.Errorf("Expected name in Asia/Tokyo time, got '%s'", name)
+	}
+	if parsed, ok := naming.Parse(name); !ok || !parsed.Equal(created) {
+		t.Errorf("Parse(%q) = %v, %v, expected %v", name, parsed, ok, created)
+	}
+
+	// UTC is used when no timezone is set
+	target.Timezone = ""
+	naming, err = target.SnapshotNaming()
+	if err != nil {
+		t.Fatalf("SnapshotNaming failed: %v", err)
+	}
+	if name := naming.Name(created); name != "home-20230701-223000" {
+		t.Errorf("Expected name in UTC, got '%s'", name)
+	}
+
+	target.Timezone = "Mars/Olympus_Mons"
+	if _, err := target.SnapshotNaming(); err == nil {
+		t.Error("Expected error for unknown timezone")
+	}
+}
+
+func TestLoadTargetConfigWithResticKeep(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "btrfs-backup-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	targetFile := filepath.Join(tmpDir, "target.yaml")
+	targetData := `subvolume: /mnt/btrfs/home
+prefix: home-backup
+repository: b2-home
+restic_keep:
+  keep_last: 2
+  keep_daily: 7
+  keep_weekly: 4
+  keep_monthly: 12
+  keep_tags: [pre-migration, legal-hold]
+`
+	err = os.WriteFile(targetFile, []byte(targetData), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write target file: %v", err)
+	}
+
+	target, err := LoadTargetConfig(targetFile)
+	if err != nil {
+		t.Fatalf("LoadTargetConfig failed: %v", err)
+	}
+
+	expected := ResticKeepConfig{KeepLast: 2, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 12,
+		KeepTags: []string{"pre-migration", "legal-hold"}}
+	if !reflect.DeepEqual(target.ResticKeep, expected) {
+		t.Errorf("Expected ResticKeep %+v, got %+v", expected, target.ResticKeep)
+	}
+	if !target.ResticKeep.IsEnabled() {
+		t.Error("Expected restic retention policy to be enabled")
+	}
+	if !(ResticKeepConfig{KeepTags: []string{"legal-hold"}}).IsEnabled() {
+		t.Error("Expected a restic retention policy with only keep_tags to be enabled")
+	}
+	if (ResticKeepConfig{}).IsEnabled() {
+		t.Error("Expected empty restic retention policy to be disabled")
+	}
 }
 
 func TestGetConfigPath(t *testing.T) {
@@ -307,4 +1062,160 @@ func TestGetTargetConfigPath(t *testing.T) {
 	if result != expected {
 		t.Errorf("Expected default path '%s', got '%s'", expected, result)
 	}
+
+	// Test file with extension
+	targetDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(targetDir, "home.yaml"), []byte("subvolume: /mnt/btrfs/home\nprefix: home\nrepository: b2-home\n"), 0644); err != nil {
+		t.Fatalf("Failed to write target config file: %v", err)
+	}
+	result = GetTargetConfigPath("", targetDir, "home")
+	if result != filepath.Join(targetDir, "home.yaml") {
+		t.Errorf("Expected '%s', got '%s'", filepath.Join(targetDir, "home.yaml"), result)
+	}
+
+	// Test file without extension, read as YAML
+	if err := os.Rename(filepath.Join(targetDir, "home.yaml"), filepath.Join(targetDir, "home")); err != nil {
+		t.Fatalf("Failed to rename target config file: %v", err)
+	}
+	result = GetTargetConfigPath("", targetDir, "home")
+	if result != filepath.Join(targetDir, "home") {
+		t.Errorf("Expected '%s', got '%s'", filepath.Join(targetDir, "home"), result)
+	}
+	if _, err := LoadTargetConfig(result); err != nil {
+		t.Errorf("Expected target config without extension to load as YAML: %v", err)
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	configData := `target_dir: /tmp/targets
+snapshot_dir: /tmp/snapshots
+restic_repo_dir: /tmp/repos
+stat_dir: /var/lib/btrfs-backup
+notifications:
+  email:
+    smtp_host: mail.example.com
+    smtp_prot: 25
+repositories:
+  b2-home:
+    verify_full_every: 90d
+    verify_subst: 10%
+    offsite: true
+classification_policy:
+  confidential: [encrypted, append_only]
+`
+	if err := os.WriteFile(configFile, []byte(configData), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	unknown, err := UnknownKeys(configFile)
+	if err != nil {
+		t.Fatalf("UnknownKeys failed: %v", err)
+	}
+	expected := []string{"notifications.email.smtp_prot", "repositories.b2-home.verify_subst", "stat_dir"}
+	if !slices.Equal(unknown, expected) {
+		t.Errorf("Expected unknown keys %v, got %v", expected, unknown)
+	}
+
+	targetFile := filepath.Join(dir, "home.yaml")
+	targetData := `subvolume: /mnt/btrfs/home
+repository: b2-home
+keep_snapshot: 5
+restic_keep:
+  keep_daily: 7
+success_criteria:
+  min_files: 1000
+`
+	if err := os.WriteFile(targetFile, []byte(targetData), 0644); err != nil {
+		t.Fatalf("Failed to write target config file: %v", err)
+	}
+	unknown, err = UnknownTargetKeys(targetFile)
+	if err != nil {
+		t.Fatalf("UnknownTargetKeys failed: %v", err)
+	}
+	if !slices.Equal(unknown, []string{"keep_snapshot"}) {
+		t.Errorf("Expected unknown keys [keep_snapshot], got %v", unknown)
+	}
+
+	if _, err := UnknownTargetKeys(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Expected error for a missing target config file")
+	}
+}
+
+func TestDiscoverTargets(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "btrfs-backup-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	for _, name := range []string{"root.yaml", "home.json", ".hidden.yaml"} {
+		err = os.WriteFile(filepath.Join(tmpDir, name), []byte{}, 0644)
+		if err != nil {
+			t.Fatalf("Failed to write target file: %v", err)
+		}
+	}
+	err = os.Mkdir(filepath.Join(tmpDir, "archive"), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create subdirectory: %v", err)
+	}
+
+	targets, err := DiscoverTargets(tmpDir)
+	if err != nil {
+		t.Fatalf("DiscoverTargets failed: %v", err)
+	}
+
+	expected := []TargetFile{
+		{Name: "home", Path: filepath.Join(tmpDir, "home.json")},
+		{Name: "root", Path: filepath.Join(tmpDir, "root.yaml")},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("Expected %d targets, got %d: %v", len(expected), len(targets), targets)
+	}
+	for i, want := range expected {
+		if targets[i] != want {
+			t.Errorf("Target %d: expected %+v, got %+v", i, want, targets[i])
+		}
+	}
+
+	_, err = DiscoverTargets(filepath.Join(tmpDir, "missing"))
+	if err == nil {
+		t.Error("DiscoverTargets should fail for a missing directory")
+	}
+}
+
+func TestValidMaxUnused(t *testing.T) {
+	for _, value := range []string{"5%", "0%", "12.5%", "100%", "unlimited", "500M", "2G", "1048576"} {
+		if !validMaxUnused(value) {
+			t.Errorf("Expected max_unused '%s' to be valid", value)
+		}
+	}
+	for _, value := range []string{"", "-1%", "101%", "5GB", "G", "lots", "5 %"} {
+		if validMaxUnused(value) {
+			t.Errorf("Expected max_unused '%s' to be invalid", value)
+		}
+	}
+}
+
+func TestRotationReminder(t *testing.T) {
+	config := &Config{Repositories: map[string]RepositoryConfig{
+		"b2-home": {PasswordRotatedAt: "2026-01-15", RotateEvery: "90d"},
+		"local":   {PasswordRotatedAt: "2026-01-15"},
+	}}
+	due := time.Date(2026, 4, 15, 0, 0, 0, 0, time.Local)
+	if got := config.Repository("b2-home").PasswordRotationDue(); !got.Equal(due) {
+		t.Errorf("Expected rotation due at %v, got %v", due, got)
+	}
+	if got := config.RotationReminder("B2-Home", due.Add(-time.Hour)); got != "" {
+		t.Errorf("Expected no reminder before the due date, got %q", got)
+	}
+	expected := "password of repository 'B2-Home' is due for rotation since 2026-04-15 (last rotated 2026-01-15, rotate_every 90d)"
+	if got := config.RotationReminder("B2-Home", due); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	for _, name := range []string{"local", "unconfigured"} {
+		if got := config.RotationReminder(name, due.AddDate(1, 0, 0)); got != "" {
+			t.Errorf("Expected no reminder for repository '%s' without rotate_every, got %q", name, got)
+		}
+	}
 }
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Prefixes of the environment variables overriding the settings of the main and the target
+// configurations, e.g. BTRFSBACKUP_SNAPSHOT_DIR and BTRFSBACKUP_TARGET_KEEP_SNAPSHOTS.
+const (
+	EnvPrefix       = "BTRFSBACKUP"
+	TargetEnvPrefix = "BTRFSBACKUP_TARGET"
+)
+
+// TargetNameEnv names the inline target, see InlineTarget.
+const TargetNameEnv = TargetEnvPrefix + "_NAME"
+
+// bindEnv makes every setting of the configuration struct type t, including those of nested
+// structs such as notifications.timeout, readable from the environment variable of its
+// prefix and key with dots replaced by underscores. Unlike viper.AutomaticEnv alone, this
+// covers settings missing from the file and the defaults. Lists are comma-separated.
+// Settings of map entries, such as repositories, can only be set in files.
+func bindEnv(v *viper.Viper, t reflect.Type, prefix string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		key := prefix + field.Tag.Get("mapstructure")
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			bindEnv(v, field.Type, key+".")
+		case reflect.Map:
+		default:
+			_ = v.BindEnv(key)
+		}
+	}
+}
+
+// EnvConfigured reports whether any BTRFSBACKUP_ environment variable besides
+// BTRFSBACKUP_CONFIG is set, in which case the main configuration may come from the
+// environment alone, without a file.
+func EnvConfigured() bool {
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, EnvPrefix+"_") && key != EnvPrefix+"_CONFIG" {
+			return true
+		}
+	}
+	return false
+}
+
+// InlineTarget returns the name of the target defined by BTRFSBACKUP_TARGET_ environment
+// variables alone, without a file, for containers and CI jobs backing up one target. It is
+// defined when BTRFSBACKUP_TARGET_SUBVOLUME or BTRFSBACKUP_TARGET_SUBVOLUMES is set, and
+// named by BTRFSBACKUP_TARGET_NAME or, without it, after BTRFSBACKUP_TARGET_PREFIX.
+func InlineTarget() (name string, ok bool) {
+	if os.Getenv(TargetEnvPrefix+"_SUBVOLUME") == "" && os.Getenv(TargetEnvPrefix+"_SUBVOLUMES") == "" {
+		return "", false
+	}
+	if name = os.Getenv(TargetNameEnv); name == "" {
+		name = os.Getenv(TargetEnvPrefix + "_PREFIX")
+	}
+	return name, name != ""
+}
+
+// RepositoryEnv returns the environment variable holding the configuration of repository
+// for secret_backend "env", in the format of the files in restic_repo_dir: the repository
+// name upper-cased, with characters other than letters and digits replaced by underscores,
+// e.g. BTRFSBACKUP_REPOSITORY_B2_HOME for b2-home and BTRFSBACKUP_REPOSITORY_B2_HOME_READONLY
+// for its read-only credentials.
+func RepositoryEnv(repository string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, repository)
+	return EnvPrefix + "_REPOSITORY_" + name
+}
+
+// CheckRepositoryEnv returns an error if two of the repositories map to the same
+// environment variable, see RepositoryEnv, such as b2-home and b2_home, or b2-home-readonly
+// and the read-only credentials of b2-home. Either would read the other's configuration.
+func CheckRepositoryEnv(repositories []string) error {
+	owners := make(map[string]string)
+	for _, repository := range slices.Compact(slices.Sorted(slices.Values(repositories))) {
+		for _, name := range []string{RepositoryEnv(repository), RepositoryEnv(repository + ".readonly")} {
+			if owner, ok := owners[name]; ok && owner != repository {
+				return fmt.Errorf("repositories '%s' and '%s' both map to environment variable %s", owner, repository, name)
+			}
+			owners[name] = repository
+		}
+	}
+	return nil
+}
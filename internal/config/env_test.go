@@ -0,0 +1,129 @@
+package config
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "config.yaml")
+	if _, err := LoadConfig(missing); err == nil {
+		t.Fatal("LoadConfig should fail for a missing file without environment variables")
+	}
+
+	t.Setenv("BTRFSBACKUP_SNAPSHOT_DIR", "/snapshots")
+	t.Setenv("BTRFSBACKUP_SECRET_BACKEND", SecretBackendEnv)
+	t.Setenv("BTRFSBACKUP_NOTIFICATIONS_TIMEOUT", "30s")
+	t.Setenv("BTRFSBACKUP_NOTIFICATIONS_WEBHOOKS", "https://a.example.com,https://b.example.com")
+	if _, err := LoadConfig(missing); err == nil {
+		t.Error("Expected target_dir to be required without an inline target")
+	}
+
+	t.Setenv("BTRFSBACKUP_TARGET_SUBVOLUME", "/mnt/data")
+	t.Setenv("BTRFSBACKUP_TARGET_PREFIX", "data")
+	cfg, err := LoadConfig(missing)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.SnapshotDir != "/snapshots" || cfg.SecretBackend != SecretBackendEnv || cfg.ResticBin != "/usr/bin/restic" {
+		t.Errorf("Expected settings from the environment and defaults, got %+v", cfg)
+	}
+	if cfg.Notifications.Timeout != 30*time.Second {
+		t.Errorf("Expected nested setting from the environment, got %s", cfg.Notifications.Timeout)
+	}
+	if expected := []string{"https://a.example.com", "https://b.example.com"}; !slices.Equal(cfg.Notifications.Webhooks, expected) {
+		t.Errorf("Expected webhooks %v, got %v", expected, cfg.Notifications.Webhooks)
+	}
+}
+
+func TestInlineTarget(t *testing.T) {
+	targetDir := filepath.Join(t.TempDir(), "targets")
+	if _, ok := InlineTarget(); ok {
+		t.Fatal("Expected no inline target without environment variables")
+	}
+
+	t.Setenv("BTRFSBACKUP_TARGET_SUBVOLUME", "/mnt/data")
+	t.Setenv("BTRFSBACKUP_TARGET_PREFIX", "data")
+	t.Setenv("BTRFSBACKUP_TARGET_REPOSITORY", "s3-data")
+	t.Setenv("BTRFSBACKUP_TARGET_EXCLUDES", "*.tmp,/cache")
+	t.Setenv("BTRFSBACKUP_TARGET_RESTIC_KEEP_KEEP_DAILY", "7")
+	t.Setenv("BTRFSBACKUP_TARGET_VERIFY", "full")
+	if name, ok := InlineTarget(); !ok || name != "data" {
+		t.Errorf("Expected inline target named after its prefix, got %q", name)
+	}
+	t.Setenv(TargetNameEnv, "app")
+	if name, ok := InlineTarget(); !ok || name != "app" {
+		t.Errorf("Expected inline target named app, got %q", name)
+	}
+
+	targets, err := DiscoverTargets(targetDir)
+	if err != nil || !slices.Equal(targets, []TargetFile{{Name: "app"}}) {
+		t.Errorf("Expected the inline target to be discovered, got %v (%v)", targets, err)
+	}
+	if path := GetTargetConfigPath("", targetDir, "app"); path != "" {
+		t.Errorf("Expected no file for the inline target, got %s", path)
+	}
+	if path := GetTargetConfigPath("", targetDir, "other"); path != filepath.Join(targetDir, "other") {
+		t.Errorf("Expected the file of another target, got %s", path)
+	}
+
+	target, err := LoadTargetConfig("")
+	if err != nil {
+		t.Fatalf("LoadTargetConfig failed: %v", err)
+	}
+	if target.Subvolume != "/mnt/data" || target.Repository != "s3-data" || target.KeepSnapshots != 3 {
+		t.Errorf("Expected settings from the environment and defaults, got %+v", target)
+	}
+	if !slices.Equal(target.Excludes, []string{"*.tmp", "/cache"}) || target.ResticKeep.KeepDaily != 7 {
+		t.Errorf("Expected lists and nested settings from the environment, got %v and %+v", target.Excludes, target.ResticKeep)
+	}
+	if !target.Verify || target.VerifySubset != VerifyFull {
+		t.Errorf("Expected verify: full from the environment, got %v %s", target.Verify, target.VerifySubset)
+	}
+}
+
+func TestRepositoryEnv(t *testing.T) {
+	for repository, expected := range map[string]string{
+		"b2-home":          "BTRFSBACKUP_REPOSITORY_B2_HOME",
+		"b2-home.readonly": "BTRFSBACKUP_REPOSITORY_B2_HOME_READONLY",
+		"NAS_1":            "BTRFSBACKUP_REPOSITORY_NAS_1",
+	} {
+		if got := RepositoryEnv(repository); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, repository, got)
+		}
+	}
+}
+
+func TestCheckRepositoryEnv(t *testing.T) {
+	if err := CheckRepositoryEnv([]string{"b2-home", "nas", "b2-home"}); err != nil {
+		t.Errorf("Expected no error for distinct repositories, got %v", err)
+	}
+	for _, repositories := range [][]string{
+		{"b2-home", "b2_home"},
+		{"B2-Home", "b2-home"},
+		{"b2-home", "b2-home-readonly"},
+		{"b2-home", "b2-home.readonly"},
+	} {
+		if err := CheckRepositoryEnv(repositories); err == nil {
+			t.Errorf("Expected error for repositories %v mapping to the same variable", repositories)
+		}
+	}
+
+	cfg := &Config{
+		TargetDir:     "/targets",
+		SnapshotDir:   "/snapshots",
+		SecretBackend: SecretBackendEnv,
+		ResticBin:     "/usr/bin/restic",
+		Repositories:  map[string]RepositoryConfig{"b2-home": {}, "b2_home": {}},
+	}
+	if err := validateConfig(cfg); err == nil {
+		t.Error("Expected validation to reject repositories mapping to the same variable")
+	}
+	cfg.SecretBackend = SecretBackendFile
+	cfg.ResticRepoDir = "/repos"
+	if err := validateConfig(cfg); err != nil {
+		t.Errorf("Expected the names to be accepted with secret_backend file, got %v", err)
+	}
+}
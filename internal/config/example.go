@@ -0,0 +1,156 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ExampleFile is a commented example configuration file.
+type ExampleFile struct {
+	Path    string      // Path of the file
+	Mode    os.FileMode // Permissions of the file, 0600 for files holding credentials
+	Content string      // Commented configuration
+}
+
+// exampleConfig is the example main configuration; %[1]s is the configuration directory
+// and %[2]s the state directory.
+const exampleConfig = `# btrfs-backup main configuration
+
+# Directory with one configuration file per target, named after the target
+target_dir: %[1]s/targets
+# Directory where the BTRFS snapshots are created, on the same filesystem as the subvolumes
+snapshot_dir: /mnt/btrfs/snapshots
+# Directory with one restic environment file per repository
+restic_repo_dir: %[1]s/repos
+restic_bin: /usr/bin/restic
+
+# Where targets keep state between runs, e.g. for verify_every and full_every
+state_dir: %[2]s
+
+# Log destination: "stderr", "syslog" or "journald"
+#log_backend: stderr
+
+# Record lifecycle events as JSON Lines to a file, or "syslog"
+#event_log: /var/log/btrfs-backup/events.jsonl
+
+# Prometheus metrics of every run
+#metrics_textfile_dir: /var/lib/node_exporter/textfile_collector
+#metrics_pushgateway: http://pushgateway:9091
+
+# Services notified of the result of every backup run
+#notifications:
+#  webhooks:
+#    - https://hooks.example.com/btrfs-backup
+#  email:
+#    smtp_host: smtp.example.com
+#    from: backup@example.com
+#    to:
+#      - admin@example.com
+`
+
+// exampleTarget is the example target configuration.
+const exampleTarget = `# btrfs-backup target "home", backed up with 'btrfs-backup backup home'
+
+# Subvolume to snapshot and back up
+subvolume: /mnt/btrfs/home
+# Prefix of the snapshot names, unique among the targets
+prefix: home
+# Repository configuration in restic_repo_dir
+repository: example
+
+# "incremental" or "full", which re-reads all files
+type: incremental
+# Check the repository after every backup, reading 5% of the data
+verify: true
+verify_subset: 5%
+# Local snapshots to keep
+keep_snapshots: 3
+# When the timer installed by 'btrfs-backup systemd install home' runs the backup,
+# e.g. "every 6h", "daily at 02:30", "Mon,Thu 04:00" or an OnCalendar expression
+#schedule: daily
+
+# Restic snapshots to keep, applied with 'restic forget --prune'
+#restic_keep:
+#  keep_daily: 7
+#  keep_weekly: 4
+#  keep_monthly: 12
+
+# restic --exclude patterns; a leading / anchors at the subvolume root
+#excludes:
+#  - /.cache
+
+# Commands run before and after the snapshot, e.g. to quiesce a database
+#pre_snapshot:
+#  - systemctl stop postgresql
+#post_snapshot:
+#  - systemctl start postgresql
+`
+
+// exampleRepository is the example repository configuration.
+const exampleRepository = `# Environment of the restic commands run for the repository "example"
+# Initialize the repository with 'btrfs-backup init example'
+RESTIC_REPOSITORY: /mnt/backup/restic
+RESTIC_PASSWORD: change-me
+
+# For a Backblaze B2 repository instead:
+#RESTIC_REPOSITORY: b2:my-bucket/home
+#B2_ACCOUNT_ID: my-account-id
+#B2_ACCOUNT_KEY: my-account-key
+`
+
+// Examples returns a commented example main configuration in dir, with an example
+// target and repository configuration in its target and repository directories.
+func Examples(dir string) []ExampleFile {
+	return examples(dir, DefaultStateDir)
+}
+
+func examples(dir, stateDir string) []ExampleFile {
+	return []ExampleFile{
+		{Path: filepath.Join(dir, "config.yaml"), Mode: 0o644, Content: fmt.Sprintf(exampleConfig, dir, stateDir)},
+		{Path: filepath.Join(dir, "targets", "home.yaml"), Mode: 0o644, Content: exampleTarget},
+		{Path: filepath.Join(dir, "repos", "example"), Mode: 0o600, Content: exampleRepository},
+	}
+}
+
+// WriteExamples writes the example configuration files of Examples to dir and returns
+// their paths. Nothing is written if any of the files already exists.
+func WriteExamples(dir string) ([]string, error) {
+	examples := Examples(dir)
+	for _, example := range examples {
+		if _, err := os.Lstat(example.Path); err == nil {
+			return nil, fmt.Errorf("%s already exists", example.Path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to check %s: %w", example.Path, err)
+		}
+	}
+
+	var paths []string
+	for _, example := range examples {
+		if err := writeNewFile(example); err != nil {
+			return paths, err
+		}
+		paths = append(paths, example.Path)
+	}
+	return paths, nil
+}
+
+// writeNewFile creates the file with its parent directories, failing if it exists.
+func writeNewFile(file ExampleFile) error {
+	if err := os.MkdirAll(filepath.Dir(file.Path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.OpenFile(file.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.Mode)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", file.Path, err)
+	}
+	_, err = f.WriteString(file.Content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", file.Path, err)
+	}
+	return nil
+}
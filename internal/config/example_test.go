@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteExamples(t *testing.T) {
+	dir := t.TempDir()
+
+	paths, err := WriteExamples(dir)
+	if err != nil {
+		t.Fatalf("WriteExamples failed: %v", err)
+	}
+	if len(paths) != 3 {
+		t.Fatalf("Expected 3 files written, got %v", paths)
+	}
+
+	// The examples load as they are and use only known settings
+	config, err := LoadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Example configuration failed to load: %v", err)
+	}
+	if config.TargetDir != filepath.Join(dir, "targets") || config.ResticRepoDir != filepath.Join(dir, "repos") {
+		t.Errorf("Expected directories below %s, got %+v", dir, config)
+	}
+	targetPath := filepath.Join(dir, "targets", "home.yaml")
+	if _, err := LoadTargetConfig(targetPath); err != nil {
+		t.Fatalf("Example target configuration failed to load: %v", err)
+	}
+	if unknown, err := UnknownKeys(filepath.Join(dir, "config.yaml")); err != nil || len(unknown) > 0 {
+		t.Errorf("Expected no unknown settings in the example configuration, got %v (%v)", unknown, err)
+	}
+	if unknown, err := UnknownTargetKeys(targetPath); err != nil || len(unknown) > 0 {
+		t.Errorf("Expected no unknown settings in the example target, got %v (%v)", unknown, err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "repos", "example"))
+	if err != nil {
+		t.Fatalf("Example repository configuration missing: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected repository configuration mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// Existing files are never overwritten
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("edited"), 0o644); err != nil {
+		t.Fatalf("Failed to edit config: %v", err)
+	}
+	if err := os.Remove(targetPath); err != nil {
+		t.Fatalf("Failed to remove target: %v", err)
+	}
+	if _, err := WriteExamples(dir); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected already exists error, got %v", err)
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Error("Expected nothing to be written when a file exists")
+	}
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Skeleton is the system-wide layout of btrfs-backup: the configuration directory with
+// its target and repository directories, the state directory, and the systemd-tmpfiles
+// and systemd-sysusers snippets creating them with their ownership and modes.
+type Skeleton struct {
+	ConfigDir string // Directory of the main configuration, e.g. /etc/btrfs-backup
+	StateDir  string // state_dir of the main configuration
+	User      string // Owner of the state directory, created by the sysusers snippet unless root
+	Group     string // Group of the configuration and state directories
+}
+
+// SkeletonDir is a directory of the skeleton.
+type SkeletonDir struct {
+	Path  string
+	Mode  os.FileMode
+	Owner string // User and group of the directory, for the tmpfiles snippet
+}
+
+// Dirs returns the directories of the skeleton. The repository directory holding
+// credentials is only accessible to root.
+func (s Skeleton) Dirs() []SkeletonDir {
+	return []SkeletonDir{
+		{Path: s.ConfigDir, Mode: 0o755, Owner: "root " + s.Group},
+		{Path: filepath.Join(s.ConfigDir, "targets"), Mode: 0o755, Owner: "root " + s.Group},
+		{Path: filepath.Join(s.ConfigDir, "repos"), Mode: 0o700, Owner: "root root"},
+		{Path: s.StateDir, Mode: 0o750, Owner: s.User + " " + s.Group},
+	}
+}
+
+// Files returns the files of the skeleton: the example configuration of Examples for
+// ConfigDir using StateDir, the tmpfiles snippet and, for a user other than root, the
+// sysusers snippet.
+func (s Skeleton) Files() []ExampleFile {
+	files := examples(s.ConfigDir, s.StateDir)
+
+	var tmpfiles strings.Builder
+	tmpfiles.WriteString("# Directories of btrfs-backup, see tmpfiles.d(5)\n")
+	for _, dir := range s.Dirs() {
+		fmt.Fprintf(&tmpfiles, "d %s %04o %s -\n", dir.Path, dir.Mode, dir.Owner)
+	}
+	files = append(files, ExampleFile{Path: "/usr/lib/tmpfiles.d/btrfs-backup.conf", Mode: 0o644, Content: tmpfiles.String()})
+
+	if s.User != "root" {
+		files = append(files, ExampleFile{
+			Path:    "/usr/lib/sysusers.d/btrfs-backup.conf",
+			Mode:    0o644,
+			Content: fmt.Sprintf("# User of btrfs-backup, see sysusers.d(5)\nu %s - \"btrfs-backup\" %s\n", s.User, s.StateDir),
+		})
+	}
+	return files
+}
+
+// Install creates the directories and files of the skeleton below root, "/" for the
+// running system or a staging directory when building a package. Existing directories
+// and files are kept as they are, so installing again only adds what is missing.
+// Ownership is left to the tmpfiles and sysusers snippets. Returns the paths created.
+func (s Skeleton) Install(root string) ([]string, error) {
+	var created []string
+	for _, dir := range s.Dirs() {
+		path := filepath.Join(root, dir.Path)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return created, fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := os.Mkdir(path, dir.Mode); err != nil {
+			return created, fmt.Errorf("failed to create directory: %w", err)
+		}
+		// Mkdir applies the umask
+		if err := os.Chmod(path, dir.Mode); err != nil {
+			return created, fmt.Errorf("failed to set mode of %s: %w", path, err)
+		}
+		created = append(created, path)
+	}
+
+	for _, file := range s.Files() {
+		file.Path = filepath.Join(root, file.Path)
+		err := writeNewFile(file)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+		created = append(created, file.Path)
+	}
+	return created, nil
+}
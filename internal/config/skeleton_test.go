@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSkeletonInstall(t *testing.T) {
+	root := t.TempDir()
+	skeleton := Skeleton{ConfigDir: "/etc/btrfs-backup", StateDir: "/var/lib/backup", User: "backup", Group: "backup"}
+
+	created, err := skeleton.Install(root)
+	if err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+	if len(created) != 9 {
+		t.Errorf("Expected 4 directories and 5 files created, got %v", created)
+	}
+
+	for path, mode := range map[string]os.FileMode{
+		"etc/btrfs-backup/repos":         0o700,
+		"var/lib/backup":                 0o750,
+		"etc/btrfs-backup/repos/example": 0o600,
+	} {
+		info, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %v", path, err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("Expected mode %04o of %s, got %04o", mode, path, info.Mode().Perm())
+		}
+	}
+
+	config, err := LoadConfig(filepath.Join(root, "etc/btrfs-backup/config.yaml"))
+	if err != nil {
+		t.Fatalf("Skeleton configuration failed to load: %v", err)
+	}
+	if config.TargetDir != "/etc/btrfs-backup/targets" || config.StateDir != "/var/lib/backup" {
+		t.Errorf("Expected configuration of the installed system, got %+v", config)
+	}
+
+	tmpfiles, err := os.ReadFile(filepath.Join(root, "usr/lib/tmpfiles.d/btrfs-backup.conf"))
+	if err != nil {
+		t.Fatalf("Expected tmpfiles snippet: %v", err)
+	}
+	for _, expected := range []string{"d /etc/btrfs-backup/repos 0700 root root -", "d /var/lib/backup 0750 backup backup -"} {
+		if !strings.Contains(string(tmpfiles), expected) {
+			t.Errorf("Expected tmpfiles snippet to contain %q, got:\n%s", expected, tmpfiles)
+		}
+	}
+	sysusers, err := os.ReadFile(filepath.Join(root, "usr/lib/sysusers.d/btrfs-backup.conf"))
+	if err != nil || !strings.Contains(string(sysusers), `u backup - "btrfs-backup" /var/lib/backup`) {
+		t.Errorf("Expected sysusers snippet creating the user, got %q (%v)", sysusers, err)
+	}
+
+	// Installing again keeps existing files
+	configPath := filepath.Join(root, "etc/btrfs-backup/config.yaml")
+	if err := os.WriteFile(configPath, []byte("edited"), 0o644); err != nil {
+		t.Fatalf("Failed to edit config: %v", err)
+	}
+	created, err = skeleton.Install(root)
+	if err != nil || len(created) != 0 {
+		t.Errorf("Expected nothing created when installing again, got %v (%v)", created, err)
+	}
+	if data, _ := os.ReadFile(configPath); string(data) != "edited" {
+		t.Error("Expected the edited configuration to be kept")
+	}
+}
+
+func TestSkeletonRootUser(t *testing.T) {
+	skeleton := Skeleton{ConfigDir: "/etc/btrfs-backup", StateDir: DefaultStateDir, User: "root", Group: "root"}
+	for _, file := range skeleton.Files() {
+		if strings.Contains(file.Path, "sysusers.d") {
+			t.Errorf("Expected no sysusers snippet for root, got %s", file.Path)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func decodeEvents(t *testing.T, data string) []Event {
+	t.Helper()
+	var result []Event
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Invalid event line %q: %v", line, err)
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func TestEmit(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf)
+	home := log.ForTarget("home")
+
+	if err := home.Emit(Event{Type: RunStarted, Repository: "b2-home"}); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+	if err := home.Emit(Event{Type: SnapshotDeleted, Snapshot: "/snapshots/home-1", Outcome: OutcomeFailure, Error: "busy"}); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+	if err := log.Emit(Event{Type: RunFinished, Target: "root"}); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+
+	got := decodeEvents(t, buf.String())
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(got))
+	}
+
+	if got[0].ID != 1000 || got[0].Type != RunStarted || got[0].Target != "home" || got[0].Outcome != OutcomeSuccess {
+		t.Errorf("Unexpected run_started event: %+v", got[0])
+	}
+	if got[1].ID != 3000 || got[1].Outcome != OutcomeFailure || got[1].Error != "busy" {
+		t.Errorf("Unexpected snapshot_deleted event: %+v", got[1])
+	}
+	if got[2].Target != "root" {
+		t.Errorf("Expected explicit target to be kept, got %q", got[2].Target)
+	}
+	for _, e := range got {
+		if e.Schema != SchemaVersion || e.RunID != got[0].RunID || e.RunID == "" || e.Time.IsZero() {
+			t.Errorf("Event not completed consistently: %+v", e)
+		}
+	}
+}
+
+func TestWithRunID(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf).ForTarget("home").WithRunID("0123456789abcdef")
+	if err := log.Emit(Event{Type: RunStarted}); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+
+	got := decodeEvents(t, buf.String())
+	if len(got) != 1 || got[0].RunID != "0123456789abcdef" || got[0].Target != "home" {
+		t.Errorf("Expected event with the given run ID, got %+v", got)
+	}
+}
+
+func TestEmitUnknownType(t *testing.T) {
+	var buf bytes.Buffer
+	err := New(&buf).Emit(Event{Type: "something"})
+	if err == nil || !strings.Contains(err.Error(), "unknown event type") {
+		t.Errorf("Expected unknown event type error, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written, got %q", buf.String())
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var log *Log
+	if err := log.ForTarget("home").Emit(Event{Type: RunStarted}); err != nil {
+		t.Errorf("Expected nil log to discard events, got %v", err)
+	}
+	if err := log.Close(); err != nil {
+		t.Errorf("Expected nil log to close without error, got %v", err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	for range 2 {
+		log, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if err := log.Emit(Event{Type: UploadFinished}); err != nil {
+			t.Fatalf("Emit failed: %v", err)
+		}
+		if err := log.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read event log: %v", err)
+	}
+	got := decodeEvents(t, string(data))
+	if len(got) != 2 {
+		t.Fatalf("Expected events to be appended, got %d events", len(got))
+	}
+	if got[0].RunID == got[1].RunID {
+		t.Errorf("Expected separate runs to get different run IDs")
+	}
+}
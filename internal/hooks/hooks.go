@@ -0,0 +1,61 @@
+// Package hooks runs user-defined shell commands around backup workflow steps.
+package hooks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Run executes each command of a hook phase in order using 'sh -c'.
+// Every command gets its own timeout, inherits the process environment extended with env,
+// and has its combined stdout/stderr logged line by line, tagged with the phase name.
+// Execution stops at the first command that fails or times out, or once ctx is done.
+func Run(ctx context.Context, phase string, commands []string, timeout time.Duration, env []string) error {
+	for _, command := range commands {
+		err := runCommand(ctx, phase, command, timeout, env)
+		if err != nil {
+			return fmt.Errorf("%s hook %q failed: %w", phase, command, err)
+		}
+	}
+	return nil
+}
+
+func runCommand(ctx context.Context, phase, command string, timeout time.Duration, env []string) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Run the hook in its own process group so a timeout also stops its children
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	slog.Info("Running hook", "phase", phase, "command", command)
+	err := cmd.Run()
+
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		slog.Info("Hook output", "phase", phase, "output", scanner.Text())
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
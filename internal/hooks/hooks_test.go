@@ -0,0 +1,64 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestRun(t *testing.T) {
+	logs := captureLog(t)
+
+	err := Run(context.Background(), "pre_snapshot", []string{"echo first", "echo \"$TARGET_NAME\" >&2"}, time.Minute, []string{"TARGET_NAME=home"})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	output := logs.String()
+	for _, expected := range []string{`Running hook phase=pre_snapshot command="echo first"`, "phase=pre_snapshot output=first", "phase=pre_snapshot output=home"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected log to contain %q, got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestRunStopsAtFirstFailure(t *testing.T) {
+	logs := captureLog(t)
+
+	err := Run(context.Background(), "pre_backup", []string{"echo broken; exit 3", "echo not-reached"}, time.Minute, nil)
+	if err == nil {
+		t.Fatal("Expected error from failing hook")
+	}
+	if !strings.Contains(err.Error(), `pre_backup hook "echo broken; exit 3" failed`) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "phase=pre_backup output=broken") {
+		t.Errorf("Expected output of failing hook to be logged, got:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "not-reached") {
+		t.Error("Hooks after a failing hook should not run")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	captureLog(t)
+
+	err := Run(context.Background(), "post_snapshot", []string{"sleep 5"}, 100*time.Millisecond, nil)
+	if err == nil {
+		t.Fatal("Expected timeout error")
+	}
+	if !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
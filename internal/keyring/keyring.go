@@ -0,0 +1,67 @@
+// Package keyring stores secrets in the system keyring through the Secret Service API,
+// as provided by GNOME Keyring, KWallet or KeePassXC, using secret-tool from libsecret.
+package keyring
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"btrfs-backup/internal/command"
+)
+
+// Service is the service attribute of the secrets stored by btrfs-backup.
+const Service = "btrfs-backup"
+
+// ErrNotFound is returned when the keyring holds no secret for a name.
+var ErrNotFound = errors.New("secret not found in keyring")
+
+// Keyring looks up and stores secrets, identified by the name of the repository they
+// belong to, with the secret-tool binary.
+type Keyring struct {
+	bin string
+}
+
+// New returns a Keyring using the secret-tool binary bin.
+func New(bin string) *Keyring {
+	return &Keyring{bin: bin}
+}
+
+// attributes returns the secret-tool attributes identifying the secret of name.
+func attributes(name string) []string {
+	return []string{"service", Service, "repository", name}
+}
+
+// Lookup returns the secret stored for name. It runs 'secret-tool lookup service
+// btrfs-backup repository <name>', which exits with status 1 and no error output if the
+// keyring holds no such secret, reported as ErrNotFound.
+func (k *Keyring) Lookup(ctx context.Context, name string) ([]byte, error) {
+	secret, err := command.Output(command.Command(ctx, k.bin, append([]string{"lookup"}, attributes(name)...)...))
+	var cmdErr *command.Error
+	var exitErr *exec.ExitError
+	if errors.As(err, &cmdErr) && errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && strings.TrimSpace(cmdErr.Stderr) == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keyring lookup failed: %w", err)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return secret, nil
+}
+
+// Store saves secret for name, replacing a secret stored before. It runs 'secret-tool
+// store' with the secret on its standard input, so it never shows up in process listings.
+func (k *Keyring) Store(ctx context.Context, name string, secret []byte) error {
+	args := append([]string{"store", "--label", "btrfs-backup repository " + name}, attributes(name)...)
+	cmd := command.Command(ctx, k.bin, args...)
+	cmd.Stdin = bytes.NewReader(secret)
+	if err := command.Run(cmd); err != nil {
+		return fmt.Errorf("keyring store failed: %w", err)
+	}
+	return nil
+}
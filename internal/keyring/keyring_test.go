@@ -0,0 +1,60 @@
+package keyring
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSecretTool writes a stand-in for secret-tool keeping one file per secret in dir.
+func fakeSecretTool(t *testing.T, dir string) string {
+	bin := filepath.Join(dir, "secret-tool")
+	script := `#!/bin/sh
+op=$1; shift
+[ "$op" = store ] && { [ "$1" = --label ] || exit 2; shift 2; }
+[ "$1 $2 $3" = "service btrfs-backup repository" ] || { echo "bad attributes: $*" >&2; exit 2; }
+file="` + dir + `/$4"
+case $op in
+lookup) [ -f "$file" ] || exit 1; cat "$file" ;;
+store) cat > "$file" ;;
+*) exit 2 ;;
+esac
+`
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+func TestStoreLookup(t *testing.T) {
+	k := New(fakeSecretTool(t, t.TempDir()))
+	ctx := context.Background()
+
+	if _, err := k.Lookup(ctx, "b2-home"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound before storing, got %v", err)
+	}
+
+	secret := []byte("RESTIC_PASSWORD: secret\n")
+	if err := k.Store(ctx, "b2-home", secret); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	data, err := k.Lookup(ctx, "b2-home")
+	if err != nil || string(data) != string(secret) {
+		t.Errorf("Expected stored secret, got %q (%v)", data, err)
+	}
+}
+
+func TestLookupError(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "secret-tool")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\necho 'Cannot autolaunch D-Bus without X11 $DISPLAY' >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := New(bin).Lookup(context.Background(), "b2-home")
+	if err == nil || errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "D-Bus") {
+		t.Errorf("Expected keyring error with secret-tool's message, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Package logging provides slog handlers that deliver structured log records directly
+// to the local syslog daemon (RFC 5424) or to the systemd journal (native protocol), so
+// their fields stay queryable without wrapping stderr.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// field is a flattened log attribute, the key prefixed with its enclosing groups.
+type field struct {
+	key   string
+	value string
+}
+
+// encoder turns a record and its flattened attributes into a datagram.
+type encoder func(r slog.Record, fields []field) []byte
+
+// handler is the slog.Handler shared by the syslog and journald backends.
+// Each record is encoded into a single datagram and written to conn.
+type handler struct {
+	conn   net.Conn
+	level  slog.Leveler
+	encode encoder
+	fields []field
+	prefix string
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.level != nil {
+		minLevel = h.level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *handler) Handle(_ context.Context, r slog.Record) error {
+	fields := append([]field(nil), h.fields...)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = appendAttr(fields, h.prefix, a)
+		return true
+	})
+
+	if _, err := h.conn.Write(h.encode(r, fields)); err != nil {
+		return fmt.Errorf("failed to send log record: %w", err)
+	}
+	return nil
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.fields = append([]field(nil), h.fields...)
+	for _, a := range attrs {
+		clone.fields = appendAttr(clone.fields, h.prefix, a)
+	}
+	return &clone
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+// appendAttr flattens an attribute, recursing into groups. Durations are rendered as
+// fractional seconds, like in the JSON log format.
+func appendAttr(fields []field, prefix string, a slog.Attr) []field {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return fields
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			fields = appendAttr(fields, groupPrefix, ga)
+		}
+		return fields
+	case slog.KindDuration:
+		return append(fields, field{prefix + a.Key, strconv.FormatFloat(a.Value.Duration().Seconds(), 'f', -1, 64)})
+	case slog.KindTime:
+		return append(fields, field{prefix + a.Key, a.Value.Time().Format(time.RFC3339Nano)})
+	default:
+		return append(fields, field{prefix + a.Key, a.Value.String()})
+	}
+}
+
+// severity maps a slog level to a syslog severity, which the journal uses as priority.
+func severity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
+
+// dialFirst connects to the first reachable unix datagram socket of paths.
+func dialFirst(paths []string) (net.Conn, error) {
+	var err error
+	for _, path := range paths {
+		var conn net.Conn
+		conn, err = net.Dial("unixgram", path)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// journalSocket is the socket of the systemd journal's native protocol.
+var journalSocket = "/run/systemd/journal/socket"
+
+// NewJournalHandler returns a handler sending records to the systemd journal using its
+// native protocol. The attributes of a record become journal fields with upper-cased
+// names, e.g. TARGET=home or PHASE=backup, queryable with 'journalctl TARGET=home'.
+// Records must fit into a single datagram of the journal socket.
+func NewJournalHandler(level slog.Leveler) (slog.Handler, error) {
+	conn, err := dialFirst([]string{journalSocket})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to journald: %w", err)
+	}
+
+	return &handler{
+		conn:   conn,
+		level:  level,
+		encode: encodeJournal,
+	}, nil
+}
+
+func encodeJournal(r slog.Record, fields []field) []byte {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", r.Message)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(severity(r.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "btrfs-backup")
+	for _, f := range fields {
+		name := journalFieldName(f.key)
+		if name == "" {
+			continue
+		}
+		writeJournalField(&b, name, f.value)
+	}
+	return b.Bytes()
+}
+
+// writeJournalField appends a field in the native protocol format. Values containing
+// newlines use the binary form with an explicit little-endian 64-bit length.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteString("=" + value + "\n")
+		return
+	}
+
+	b.WriteString("\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journalFieldName converts an attribute key to a valid journal field name: upper-case
+// letters, digits and underscores, not starting with an underscore or digit, which are
+// reserved for trusted fields or invalid.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	return strings.TrimLeft(name, "_0123456789")
+}
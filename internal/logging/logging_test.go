@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenSocket(t *testing.T) (string, *net.UnixConn) {
+	socketPath := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on socket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return socketPath, conn
+}
+
+func readDatagram(t *testing.T, conn *net.UnixConn) []byte {
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestSyslogHandler(t *testing.T) {
+	socketPath, conn := listenSocket(t)
+	original := syslogSockets
+	syslogSockets = []string{filepath.Join(t.TempDir(), "missing.sock"), socketPath}
+	t.Cleanup(func() { syslogSockets = original })
+
+	h, err := NewSyslogHandler(slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("NewSyslogHandler failed: %v", err)
+	}
+	logger := slog.New(h).With("target", "home")
+
+	logger.Debug("Not sent")
+	logger.Warn("Backup failed", "phase", "backup", "duration", 1500*time.Millisecond, "error", `repo "b2" down]`)
+
+	msg := string(readDatagram(t, conn))
+	if !strings.HasPrefix(msg, "<28>1 ") {
+		t.Errorf("Expected daemon.warning priority and version 1, got %q", msg)
+	}
+	for _, expected := range []string{
+		" btrfs-backup ",
+		`[btrfs-backup@32473 target="home" phase="backup" duration="1.5" error="repo \"b2\" down\]"]`,
+		"] Backup failed",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("Expected message to contain %q, got %q", expected, msg)
+		}
+	}
+}
+
+func TestSyslogHandlerUnavailable(t *testing.T) {
+	original := syslogSockets
+	syslogSockets = []string{filepath.Join(t.TempDir(), "missing.sock")}
+	t.Cleanup(func() { syslogSockets = original })
+
+	if _, err := NewSyslogHandler(nil); err == nil || !strings.Contains(err.Error(), "failed to connect to syslog") {
+		t.Errorf("Expected connection error, got %v", err)
+	}
+}
+
+func TestJournalHandler(t *testing.T) {
+	socketPath, conn := listenSocket(t)
+	original := journalSocket
+	journalSocket = socketPath
+	t.Cleanup(func() { journalSocket = original })
+
+	h, err := NewJournalHandler(slog.LevelDebug)
+	if err != nil {
+		t.Fatalf("NewJournalHandler failed: %v", err)
+	}
+	logger := slog.New(h).WithGroup("restic")
+
+	logger.Error("Backup failed", "snapshot-id", "abc123", "stderr", "line one\nline two")
+
+	var expected bytes.Buffer
+	expected.WriteString("MESSAGE=Backup failed\nPRIORITY=3\nSYSLOG_IDENTIFIER=btrfs-backup\n")
+	expected.WriteString("RESTIC_SNAPSHOT_ID=abc123\n")
+	expected.WriteString("RESTIC_STDERR\n")
+	_ = binary.Write(&expected, binary.LittleEndian, uint64(len("line one\nline two")))
+	expected.WriteString("line one\nline two\n")
+
+	if got := readDatagram(t, conn); !bytes.Equal(got, expected.Bytes()) {
+		t.Errorf("Unexpected journal datagram:\n got %q\nwant %q", got, expected.Bytes())
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	tests := map[string]string{
+		"target":      "TARGET",
+		"keep.daily":  "KEEP_DAILY",
+		"_hidden":     "HIDDEN",
+		"1st":         "ST",
+		"Snapshot-ID": "SNAPSHOT_ID",
+	}
+	for key, expected := range tests {
+		if got := journalFieldName(key); got != expected {
+			t.Errorf("journalFieldName(%q) = %q, expected %q", key, got, expected)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// syslogSockets are the well-known locations of the local syslog socket.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+const (
+	syslogFacilityDaemon = 3
+	// syslogSDID identifies the structured data element holding the record's attributes.
+	// 32473 is the private enterprise number reserved for documentation (RFC 5612).
+	syslogSDID = "btrfs-backup@32473"
+)
+
+// NewSyslogHandler returns a handler sending records as RFC 5424 messages with the
+// daemon facility to the local syslog daemon. The attributes of a record are carried
+// as structured data parameters.
+func NewSyslogHandler(level slog.Leveler) (slog.Handler, error) {
+	conn, err := dialFirst(syslogSockets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	pid := os.Getpid()
+
+	return &handler{
+		conn:  conn,
+		level: level,
+		encode: func(r slog.Record, fields []field) []byte {
+			return encodeSyslog(r, fields, hostname, pid)
+		},
+	}, nil
+}
+
+func encodeSyslog(r slog.Record, fields []field, hostname string, pid int) []byte {
+	var b strings.Builder
+	timestamp := "-"
+	if !r.Time.IsZero() {
+		timestamp = r.Time.UTC().Format(time.RFC3339Nano)
+	}
+	fmt.Fprintf(&b, "<%d>1 %s %s btrfs-backup %d - ",
+		syslogFacilityDaemon*8+severity(r.Level), timestamp, hostname, pid)
+
+	if len(fields) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[" + syslogSDID)
+		for _, f := range fields {
+			fmt.Fprintf(&b, " %s=\"%s\"", syslogParamName(f.key), syslogParamValue(f.value))
+		}
+		b.WriteString("]")
+	}
+
+	b.WriteString(" " + r.Message)
+	return []byte(b.String())
+}
+
+// syslogParamName restricts a name to the printable ASCII characters allowed in
+// structured data parameter names and to their maximum length of 32.
+func syslogParamName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// syslogParamValue escapes the characters that must be escaped in parameter values.
+func syslogParamValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,200 @@
+// Package metadata captures the ownership, permissions, ACLs and extended attributes of
+// a directory tree in a manifest and applies such a manifest to a restored tree, for
+// restores to filesystems or with tools that don't preserve all of them.
+// The manifest holds the output of getfacl and getfattr, which do the work.
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"btrfs-backup/internal/command"
+)
+
+// Section markers of a manifest. The getfacl and getfattr outputs only contain comment
+// lines starting with "# file:", "# owner:", "# group:" and "# flags:".
+const (
+	aclSection   = "# btrfs-backup: acl"
+	xattrSection = "# btrfs-backup: xattr"
+)
+
+// fileComment starts the comment naming the entry the following lines of a section
+// apply to.
+const fileComment = "# file: "
+
+// Tools holds the binaries reading and writing the metadata.
+type Tools struct {
+	Getfacl  string
+	Setfacl  string
+	Getfattr string
+	Setfattr string
+}
+
+// DefaultTools returns the tools of the acl and attr packages, looked up in PATH.
+func DefaultTools() Tools {
+	return Tools{Getfacl: "getfacl", Setfacl: "setfacl", Getfattr: "getfattr", Setfattr: "setfattr"}
+}
+
+// Capture writes the manifest of the tree at dir to w: the owner, group, permissions and
+// ACLs of every entry as listed by 'getfacl', and all of their extended attributes as
+// dumped by 'getfattr', with paths relative to dir. Symlinks are not followed.
+func (t Tools) Capture(ctx context.Context, dir string, w io.Writer) error {
+	if _, err := fmt.Fprintln(w, aclSection); err != nil {
+		return err
+	}
+	cmd := command.Command(ctx, t.Getfacl, "--recursive", "--physical", ".")
+	cmd.Dir = dir
+	cmd.Stdout = w
+	if err := command.Run(cmd); err != nil {
+		return fmt.Errorf("getfacl failed: %w", err)
+	}
+
+	if _, err := fmt.Fprintln(w, xattrSection); err != nil {
+		return err
+	}
+	cmd = command.Command(ctx, t.Getfattr, "--recursive", "--physical", "--no-dereference",
+		"--dump", "--match=-", "--encoding=base64", ".")
+	cmd.Dir = dir
+	cmd.Stdout = w
+	if err := command.Run(cmd); err != nil {
+		return fmt.Errorf("getfattr failed: %w", err)
+	}
+	return nil
+}
+
+// Apply restores the metadata of a manifest written by Capture to the tree at dir with
+// 'setfacl --restore' and 'setfattr --restore'. Entries of the manifest missing from dir
+// make the tools fail, after applying the metadata of the other entries. As the manifest
+// is read from the repository, nothing is applied if any entry lies outside of dir: an
+// absolute path, one leaving dir with "..", or one through a symlink in dir.
+func (t Tools) Apply(ctx context.Context, dir string, r io.Reader) error {
+	m, err := parse(r)
+	if err != nil {
+		return err
+	}
+	for _, file := range m.aclFiles {
+		if err := checkInside(dir, file, true); err != nil {
+			return err
+		}
+	}
+	for _, file := range m.xattrFiles {
+		// setfattr --no-dereference doesn't follow a symlink entry itself
+		if err := checkInside(dir, file, false); err != nil {
+			return err
+		}
+	}
+	acl, xattr := m.acl, m.xattr
+
+	cmd := command.Command(ctx, t.Setfacl, "--restore=-")
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(acl)
+	if err := command.Run(cmd); err != nil {
+		return fmt.Errorf("setfacl failed: %w", err)
+	}
+
+	if len(bytes.TrimSpace(xattr)) == 0 {
+		return nil
+	}
+	cmd = command.Command(ctx, t.Setfattr, "--no-dereference", "--restore=-")
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(xattr)
+	if err := command.Run(cmd); err != nil {
+		return fmt.Errorf("setfattr failed: %w", err)
+	}
+	return nil
+}
+
+// manifest is a manifest split into its getfacl and getfattr sections, with the paths of
+// the entries of each.
+type manifest struct {
+	acl, xattr           []byte
+	aclFiles, xattrFiles []string
+}
+
+// parse splits a manifest into its getfacl and getfattr sections. It fails for entries
+// that are absolute or leave the tree with "..".
+func parse(r io.Reader) (*manifest, error) {
+	var m manifest
+	var current *[]byte
+	var files *[]string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch strings.TrimSpace(line) {
+		case aclSection:
+			current, files = &m.acl, &m.aclFiles
+			continue
+		case xattrSection:
+			current, files = &m.xattr, &m.xattrFiles
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("not a metadata manifest")
+		}
+		if escaped, ok := strings.CutPrefix(line, fileComment); ok {
+			file := unescape(escaped)
+			if !filepath.IsLocal(file) {
+				return nil, fmt.Errorf("invalid manifest entry %q outside of the restored tree", escaped)
+			}
+			*files = append(*files, file)
+		}
+		*current = append(*current, line+"\n"...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if current == nil {
+		return nil, fmt.Errorf("not a metadata manifest")
+	}
+	return &m, nil
+}
+
+// unescape decodes the octal escapes getfacl and getfattr write for special characters
+// in paths, such as \040 for a space and \134 for a backslash, like the set tools do.
+func unescape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// checkInside fails if the entry file of a manifest leads out of dir through a symlink
+// in its parent directories or, with final, as the entry itself. Missing entries are left
+// to the tools to report.
+func checkInside(dir, file string, final bool) error {
+	parts := strings.Split(filepath.Clean(file), string(filepath.Separator))
+	if !final {
+		parts = parts[:len(parts)-1]
+	}
+	path := dir
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("invalid manifest entry %q through the symlink %s", file, path)
+		}
+	}
+	return nil
+}
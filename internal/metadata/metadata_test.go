@@ -0,0 +1,114 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeTools writes stand-ins for the acl and attr tools to dir: the get tools print an
+// entry naming their working directory, the set tools save their input next to them.
+func fakeTools(t *testing.T, dir string) Tools {
+	scripts := map[string]string{
+		"getfacl":  "#!/bin/sh\n[ \"$*\" = '--recursive --physical .' ] || exit 2\nprintf '# file: .\\n# owner: root\\nuser::rwx\\n\\n# cwd: %s\\n' \"$(pwd)\"\n",
+		"getfattr": "#!/bin/sh\n[ \"$*\" = '--recursive --physical --no-dereference --dump --match=- --encoding=base64 .' ] || exit 2\nprintf '# file: a\\nuser.tag=0sdGFn\\n'\n",
+		"setfacl":  "#!/bin/sh\n[ \"$*\" = '--restore=-' ] || exit 2\ncat > \"$0.in\"\npwd > \"$0.cwd\"\n",
+		"setfattr": "#!/bin/sh\n[ \"$*\" = '--no-dereference --restore=-' ] || exit 2\ncat > \"$0.in\"\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Tools{
+		Getfacl:  filepath.Join(dir, "getfacl"),
+		Setfacl:  filepath.Join(dir, "setfacl"),
+		Getfattr: filepath.Join(dir, "getfattr"),
+		Setfattr: filepath.Join(dir, "setfattr"),
+	}
+}
+
+func TestCaptureApply(t *testing.T) {
+	binDir, tree, restored := t.TempDir(), t.TempDir(), t.TempDir()
+	tools := fakeTools(t, binDir)
+	ctx := context.Background()
+
+	var manifest bytes.Buffer
+	if err := tools.Capture(ctx, tree, &manifest); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	expected := aclSection + "\n# file: .\n# owner: root\nuser::rwx\n\n# cwd: " + tree + "\n" + xattrSection + "\n# file: a\nuser.tag=0sdGFn\n"
+	if manifest.String() != expected {
+		t.Errorf("Expected manifest:\n%s\ngot:\n%s", expected, manifest.String())
+	}
+
+	if err := tools.Apply(ctx, restored, &manifest); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	for file, content := range map[string]string{
+		"setfacl.in":  "# file: .\n# owner: root\nuser::rwx\n\n# cwd: " + tree + "\n",
+		"setfacl.cwd": restored + "\n",
+		"setfattr.in": "# file: a\nuser.tag=0sdGFn\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(binDir, file))
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to be %q, got %q (%v)", file, content, data, err)
+		}
+	}
+}
+
+func TestApplyWithoutXattrs(t *testing.T) {
+	binDir := t.TempDir()
+	tools := fakeTools(t, binDir)
+
+	manifest := aclSection + "\n# file: .\nuser::rwx\n" + xattrSection + "\n"
+	if err := tools.Apply(context.Background(), t.TempDir(), strings.NewReader(manifest)); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(binDir, "setfattr.in")); !os.IsNotExist(err) {
+		t.Error("Expected setfattr not to run without extended attributes")
+	}
+
+	if err := tools.Apply(context.Background(), t.TempDir(), strings.NewReader("# file: .\nuser::rwx\n")); err == nil {
+		t.Error("Expected error for input that is not a manifest")
+	}
+}
+
+func TestApplyHostileManifest(t *testing.T) {
+	binDir, restored := t.TempDir(), t.TempDir()
+	tools := fakeTools(t, binDir)
+	if err := os.Symlink("/etc", filepath.Join(restored, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(restored, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, manifest := range map[string]string{
+		"absolute":              aclSection + "\n# file: /etc/shadow\nuser::rw-\n" + xattrSection + "\n",
+		"parent":                aclSection + "\n# file: .\nuser::rwx\n\n# file: ../outside\nuser::rwx\n" + xattrSection + "\n",
+		"escaped_parent":        aclSection + "\n# file: dir/\\056\\056/\\056\\056/outside\nuser::rwx\n" + xattrSection + "\n",
+		"xattr_parent":          aclSection + "\n# file: .\nuser::rwx\n" + xattrSection + "\n# file: dir/../../outside\nuser.tag=0sdGFn\n",
+		"acl_through_symlink":   aclSection + "\n# file: link/shadow\nuser::rw-\n" + xattrSection + "\n",
+		"acl_on_symlink":        aclSection + "\n# file: link\nuser::rwx\n" + xattrSection + "\n",
+		"xattr_through_symlink": aclSection + "\n# file: .\nuser::rwx\n" + xattrSection + "\n# file: link/shadow\nuser.tag=0sdGFn\n",
+	} {
+		if err := tools.Apply(context.Background(), restored, strings.NewReader(manifest)); err == nil {
+			t.Errorf("Expected error for manifest %s", name)
+		}
+	}
+	for _, file := range []string{"setfacl.in", "setfattr.in"} {
+		if _, err := os.Stat(filepath.Join(binDir, file)); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing applied from a hostile manifest, %s exists", file)
+		}
+	}
+
+	// The symlink entry itself is left alone by setfattr --no-dereference
+	manifest := aclSection + "\n# file: dir/a\\040b\nuser::rw-\n" + xattrSection + "\n# file: link\nuser.tag=0sdGFn\n"
+	if err := tools.Apply(context.Background(), restored, strings.NewReader(manifest)); err != nil {
+		t.Errorf("Expected the xattrs of a symlink and escaped names to be applied, got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// job is the job label of pushed metrics.
+const job = "btrfs-backup"
+
+// pushTimeout limits every request to a Pushgateway or remote-write endpoint.
+const pushTimeout = 30 * time.Second
+
+// Push replaces the metrics of the run's target on the Prometheus Pushgateway at
+// gatewayURL, grouped by job "btrfs-backup" and the target. After a failed run the last
+// success timestamp is taken from run.LastSuccess. Credentials in the URL are sent as
+// basic authentication.
+func Push(gatewayURL string, run Run) error {
+	pushURL := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + job + "/target/" + url.PathEscape(run.Target)
+	body := []byte(run.exposition(run.lastSuccess()))
+
+	if err := send(http.MethodPut, pushURL, body, map[string]string{
+		"Content-Type": "text/plain; version=0.0.4",
+	}); err != nil {
+		return fmt.Errorf("pushgateway %s failed: %w", gatewayURL, err)
+	}
+	return nil
+}
+
+// RemoteWrite sends the metrics of a run as samples at the end of the run to a
+// Prometheus remote-write endpoint, labeled with job "btrfs-backup" and the target.
+// After a failed run the last success timestamp is taken from run.LastSuccess, and
+// omitted if it's unknown. Credentials in the URL are sent as basic authentication.
+func RemoteWrite(endpoint string, run Run) error {
+	lastSuccess := run.lastSuccess()
+	var request []byte
+	for _, s := range run.samples(lastSuccess) {
+		if s.name == "btrfs_backup_last_success_timestamp" && lastSuccess == 0 {
+			continue
+		}
+		request = appendField(request, 1, timeSeries(s, run.Target, run.Finished))
+	}
+
+	if err := send(http.MethodPost, endpoint, snappyEncode(request), map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	}); err != nil {
+		return fmt.Errorf("remote write %s failed: %w", endpoint, err)
+	}
+	return nil
+}
+
+// send makes a request with body and headers and fails unless the response is 2xx.
+func send(method, target string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	client := &http.Client{Timeout: pushTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// timeSeries encodes a sample as a remote-write TimeSeries protobuf message. Labels are
+// sorted by name, as remote write requires.
+func timeSeries(s sample, target string, at time.Time) []byte {
+	var ts []byte
+	for _, label := range [][2]string{{"__name__", s.name}, {"job", job}, {"target", target}} {
+		var l []byte
+		l = appendField(l, 1, []byte(label[0]))
+		l = appendField(l, 2, []byte(label[1]))
+		ts = appendField(ts, 1, l)
+	}
+
+	var v []byte
+	v = binary.AppendUvarint(v, 1<<3|1) // value, 64-bit
+	v = binary.LittleEndian.AppendUint64(v, math.Float64bits(s.value))
+	v = binary.AppendUvarint(v, 2<<3|0) // timestamp in milliseconds, varint
+	v = binary.AppendUvarint(v, uint64(at.UnixMilli()))
+	return appendField(ts, 2, v)
+}
+
+// appendField appends a length-delimited protobuf field.
+func appendField(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// snappyEncode encodes data in the snappy block format remote write requires, as
+// literals only. The requests are small enough that compressing them isn't worth an
+// implementation of the compressor.
+func snappyEncode(data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), 1<<16)
+		if n <= 60 {
+			b = append(b, byte(n-1)<<2)
+		} else {
+			b = append(b, 61<<2, byte(n-1), byte((n-1)>>8)) // length in the next two bytes
+		}
+		b = append(b, data[:n]...)
+		data = data[n:]
+	}
+	return b
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPush(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/btrfs-backup/target/home" || user != "backup" || password != "secret" {
+			t.Errorf("Unexpected request %s %s as %q", r.Method, r.URL.Path, user)
+		}
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	gatewayURL := strings.Replace(server.URL, "http://", "http://backup:secret@", 1) + "/"
+	err := Push(gatewayURL, Run{
+		Target:        "home",
+		Duration:      2 * time.Second,
+		SnapshotCount: 3,
+		Finished:      time.Unix(1700086400, 0),
+		LastSuccess:   time.Unix(1700000000, 0),
+	})
+	if err != nil {
+		t.Fatalf("Push failed: %v", err)
+	}
+
+	for _, expected := range []string{
+		`btrfs_backup_last_success_timestamp{target="home"} 1700000000`,
+		`btrfs_backup_snapshot_count{target="home"} 3`,
+		`btrfs_backup_result{target="home"} 0`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected pushed metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestPushFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := Push(server.URL, Run{Target: "home"})
+	if err == nil || !strings.Contains(err.Error(), "unexpected status 400") {
+		t.Errorf("Expected status error, got %v", err)
+	}
+}
+
+// snappyDecode decodes a snappy block made of literals only, as snappyEncode writes it.
+func snappyDecode(t *testing.T, b []byte) []byte {
+	t.Helper()
+	length, n := binary.Uvarint(b)
+	b = b[n:]
+	var data []byte
+	for len(b) > 0 {
+		tag := b[0]
+		if tag&0x03 != 0 {
+			t.Fatalf("Unexpected snappy element type %d", tag&0x03)
+		}
+		size, header := int(tag>>2)+1, 1
+		if tag>>2 == 61 {
+			size, header = int(b[1])|int(b[2])<<8+1, 3
+		}
+		data = append(data, b[header:header+size]...)
+		b = b[header+size:]
+	}
+	if uint64(len(data)) != length {
+		t.Fatalf("Expected %d decoded bytes, got %d", length, len(data))
+	}
+	return data
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var request []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Unexpected request %s with headers %v", r.Method, r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		request = snappyDecode(t, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	finished := time.Unix(1700000000, 0)
+	err := RemoteWrite(server.URL, Run{Target: "home", Finished: finished})
+	if err != nil {
+		t.Fatalf("RemoteWrite failed: %v", err)
+	}
+
+	for _, expected := range []string{"btrfs_backup_result", "btrfs_backup_duration_seconds", "job\x12\x0cbtrfs-backup", "target\x12\x04home"} {
+		if !bytes.Contains(request, []byte(expected)) {
+			t.Errorf("Expected request to contain %q", expected)
+		}
+	}
+	if bytes.Contains(request, []byte("btrfs_backup_last_success_timestamp")) {
+		t.Error("Expected an unknown last success to be omitted")
+	}
+	if !bytes.Contains(request, binary.AppendUvarint([]byte{2 << 3}, uint64(finished.UnixMilli()))) {
+		t.Error("Expected samples at the end of the run")
+	}
+}
+
+func TestSnappyEncodeLongLiteral(t *testing.T) {
+	data := bytes.Repeat([]byte("btrfs-backup "), 10000)
+	if decoded := snappyDecode(t, snappyEncode(data)); !bytes.Equal(decoded, data) {
+		t.Error("Expected long input to round-trip")
+	}
+}
@@ -0,0 +1,141 @@
+// Package metrics exports backup run metrics to Prometheus: in the text exposition
+// format for the node_exporter textfile collector, or pushed to a Pushgateway or a
+// remote-write endpoint.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Run holds the metrics of a single backup run of a target.
+type Run struct {
+	Target        string        // Target name, exported as the target label
+	Success       bool          // Whether the run completed successfully
+	Duration      time.Duration // Wall-clock duration of the run
+	SnapshotCount int           // Number of local snapshots of the target after the run
+	Finished      time.Time     // Time the run ended
+	LastSuccess   time.Time     // End of the last successful run before this one, zero if unknown
+	Health        *int          // Health score of the target after the run, from 0 to 100, nil if unknown
+}
+
+// sample is a metric of a run, exported with the target label.
+type sample struct {
+	name  string
+	help  string
+	value float64
+}
+
+// samples returns the metrics of a run, with lastSuccess as the Unix time of the last
+// successful run.
+func (run Run) samples(lastSuccess float64) []sample {
+	result := 0.0
+	if run.Success {
+		result = 1
+	}
+	samples := []sample{
+		{"btrfs_backup_last_success_timestamp", "Unix time of the last successful backup run.", lastSuccess},
+		{"btrfs_backup_duration_seconds", "Duration of the last backup run in seconds.", run.Duration.Seconds()},
+		{"btrfs_backup_snapshot_count", "Number of local BTRFS snapshots of the target.", float64(run.SnapshotCount)},
+		{"btrfs_backup_result", "Result of the last backup run (1 = success, 0 = failure).", result},
+	}
+	if run.Health != nil {
+		samples = append(samples, sample{"btrfs_backup_health_score", "Health score of the backup chain of the target, from 0 to 100.", float64(*run.Health)})
+	}
+	return samples
+}
+
+// lastSuccess returns the Unix time of the last successful run: the end of run if it
+// succeeded, its LastSuccess otherwise, or 0 if no run is known to have succeeded.
+func (run Run) lastSuccess() float64 {
+	switch {
+	case run.Success:
+		return float64(run.Finished.Unix())
+	case !run.LastSuccess.IsZero():
+		return float64(run.LastSuccess.Unix())
+	}
+	return 0
+}
+
+// exposition renders the metrics of a run in the Prometheus text exposition format.
+func (run Run) exposition(lastSuccess float64) string {
+	label := fmt.Sprintf("{target=%q}", run.Target)
+	var b strings.Builder
+	for _, s := range run.samples(lastSuccess) {
+		fmt.Fprintf(&b, "# HELP %s %s\n", s.name, s.help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", s.name)
+		fmt.Fprintf(&b, "%s%s %s\n", s.name, label, strconv.FormatFloat(s.value, 'f', -1, 64))
+	}
+	return b.String()
+}
+
+// TextfilePath returns the path of the metrics file of a target in dir.
+func TextfilePath(dir, target string) string {
+	return filepath.Join(dir, fmt.Sprintf("btrfs_backup_%s.prom", target))
+}
+
+// WriteTextfile writes the metrics of a run to the target's file in dir. After a failed
+// run the last success timestamp of the previous file is carried over, so alerts on the
+// age of the last successful backup keep working. The file is replaced atomically so
+// node_exporter never reads a partially written file.
+func WriteTextfile(dir string, run Run) error {
+	path := TextfilePath(dir, run.Target)
+
+	lastSuccess := run.lastSuccess()
+	if !run.Success {
+		if previous, err := readLastSuccess(path); err == nil {
+			lastSuccess = previous
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, ".btrfs_backup_*.prom.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create metrics file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err = tmp.WriteString(run.exposition(lastSuccess)); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace metrics file: %w", err)
+	}
+	return nil
+}
+
+// readLastSuccess returns the last success timestamp recorded in an existing metrics file.
+func readLastSuccess(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "btrfs_backup_last_success_timestamp{") {
+			continue
+		}
+		fields := strings.Fields(line)
+		return strconv.ParseFloat(fields[len(fields)-1], 64)
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no last success timestamp in %s", path)
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readTextfile(t *testing.T, dir, target string) string {
+	t.Helper()
+	data, err := os.ReadFile(TextfilePath(dir, target))
+	if err != nil {
+		t.Fatalf("Failed to read metrics file: %v", err)
+	}
+	return string(data)
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	finished := time.Unix(1700000000, 0)
+
+	health := 85
+	err := WriteTextfile(dir, Run{
+		Target:        "home",
+		Success:       true,
+		Duration:      90 * time.Second,
+		SnapshotCount: 3,
+		Finished:      finished,
+		Health:        &health,
+	})
+	if err != nil {
+		t.Fatalf("WriteTextfile failed: %v", err)
+	}
+
+	content := readTextfile(t, dir, "home")
+	for _, expected := range []string{
+		"# TYPE btrfs_backup_last_success_timestamp gauge",
+		`btrfs_backup_last_success_timestamp{target="home"} 1700000000`,
+		`btrfs_backup_duration_seconds{target="home"} 90`,
+		`btrfs_backup_snapshot_count{target="home"} 3`,
+		`btrfs_backup_result{target="home"} 1`,
+		`btrfs_backup_health_score{target="home"} 85`,
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, content)
+		}
+	}
+
+	// A failed run keeps the previous success timestamp
+	err = WriteTextfile(dir, Run{
+		Target:   "home",
+		Duration: 2 * time.Second,
+		Finished: finished.Add(24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("WriteTextfile failed: %v", err)
+	}
+
+	content = readTextfile(t, dir, "home")
+	for _, expected := range []string{
+		`btrfs_backup_last_success_timestamp{target="home"} 1700000000`,
+		`btrfs_backup_result{target="home"} 0`,
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, content)
+		}
+	}
+	if strings.Contains(content, "btrfs_backup_health_score") {
+		t.Errorf("Expected no health score without one, got:\n%s", content)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read metrics directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the metrics file to remain, got %d entries", len(entries))
+	}
+}
+
+func TestWriteTextfileFirstRunFailed(t *testing.T) {
+	dir := t.TempDir()
+
+	err := WriteTextfile(dir, Run{Target: "root", Finished: time.Now()})
+	if err != nil {
+		t.Fatalf("WriteTextfile failed: %v", err)
+	}
+
+	content := readTextfile(t, dir, "root")
+	if !strings.Contains(content, `btrfs_backup_last_success_timestamp{target="root"} 0`) {
+		t.Errorf("Expected zero last success timestamp, got:\n%s", content)
+	}
+}
+
+func TestWriteTextfileMissingDir(t *testing.T) {
+	err := WriteTextfile("/nonexistent/metrics", Run{Target: "home"})
+	if err == nil || !strings.Contains(err.Error(), "failed to create metrics file") {
+		t.Errorf("Expected create error, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Aggregate reduces the results of a run over several targets before they are sent, so
+// an outage of a shared repository raises one alert instead of one per target. Once at
+// least threshold targets failed on the same repository, their failures are merged into
+// a single result listing the failed targets, placed where the first of them was.
+// Other results are returned unchanged and in order. A threshold below 2 disables
+// aggregation.
+func Aggregate(results []Result, threshold int) []Result {
+	if threshold < 2 {
+		return results
+	}
+
+	failures := make(map[string][]Result)
+	for _, r := range results {
+		if !r.Success {
+			failures[r.Repository] = append(failures[r.Repository], r)
+		}
+	}
+
+	aggregated := make([]Result, 0, len(results))
+	merged := make(map[string]bool)
+	for _, r := range results {
+		group := failures[r.Repository]
+		if r.Success || len(group) < threshold {
+			aggregated = append(aggregated, r)
+			continue
+		}
+		if !merged[r.Repository] {
+			aggregated = append(aggregated, mergeFailures(group))
+			merged[r.Repository] = true
+		}
+	}
+
+	return aggregated
+}
+
+// mergeFailures combines failures sharing a repository into one result. The error
+// of the first failure is kept as the likely root cause.
+func mergeFailures(group []Result) Result {
+	first := group[0]
+	merged := Result{
+		Host:       first.Host,
+		RunID:      first.RunID,
+		Started:    first.Started,
+		Repository: first.Repository,
+		Restic:     first.Restic,
+		Output:     first.Output,
+		Reminders:  first.Reminders,
+	}
+
+	for _, r := range group {
+		merged.Targets = append(merged.Targets, r.Target)
+		merged.Duration += r.Duration
+	}
+	merged.Error = fmt.Sprintf("%d targets failed on repository %s (%s): %s",
+		len(group), first.Repository, strings.Join(merged.Targets, ", "), first.Error)
+
+	return merged
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	results := []Result{
+		{Target: "home", Repository: "nas", Restic: ResticSkipped, Error: "repository unreachable", Duration: 1},
+		{Target: "docs", Repository: "b2", Success: true, Restic: ResticSuccess, Duration: 5},
+		{Target: "root", Repository: "nas", Restic: ResticSkipped, Error: "repository unreachable", Duration: 2},
+		{Target: "photos", Repository: "b2", Restic: ResticFailure, Error: "upload failed", Duration: 3},
+		{Target: "mail", Repository: "nas", Restic: ResticSkipped, Error: "repository unreachable", Duration: 4},
+	}
+
+	tests := []struct {
+		name            string
+		threshold       int
+		expectedTargets [][]string
+	}{
+		{
+			name:            "disabled",
+			threshold:       0,
+			expectedTargets: [][]string{{"home"}, {"docs"}, {"root"}, {"photos"}, {"mail"}},
+		},
+		{
+			name:            "merges_failures_on_shared_repository",
+			threshold:       3,
+			expectedTargets: [][]string{{"home", "root", "mail"}, {"docs"}, {"photos"}},
+		},
+		{
+			name:            "below_threshold",
+			threshold:       4,
+			expectedTargets: [][]string{{"home"}, {"docs"}, {"root"}, {"photos"}, {"mail"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Aggregate(results, tt.threshold)
+
+			if len(got) != len(tt.expectedTargets) {
+				t.Fatalf("Expected %d results, got %d: %+v", len(tt.expectedTargets), len(got), got)
+			}
+			for i, r := range got {
+				targets := r.Targets
+				if r.Target != "" {
+					targets = []string{r.Target}
+				}
+				if !slices.Equal(targets, tt.expectedTargets[i]) {
+					t.Errorf("Result %d: expected targets %v, got %v", i, tt.expectedTargets[i], targets)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregateMergedResult(t *testing.T) {
+	got := Aggregate([]Result{
+		{Target: "home", Host: "nas1", Repository: "nas", Restic: ResticSkipped, Error: "repository unreachable", Duration: 1},
+		{Target: "root", Host: "nas1", Repository: "nas", Restic: ResticSkipped, Error: "repository unreachable", Duration: 2},
+	}, 2)
+
+	if len(got) != 1 {
+		t.Fatalf("Expected one merged result, got %d", len(got))
+	}
+	merged := got[0]
+	if merged.Success || merged.Target != "" || merged.Repository != "nas" || merged.Host != "nas1" || merged.Duration != 3 {
+		t.Errorf("Unexpected merged result: %+v", merged)
+	}
+	if !strings.HasPrefix(merged.Error, "2 targets failed on repository nas (home, root): repository unreachable") {
+		t.Errorf("Unexpected merged error: %q", merged.Error)
+	}
+}
@@ -0,0 +1,193 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Email sends a message through an SMTP server when a backup run fails or has reminders.
+// The error output of the failed btrfs or restic commands is attached to the message.
+type Email struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+	timeout  time.Duration
+
+	send func(ctx context.Context, msg []byte) error
+}
+
+// NewEmail creates an email notifier sending through the SMTP server at host:port.
+// STARTTLS is used when the server offers it, and the credentials are only sent over
+// an encrypted connection or to localhost. An empty username disables authentication.
+// The whole SMTP conversation is limited by timeout.
+func NewEmail(host string, port int, username, password, from string, to []string, timeout time.Duration) *Email {
+	e := &Email{
+		addr:     net.JoinHostPort(host, fmt.Sprint(port)),
+		host:     host,
+		username: username,
+		password: password,
+		from:     from,
+		to:       to,
+		timeout:  timeout,
+	}
+	e.send = e.sendSMTP
+	return e
+}
+
+// Notify sends a failure report. Successful runs are only reported if they have reminders.
+func (e *Email) Notify(ctx context.Context, result Result) error {
+	if result.Success && len(result.Reminders) == 0 {
+		return nil
+	}
+
+	msg, err := buildEmail(e.from, e.to, result, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to build email: %w", err)
+	}
+	if err = e.send(ctx, msg); err != nil {
+		return fmt.Errorf("email to %s failed: %w", strings.Join(e.to, ", "), err)
+	}
+	return nil
+}
+
+func (e *Email) sendSMTP(ctx context.Context, msg []byte) error {
+	conn, err := (&net.Dialer{Timeout: e.timeout}).DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	if e.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(e.timeout))
+	}
+
+	client, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() { _ = client.Close() }()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+			return err
+		}
+	}
+	if e.username != "" {
+		if err = client.Auth(smtp.PlainAuth("", e.username, e.password, e.host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(e.from); err != nil {
+		return err
+	}
+	for _, rcpt := range e.to {
+		if err = client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// buildEmail renders the failure report as a multipart message with the captured
+// command output as attachment.
+func buildEmail(from string, to []string, result Result, date time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	subject := fmt.Sprintf("[btrfs-backup] Backup of %s on %s failed", result.Target, result.Host)
+	switch {
+	case len(result.Targets) > 0:
+		subject = fmt.Sprintf("[btrfs-backup] Backup of %d targets on %s failed", len(result.Targets), result.Host)
+	case result.Success:
+		subject = fmt.Sprintf("[btrfs-backup] Reminder for the backup of %s on %s", result.Target, result.Host)
+	}
+
+	var header bytes.Buffer
+	fmt.Fprintf(&header, "From: %s\r\n", from)
+	fmt.Fprintf(&header, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&header, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&header, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&header, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&header, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "Target:     %s\r\n", describeTargets(result))
+	fmt.Fprintf(text, "Host:       %s\r\n", result.Host)
+	if result.RunID != "" {
+		fmt.Fprintf(text, "Run ID:     %s\r\n", result.RunID)
+	}
+	fmt.Fprintf(text, "Repository: %s\r\n", result.Repository)
+	if result.Snapshot != "" {
+		fmt.Fprintf(text, "Snapshot:   %s\r\n", result.Snapshot)
+	}
+	fmt.Fprintf(text, "Started:    %s\r\n", result.Started.Format(time.RFC3339))
+	fmt.Fprintf(text, "Duration:   %.0fs\r\n", result.Duration)
+	fmt.Fprintf(text, "Restic:     %s\r\n", result.Restic)
+	if upload := describeUpload(result); upload != "" {
+		fmt.Fprintf(text, "Upload:     %s\r\n", upload)
+	}
+	fmt.Fprintf(text, "\r\n")
+	if result.Error != "" {
+		fmt.Fprintf(text, "%s\r\n", result.Error)
+	}
+	for _, reminder := range result.Reminders {
+		fmt.Fprintf(text, "Reminder: %s\r\n", reminder)
+	}
+
+	if result.Output != "" {
+		attachment, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=utf-8"},
+			"Content-Disposition":       {`attachment; filename="output.txt"`},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString([]byte(result.Output))
+		for len(encoded) > 76 {
+			fmt.Fprintf(attachment, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(attachment, "%s\r\n", encoded)
+	}
+
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return append(header.Bytes(), body.Bytes()...), nil
+}
+
+func describeTargets(result Result) string {
+	if len(result.Targets) > 0 {
+		return strings.Join(result.Targets, ", ")
+	}
+	return result.Target
+}
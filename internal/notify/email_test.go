@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmailNotify(t *testing.T) {
+	var sent [][]byte
+	e := NewEmail("smtp.example.com", 587, "", "", "backup@example.com", []string{"admin@example.com", "ops@example.com"}, time.Second)
+	e.send = func(_ context.Context, msg []byte) error {
+		sent = append(sent, msg)
+		return nil
+	}
+
+	if err := e.Notify(context.Background(), Result{Target: "home", Success: true}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("Expected no email for a successful run, got %d", len(sent))
+	}
+
+	result := Result{
+		Target:     "home",
+		Host:       "nas",
+		RunID:      "0123456789abcdef",
+		Repository: "b2-home",
+		Snapshot:   "/snapshots/home-20230101-120000",
+		Restic:     ResticFailure,
+		Error:      "backup operation failed: exit status 1: Fatal: wrong password or no key found",
+		Output:     "Fatal: wrong password or no key found\n",
+	}
+	if err := e.Notify(context.Background(), result); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("Expected one email, got %d", len(sent))
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(sent[0]))
+	if err != nil {
+		t.Fatalf("Invalid message: %v", err)
+	}
+	if got := msg.Header.Get("Subject"); got != "[btrfs-backup] Backup of home on nas failed" {
+		t.Errorf("Unexpected subject %q", got)
+	}
+	if got := msg.Header.Get("To"); got != "admin@example.com, ops@example.com" {
+		t.Errorf("Unexpected recipients %q", got)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Invalid content type: %v", err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+
+	text, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("Missing text part: %v", err)
+	}
+	body, _ := io.ReadAll(text)
+	if !strings.Contains(string(body), "Snapshot:   /snapshots/home-20230101-120000") || !strings.Contains(string(body), "Run ID:     0123456789abcdef") || !strings.Contains(string(body), result.Error) {
+		t.Errorf("Unexpected text part:\n%s", body)
+	}
+
+	attachment, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("Missing attachment: %v", err)
+	}
+	if attachment.FileName() != "output.txt" {
+		t.Errorf("Expected output.txt attachment, got %q", attachment.FileName())
+	}
+	// multipart.Reader decodes quoted-printable only, so decode base64 here
+	encoded, _ := io.ReadAll(attachment)
+	decoded, err := decodeBase64Lines(string(encoded))
+	if err != nil || decoded != result.Output {
+		t.Errorf("Expected attached output %q, got %q (%v)", result.Output, decoded, err)
+	}
+}
+
+func TestEmailWithoutOutput(t *testing.T) {
+	msg, err := buildEmail("backup@example.com", []string{"admin@example.com"}, Result{
+		Targets: []string{"home", "root"},
+		Host:    "nas",
+		Error:   "2 targets failed on repository nas (home, root): repository unreachable",
+	}, time.Now())
+	if err != nil {
+		t.Fatalf("buildEmail failed: %v", err)
+	}
+
+	if !strings.Contains(string(msg), "Subject: [btrfs-backup] Backup of 2 targets on nas failed") {
+		t.Errorf("Expected aggregated subject, got:\n%s", msg)
+	}
+	if strings.Contains(string(msg), "output.txt") {
+		t.Errorf("Expected no attachment without captured output")
+	}
+	if strings.Contains(string(msg), "Upload:") {
+		t.Errorf("Expected no upload statistics without an upload")
+	}
+}
+
+func TestEmailReminders(t *testing.T) {
+	var sent [][]byte
+	e := NewEmail("smtp.example.com", 587, "", "", "backup@example.com", []string{"admin@example.com"}, time.Second)
+	e.send = func(_ context.Context, msg []byte) error {
+		sent = append(sent, msg)
+		return nil
+	}
+
+	reminder := "password of repository 'b2-home' is due for rotation since 2026-04-15 (last rotated 2026-01-15, rotate_every 90d)"
+	if err := e.Notify(context.Background(), Result{Target: "home", Host: "nas", Success: true, Reminders: []string{reminder}}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("Expected an email for a successful run with reminders, got %d", len(sent))
+	}
+	if !strings.Contains(string(sent[0]), "Subject: [btrfs-backup] Reminder for the backup of home on nas") {
+		t.Errorf("Expected reminder subject, got:\n%s", sent[0])
+	}
+	if !strings.Contains(string(sent[0]), "Reminder: "+reminder) {
+		t.Errorf("Expected the reminder in the text, got:\n%s", sent[0])
+	}
+}
+
+func decodeBase64Lines(s string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.NewReplacer("\r", "", "\n", "").Replace(s))
+	return string(decoded), err
+}
@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Healthcheck reports backup runs to a Healthchecks.io compatible ping URL, so a missing
+// or failed backup raises an alert on the monitoring side.
+type Healthcheck struct {
+	url    string
+	sender sender
+}
+
+// NewHealthcheck creates a Healthchecks.io notifier for a check's ping URL. Every request
+// is limited by timeout and failed pings are retried up to retries times.
+func NewHealthcheck(url string, timeout time.Duration, retries int) *Healthcheck {
+	return &Healthcheck{
+		url:    strings.TrimSuffix(url, "/"),
+		sender: newSender(timeout, retries),
+	}
+}
+
+// Start signals that a backup run has started, which lets Healthchecks.io measure the
+// run time and detect runs that never finish.
+func (h *Healthcheck) Start(ctx context.Context) error {
+	if err := h.sender.post(ctx, h.url+"/start", "text/plain", nil); err != nil {
+		return fmt.Errorf("healthcheck start ping failed: %w", err)
+	}
+	return nil
+}
+
+// Notify pings the base URL after a successful run and the /fail endpoint after a
+// failed one. The error message is sent as request body and shows up in the check's log,
+// followed by the reminders of the result.
+func (h *Healthcheck) Notify(ctx context.Context, result Result) error {
+	url := h.url
+	body := fmt.Sprintf("target %s: backup completed in %.0fs", result.Target, result.Duration)
+	if upload := describeUpload(result); upload != "" {
+		body += " (" + upload + ")"
+	}
+	if !result.Success {
+		url += "/fail"
+		body = fmt.Sprintf("target %s: %s", result.Target, result.Error)
+	}
+	for _, reminder := range result.Reminders {
+		body += "\nreminder: " + reminder
+	}
+
+	if err := h.sender.post(ctx, url, "text/plain", []byte(body)); err != nil {
+		return fmt.Errorf("healthcheck ping failed: %w", err)
+	}
+	return nil
+}
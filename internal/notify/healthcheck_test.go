@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthcheck(t *testing.T) {
+	var paths, bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		paths = append(paths, r.URL.Path)
+		bodies = append(bodies, string(body))
+	}))
+	defer server.Close()
+
+	h := NewHealthcheck(server.URL+"/ping/abc-123/", time.Second, 0)
+
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := h.Notify(context.Background(), Result{Target: "home", Success: true, Duration: 61, FilesProcessed: 1200, DataAdded: 4096, DedupRatio: 0.97}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if err := h.Notify(context.Background(), Result{Target: "home", Error: "snapshot creation failed"}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if err := h.Notify(context.Background(), Result{Target: "home", Success: true, Duration: 5, Reminders: []string{"password of repository 'b2-home' is due for rotation"}}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	expectedPaths := []string{"/ping/abc-123/start", "/ping/abc-123", "/ping/abc-123/fail", "/ping/abc-123"}
+	if strings.Join(paths, " ") != strings.Join(expectedPaths, " ") {
+		t.Errorf("Expected pings %v, got %v", expectedPaths, paths)
+	}
+	if bodies[1] != "target home: backup completed in 61s (1200 files, 4096 bytes added, 97% deduplicated)" {
+		t.Errorf("Expected success ping to carry the upload statistics, got %q", bodies[1])
+	}
+	if !strings.Contains(bodies[2], "snapshot creation failed") {
+		t.Errorf("Expected failure ping to carry the error, got %q", bodies[2])
+	}
+	if bodies[3] != "target home: backup completed in 5s\nreminder: password of repository 'b2-home' is due for rotation" {
+		t.Errorf("Expected ping to carry the reminder, got %q", bodies[3])
+	}
+}
+
+func TestHealthcheckUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	err := NewHealthcheck(server.URL, time.Second, 2).Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "healthcheck start ping failed") {
+		t.Errorf("Expected start ping error, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// MQTT publishes backup results as retained JSON messages to an MQTT broker, one topic
+// per target, so dashboards such as Home Assistant always show the latest result.
+// It speaks just enough MQTT 3.1.1 to connect, publish with QoS 1 and disconnect.
+type MQTT struct {
+	addr        string
+	tlsConfig   *tls.Config // nil for plain TCP
+	username    string
+	password    string
+	topicPrefix string
+	clientID    string
+	timeout     time.Duration
+	retries     int
+	backoff     time.Duration
+}
+
+// NewMQTT creates an MQTT notifier for the broker URL, mqtt://host[:1883] or
+// mqtts://host[:8883] for TLS. The broker certificate is verified against caFile if set,
+// or the system roots otherwise. An empty username disables authentication. Results are
+// published to <topicPrefix>/<target>. Each connection is limited by timeout and failed
+// deliveries are retried up to retries times with exponential backoff.
+func NewMQTT(broker, topicPrefix, username, password, caFile string, timeout time.Duration, retries int) (*MQTT, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT broker URL '%s': %w", broker, err)
+	}
+
+	m := &MQTT{
+		username:    username,
+		password:    password,
+		topicPrefix: strings.TrimSuffix(topicPrefix, "/"),
+		clientID:    "btrfs-backup-" + fmt.Sprint(os.Getpid()),
+		timeout:     timeout,
+		retries:     retries,
+		backoff:     time.Second,
+	}
+
+	port := u.Port()
+	switch u.Scheme {
+	case "mqtt":
+		if port == "" {
+			port = "1883"
+		}
+	case "mqtts":
+		if port == "" {
+			port = "8883"
+		}
+		m.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read MQTT CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in MQTT CA file %s", caFile)
+			}
+			m.tlsConfig.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("invalid MQTT broker URL '%s', must start with mqtt:// or mqtts://", broker)
+	}
+	m.addr = net.JoinHostPort(u.Hostname(), port)
+
+	return m, nil
+}
+
+// Notify publishes the result to the topic of its target. A result merged from several
+// targets is published to the topic of each of them.
+func (m *MQTT) Notify(ctx context.Context, result Result) error {
+	targets := result.Targets
+	if len(targets) == 0 {
+		targets = []string{result.Target}
+	}
+
+	messages := make(map[string][]byte, len(targets))
+	for _, target := range targets {
+		r := result
+		r.Target, r.Targets = target, nil
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("failed to encode MQTT payload: %w", err)
+		}
+		messages[m.topicPrefix+"/"+target] = payload
+	}
+
+	delay := m.backoff
+	for attempt := 0; ; attempt++ {
+		err := m.publish(ctx, messages)
+		if err == nil {
+			return nil
+		}
+		var refused mqttRefusedError
+		if errors.As(err, &refused) || attempt >= m.retries {
+			return fmt.Errorf("MQTT broker %s failed: %w", m.addr, err)
+		}
+		if sleep(ctx, delay) != nil {
+			return fmt.Errorf("MQTT broker %s failed: %w", m.addr, err)
+		}
+		delay *= 2
+	}
+}
+
+// mqttRefusedError is a connection refused by the broker, e.g. for bad credentials,
+// which retrying won't fix.
+type mqttRefusedError byte
+
+func (e mqttRefusedError) Error() string {
+	return fmt.Sprintf("connection refused with return code %d", byte(e))
+}
+
+// MQTT 3.1.1 control packet types, shifted into the high nibble of the fixed header.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// publish connects to the broker, publishes every message retained with QoS 1 and
+// disconnects.
+func (m *MQTT) publish(ctx context.Context, messages map[string][]byte) error {
+	dialer := &net.Dialer{Timeout: m.timeout}
+	var conn net.Conn
+	var err error
+	if m.tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: m.tlsConfig}).DialContext(ctx, "tcp", m.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", m.addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	if m.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(m.timeout))
+	}
+	r := bufio.NewReader(conn)
+
+	if _, err = conn.Write(m.connectPacket()); err != nil {
+		return err
+	}
+	header, body, err := readPacket(r)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if header&0xf0 != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("unexpected packet type %d instead of CONNACK", header>>4)
+	}
+	if body[1] != 0 {
+		return mqttRefusedError(body[1])
+	}
+
+	packetID := uint16(0)
+	for topic, payload := range messages {
+		packetID++
+		if _, err = conn.Write(publishPacket(topic, payload, packetID)); err != nil {
+			return err
+		}
+		header, body, err = readPacket(r)
+		if err != nil {
+			return fmt.Errorf("failed to read PUBACK: %w", err)
+		}
+		if header&0xf0 != mqttPuback || len(body) != 2 || binary.BigEndian.Uint16(body) != packetID {
+			return fmt.Errorf("unexpected packet type %d instead of PUBACK", header>>4)
+		}
+	}
+
+	_, err = conn.Write([]byte{mqttDisconnect, 0})
+	return err
+}
+
+// connectPacket builds a CONNECT packet with a clean session and the credentials, if any.
+func (m *MQTT) connectPacket() []byte {
+	var body []byte
+	body = appendString(body, "MQTT")
+	flags := byte(0x02) // clean session
+	if m.username != "" {
+		flags |= 0x80
+		if m.password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags) // protocol level 4 is MQTT 3.1.1
+	body = binary.BigEndian.AppendUint16(body, 60)
+	body = appendString(body, m.clientID)
+	if m.username != "" {
+		body = appendString(body, m.username)
+		if m.password != "" {
+			body = appendString(body, m.password)
+		}
+	}
+	return packet(mqttConnect, body)
+}
+
+// publishPacket builds a retained PUBLISH packet with QoS 1.
+func publishPacket(topic string, payload []byte, packetID uint16) []byte {
+	var body []byte
+	body = appendString(body, topic)
+	body = binary.BigEndian.AppendUint16(body, packetID)
+	body = append(body, payload...)
+	return packet(mqttPublish|0x02|0x01, body)
+}
+
+// packet prefixes body with the fixed header of a control packet.
+func packet(header byte, body []byte) []byte {
+	b := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+// appendString appends a length-prefixed UTF-8 string.
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readPacket reads a control packet and returns the first byte of its fixed header,
+// holding the packet type and flags, and its body.
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
@@ -0,0 +1,123 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishedMessage is a PUBLISH packet received by the test broker.
+type publishedMessage struct {
+	header  byte
+	topic   string
+	payload []byte
+}
+
+// startTestBroker accepts MQTT connections, answering CONNECT with returnCode and
+// acknowledging every PUBLISH, and sends the CONNECT bodies and messages it received
+// to the returned channels.
+func startTestBroker(t *testing.T, returnCode byte) (string, chan []byte, chan publishedMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	connects := make(chan []byte, 10)
+	messages := make(chan publishedMessage, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				header, body, err := readPacket(r)
+				if err != nil {
+					break
+				}
+				switch header & 0xf0 {
+				case mqttConnect:
+					connects <- body
+					_, _ = conn.Write([]byte{mqttConnack, 2, 0, returnCode})
+				case mqttPublish:
+					length := binary.BigEndian.Uint16(body)
+					topic := string(body[2 : 2+length])
+					packetID := body[2+length : 4+length]
+					messages <- publishedMessage{header: header, topic: topic, payload: body[4+length:]}
+					_, _ = conn.Write([]byte{mqttPuback, 2, packetID[0], packetID[1]})
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	return "mqtt://" + listener.Addr().String(), connects, messages
+}
+
+func TestMQTTNotify(t *testing.T) {
+	broker, connects, messages := startTestBroker(t, 0)
+	m, err := NewMQTT(broker, "homelab/backup/", "ha", "secret", "", time.Second, 0)
+	if err != nil {
+		t.Fatalf("NewMQTT failed: %v", err)
+	}
+
+	result := Result{Targets: []string{"home", "docs"}, Repository: "nas", Restic: ResticFailure, Error: "repository unreachable"}
+	if err := m.Notify(context.Background(), result); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	connect := <-connects
+	if !strings.Contains(string(connect), "MQTT") || connect[7]&0xc0 != 0xc0 || !strings.HasSuffix(string(connect), "ha\x00\x06secret") {
+		t.Errorf("Unexpected CONNECT %q", connect)
+	}
+
+	received := map[string]Result{}
+	for range 2 {
+		msg := <-messages
+		if msg.header != mqttPublish|0x03 {
+			t.Errorf("Expected retained QoS 1 publish, got header %#x", msg.header)
+		}
+		var r Result
+		if err := json.Unmarshal(msg.payload, &r); err != nil {
+			t.Fatalf("Invalid payload: %v", err)
+		}
+		received[msg.topic] = r
+	}
+	for _, target := range []string{"home", "docs"} {
+		r, ok := received["homelab/backup/"+target]
+		if !ok || r.Target != target || r.Targets != nil || r.Error != result.Error {
+			t.Errorf("Unexpected message for %s: %+v", target, r)
+		}
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	broker, connects, _ := startTestBroker(t, 5)
+	m, err := NewMQTT(broker, "backup", "ha", "wrong", "", time.Second, 3)
+	if err != nil {
+		t.Fatalf("NewMQTT failed: %v", err)
+	}
+	m.backoff = time.Millisecond
+
+	err = m.Notify(context.Background(), Result{Target: "home", Success: true})
+	if err == nil || !strings.Contains(err.Error(), "return code 5") {
+		t.Fatalf("Expected refused connection error, got %v", err)
+	}
+	if len(connects) != 1 {
+		t.Errorf("Expected a refused connection not to be retried, got %d attempts", len(connects))
+	}
+}
+
+func TestNewMQTTInvalidBroker(t *testing.T) {
+	if _, err := NewMQTT("http://broker", "backup", "", "", "", time.Second, 0); err == nil {
+		t.Error("Expected error for a broker URL that isn't mqtt:// or mqtts://")
+	}
+}
@@ -0,0 +1,73 @@
+// Package notify delivers backup results to external notification services.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Results of the restic upload step of a backup run.
+const (
+	ResticSuccess = "success"
+	ResticFailure = "failure"
+	ResticSkipped = "skipped" // the run failed before the upload started
+)
+
+// Result describes the outcome of a backup run of a target, or of the failed runs
+// of several targets merged by Aggregate, in which case Targets is set instead of Target.
+// Output holds the error output of the btrfs or restic commands that failed.
+// FilesProcessed, DataAdded and DedupRatio describe the restic upload, see restic.Summary,
+// and are zero if it didn't complete. Reminders, such as a repository password due for
+// rotation, are reported with successful runs as well.
+type Result struct {
+	Target     string    `json:"target,omitempty"`
+	Targets    []string  `json:"targets,omitempty"`
+	Host       string    `json:"host"`
+	RunID      string    `json:"run_id,omitempty"`
+	Success    bool      `json:"success"`
+	Started    time.Time `json:"started"`
+	Duration   float64   `json:"duration_seconds"`
+	Repository string    `json:"repository"`
+	Snapshot   string    `json:"snapshot,omitempty"`
+	Restic     string    `json:"restic_result"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output,omitempty"`
+	Reminders  []string  `json:"reminders,omitempty"`
+
+	FilesProcessed int     `json:"files_processed,omitempty"`
+	DataAdded      int64   `json:"data_added,omitempty"`
+	DedupRatio     float64 `json:"dedup_ratio,omitempty"`
+}
+
+// describeUpload summarizes the restic upload of a result, e.g. "1200 files, 5242880 bytes
+// added, 97% deduplicated", or returns an empty string without one.
+func describeUpload(result Result) string {
+	if result.FilesProcessed == 0 && result.DataAdded == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d files, %d bytes added, %.0f%% deduplicated",
+		result.FilesProcessed, result.DataAdded, result.DedupRatio*100)
+}
+
+// Notifier sends the result of a backup run to a notification service. Retries of
+// failed deliveries stop once ctx is done.
+type Notifier interface {
+	Notify(ctx context.Context, result Result) error
+}
+
+// NotifyAll sends the result to every notifier, even if some of them fail.
+// Returns the combined errors of all failed notifiers.
+func NotifyAll(ctx context.Context, notifiers []Notifier, result Result) error {
+	var errs []error
+	for _, n := range notifiers {
+		if err := n.Notify(ctx, result); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to send notifications: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// sender posts requests with a timeout and retries transient failures.
+type sender struct {
+	client  *http.Client
+	retries int
+	backoff time.Duration
+}
+
+func newSender(timeout time.Duration, retries int) sender {
+	return sender{
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+		backoff: time.Second,
+	}
+}
+
+// post sends body to url. Network errors, 429 and 5xx responses are retried with
+// exponential backoff until ctx is done, other non-2xx responses fail immediately.
+func (s sender) post(ctx context.Context, url, contentType string, body []byte) error {
+	delay := s.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.postOnce(ctx, url, contentType, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= s.retries {
+			return err
+		}
+		if sleep(ctx, delay) != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// postOnce sends a single request and reports whether a failure is worth retrying.
+func (s sender) postOnce(ctx context.Context, url, contentType string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// sleep waits for delay before a retry. Returns the error of ctx if it is done first.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Webhook posts backup results as JSON to a URL.
+type Webhook struct {
+	url    string
+	sender sender
+}
+
+// NewWebhook creates a webhook notifier. Every request is limited by timeout and failed
+// deliveries are retried up to retries times with exponential backoff.
+func NewWebhook(url string, timeout time.Duration, retries int) *Webhook {
+	return &Webhook{
+		url:    url,
+		sender: newSender(timeout, retries),
+	}
+}
+
+// Notify posts the result. Network errors, 429 and 5xx responses are retried,
+// other non-2xx responses fail immediately since repeating the request won't help.
+func (w *Webhook) Notify(ctx context.Context, result Result) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	if err = w.sender.post(ctx, w.url, "application/json", body); err != nil {
+		return fmt.Errorf("webhook %s failed: %w", w.url, err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestWebhook(url string, retries int) *Webhook {
+	w := NewWebhook(url, time.Second, retries)
+	w.sender.backoff = time.Millisecond
+	return w
+}
+
+func TestWebhookNotify(t *testing.T) {
+	var received Result
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Invalid payload: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	result := Result{
+		Target:     "home",
+		Success:    false,
+		Duration:   12.5,
+		Repository: "b2-home",
+		Snapshot:   "/snapshots/home-20230101-120000",
+		Restic:     ResticFailure,
+		Error:      "restic backup command failed: exit status 1",
+	}
+	if err := newTestWebhook(server.URL, 0).Notify(context.Background(), result); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	if received.Target != "home" || received.Restic != ResticFailure || received.Error != result.Error || received.Snapshot != result.Snapshot {
+		t.Errorf("Unexpected payload: %+v", received)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		retries       int
+		expectError   bool
+		errorContains string
+		expectedCalls int32
+	}{
+		{
+			name:          "recovers_after_server_errors",
+			statuses:      []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK},
+			retries:       3,
+			expectedCalls: 3,
+		},
+		{
+			name:          "gives_up_after_retries",
+			statuses:      []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			retries:       2,
+			expectError:   true,
+			errorContains: "503 Service Unavailable",
+			expectedCalls: 3,
+		},
+		{
+			name:          "client_error_not_retried",
+			statuses:      []int{http.StatusNotFound, http.StatusOK},
+			retries:       3,
+			expectError:   true,
+			errorContains: "404 Not Found",
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer server.Close()
+
+			err := newTestWebhook(server.URL, tt.retries).Notify(context.Background(), Result{Target: "home"})
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				} else if !strings.Contains(err.Error(), tt.errorContains) {
+					t.Errorf("Expected error containing '%s', got '%s'", tt.errorContains, err.Error())
+				}
+			} else if err != nil {
+				t.Errorf("Expected no error but got: %v", err)
+			}
+
+			if got := calls.Load(); got != tt.expectedCalls {
+				t.Errorf("Expected %d requests, got %d", tt.expectedCalls, got)
+			}
+		})
+	}
+}
+
+func TestWebhookRetryCancelled(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	w := NewWebhook(server.URL, time.Second, 3)
+	w.sender.backoff = time.Hour
+	err := w.Notify(ctx, Result{Target: "home"})
+	if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable") {
+		t.Errorf("Expected the last failure, got %v", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Expected no retries once the context is done, got %d requests", got)
+	}
+}
+
+type failingNotifier struct{ err error }
+
+func (f failingNotifier) Notify(context.Context, Result) error { return f.err }
+
+func TestNotifyAll(t *testing.T) {
+	var delivered int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered++
+	}))
+	defer server.Close()
+
+	notifiers := []Notifier{
+		failingNotifier{errors.New("first broken")},
+		newTestWebhook(server.URL, 0),
+		failingNotifier{errors.New("second broken")},
+	}
+
+	err := NotifyAll(context.Background(), notifiers, Result{Target: "home"})
+	if err == nil || !strings.Contains(err.Error(), "first broken") || !strings.Contains(err.Error(), "second broken") {
+		t.Errorf("Expected combined error, got %v", err)
+	}
+	if delivered != 1 {
+		t.Errorf("Expected remaining notifiers to be called, got %d deliveries", delivered)
+	}
+}
@@ -2,13 +2,107 @@
 package restic
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"btrfs-backup/internal/command"
 )
 
 // Client interface abstracts Restic operations for dependency injection and testing.
 type Client interface {
-	Backup(repositoryEnv []string, snapshotPath string, tags []string, excludeCaches bool, force bool) error
-	Check(repositoryEnv []string, readDataSubset string) error
+	Backup(ctx context.Context, repositoryEnv []string, snapshotPath string, options BackupOptions) (*Summary, error)
+	BackupStdin(ctx context.Context, repositoryEnv []string, r io.Reader, filename string, options BackupOptions) (*Summary, error)
+	Check(ctx context.Context, repositoryEnv []string, readDataSubset string) error
+	Restore(ctx context.Context, repositoryEnv []string, snapshotID, path, targetDir string) error
+	Dump(ctx context.Context, repositoryEnv []string, snapshotID, path string, w io.Writer) error
+	Snapshots(ctx context.Context, repositoryEnv []string, tags []string, noLock bool) ([]Snapshot, error)
+	Forget(ctx context.Context, repositoryEnv []string, tags []string, policy ForgetPolicy, prune bool) error
+	Prune(ctx context.Context, repositoryEnv []string, maxUnused string) error
+	Tag(ctx context.Context, repositoryEnv []string, snapshotID string, add, remove []string) error
+	Init(ctx context.Context, repositoryEnv []string) error
+}
+
+// ErrRepositoryExists is returned by Init when the repository is already initialized.
+var ErrRepositoryExists = errors.New("repository already initialized")
+
+// ForgetPolicy holds the --keep-* rules passed to 'restic forget'.
+// Rules with a zero value are omitted.
+type ForgetPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepTags    []string // snapshots with any of these tags are kept
+}
+
+// BackupOptions holds the options of a 'restic backup' command.
+type BackupOptions struct {
+	Tags          []string
+	ExcludeCaches bool
+	Force         bool           // re-read all files instead of relying on the parent snapshot
+	Excludes      []string       // --exclude patterns
+	ExcludeFiles  []string       // --exclude-file pattern files
+	Limit         BandwidthLimit // transfer rate limits
+	Progress      func(Status)   // called with each status message while the backup runs, if set
+}
+
+// BandwidthLimit holds the --limit-upload and --limit-download rates in KiB/s.
+// A zero value means unlimited.
+type BandwidthLimit struct {
+	Upload   int
+	Download int
+}
+
+// Snapshot is a restic snapshot as reported by 'restic snapshots --json'.
+type Snapshot struct {
+	ID       string    `json:"id"`
+	ShortID  string    `json:"short_id"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Paths    []string  `json:"paths"`
+	Tags     []string  `json:"tags"`
+}
+
+// Summary is the summary of a backup as reported by 'restic backup --json'.
+type Summary struct {
+	SnapshotID          string  `json:"snapshot_id"`
+	FilesNew            int     `json:"files_new"`
+	FilesChanged        int     `json:"files_changed"`
+	FilesUnmodified     int     `json:"files_unmodified"`
+	DataAdded           int64   `json:"data_added"`
+	TotalFilesProcessed int     `json:"total_files_processed"`
+	TotalBytesProcessed int64   `json:"total_bytes_processed"`
+	TotalDuration       float64 `json:"total_duration"` // seconds
+}
+
+// DedupRatio returns the share of the bytes processed that restic didn't need to add to
+// the repository because the data was already stored, from 0 to 1. Returns 0 if nothing
+// was processed.
+func (s *Summary) DedupRatio() float64 {
+	if s.TotalBytesProcessed <= 0 {
+		return 0
+	}
+	return max(0, 1-float64(s.DataAdded)/float64(s.TotalBytesProcessed))
+}
+
+// Status is the progress of a running backup as reported by 'restic backup --json'.
+type Status struct {
+	SecondsElapsed   int64   `json:"seconds_elapsed"`
+	SecondsRemaining int64   `json:"seconds_remaining"`
+	PercentDone      float64 `json:"percent_done"` // from 0 to 1
+	TotalFiles       int     `json:"total_files"`
+	FilesDone        int     `json:"files_done"`
+	TotalBytes       int64   `json:"total_bytes"`
+	BytesDone        int64   `json:"bytes_done"`
 }
 
 // DefaultClient is the production implementation of the Client interface
@@ -22,34 +116,442 @@ func NewDefaultClient(resticBin string) *DefaultClient {
 	return &DefaultClient{resticBin: resticBin}
 }
 
+// IsOption reports whether the key of a repository variable names an extended option of
+// restic, like rclone.args or s3.storage-class, rather than an environment variable.
+// Options are lower case and contain a dot.
+func IsOption(key string) bool {
+	return strings.Contains(key, ".") && key == strings.ToLower(key)
+}
+
+// ExtraArgsKey is the key of repository environment pairs holding one argument each that
+// is appended to the restic backup, check, forget and prune commands, for flags of restic
+// that aren't wrapped. The pairs are never exported as environment variables.
+const ExtraArgsKey = "restic_extra_args"
+
+// ExtraArgs returns the arguments of the ExtraArgsKey pairs of a repository environment,
+// in order.
+func ExtraArgs(repositoryEnv []string) []string {
+	var args []string
+	for _, kv := range repositoryEnv {
+		if arg, ok := strings.CutPrefix(kv, ExtraArgsKey+"="); ok {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// SplitOptions separates the KEY=VALUE pairs of a repository environment whose key is
+// an option, see IsOption, from the environment variables. The options are returned as
+// '-o key=value' arguments of restic. ExtraArgsKey pairs are dropped.
+func SplitOptions(repositoryEnv []string) (env, optionArgs []string) {
+	for _, kv := range repositoryEnv {
+		key, _, _ := strings.Cut(kv, "=")
+		switch {
+		case IsOption(key):
+			optionArgs = append(optionArgs, "-o", kv)
+		case key != ExtraArgsKey:
+			env = append(env, kv)
+		}
+	}
+	return env, optionArgs
+}
+
+// command returns the restic command running args in the repository configured in
+// repositoryEnv, with its options passed as arguments, see SplitOptions.
+func (c *DefaultClient) command(ctx context.Context, repositoryEnv []string, args ...string) *exec.Cmd {
+	env, optionArgs := SplitOptions(repositoryEnv)
+	cmd := command.Command(ctx, c.resticBin, slices.Concat(args, optionArgs)...)
+	cmd.Env = env
+	return cmd
+}
+
 // Backup creates a backup of the specified snapshot path to a Restic repository.
-// It runs the restic backup command with the provided environment variables, tags, and options.
-func (c *DefaultClient) Backup(repositoryEnv []string, snapshotPath string, tags []string, excludeCaches bool, force bool) error {
-	args := []string{"backup", snapshotPath}
-	for _, tag := range tags {
+// It runs the restic backup command with the provided environment variables and options,
+// and returns the summary restic reports.
+func (c *DefaultClient) Backup(ctx context.Context, repositoryEnv []string, snapshotPath string, options BackupOptions) (*Summary, error) {
+	args := slices.Concat(buildBackupArgs(snapshotPath, options), ExtraArgs(repositoryEnv), []string{"--json"})
+	cmd := c.command(ctx, repositoryEnv, args...)
+	output := &backupOutput{progress: options.Progress}
+	cmd.Stdout = output
+
+	if err := command.Run(cmd); err != nil {
+		return nil, err
+	}
+	return parseBackupSummary(output.Summary())
+}
+
+// BackupStdin backs up the data read from r to a Restic repository as a single file
+// named filename. It runs 'restic backup --stdin' and returns the summary restic reports.
+func (c *DefaultClient) BackupStdin(ctx context.Context, repositoryEnv []string, r io.Reader, filename string, options BackupOptions) (*Summary, error) {
+	args := slices.Concat(buildStdinBackupArgs(filename, options), ExtraArgs(repositoryEnv), []string{"--json"})
+	cmd := c.command(ctx, repositoryEnv, args...)
+	cmd.Stdin = &abortingReader{r: r, cmd: cmd}
+	output := &backupOutput{progress: options.Progress}
+	cmd.Stdout = output
+
+	if err := command.Run(cmd); err != nil {
+		return nil, err
+	}
+	return parseBackupSummary(output.Summary())
+}
+
+// backupOutput is the standard output of 'restic backup --json'. It passes the status
+// messages to progress as they arrive and keeps only the summary message, as a long
+// backup prints many status messages.
+type backupOutput struct {
+	progress func(Status)
+	partial  []byte // incomplete last line
+	summary  []byte
+}
+
+func (o *backupOutput) Write(p []byte) (int, error) {
+	o.partial = append(o.partial, p...)
+	for {
+		line, rest, found := bytes.Cut(o.partial, []byte("\n"))
+		if !found {
+			break
+		}
+		o.message(line)
+		o.partial = rest
+	}
+	return len(p), nil
+}
+
+// Summary returns the summary message written, if any.
+func (o *backupOutput) Summary() []byte {
+	if len(o.partial) > 0 {
+		o.message(o.partial)
+		o.partial = nil
+	}
+	return o.summary
+}
+
+func (o *backupOutput) message(line []byte) {
+	var message struct {
+		MessageType string `json:"message_type"`
+	}
+	if json.Unmarshal(line, &message) != nil {
+		return
+	}
+	switch message.MessageType {
+	case "status":
+		var status Status
+		if o.progress != nil && json.Unmarshal(line, &status) == nil {
+			o.progress(status)
+		}
+	case "summary":
+		o.summary = bytes.Clone(line)
+	}
+}
+
+// abortingReader kills the restic process when reading its input fails. Otherwise restic
+// would see the end of its standard input and store the truncated data as a snapshot.
+type abortingReader struct {
+	r   io.Reader
+	cmd *exec.Cmd
+}
+
+func (a *abortingReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err != nil && err != io.EOF && a.cmd.Process != nil {
+		_ = a.cmd.Process.Kill()
+	}
+	return n, err
+}
+
+func buildBackupArgs(snapshotPath string, options BackupOptions) []string {
+	return append([]string{"backup", snapshotPath}, buildBackupOptionArgs(options)...)
+}
+
+func buildStdinBackupArgs(filename string, options BackupOptions) []string {
+	return append([]string{"backup", "--stdin", "--stdin-filename", filename}, buildBackupOptionArgs(options)...)
+}
+
+func buildBackupOptionArgs(options BackupOptions) []string {
+	var args []string
+	for _, tag := range options.Tags {
 		args = append(args, "--tag", tag)
 	}
-	if excludeCaches {
+	if options.ExcludeCaches {
 		args = append(args, "--exclude-caches")
 	}
-	if force {
+	for _, pattern := range options.Excludes {
+		args = append(args, "--exclude", pattern)
+	}
+	for _, file := range options.ExcludeFiles {
+		args = append(args, "--exclude-file", file)
+	}
+	if options.Force {
 		args = append(args, "--force")
 	}
-
-	cmd := exec.Command(c.resticBin, args...)
-	cmd.Env = repositoryEnv
-	return cmd.Run()
+	if options.Limit.Upload > 0 {
+		args = append(args, "--limit-upload", strconv.Itoa(options.Limit.Upload))
+	}
+	if options.Limit.Download > 0 {
+		args = append(args, "--limit-download", strconv.Itoa(options.Limit.Download))
+	}
+	return args
 }
 
+// ReadAllData is the read data subset making Check read all data of the repository.
+const ReadAllData = "full"
+
 // Check verifies the integrity of a Restic repository.
-// It runs 'restic check' with optional data subset verification.
-func (c *DefaultClient) Check(repositoryEnv []string, readDataSubset string) error {
+// It runs 'restic check' with optional data subset verification: readDataSubset is
+// passed to --read-data-subset, or ReadAllData runs 'restic check --read-data'.
+func (c *DefaultClient) Check(ctx context.Context, repositoryEnv []string, readDataSubset string) error {
+	cmd := c.command(ctx, repositoryEnv, slices.Concat(buildCheckArgs(readDataSubset), ExtraArgs(repositoryEnv))...)
+	return command.Run(cmd)
+}
+
+func buildCheckArgs(readDataSubset string) []string {
 	args := []string{"check"}
+	if readDataSubset == ReadAllData {
+		return append(args, "--read-data")
+	}
 	if readDataSubset != "" {
 		args = append(args, "--read-data-subset="+readDataSubset)
 	}
+	return args
+}
+
+// Restore restores the directory path of a restic snapshot, rather than the whole
+// snapshot, so the contents of path end up directly in targetDir.
+// It runs 'restic restore <snapshotID>:<path> --target <targetDir>'.
+func (c *DefaultClient) Restore(ctx context.Context, repositoryEnv []string, snapshotID, path, targetDir string) error {
+	cmd := c.command(ctx, repositoryEnv, buildRestoreArgs(snapshotID, path, targetDir)...)
+	return command.Run(cmd)
+}
+
+func buildRestoreArgs(snapshotID, path, targetDir string) []string {
+	return []string{"restore", snapshotID + ":" + path, "--target", targetDir}
+}
+
+// Dump writes path of a restic snapshot to w as a tar archive, reading, decrypting and
+// checking every blob of the files below path on the way.
+// It runs 'restic dump --archive tar <snapshotID> <path>'.
+func (c *DefaultClient) Dump(ctx context.Context, repositoryEnv []string, snapshotID, path string, w io.Writer) error {
+	cmd := c.command(ctx, repositoryEnv, buildDumpArgs(snapshotID, path)...)
+	cmd.Stdout = w
+	return command.Run(cmd)
+}
+
+func buildDumpArgs(snapshotID, path string) []string {
+	return []string{"dump", "--archive", "tar", snapshotID, path}
+}
+
+// Snapshots lists the snapshots in a Restic repository that carry all of the given tags.
+// It runs 'restic snapshots --json [--tag <tag,...>]' and decodes its output.
+func (c *DefaultClient) Snapshots(ctx context.Context, repositoryEnv []string, tags []string, noLock bool) ([]Snapshot, error) {
+	cmd := c.command(ctx, repositoryEnv, buildSnapshotsArgs(tags, noLock)...)
+	output, err := command.Output(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSnapshots(output)
+}
+
+// buildSnapshotsArgs builds the 'restic snapshots' arguments. With noLock the repository
+// is read without taking a lock, so listing doesn't wait for or block a running backup.
+func buildSnapshotsArgs(tags []string, noLock bool) []string {
+	args := []string{"snapshots", "--json"}
+	if len(tags) > 0 {
+		args = append(args, "--tag", strings.Join(tags, ","))
+	}
+	if noLock {
+		args = append(args, "--no-lock")
+	}
+	return args
+}
+
+// Forget removes snapshots carrying all of the given tags that are not retained by the policy.
+// Snapshots are grouped by host only, because every snapshot of a target has its own path
+// and snapshot-name tag, which would otherwise place each one in a group of its own.
+// If prune is true, unreferenced data is removed from the repository as well.
+func (c *DefaultClient) Forget(ctx context.Context, repositoryEnv []string, tags []string, policy ForgetPolicy, prune bool) error {
+	cmd := c.command(ctx, repositoryEnv, slices.Concat(buildForgetArgs(tags, policy, prune), ExtraArgs(repositoryEnv))...)
+	return command.Run(cmd)
+}
+
+// Prune removes the data of forgotten snapshots from the repository. It runs
+// 'restic prune', with '--max-unused <maxUnused>' if set, e.g. "5%", to tolerate that much
+// unused space instead of repacking more of the repository.
+func (c *DefaultClient) Prune(ctx context.Context, repositoryEnv []string, maxUnused string) error {
+	cmd := c.command(ctx, repositoryEnv, slices.Concat(buildPruneArgs(maxUnused), ExtraArgs(repositoryEnv))...)
+	return command.Run(cmd)
+}
+
+func buildPruneArgs(maxUnused string) []string {
+	args := []string{"prune"}
+	if maxUnused != "" {
+		args = append(args, "--max-unused", maxUnused)
+	}
+	return args
+}
+
+// Tag adds and removes tags of a snapshot. It runs
+// 'restic tag --add <tag> ... --remove <tag> ... <snapshotID>'.
+func (c *DefaultClient) Tag(ctx context.Context, repositoryEnv []string, snapshotID string, add, remove []string) error {
+	cmd := c.command(ctx, repositoryEnv, buildTagArgs(snapshotID, add, remove)...)
+	return command.Run(cmd)
+}
+
+func buildTagArgs(snapshotID string, add, remove []string) []string {
+	args := []string{"tag"}
+	for _, tag := range add {
+		args = append(args, "--add", tag)
+	}
+	for _, tag := range remove {
+		args = append(args, "--remove", tag)
+	}
+	return append(args, snapshotID)
+}
+
+// Init creates a new Restic repository at the location configured in the environment.
+// It runs 'restic init' and returns ErrRepositoryExists if a repository is already present.
+func (c *DefaultClient) Init(ctx context.Context, repositoryEnv []string) error {
+	cmd := c.command(ctx, repositoryEnv, "init")
+
+	err := command.Run(cmd)
+	if err != nil && isRepositoryExistsOutput(command.Stderr(err)) {
+		return ErrRepositoryExists
+	}
+	return err
+}
 
-	cmd := exec.Command(c.resticBin, args...)
-	cmd.Env = repositoryEnv
-	return cmd.Run()
+// isRepositoryExistsOutput reports whether restic's error output says the repository exists.
+func isRepositoryExistsOutput(output string) bool {
+	return strings.Contains(output, "config file already exists") ||
+		strings.Contains(output, "repository master key and config already initialized")
+}
+
+// Exit codes of restic that say the repository can't be used as configured.
+const (
+	exitRepositoryMissing = 10
+	exitRepositoryLocked  = 11
+	exitWrongPassword     = 12
+)
+
+// permanentErrors are restic error messages that won't go away by retrying.
+var permanentErrors = []string{
+	"wrong password",
+	"no key found",
+	"repository does not exist",
+	"Is there a repository at the following location?",
+}
+
+// transientErrors are restic error messages caused by network or backend hiccups
+// or by a concurrent operation holding the repository lock. Timeouts are matched by the
+// messages of the network layer only, as other timeouts aren't cured by retrying.
+var transientErrors = []string{
+	"connection reset",
+	"connection refused",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"Client.Timeout exceeded",
+	"no such host",
+	"network is unreachable",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+	"temporary failure",
+	"context deadline exceeded",
+	"already locked",
+	"unable to create lock",
+}
+
+// IsTransient reports whether a failed restic command is worth retrying. The decision is
+// based on restic's exit code and error output; failures that can't be classified, as well
+// as permanent ones such as a wrong password or a missing repository, are not retried.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case exitRepositoryMissing, exitWrongPassword:
+			return false
+		case exitRepositoryLocked:
+			return true
+		}
+	}
+
+	output := strings.ToLower(command.Stderr(err))
+	for _, msg := range permanentErrors {
+		if strings.Contains(output, strings.ToLower(msg)) {
+			return false
+		}
+	}
+	for _, msg := range transientErrors {
+		if strings.Contains(output, strings.ToLower(msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+func buildForgetArgs(tags []string, policy ForgetPolicy, prune bool) []string {
+	args := []string{"forget", "--group-by", "host"}
+	if len(tags) > 0 {
+		args = append(args, "--tag", strings.Join(tags, ","))
+	}
+
+	rules := []struct {
+		flag  string
+		value int
+	}{
+		{"--keep-last", policy.KeepLast},
+		{"--keep-daily", policy.KeepDaily},
+		{"--keep-weekly", policy.KeepWeekly},
+		{"--keep-monthly", policy.KeepMonthly},
+	}
+	for _, rule := range rules {
+		if rule.value > 0 {
+			args = append(args, rule.flag, strconv.Itoa(rule.value))
+		}
+	}
+	// One flag per tag: restic keeps snapshots matching any --keep-tag, while the tags of
+	// a single comma-separated flag would all have to be present
+	for _, tag := range policy.KeepTags {
+		args = append(args, "--keep-tag", tag)
+	}
+
+	if prune {
+		args = append(args, "--prune")
+	}
+	return args
+}
+
+// parseBackupSummary extracts the summary message from the JSON lines that
+// 'restic backup --json' prints, ignoring the status messages before it.
+func parseBackupSummary(data []byte) (*Summary, error) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var message struct {
+			MessageType string `json:"message_type"`
+		}
+		if json.Unmarshal(line, &message) != nil || message.MessageType != "summary" {
+			continue
+		}
+
+		var summary Summary
+		if err := json.Unmarshal(line, &summary); err != nil {
+			return nil, fmt.Errorf("failed to decode restic backup summary: %w", err)
+		}
+		return &summary, nil
+	}
+	return nil, fmt.Errorf("restic backup output contains no summary")
+}
+
+func parseSnapshots(data []byte) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to decode restic snapshots output: %w", err)
+	}
+	if snapshots == nil {
+		snapshots = []Snapshot{}
+	}
+	return snapshots, nil
 }
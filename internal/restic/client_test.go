@@ -1,7 +1,19 @@
 package restic
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+
+	"btrfs-backup/internal/command"
 )
 
 func TestNewDefaultClient(t *testing.T) {
@@ -23,3 +35,502 @@ func TestNewDefaultClient(t *testing.T) {
 func TestDefaultClientImplementsInterface(t *testing.T) {
 	var _ Client = (*DefaultClient)(nil)
 }
+
+func TestParseSnapshots(t *testing.T) {
+	data := []byte(`[
+  {
+    "time": "2023-01-02T12:00:00.123456789+01:00",
+    "tree": "abc",
+    "paths": ["/snapshots/home-20230102-120000"],
+    "hostname": "nas",
+    "username": "root",
+    "tags": ["btrfs-backup", "home", "home-20230102-120000"],
+    "id": "0123456789abcdef",
+    "short_id": "01234567"
+  }
+]`)
+
+	snapshots, err := parseSnapshots(data)
+	if err != nil {
+		t.Fatalf("parseSnapshots failed: %v", err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("Expected 1 snapshot, got %d", len(snapshots))
+	}
+
+	s := snapshots[0]
+	if s.ID != "0123456789abcdef" || s.ShortID != "01234567" {
+		t.Errorf("Unexpected snapshot IDs: %s / %s", s.ID, s.ShortID)
+	}
+	if s.Hostname != "nas" {
+		t.Errorf("Expected hostname 'nas', got '%s'", s.Hostname)
+	}
+	if len(s.Tags) != 3 || s.Tags[2] != "home-20230102-120000" {
+		t.Errorf("Unexpected tags: %v", s.Tags)
+	}
+	if len(s.Paths) != 1 || s.Paths[0] != "/snapshots/home-20230102-120000" {
+		t.Errorf("Unexpected paths: %v", s.Paths)
+	}
+	if s.Time.UTC().Hour() != 11 {
+		t.Errorf("Expected time to be parsed with zone, got %v", s.Time)
+	}
+
+	// An empty or "null" listing yields an empty slice
+	snapshots, err = parseSnapshots([]byte("null"))
+	if err != nil {
+		t.Fatalf("parseSnapshots failed for null output: %v", err)
+	}
+	if snapshots == nil || len(snapshots) != 0 {
+		t.Errorf("Expected empty non-nil slice, got %v", snapshots)
+	}
+
+	_, err = parseSnapshots([]byte("not json"))
+	if err == nil {
+		t.Error("parseSnapshots should fail for invalid JSON")
+	}
+}
+
+func TestParseBackupSummary(t *testing.T) {
+	output := `{"message_type":"status","percent_done":0.5,"total_files":10}
+{"message_type":"summary","files_new":2,"files_changed":1,"files_unmodified":7,"data_added":2048,"total_files_processed":10,"total_bytes_processed":1048576,"total_duration":12.5,"snapshot_id":"4a3c2e1f"}
+`
+	summary, err := parseBackupSummary([]byte(output))
+	if err != nil {
+		t.Fatalf("parseBackupSummary failed: %v", err)
+	}
+	expected := Summary{
+		SnapshotID:          "4a3c2e1f",
+		FilesNew:            2,
+		FilesChanged:        1,
+		FilesUnmodified:     7,
+		DataAdded:           2048,
+		TotalFilesProcessed: 10,
+		TotalBytesProcessed: 1048576,
+		TotalDuration:       12.5,
+	}
+	if *summary != expected {
+		t.Errorf("Expected summary %+v, got %+v", expected, *summary)
+	}
+
+	_, err = parseBackupSummary([]byte(`{"message_type":"status","percent_done":1}`))
+	if err == nil {
+		t.Error("parseBackupSummary should fail without a summary message")
+	}
+}
+
+func TestBackupOutput(t *testing.T) {
+	var statuses []Status
+	output := &backupOutput{progress: func(status Status) { statuses = append(statuses, status) }}
+	// Messages split across writes, the last one without a trailing newline
+	for _, chunk := range []string{
+		`{"message_type":"status","percent_done":0.25,"files_done":1,"tot`,
+		`al_files":4,"bytes_done":256,"total_bytes":1024}` + "\n" + `{"message_type":"status","percent_done":0.5}` + "\n",
+		"not json\n",
+		`{"message_type":"summary","total_files_processed":4,"total_bytes_processed":1024,"data_added":256}`,
+	} {
+		if n, err := output.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("Write returned %d, %v", n, err)
+		}
+	}
+
+	expected := []Status{{PercentDone: 0.25, FilesDone: 1, TotalFiles: 4, BytesDone: 256, TotalBytes: 1024}, {PercentDone: 0.5}}
+	if !slices.Equal(statuses, expected) {
+		t.Errorf("Expected statuses %+v, got %+v", expected, statuses)
+	}
+	summary, err := parseBackupSummary(output.Summary())
+	if err != nil {
+		t.Fatalf("parseBackupSummary failed: %v", err)
+	}
+	if summary.TotalFilesProcessed != 4 || summary.DedupRatio() != 0.75 {
+		t.Errorf("Expected 4 files with a dedup ratio of 0.75, got %+v", *summary)
+	}
+}
+
+func TestDedupRatio(t *testing.T) {
+	tests := []struct {
+		summary  Summary
+		expected float64
+	}{
+		{Summary{DataAdded: 0, TotalBytesProcessed: 1000}, 1},
+		{Summary{DataAdded: 1000, TotalBytesProcessed: 1000}, 0},
+		{Summary{DataAdded: 100, TotalBytesProcessed: 400}, 0.75},
+		{Summary{DataAdded: 0, TotalBytesProcessed: 0}, 0},
+		{Summary{DataAdded: 2000, TotalBytesProcessed: 1000}, 0}, // metadata of tiny backups
+	}
+	for _, tt := range tests {
+		if ratio := tt.summary.DedupRatio(); ratio != tt.expected {
+			t.Errorf("Expected dedup ratio %v for %+v, got %v", tt.expected, tt.summary, ratio)
+		}
+	}
+}
+
+func TestBuildForgetArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     []string
+		policy   ForgetPolicy
+		prune    bool
+		expected []string
+	}{
+		{
+			name:   "full_policy_with_prune",
+			tags:   []string{"btrfs-backup", "home"},
+			policy: ForgetPolicy{KeepLast: 2, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 12},
+			prune:  true,
+			expected: []string{"forget", "--group-by", "host", "--tag", "btrfs-backup,home",
+				"--keep-last", "2", "--keep-daily", "7", "--keep-weekly", "4", "--keep-monthly", "12", "--prune"},
+		},
+		{
+			name:   "keep_tags",
+			tags:   []string{"btrfs-backup", "home"},
+			policy: ForgetPolicy{KeepDaily: 7, KeepTags: []string{"pre-migration", "legal-hold"}},
+			expected: []string{"forget", "--group-by", "host", "--tag", "btrfs-backup,home", "--keep-daily", "7",
+				"--keep-tag", "pre-migration", "--keep-tag", "legal-hold"},
+		},
+		{
+			name:     "zero_rules_omitted",
+			tags:     []string{"btrfs-backup", "home"},
+			policy:   ForgetPolicy{KeepDaily: 7},
+			prune:    false,
+			expected: []string{"forget", "--group-by", "host", "--tag", "btrfs-backup,home", "--keep-daily", "7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := buildForgetArgs(tt.tags, tt.policy, tt.prune)
+			if !slices.Equal(args, tt.expected) {
+				t.Errorf("Expected args %v, got %v", tt.expected, args)
+			}
+		})
+	}
+}
+
+func TestBuildCheckArgs(t *testing.T) {
+	tests := []struct {
+		subset   string
+		expected []string
+	}{
+		{subset: "", expected: []string{"check"}},
+		{subset: "10%", expected: []string{"check", "--read-data-subset=10%"}},
+		{subset: "2G", expected: []string{"check", "--read-data-subset=2G"}},
+		{subset: ReadAllData, expected: []string{"check", "--read-data"}},
+	}
+
+	for _, tt := range tests {
+		args := buildCheckArgs(tt.subset)
+		if !slices.Equal(args, tt.expected) {
+			t.Errorf("Expected args %v for subset '%s', got %v", tt.expected, tt.subset, args)
+		}
+	}
+}
+
+func TestBuildTagArgs(t *testing.T) {
+	args := buildTagArgs("4f3a2b1c", []string{"docs", "docs-20230101-120000"}, []string{"home", "home-20230101-120000"})
+	expected := []string{"tag", "--add", "docs", "--add", "docs-20230101-120000",
+		"--remove", "home", "--remove", "home-20230101-120000", "4f3a2b1c"}
+	if !slices.Equal(args, expected) {
+		t.Errorf("Expected args %v, got %v", expected, args)
+	}
+}
+
+func TestBuildBackupArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  BackupOptions
+		expected []string
+	}{
+		{
+			name:     "defaults",
+			options:  BackupOptions{Tags: []string{"home"}, ExcludeCaches: true},
+			expected: []string{"backup", "/snapshots/home", "--tag", "home", "--exclude-caches"},
+		},
+		{
+			name: "excludes",
+			options: BackupOptions{
+				Excludes:     []string{"node_modules", "*.qcow2"},
+				ExcludeFiles: []string{"/etc/btrfs-backup/home.exclude"},
+			},
+			expected: []string{"backup", "/snapshots/home", "--exclude", "node_modules", "--exclude", "*.qcow2",
+				"--exclude-file", "/etc/btrfs-backup/home.exclude"},
+		},
+		{
+			name:    "full_with_limits",
+			options: BackupOptions{Tags: []string{"home"}, ExcludeCaches: true, Force: true, Limit: BandwidthLimit{Upload: 1024, Download: 4096}},
+			expected: []string{"backup", "/snapshots/home", "--tag", "home", "--exclude-caches", "--force",
+				"--limit-upload", "1024", "--limit-download", "4096"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := buildBackupArgs("/snapshots/home", tt.options)
+			if !slices.Equal(args, tt.expected) {
+				t.Errorf("Expected args %v, got %v", tt.expected, args)
+			}
+		})
+	}
+}
+
+func TestBuildPruneArgs(t *testing.T) {
+	if args := buildPruneArgs(""); !slices.Equal(args, []string{"prune"}) {
+		t.Errorf("Unexpected args %v", args)
+	}
+	if args := buildPruneArgs("5%"); !slices.Equal(args, []string{"prune", "--max-unused", "5%"}) {
+		t.Errorf("Unexpected args %v", args)
+	}
+}
+
+func TestBuildSnapshotsArgs(t *testing.T) {
+	args := buildSnapshotsArgs([]string{"btrfs-backup", "home"}, true)
+	expected := []string{"snapshots", "--json", "--tag", "btrfs-backup,home", "--no-lock"}
+	if !slices.Equal(args, expected) {
+		t.Errorf("Expected args %v, got %v", expected, args)
+	}
+
+	args = buildSnapshotsArgs(nil, false)
+	if !slices.Equal(args, []string{"snapshots", "--json"}) {
+		t.Errorf("Expected no tag or lock arguments, got %v", args)
+	}
+}
+
+func TestBuildRestoreArgs(t *testing.T) {
+	args := buildRestoreArgs("a1b2c3d4", "/snapshots/home-20230101-120000", "/tmp/restore")
+	expected := []string{"restore", "a1b2c3d4:/snapshots/home-20230101-120000", "--target", "/tmp/restore"}
+	if !slices.Equal(args, expected) {
+		t.Errorf("Expected args %v, got %v", expected, args)
+	}
+}
+
+func TestBuildDumpArgs(t *testing.T) {
+	args := buildDumpArgs("a1b2c3d4", "/")
+	expected := []string{"dump", "--archive", "tar", "a1b2c3d4", "/"}
+	if !slices.Equal(args, expected) {
+		t.Errorf("Expected args %v, got %v", expected, args)
+	}
+}
+
+func TestDefaultClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	resticBin := filepath.Join(dir, "restic")
+	script := "#!/bin/sh\nfor arg; do echo \"$arg\"; done > \"$0.args\"\necho \"$RESTIC_REPOSITORY\" > \"$0.env\"\nenv | grep -c '^rclone\\.\\|^restic_extra_args' > \"$0.leaked\"\nexit 0\n"
+	if err := os.WriteFile(resticBin, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake restic: %v", err)
+	}
+	client := NewDefaultClient(resticBin)
+
+	env := []string{"RESTIC_REPOSITORY=rclone:gdrive:backups", "rclone.args=serve restic --stdio --drive-use-trash=false",
+		ExtraArgsKey + "=--retry-lock", ExtraArgsKey + "=5m", "PATH=" + os.Getenv("PATH")}
+	if err := client.Check(context.Background(), env, ""); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	for file, expected := range map[string]string{
+		".args":   "check\n--retry-lock\n5m\n-o\nrclone.args=serve restic --stdio --drive-use-trash=false\n",
+		".env":    "rclone:gdrive:backups\n",
+		".leaked": "0\n",
+	} {
+		data, err := os.ReadFile(resticBin + file)
+		if err != nil || string(data) != expected {
+			t.Errorf("Expected %s to be %q, got %q (%v)", file, expected, data, err)
+		}
+	}
+}
+
+func TestIsOption(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"rclone.args":       true,
+		"s3.storage-class":  true,
+		"RESTIC_REPOSITORY": false,
+		"bucket":            false,
+		"My.Variable":       false,
+	} {
+		if IsOption(key) != expected {
+			t.Errorf("Expected IsOption(%s) to be %v", key, expected)
+		}
+	}
+}
+
+func TestSplitOptions(t *testing.T) {
+	env, optionArgs := SplitOptions([]string{
+		"RESTIC_REPOSITORY=sftp:backup@nas:/srv/restic",
+		"sftp.args=-J bastion -i /etc/btrfs-backup/id_ed25519",
+		ExtraArgsKey + "=--pack-size",
+		"RESTIC_PASSWORD=secret",
+	})
+	if expected := []string{"RESTIC_REPOSITORY=sftp:backup@nas:/srv/restic", "RESTIC_PASSWORD=secret"}; !slices.Equal(env, expected) {
+		t.Errorf("Expected environment %v, got %v", expected, env)
+	}
+	if expected := []string{"-o", "sftp.args=-J bastion -i /etc/btrfs-backup/id_ed25519"}; !slices.Equal(optionArgs, expected) {
+		t.Errorf("Expected option arguments %v, got %v", expected, optionArgs)
+	}
+}
+
+// fakeResticScript consumes its standard input and reports a backup summary like 'restic backup --json'.
+const fakeResticScript = `#!/bin/sh
+cat > /dev/null
+touch "$0.done"
+echo '{"message_type":"summary","total_files_processed":1,"total_bytes_processed":12}'
+`
+
+type failingReader struct{ sent bool }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, "partial data"), nil
+	}
+	return 0, errors.New("btrfs send died")
+}
+
+func TestDefaultClientBackupStdin(t *testing.T) {
+	resticBin := filepath.Join(t.TempDir(), "restic")
+	if err := os.WriteFile(resticBin, []byte(fakeResticScript), 0755); err != nil {
+		t.Fatalf("Failed to write fake restic: %v", err)
+	}
+	client := NewDefaultClient(resticBin)
+
+	// A failing input must not end in a snapshot of the data read so far
+	_, err := client.BackupStdin(context.Background(), nil, &failingReader{}, "home.btrfs", BackupOptions{})
+	if err == nil {
+		t.Error("Expected BackupStdin to fail when its input fails")
+	}
+	if _, statErr := os.Stat(resticBin + ".done"); !os.IsNotExist(statErr) {
+		t.Error("Expected restic to be stopped before it finished the backup")
+	}
+
+	summary, err := client.BackupStdin(context.Background(), nil, strings.NewReader("btrfs-stream"), "home.btrfs", BackupOptions{})
+	if err != nil {
+		t.Fatalf("BackupStdin failed: %v", err)
+	}
+	if summary.TotalBytesProcessed != 12 {
+		t.Errorf("Expected 12 bytes processed, got %d", summary.TotalBytesProcessed)
+	}
+}
+
+func TestBuildStdinBackupArgs(t *testing.T) {
+	args := buildStdinBackupArgs("home-20230101-120000.btrfs", BackupOptions{Tags: []string{"home"}, Limit: BandwidthLimit{Upload: 512}})
+	expected := []string{"backup", "--stdin", "--stdin-filename", "home-20230101-120000.btrfs", "--tag", "home", "--limit-upload", "512"}
+	if !slices.Equal(args, expected) {
+		t.Errorf("Expected args %v, got %v", expected, args)
+	}
+}
+
+func TestIsRepositoryExistsOutput(t *testing.T) {
+	tests := []struct {
+		output   string
+		expected bool
+	}{
+		{"Fatal: create repository at /srv/restic failed: Fatal: config file already exists\n", true},
+		{"Fatal: create key in repository at b2:bucket failed: repository master key and config already initialized\n", true},
+		{"Fatal: create repository at /srv/restic failed: mkdir /srv/restic: permission denied\n", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isRepositoryExistsOutput(tt.output); got != tt.expected {
+			t.Errorf("isRepositoryExistsOutput(%q) = %t, expected %t", tt.output, got, tt.expected)
+		}
+	}
+}
+
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run()
+	if err == nil {
+		t.Fatalf("Expected command to exit with %d", code)
+	}
+	return err
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "unclassified", err: errors.New("exit status 1"), expected: false},
+		{
+			name:     "connection_reset",
+			err:      &command.Error{Err: exitError(t, 1), Stderr: "Save(<data/1a2b>) returned error, retrying: read tcp: connection reset by peer\nFatal: unable to save snapshot"},
+			expected: true,
+		},
+		{
+			name:     "backend_unavailable",
+			err:      fmt.Errorf("wrapped: %w", &command.Error{Err: exitError(t, 1), Stderr: "Fatal: unable to open config file: 503 Service Unavailable"}),
+			expected: true,
+		},
+		{
+			name:     "network_timeout",
+			err:      &command.Error{Err: exitError(t, 1), Stderr: "Fatal: unable to open repository: dial tcp 10.0.0.2:443: i/o timeout"},
+			expected: true,
+		},
+		{
+			name:     "tls_handshake_timeout",
+			err:      &command.Error{Err: exitError(t, 1), Stderr: "Load(<key/0c1d>) returned error: Get \"https://s3.example.com/\": net/http: TLS handshake timeout"},
+			expected: true,
+		},
+		{
+			name:     "unrelated_timeout",
+			err:      &command.Error{Err: exitError(t, 1), Stderr: "Fatal: hook \"post_backup\" failed: timeout after 5m0s"},
+			expected: false,
+		},
+		{
+			name:     "wrong_password",
+			err:      &command.Error{Err: exitError(t, 1), Stderr: "Fatal: wrong password or no key found"},
+			expected: false,
+		},
+		{
+			name:     "wrong_password_exit_code",
+			err:      &command.Error{Err: exitError(t, 12), Stderr: "i/o timeout"},
+			expected: false,
+		},
+		{
+			name:     "repository_missing_exit_code",
+			err:      &command.Error{Err: exitError(t, 10)},
+			expected: false,
+		},
+		{
+			name:     "repository_locked_exit_code",
+			err:      &command.Error{Err: exitError(t, 11)},
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.expected {
+				t.Errorf("IsTransient(%v) = %t, expected %t", tt.err, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDryRunClient(t *testing.T) {
+	var out bytes.Buffer
+	client := NewDryRunClient(NewDefaultClient("/usr/bin/restic"), &out, "/usr/bin/restic")
+	env := []string{"RESTIC_PASSWORD=secret123"}
+
+	options := BackupOptions{Tags: []string{"btrfs-backup", "home"}, ExcludeCaches: true, Limit: BandwidthLimit{Upload: 2048}}
+	_, err := client.Backup(context.Background(), env, "/snapshots/home-20230101-120000", options)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err = client.Forget(context.Background(), env, []string{"btrfs-backup", "home"}, ForgetPolicy{KeepLast: 3}, true); err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	if err = client.Check(context.Background(), env, "5%"); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+
+	expected := "[dry-run] /usr/bin/restic backup /snapshots/home-20230101-120000 --tag btrfs-backup --tag home --exclude-caches --limit-upload 2048\n" +
+		"[dry-run] /usr/bin/restic forget --group-by host --tag btrfs-backup,home --keep-last 3 --prune\n" +
+		"[dry-run] /usr/bin/restic check --read-data-subset=5%\n"
+	if out.String() != expected {
+		t.Errorf("Expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestDryRunClientImplementsInterface(t *testing.T) {
+	var _ Client = (*DryRunClient)(nil)
+}
@@ -0,0 +1,83 @@
+package restic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DryRunClient wraps a Client so that read-only operations are passed through
+// while operations that write to or lock a repository are only printed.
+// The repository environment is never printed, as it usually contains secrets.
+type DryRunClient struct {
+	client    Client
+	out       io.Writer
+	resticBin string
+}
+
+// NewDryRunClient creates a DryRunClient that prints skipped commands to out,
+// using resticBin as the command name.
+func NewDryRunClient(client Client, out io.Writer, resticBin string) *DryRunClient {
+	return &DryRunClient{client: client, out: out, resticBin: resticBin}
+}
+
+// Backup prints the 'restic backup' command instead of running it. No summary is returned.
+func (c *DryRunClient) Backup(ctx context.Context, repositoryEnv []string, snapshotPath string, options BackupOptions) (*Summary, error) {
+	return nil, c.print(append(buildBackupArgs(snapshotPath, options), ExtraArgs(repositoryEnv)...))
+}
+
+// BackupStdin prints the 'restic backup --stdin' command instead of running it. The data
+// is read from r and discarded, so the producer can finish. No summary is returned.
+func (c *DryRunClient) BackupStdin(ctx context.Context, repositoryEnv []string, r io.Reader, filename string, options BackupOptions) (*Summary, error) {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+	return nil, c.print(append(buildStdinBackupArgs(filename, options), ExtraArgs(repositoryEnv)...))
+}
+
+// Check prints the 'restic check' command instead of running it.
+func (c *DryRunClient) Check(ctx context.Context, repositoryEnv []string, readDataSubset string) error {
+	return c.print(append(buildCheckArgs(readDataSubset), ExtraArgs(repositoryEnv)...))
+}
+
+// Restore prints the 'restic restore' command instead of running it.
+func (c *DryRunClient) Restore(ctx context.Context, repositoryEnv []string, snapshotID, path, targetDir string) error {
+	return c.print(buildRestoreArgs(snapshotID, path, targetDir))
+}
+
+// Dump prints the 'restic dump' command instead of running it, as it locks the repository.
+// Nothing is written to w.
+func (c *DryRunClient) Dump(ctx context.Context, repositoryEnv []string, snapshotID, path string, w io.Writer) error {
+	return c.print(buildDumpArgs(snapshotID, path))
+}
+
+// Snapshots is read-only and delegates to the wrapped client.
+func (c *DryRunClient) Snapshots(ctx context.Context, repositoryEnv []string, tags []string, noLock bool) ([]Snapshot, error) {
+	return c.client.Snapshots(ctx, repositoryEnv, tags, noLock)
+}
+
+// Forget prints the 'restic forget' command instead of running it.
+func (c *DryRunClient) Forget(ctx context.Context, repositoryEnv []string, tags []string, policy ForgetPolicy, prune bool) error {
+	return c.print(append(buildForgetArgs(tags, policy, prune), ExtraArgs(repositoryEnv)...))
+}
+
+// Prune prints the 'restic prune' command instead of running it.
+func (c *DryRunClient) Prune(ctx context.Context, repositoryEnv []string, maxUnused string) error {
+	return c.print(append(buildPruneArgs(maxUnused), ExtraArgs(repositoryEnv)...))
+}
+
+// Tag prints the 'restic tag' command instead of running it.
+func (c *DryRunClient) Tag(ctx context.Context, repositoryEnv []string, snapshotID string, add, remove []string) error {
+	return c.print(buildTagArgs(snapshotID, add, remove))
+}
+
+// Init prints the 'restic init' command instead of running it.
+func (c *DryRunClient) Init(ctx context.Context, repositoryEnv []string) error {
+	return c.print([]string{"init"})
+}
+
+func (c *DryRunClient) print(args []string) error {
+	_, err := fmt.Fprintf(c.out, "[dry-run] %s %s\n", c.resticBin, strings.Join(args, " "))
+	return err
+}
@@ -0,0 +1,249 @@
+// Package schedule parses the schedules of targets, such as "every 6h", "daily at 02:30"
+// or "Mon,Thu 04:00", computes their next run and turns them into systemd OnCalendar
+// expressions for the timers running the backups.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnsupported is returned by Parse for expressions that are not in the syntax of this
+// package, such as the full systemd calendar syntax. They are passed to systemd as they
+// are, without a next run being known.
+var ErrUnsupported = errors.New("not a schedule expression")
+
+// Schedule is a set of times of the week a backup runs at: the given minutes of the
+// given hours on the given days.
+type Schedule struct {
+	days    [7]bool // by time.Weekday
+	hours   []int
+	minutes []int
+}
+
+// weekdays are the names of the days of the week, by time.Weekday.
+var weekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// Parse parses a schedule expression:
+//
+//   - "hourly", "daily" or "weekly", at the start of the hour, day or Monday
+//   - "every <interval>", e.g. "every 15m" or "every 6h", aligned to midnight; the
+//     interval must divide an hour or a day, "every 1d" is daily
+//   - "[daily at] HH:MM", every day at that time
+//   - "<days> [at] HH:MM", e.g. "Mon,Thu 04:00" or "Mon..Fri at 18:00"
+//
+// Returns an error wrapping ErrUnsupported for expressions in none of these forms.
+func Parse(expr string) (*Schedule, error) {
+	fields := strings.Fields(strings.ToLower(expr))
+	switch {
+	case len(fields) == 1 && fields[0] == "hourly":
+		return &Schedule{days: allDays(), hours: series(0, 24, 1), minutes: []int{0}}, nil
+	case len(fields) == 1 && fields[0] == "daily":
+		return &Schedule{days: allDays(), hours: []int{0}, minutes: []int{0}}, nil
+	case len(fields) == 1 && fields[0] == "weekly":
+		s := &Schedule{hours: []int{0}, minutes: []int{0}}
+		s.days[time.Monday] = true
+		return s, nil
+	case len(fields) > 0 && fields[0] == "every":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid schedule '%s', expected 'every <interval>'", expr)
+		}
+		return parseInterval(fields[1])
+	}
+
+	// Expressions with "at" are always ours, others only once their days are recognized
+	i := slices.Index(fields, "at")
+	ours := i >= 0
+	if ours {
+		fields = slices.Delete(fields, i, i+1)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid schedule '%s', expected '[<days>] at HH:MM'", expr)
+		}
+	} else if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupported, expr)
+	}
+
+	s := &Schedule{days: allDays()}
+	if len(fields) == 2 && fields[0] != "daily" {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			if ours {
+				return nil, fmt.Errorf("invalid schedule '%s': %w", expr, err)
+			}
+			return nil, fmt.Errorf("%w: '%s'", ErrUnsupported, expr)
+		}
+		s.days = days
+		ours = true
+	}
+	hour, minute, err := parseTime(fields[len(fields)-1])
+	if err != nil {
+		if !ours {
+			return nil, fmt.Errorf("%w: '%s'", ErrUnsupported, expr)
+		}
+		return nil, fmt.Errorf("invalid schedule '%s': %w", expr, err)
+	}
+	s.hours, s.minutes = []int{hour}, []int{minute}
+	return s, nil
+}
+
+// parseInterval parses the interval of "every <interval>": a duration like "30m" or
+// "6h", or a number of days like "1d".
+func parseInterval(value string) (*Schedule, error) {
+	var interval time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval '%s'", value)
+		}
+		interval = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid interval '%s'", value)
+		}
+	}
+
+	s := &Schedule{days: allDays()}
+	switch {
+	case interval == 24*time.Hour:
+		s.hours, s.minutes = []int{0}, []int{0}
+	case interval >= time.Hour && interval%time.Hour == 0 && 24%int(interval/time.Hour) == 0:
+		s.hours, s.minutes = series(0, 24, int(interval/time.Hour)), []int{0}
+	case interval >= time.Minute && interval < time.Hour && interval%time.Minute == 0 && 60%int(interval/time.Minute) == 0:
+		s.hours, s.minutes = series(0, 24, 1), series(0, 60, int(interval/time.Minute))
+	default:
+		return nil, fmt.Errorf("interval '%s' must divide an hour or a day, e.g. 15m, 6h or 1d", value)
+	}
+	return s, nil
+}
+
+// parseDays parses a comma separated list of days of the week and ranges of them such
+// as "mon..fri". Days are named by their first three letters or in full.
+func parseDays(value string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(part, "..")
+		first, err := parseDay(from)
+		if err != nil {
+			return days, err
+		}
+		last := first
+		if isRange {
+			if last, err = parseDay(to); err != nil {
+				return days, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseDay(name string) (time.Weekday, error) {
+	for d, day := range weekdays {
+		full := strings.ToLower(time.Weekday(d).String())
+		if name == strings.ToLower(day) || name == full {
+			return time.Weekday(d), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day '%s'", name)
+}
+
+// parseTime parses a time of day in the form H:MM or HH:MM.
+func parseTime(value string) (hour, minute int, err error) {
+	h, m, found := strings.Cut(value, ":")
+	if !found || len(m) != 2 {
+		return 0, 0, fmt.Errorf("invalid time '%s', expected HH:MM", value)
+	}
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("invalid time '%s', expected HH:MM", value)
+	}
+	return hour, minute, nil
+}
+
+func allDays() [7]bool {
+	return [7]bool{true, true, true, true, true, true, true}
+}
+
+// series returns the multiples of step from start up to, excluding, end.
+func series(start, end, step int) []int {
+	var values []int
+	for v := start; v < end; v += step {
+		values = append(values, v)
+	}
+	return values
+}
+
+// Next returns the first time of the schedule after after, in its location.
+func (s *Schedule) Next(after time.Time) time.Time {
+	year, month, day := after.Date()
+	for offset := range 8 {
+		date := time.Date(year, month, day+offset, 0, 0, 0, 0, after.Location())
+		if !s.days[date.Weekday()] {
+			continue
+		}
+		for _, hour := range s.hours {
+			for _, minute := range s.minutes {
+				next := time.Date(year, month, day+offset, hour, minute, 0, 0, after.Location())
+				if next.After(after) {
+					return next
+				}
+			}
+		}
+	}
+	// Unreachable for schedules returned by Parse, which run at least once a week
+	return time.Time{}
+}
+
+// OnCalendar returns the systemd OnCalendar expression of the schedule, e.g.
+// "Mon,Thu *-*-* 04:00:00".
+func (s *Schedule) OnCalendar() string {
+	var calendar strings.Builder
+	if s.days != allDays() {
+		var names []string
+		for d, selected := range s.days {
+			if selected {
+				names = append(names, weekdays[d])
+			}
+		}
+		// systemd week days start on Monday
+		if s.days[time.Sunday] {
+			names = append(names[1:], names[0])
+		}
+		calendar.WriteString(strings.Join(names, ",") + " ")
+	}
+	calendar.WriteString("*-*-* " + joinTwoDigits(s.hours) + ":" + joinTwoDigits(s.minutes) + ":00")
+	return calendar.String()
+}
+
+func joinTwoDigits(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%02d", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Calendar returns the systemd OnCalendar expression of a schedule expression: that of
+// the parsed schedule, or the expression as it is if it is not in the syntax of this
+// package. Returns an error for invalid expressions in the syntax.
+func Calendar(expr string) (string, error) {
+	s, err := Parse(expr)
+	if errors.Is(err, ErrUnsupported) {
+		return expr, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.OnCalendar(), nil
+}
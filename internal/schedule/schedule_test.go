@@ -0,0 +1,118 @@
+package schedule
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	// Wednesday
+	now := time.Date(2026, 10, 14, 13, 47, 20, 0, time.UTC)
+
+	tests := []struct {
+		expr       string
+		onCalendar string
+		next       time.Time
+	}{
+		{"hourly", "*-*-* 00,01,02,03,04,05,06,07,08,09,10,11,12,13,14,15,16,17,18,19,20,21,22,23:00:00", time.Date(2026, 10, 14, 14, 0, 0, 0, time.UTC)},
+		{"daily", "*-*-* 00:00:00", time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)},
+		{"weekly", "Mon *-*-* 00:00:00", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"every 6h", "*-*-* 00,06,12,18:00:00", time.Date(2026, 10, 14, 18, 0, 0, 0, time.UTC)},
+		{"every 15m", "*-*-* 00,01,02,03,04,05,06,07,08,09,10,11,12,13,14,15,16,17,18,19,20,21,22,23:00,15,30,45:00", time.Date(2026, 10, 14, 14, 0, 0, 0, time.UTC)},
+		{"Every 1d", "*-*-* 00:00:00", time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)},
+		{"daily at 02:30", "*-*-* 02:30:00", time.Date(2026, 10, 15, 2, 30, 0, 0, time.UTC)},
+		{"13:48", "*-*-* 13:48:00", time.Date(2026, 10, 14, 13, 48, 0, 0, time.UTC)},
+		{"at 9:05", "*-*-* 09:05:00", time.Date(2026, 10, 15, 9, 5, 0, 0, time.UTC)},
+		{"Mon,Thu 04:00", "Mon,Thu *-*-* 04:00:00", time.Date(2026, 10, 15, 4, 0, 0, 0, time.UTC)},
+		{"sun,wed 13:00", "Wed,Sun *-*-* 13:00:00", time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC)},
+		{"Mon..Fri at 18:00", "Mon,Tue,Wed,Thu,Fri *-*-* 18:00:00", time.Date(2026, 10, 14, 18, 0, 0, 0, time.UTC)},
+		{"Saturday..Monday 01:00", "Mon,Sat,Sun *-*-* 01:00:00", time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC)},
+		{"Wed 13:47", "Wed *-*-* 13:47:00", time.Date(2026, 10, 21, 13, 47, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			if got := s.OnCalendar(); got != tt.onCalendar {
+				t.Errorf("Expected OnCalendar '%s', got '%s'", tt.onCalendar, got)
+			}
+			if got := s.Next(now); !got.Equal(tt.next) {
+				t.Errorf("Expected next run %v, got %v", tt.next, got)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr          string
+		unsupported   bool
+		errorContains string
+	}{
+		{expr: "Mon *-*-* 03:00:00", unsupported: true},
+		{expr: "monthly", unsupported: true},
+		{expr: "*-*-* 02:00", unsupported: true},
+		{expr: "", unsupported: true},
+		{expr: "every 7h", errorContains: "must divide an hour or a day"},
+		{expr: "every 45m", errorContains: "must divide an hour or a day"},
+		{expr: "every 2d", errorContains: "must divide an hour or a day"},
+		{expr: "every often", errorContains: "invalid interval"},
+		{expr: "every", errorContains: "expected 'every <interval>'"},
+		{expr: "daily at 25:00", errorContains: "invalid time '25:00'"},
+		{expr: "Mon,Thu 4:0", errorContains: "invalid time '4:0'"},
+		{expr: "at", errorContains: "expected '[<days>] at HH:MM'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if errors.Is(err, ErrUnsupported) != tt.unsupported {
+				t.Errorf("Expected unsupported %v, got %v", tt.unsupported, err)
+			}
+			if !strings.Contains(err.Error(), tt.errorContains) {
+				t.Errorf("Expected error containing '%s', got %v", tt.errorContains, err)
+			}
+		})
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	for expr, expected := range map[string]string{
+		"daily":           "*-*-* 00:00:00",
+		"Mon *-*-* 03:00": "Mon *-*-* 03:00",
+		"every 12h":       "*-*-* 00,12:00:00",
+		"Fri,Sat 23:30":   "Fri,Sat *-*-* 23:30:00",
+		"*-*-01 04:00:00": "*-*-01 04:00:00",
+	} {
+		if got, err := Calendar(expr); err != nil || got != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s' (%v)", expected, expr, got, err)
+		}
+	}
+	if _, err := Calendar("every 5h"); err == nil {
+		t.Error("Expected error for invalid interval")
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	s, err := Parse("daily at 02:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 02:30 doesn't exist on 2026-03-29 in Berlin, the run is an hour later
+	next := s.Next(time.Date(2026, 3, 28, 12, 0, 0, 0, berlin))
+	if next.Day() != 29 || !next.After(time.Date(2026, 3, 29, 0, 0, 0, 0, berlin)) {
+		t.Errorf("Unexpected next run %v", next)
+	}
+}
@@ -0,0 +1,316 @@
+// Package selftest runs the complete backup workflow against a throwaway BTRFS
+// filesystem on a loopback image and a temporary local restic repository, so that a
+// single command shows whether the privileges, binaries and kernel of a machine work.
+package selftest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"btrfs-backup/internal/backup"
+	"btrfs-backup/internal/command"
+	"btrfs-backup/internal/config"
+)
+
+// DefaultImageSize is the size of the loopback image, above the minimum mkfs.btrfs accepts.
+const DefaultImageSize = 256 << 20
+
+// targetName is the name of the target and repository of the self-test.
+const targetName = "selftest"
+
+// Options controls the self-test.
+type Options struct {
+	ResticBin string // restic binary to test
+	Dir       string // directory the work directory is created in, empty for the system default
+	ImageSize int64  // size of the loopback image in bytes
+	Keep      bool   // keep the work directory with the image and repository for inspection
+	Verbose   bool   // log the commands of the backup workflow
+}
+
+// Step is a completed or failed step of the self-test.
+type Step struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Report is the result of the self-test.
+type Report struct {
+	WorkDir string `json:"work_dir"` // removed afterwards unless Options.Keep is set
+	Steps   []Step `json:"steps"`
+	Success bool   `json:"success"`
+}
+
+// selftest holds the paths of a running self-test.
+type selftest struct {
+	options   Options
+	workDir   string
+	image     string
+	mountDir  string
+	configDir string
+	mounted   bool
+	cfg       *config.Config
+	target    *config.TargetConfig
+}
+
+// Run creates a loopback image in a new work directory, formats it BTRFS, mounts it,
+// creates a subvolume with sample data and a local restic repository, then backs the
+// subvolume up with the regular backup workflow, restores the restic snapshot and
+// compares it with the local snapshot. The steps run in order until one fails.
+// Afterwards the image is unmounted and the work directory removed unless Options.Keep
+// is set. Mounting requires root.
+// Returns the report of the steps run, with an error if a step or the cleanup failed.
+func Run(ctx context.Context, options Options) (report *Report, err error) {
+	if options.ImageSize == 0 {
+		options.ImageSize = DefaultImageSize
+	}
+	t := &selftest{options: options}
+	report = &Report{}
+
+	defer func() {
+		if cleanupErr := t.cleanup(); cleanupErr != nil {
+			err = errors.Join(err, fmt.Errorf("cleanup failed: %w", cleanupErr))
+		}
+		report.WorkDir = t.workDir
+		report.Success = err == nil
+	}()
+
+	steps := []struct {
+		name string
+		run  func(ctx context.Context) error
+	}{
+		{"check environment", t.checkEnvironment},
+		{"create loopback image", t.createImage},
+		{"mount filesystem", t.mount},
+		{"create subvolume with sample data", t.createSubvolume},
+		{"write configuration", t.writeConfig},
+		{"initialize repository", t.initRepository},
+		{"back up", t.backup},
+		{"verify repository", t.verifyRepository},
+		{"restore and compare", t.verifyRestore},
+	}
+	for _, step := range steps {
+		slog.Info("Self-test step", "step", step.name)
+		start := time.Now()
+		err := step.run(ctx)
+		result := Step{Name: step.name, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		report.Steps = append(report.Steps, result)
+		if err != nil {
+			return report, fmt.Errorf("%s failed: %w", step.name, err)
+		}
+	}
+	return report, nil
+}
+
+// checkEnvironment checks for root and the binaries used by the self-test.
+func (t *selftest) checkEnvironment(_ context.Context) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("mounting the loopback image requires root")
+	}
+	var missing []error
+	for _, name := range []string{"mkfs.btrfs", "btrfs", "mount", "umount", t.options.ResticBin} {
+		if _, err := exec.LookPath(name); err != nil {
+			missing = append(missing, err)
+		}
+	}
+	return errors.Join(missing...)
+}
+
+// createImage creates the work directory and the BTRFS loopback image in it.
+func (t *selftest) createImage(ctx context.Context) error {
+	workDir, err := os.MkdirTemp(t.options.Dir, "btrfs-backup-selftest-")
+	if err != nil {
+		return fmt.Errorf("failed to create work directory: %w", err)
+	}
+	t.workDir = workDir
+	t.image = filepath.Join(workDir, "btrfs.img")
+
+	f, err := os.Create(t.image)
+	if err != nil {
+		return fmt.Errorf("failed to create image: %w", err)
+	}
+	err = f.Truncate(t.options.ImageSize)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to size image: %w", err)
+	}
+
+	return command.Run(command.Command(ctx, "mkfs.btrfs", "-q", t.image))
+}
+
+// mount mounts the image through a loop device.
+func (t *selftest) mount(ctx context.Context) error {
+	t.mountDir = filepath.Join(t.workDir, "mnt")
+	if err := os.Mkdir(t.mountDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	if err := command.Run(command.Command(ctx, "mount", "-o", "loop", t.image, t.mountDir)); err != nil {
+		return err
+	}
+	t.mounted = true
+	return nil
+}
+
+// createSubvolume creates the subvolume to back up, with sample data, and the snapshot
+// directory next to it.
+func (t *selftest) createSubvolume(ctx context.Context) error {
+	subvolume := filepath.Join(t.mountDir, "data")
+	if err := command.Run(command.Command(ctx, "btrfs", "subvolume", "create", subvolume)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(filepath.Join(t.mountDir, "snapshots"), 0o755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	return writeSampleData(subvolume)
+}
+
+// writeSampleData writes files of different kinds to dir: text, empty, nested and
+// incompressible files, a private file and a symlink.
+func writeSampleData(dir string) error {
+	random := make([]byte, 1<<20)
+	if _, err := rand.Read(random); err != nil {
+		return fmt.Errorf("failed to generate sample data: %w", err)
+	}
+
+	files := []struct {
+		path    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{"README", []byte("Sample data of the btrfs-backup self-test\n"), 0o644},
+		{"empty", nil, 0o644},
+		{"nested/deeper/notes.txt", []byte("nested file\n"), 0o644},
+		{"nested/random.bin", random, 0o644},
+		{"private/secret", []byte("not for everyone\n"), 0o600},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("failed to create sample directory: %w", err)
+		}
+		if err := os.WriteFile(path, file.content, file.mode); err != nil {
+			return fmt.Errorf("failed to write sample file: %w", err)
+		}
+	}
+	if err := os.Symlink("nested/deeper/notes.txt", filepath.Join(dir, "link")); err != nil {
+		return fmt.Errorf("failed to create sample symlink: %w", err)
+	}
+	return nil
+}
+
+// writeConfig writes the main, target and repository configuration of the self-test to
+// the work directory and loads them, exercising the regular configuration loading.
+func (t *selftest) writeConfig(_ context.Context) error {
+	t.configDir = filepath.Join(t.workDir, "config")
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return fmt.Errorf("failed to generate repository password: %w", err)
+	}
+
+	files := configFiles(t.configDir, t.mountDir, filepath.Join(t.workDir, "repo"), t.options.ResticBin, hex.EncodeToString(password))
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(file.Path), 0o700); err != nil {
+			return fmt.Errorf("failed to create configuration directory: %w", err)
+		}
+		if err := os.WriteFile(file.Path, []byte(file.Content), file.Mode); err != nil {
+			return fmt.Errorf("failed to write configuration: %w", err)
+		}
+	}
+
+	cfg, err := config.LoadConfig(files[0].Path)
+	if err != nil {
+		return err
+	}
+	target, err := config.LoadTargetConfig(config.GetTargetConfigPath("", cfg.TargetDir, targetName))
+	if err != nil {
+		return err
+	}
+	t.cfg, t.target = cfg, target
+	return nil
+}
+
+// configFiles returns the configuration files of the self-test in configDir, the
+// main configuration first, for the filesystem mounted at mountDir and the restic
+// repository at repo.
+func configFiles(configDir, mountDir, repo, resticBin, password string) []config.ExampleFile {
+	return []config.ExampleFile{
+		{
+			Path: filepath.Join(configDir, "config.yaml"),
+			Mode: 0o644,
+			Content: fmt.Sprintf("target_dir: %q\nsnapshot_dir: %q\nrestic_repo_dir: %q\nrestic_bin: %q\n",
+				filepath.Join(configDir, "targets"), filepath.Join(mountDir, "snapshots"), filepath.Join(configDir, "repos"), resticBin),
+		},
+		{
+			Path: filepath.Join(configDir, "targets", targetName+".yaml"),
+			Mode: 0o644,
+			Content: fmt.Sprintf("subvolume: %q\nprefix: %s\nrepository: %s\nverify: true\nverify_subset: full\nkeep_snapshots: 1\n",
+				filepath.Join(mountDir, "data"), targetName, targetName),
+		},
+		{
+			Path:    filepath.Join(configDir, "repos", targetName),
+			Mode:    0o600,
+			Content: fmt.Sprintf("RESTIC_REPOSITORY: %q\nRESTIC_PASSWORD: %s\n", repo, password),
+		},
+	}
+}
+
+func (t *selftest) manager() *backup.Manager {
+	return backup.NewManager(t.cfg, t.options.Verbose)
+}
+
+func (t *selftest) initRepository(ctx context.Context) error {
+	return t.manager().InitRepository(ctx, t.target.Repository)
+}
+
+func (t *selftest) backup(ctx context.Context) error {
+	return t.manager().RunBackup(ctx, targetName, t.target)
+}
+
+// verifyRepository reads all data of the repository with 'restic check'. The backup
+// workflow verifies it as well, but only warns if the verification fails.
+func (t *selftest) verifyRepository(ctx context.Context) error {
+	return t.manager().VerifyRepository(ctx, t.target.Repository, config.VerifyFull, nil)
+}
+
+// verifyRestore restores the backup and compares every file with the local snapshot.
+func (t *selftest) verifyRestore(ctx context.Context) error {
+	report, err := t.manager().VerifyRestore(ctx, targetName, t.target, "", backup.RestoreVerifyOptions{Dir: t.workDir, Sample: 100})
+	if err != nil {
+		return err
+	}
+	if !report.Success {
+		return fmt.Errorf("restored snapshot differs from the local snapshot: %d missing, %d extra, %d mismatched entries",
+			len(report.Missing), len(report.Extra), len(report.Mismatched))
+	}
+	return nil
+}
+
+// cleanup unmounts the image and removes the work directory unless it is kept.
+func (t *selftest) cleanup() error {
+	if t.mounted {
+		// The run's context may already be done, e.g. after an interrupt
+		if err := command.Run(command.Command(context.Background(), "umount", t.mountDir)); err != nil {
+			return fmt.Errorf("failed to unmount %s, work directory %s kept: %w", t.mountDir, t.workDir, err)
+		}
+	}
+	if t.options.Keep || t.workDir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(t.workDir); err != nil {
+		return fmt.Errorf("failed to remove work directory: %w", err)
+	}
+	return nil
+}
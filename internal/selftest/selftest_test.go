@@ -0,0 +1,78 @@
+package selftest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"btrfs-backup/internal/config"
+)
+
+func TestConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, "config")
+	mountDir := filepath.Join(dir, "mnt")
+	for _, file := range configFiles(configDir, mountDir, filepath.Join(dir, "repo"), "/usr/bin/restic", "secret") {
+		if err := os.MkdirAll(filepath.Dir(file.Path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file.Path, []byte(file.Content), file.Mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := config.LoadConfig(filepath.Join(configDir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.SnapshotDir != filepath.Join(mountDir, "snapshots") || cfg.ResticBin != "/usr/bin/restic" {
+		t.Errorf("Unexpected configuration %+v", cfg)
+	}
+
+	target, err := config.LoadTargetConfig(config.GetTargetConfigPath("", cfg.TargetDir, targetName))
+	if err != nil {
+		t.Fatalf("LoadTargetConfig failed: %v", err)
+	}
+	if target.Subvolume != filepath.Join(mountDir, "data") || target.Repository != targetName || !target.Verify {
+		t.Errorf("Unexpected target configuration %+v", target)
+	}
+}
+
+func TestWriteSampleData(t *testing.T) {
+	dir := t.TempDir()
+	if err := writeSampleData(dir); err != nil {
+		t.Fatalf("writeSampleData failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "link"))
+	if err != nil || string(data) != "nested file\n" {
+		t.Errorf("Expected symlink to the nested file, got %q (%v)", data, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "nested", "random.bin"))
+	if err != nil || info.Size() != 1<<20 {
+		t.Errorf("Expected 1 MiB random file, got %v", err)
+	}
+}
+
+// TestRun runs the real self-test. It needs root, btrfs-progs and restic, and mounts a
+// loopback image, so it only runs with BTRFS_BACKUP_SELFTEST=1.
+func TestRun(t *testing.T) {
+	if os.Getenv("BTRFS_BACKUP_SELFTEST") != "1" {
+		t.Skip("set BTRFS_BACKUP_SELFTEST=1 to run the self-test against a loopback image")
+	}
+
+	report, err := Run(context.Background(), Options{ResticBin: "restic", Dir: t.TempDir()})
+	for _, step := range report.Steps {
+		t.Logf("%s: %s %s", step.Name, step.Duration, step.Error)
+	}
+	if err != nil {
+		t.Fatalf("Self-test failed: %v", err)
+	}
+	if !report.Success || len(report.Steps) != 9 {
+		t.Errorf("Expected all steps to succeed, got %+v", report)
+	}
+	if _, err := os.Stat(report.WorkDir); !os.IsNotExist(err) {
+		t.Errorf("Expected work directory %s removed", report.WorkDir)
+	}
+}
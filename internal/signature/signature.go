@@ -0,0 +1,107 @@
+// Package signature signs JSON documents, such as restore verification reports, with an
+// Ed25519 key and verifies them, so that a report can be shown to come from the backup
+// host unchanged. Keys are PEM files as written by
+// 'openssl genpkey -algorithm ed25519' and 'openssl pkey -pubout'.
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrInvalid is returned by Verify for documents whose signature doesn't match.
+var ErrInvalid = errors.New("invalid signature")
+
+// Signed is a signed JSON document. The signature covers the compact encoding of the
+// document, so re-indenting the file doesn't invalidate it.
+type Signed struct {
+	Document  json.RawMessage `json:"document"`
+	PublicKey []byte          `json:"public_key"` // Ed25519 public key of the signer, base64-encoded
+	Signature []byte          `json:"signature"`  // Ed25519 signature of the document, base64-encoded
+}
+
+// LoadPrivateKey reads an Ed25519 private key from a PEM file in PKCS #8 form.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	key, err := loadKey(path)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	return private, nil
+}
+
+// LoadPublicKey reads an Ed25519 public key from a PEM file in PKIX form. The public key
+// of a private key file is accepted as well.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := loadKey(path)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key.Public().(ed25519.PublicKey), nil
+	default:
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+}
+
+func loadKey(path string) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block '%s' in %s", block.Type, path)
+	}
+}
+
+// Sign encodes document as JSON and signs it with key.
+func Sign(key ed25519.PrivateKey, document any) (*Signed, error) {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	return &Signed{
+		Document:  data,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, data),
+	}, nil
+}
+
+// Verify checks the signature of the signed document data, as written by encoding a
+// Signed, against key and returns the document. Returns ErrInvalid if the document was
+// changed or signed with another key.
+func Verify(key ed25519.PublicKey, data []byte) (json.RawMessage, error) {
+	var signed Signed
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("not a signed document: %w", err)
+	}
+	var document bytes.Buffer
+	if err := json.Compact(&document, signed.Document); err != nil {
+		return nil, fmt.Errorf("not a signed document: %w", err)
+	}
+	if !ed25519.Verify(key, document.Bytes(), signed.Signature) {
+		return nil, ErrInvalid
+	}
+	return signed.Document, nil
+}
@@ -0,0 +1,88 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeys writes a new key pair as PEM files to dir and returns their paths.
+func writeKeys(t *testing.T, dir string) (privatePath, publicPath string) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath, publicPath = filepath.Join(dir, "report.key"), filepath.Join(dir, "report.pub")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return privatePath, publicPath
+}
+
+func TestSignVerify(t *testing.T) {
+	dir := t.TempDir()
+	privatePath, publicPath := writeKeys(t, dir)
+	private, err := LoadPrivateKey(privatePath)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey failed: %v", err)
+	}
+	public, err := LoadPublicKey(publicPath)
+	if err != nil {
+		t.Fatalf("LoadPublicKey failed: %v", err)
+	}
+	if derived, err := LoadPublicKey(privatePath); err != nil || !derived.Equal(public) {
+		t.Errorf("Expected the public key of the private key file, got %v (%v)", derived, err)
+	}
+	if _, err := LoadPrivateKey(publicPath); err == nil {
+		t.Error("Expected error loading a public key as private key")
+	}
+
+	signed, err := Sign(private, map[string]any{"target": "home", "success": true})
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	data, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	document, err := Verify(public, data)
+	if err != nil {
+		t.Fatalf("Verify failed for the indented document: %v", err)
+	}
+	if !bytes.Contains(document, []byte(`"target": "home"`)) {
+		t.Errorf("Expected the document, got %s", document)
+	}
+
+	tampered := bytes.Replace(data, []byte(`"success": true`), []byte(`"success": false`), 1)
+	if _, err := Verify(public, tampered); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid for a changed document, got %v", err)
+	}
+	_, otherPublic := writeKeys(t, t.TempDir())
+	other, err := LoadPublicKey(otherPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(other, data); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid for another key, got %v", err)
+	}
+	if _, err := Verify(public, []byte("not json")); err == nil || errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected a parse error, got %v", err)
+	}
+}
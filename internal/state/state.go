@@ -0,0 +1,310 @@
+// Package state persists what a target's backup runs need to remember between runs,
+// one JSON file per target, and what the targets sharing a repository need to coordinate,
+// one JSON file and one lock file per repository, next to the history of the restic
+// commands run against the repository.
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// Target is the persisted state of a target.
+type Target struct {
+	LastAttempt        time.Time `json:"last_attempt"`                   // Start of the last backup run
+	LastSuccess        time.Time `json:"last_success"`                   // Start of the last successful backup run
+	LastSnapshot       string    `json:"last_snapshot,omitempty"`        // Path of the last snapshot created
+	LastResticSnapshot string    `json:"last_restic_snapshot,omitempty"` // ID of the last restic snapshot uploaded
+	LastError          string    `json:"last_error,omitempty"`           // Error of the last run, empty if it succeeded
+	LastRunID          string    `json:"last_run_id,omitempty"`          // Run ID of the last run, as in its logs, events and notifications
+
+	ConsecutiveFailures int `json:"consecutive_failures"` // Runs failed in a row since the last successful run
+
+	BackupsSinceVerify int       `json:"backups_since_verify"`        // Backups uploaded since the repository was last verified
+	LastVerify         time.Time `json:"last_verify"`                 // Time of the last successful repository verification
+	LastFullVerify     time.Time `json:"last_full_verify"`            // Time of the last successful verification reading all data
+	LastVerifyError    string    `json:"last_verify_error,omitempty"` // Error of the last verification, empty if it succeeded
+
+	LastFull time.Time `json:"last_full"` // Start of the upload of the last full backup
+
+	LastSnapshotVerify    time.Time            `json:"last_snapshot_verify"`             // Time of the last successful verification of an older restic snapshot
+	SnapshotVerifications map[string]time.Time `json:"snapshot_verifications,omitempty"` // Time each restic snapshot, by ID, was last read back in full
+
+	DeviceErrors map[string]int64 `json:"device_errors,omitempty"` // btrfs device error counters at the last check, by "<device> <counter>"
+
+	Uploads []Upload `json:"uploads,omitempty"` // Recent uploads, oldest first, see AddUpload
+}
+
+// Upload is the record of a backup uploaded to the repository.
+type Upload struct {
+	Time           time.Time `json:"time"`            // Start of the backup run
+	DataAdded      int64     `json:"data_added"`      // Bytes added to the repository, as reported by restic
+	BytesProcessed int64     `json:"bytes_processed"` // Size of the snapshot data read
+	FilesProcessed int       `json:"files_processed"` // Files read from the snapshot
+}
+
+// Repository is the persisted state of a repository, shared by the targets backed up to it.
+type Repository struct {
+	LastPrune time.Time `json:"last_prune"` // Time of the last successful 'restic prune' scheduled by prune_every
+}
+
+// Maintenance is the maintenance mode of the host, set by 'btrfs-backup maintenance on':
+// while it is active, the backups of all targets are skipped.
+type Maintenance struct {
+	Reason string    `json:"reason,omitempty"` // Why backups are paused, shown by status
+	Since  time.Time `json:"since"`            // Time maintenance mode was turned on
+	Until  time.Time `json:"until,omitzero"`   // Time maintenance mode ends by itself, zero until turned off
+}
+
+// Active reports whether maintenance mode is on at now.
+func (m *Maintenance) Active(now time.Time) bool {
+	return !m.Since.IsZero() && (m.Until.IsZero() || now.Before(m.Until))
+}
+
+// maintenanceName is the name of the maintenance mode file in the state directory; the
+// leading dot keeps it apart from the state files of the targets.
+const maintenanceName = ".maintenance"
+
+// LoadMaintenance reads the maintenance mode from the state directory dir. Without a
+// maintenance file, maintenance mode is off.
+func LoadMaintenance(dir string) (*Maintenance, error) {
+	return load[Maintenance](dir, maintenanceName)
+}
+
+// SaveMaintenance turns maintenance mode on by writing m to the state directory dir
+// like Save.
+func SaveMaintenance(dir string, m *Maintenance) error {
+	return save(dir, maintenanceName, m)
+}
+
+// ClearMaintenance turns maintenance mode off by removing its file from the state
+// directory dir.
+func ClearMaintenance(dir string) error {
+	if err := os.Remove(Path(dir, maintenanceName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove maintenance file: %w", err)
+	}
+	return nil
+}
+
+// Invocation is the record of a restic command run against a repository, kept in the
+// repository's history, see AppendHistory.
+type Invocation struct {
+	Time     time.Time `json:"time"`                // Start of the command
+	Command  string    `json:"command"`             // restic subcommand with the flags or snapshot telling its effect apart, e.g. "forget --prune"
+	Prefix   string    `json:"prefix,omitempty"`    // Prefix of the target the command ran for, empty for repository-wide commands
+	RunID    string    `json:"run_id,omitempty"`    // Run ID of the invocation, as in its logs, events and notifications
+	Duration float64   `json:"duration_seconds"`    // Run time of the command
+	Exit     string    `json:"exit"`                // Exit class, one of the Exit constants
+	ExitCode int       `json:"exit_code,omitempty"` // Exit code of restic, if it exited by itself
+	Error    string    `json:"error,omitempty"`     // Error of a failed command
+}
+
+// Exit classes of an Invocation.
+const (
+	ExitSuccess     = "success"     // restic succeeded
+	ExitFailure     = "failure"     // restic failed permanently, e.g. a wrong password or a damaged repository
+	ExitTransient   = "transient"   // restic failed for a reason worth retrying, e.g. a network error or a lock
+	ExitInterrupted = "interrupted" // the command was stopped by a timeout or signal
+)
+
+// HistoryPath returns the path of the history of a repository in the state directory dir,
+// a file of JSON Lines, one Invocation per line, oldest first.
+func HistoryPath(dir, repository string) string {
+	return filepath.Join(RepositoryDir(dir), repository+".history.jsonl")
+}
+
+// AppendHistory appends an invocation to the history of a repository in the state
+// directory dir. Each invocation is a single append, so the targets and processes sharing
+// the repository don't need to coordinate.
+func AppendHistory(dir, repository string, invocation Invocation) error {
+	line, err := json.Marshal(invocation)
+	if err != nil {
+		return fmt.Errorf("failed to encode invocation: %w", err)
+	}
+	if err := os.MkdirAll(RepositoryDir(dir), 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	file, err := os.OpenFile(HistoryPath(dir, repository), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open repository history: %w", err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write repository history: %w", err)
+	}
+	return file.Close()
+}
+
+// LoadHistory reads the history of a repository from the state directory dir, oldest
+// first. A repository no command ran against yet has an empty history. A last line cut
+// short by a crash is skipped.
+func LoadHistory(dir, repository string) ([]Invocation, error) {
+	data, err := os.ReadFile(HistoryPath(dir, repository))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository history: %w", err)
+	}
+
+	var history []Invocation
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var invocation Invocation
+		if err := json.Unmarshal(line, &invocation); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("invalid repository history %s, line %d: %w", HistoryPath(dir, repository), i+1, err)
+		}
+		history = append(history, invocation)
+	}
+	return history, nil
+}
+
+// RepositoryDir returns the directory holding the state files of the repositories in the
+// state directory dir.
+func RepositoryDir(dir string) string {
+	return filepath.Join(dir, "repositories")
+}
+
+// MaxUploads is the number of uploads kept in the state, more than a year of daily runs.
+const MaxUploads = 400
+
+// AddUpload records an upload, dropping the oldest ones beyond MaxUploads.
+func (t *Target) AddUpload(upload Upload) {
+	t.Uploads = append(t.Uploads, upload)
+	if len(t.Uploads) > MaxUploads {
+		t.Uploads = slices.Delete(t.Uploads, 0, len(t.Uploads)-MaxUploads)
+	}
+}
+
+// Path returns the path of the state file of a target in dir.
+func Path(dir, target string) string {
+	return filepath.Join(dir, target+".json")
+}
+
+// Load reads the state of a target from dir. A target without a state file yet has
+// the zero state.
+func Load(dir, target string) (*Target, error) {
+	return load[Target](dir, target)
+}
+
+// Update applies update to the state of a target in dir and saves it.
+func Update(dir, target string, update func(*Target)) error {
+	return updateState(dir, target, update)
+}
+
+// Save writes the state of a target to dir, creating dir if needed. The file is
+// replaced atomically so an interrupted run never leaves a partially written state.
+func Save(dir, target string, state *Target) error {
+	return save(dir, target, state)
+}
+
+// LoadRepository reads the state of a repository from the state directory dir, see
+// RepositoryDir. A repository without a state file yet has the zero state.
+func LoadRepository(dir, repository string) (*Repository, error) {
+	return load[Repository](RepositoryDir(dir), repository)
+}
+
+// UpdateRepository applies update to the state of a repository in the state directory dir
+// and saves it like Save.
+func UpdateRepository(dir, repository string, update func(*Repository)) error {
+	return updateState(RepositoryDir(dir), repository, update)
+}
+
+// ErrLocked is returned by LockRepository while the lock is held in a conflicting mode.
+var ErrLocked = errors.New("repository lock held")
+
+// LockRepository takes the lock of a repository in the state directory dir without
+// waiting: shared by the backups uploading to it, exclusive for its scheduled prunes, so
+// that a prune never runs during a backup of another target or process. It returns
+// ErrLocked if the lock is held in a conflicting mode, and otherwise a function releasing
+// the lock.
+func LockRepository(dir, repository string, exclusive bool) (unlock func(), err error) {
+	dir = RepositoryDir(dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, repository+".lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", file.Name(), err)
+	}
+	return func() { _ = file.Close() }, nil
+}
+
+func load[T any](dir, name string) (*T, error) {
+	data, err := os.ReadFile(Path(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return new(T), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var state T
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", Path(dir, name), err)
+	}
+	return &state, nil
+}
+
+func updateState[T any](dir, name string, update func(*T)) error {
+	state, err := load[T](dir, name)
+	if err != nil {
+		return err
+	}
+	update(state)
+	return save(dir, name, state)
+}
+
+func save[T any](dir, name string, state *T) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "."+name+"_*.json.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), Path(dir, name)); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadMissing(t *testing.T) {
+	state, err := Load(t.TempDir(), "home")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !reflect.DeepEqual(*state, Target{}) {
+		t.Errorf("Expected zero state, got %+v", state)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	saved := &Target{BackupsSinceVerify: 3, LastVerify: time.Unix(1700000000, 0).UTC()}
+
+	if err := Save(dir, "home", saved); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := Load(dir, "home")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.BackupsSinceVerify != 3 || !loaded.LastVerify.Equal(saved.LastVerify) {
+		t.Errorf("Expected %+v, got %+v", saved, loaded)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read state directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "home.json" {
+		t.Errorf("Expected only home.json in the state directory, got %v", entries)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(Path(dir, "home"), []byte("{"), 0o644); err != nil {
+		t.Fatalf("Failed to write state file: %v", err)
+	}
+	if _, err := Load(dir, "home"); err == nil {
+		t.Error("Expected error for invalid state file")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	if err := Save(dir, "home", &Target{BackupsSinceVerify: 2, LastError: "failed"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	err := Update(dir, "home", func(s *Target) {
+		s.LastSnapshot = "/snapshots/home-20230101-120000"
+		s.LastError = ""
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	state, err := Load(dir, "home")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if state.BackupsSinceVerify != 2 || state.LastSnapshot != "/snapshots/home-20230101-120000" || state.LastError != "" {
+		t.Errorf("Unexpected state after update: %+v", state)
+	}
+}
+
+func TestAddUpload(t *testing.T) {
+	var state Target
+	start := time.Unix(1700000000, 0)
+	for i := range MaxUploads + 5 {
+		state.AddUpload(Upload{Time: start.Add(time.Duration(i) * time.Hour), DataAdded: int64(i)})
+	}
+
+	if len(state.Uploads) != MaxUploads {
+		t.Fatalf("Expected %d uploads kept, got %d", MaxUploads, len(state.Uploads))
+	}
+	if state.Uploads[0].DataAdded != 5 || state.Uploads[MaxUploads-1].DataAdded != MaxUploads+4 {
+		t.Errorf("Expected the oldest uploads dropped, got %d to %d", state.Uploads[0].DataAdded, state.Uploads[MaxUploads-1].DataAdded)
+	}
+}
+
+func TestUpdateRepository(t *testing.T) {
+	dir := t.TempDir()
+	pruned := time.Unix(1700000000, 0).UTC()
+	if err := UpdateRepository(dir, "b2-home", func(r *Repository) { r.LastPrune = pruned }); err != nil {
+		t.Fatalf("UpdateRepository failed: %v", err)
+	}
+
+	repository, err := LoadRepository(dir, "b2-home")
+	if err != nil {
+		t.Fatalf("LoadRepository failed: %v", err)
+	}
+	if !repository.LastPrune.Equal(pruned) {
+		t.Errorf("Expected last prune %s, got %s", pruned, repository.LastPrune)
+	}
+	if _, err := os.Stat(Path(RepositoryDir(dir), "b2-home")); err != nil {
+		t.Errorf("Expected the repository state in its own directory: %v", err)
+	}
+	if state, err := Load(dir, "b2-home"); err != nil || !reflect.DeepEqual(*state, Target{}) {
+		t.Errorf("Expected no target state for the repository, got %+v (%v)", state, err)
+	}
+}
+
+func TestLockRepository(t *testing.T) {
+	dir := t.TempDir()
+	unlockBackup, err := LockRepository(dir, "b2-home", false)
+	if err != nil {
+		t.Fatalf("LockRepository failed: %v", err)
+	}
+	unlockOther, err := LockRepository(dir, "b2-home", false)
+	if err != nil {
+		t.Fatalf("Expected shared locks of concurrent backups, got %v", err)
+	}
+	if _, err := LockRepository(dir, "b2-home", true); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for a prune during backups, got %v", err)
+	}
+	unlockBackup()
+	unlockOther()
+
+	unlockPrune, err := LockRepository(dir, "b2-home", true)
+	if err != nil {
+		t.Fatalf("Expected exclusive lock after the backups, got %v", err)
+	}
+	if _, err := LockRepository(dir, "b2-home", false); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for a backup during a prune, got %v", err)
+	}
+	if unlock, err := LockRepository(dir, "nas", false); err != nil {
+		t.Errorf("Expected locks of other repositories to be independent, got %v", err)
+	} else {
+		unlock()
+	}
+	unlockPrune()
+}
+
+func TestMaintenance(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	m, err := LoadMaintenance(dir)
+	if err != nil {
+		t.Fatalf("LoadMaintenance failed: %v", err)
+	}
+	if m.Active(now) {
+		t.Error("Expected maintenance mode to be off without a maintenance file")
+	}
+
+	saved := &Maintenance{Reason: "RAID rebuild", Since: now, Until: now.Add(6 * time.Hour)}
+	if err := SaveMaintenance(dir, saved); err != nil {
+		t.Fatalf("SaveMaintenance failed: %v", err)
+	}
+	m, err = LoadMaintenance(dir)
+	if err != nil {
+		t.Fatalf("LoadMaintenance failed: %v", err)
+	}
+	if m.Reason != "RAID rebuild" || !m.Until.Equal(saved.Until) {
+		t.Errorf("Expected %+v, got %+v", saved, m)
+	}
+	if !m.Active(now.Add(time.Hour)) || m.Active(now.Add(6*time.Hour)) {
+		t.Errorf("Expected maintenance mode to be active until %v only", m.Until)
+	}
+	if !(&Maintenance{Since: now}).Active(now.Add(24 * time.Hour)) {
+		t.Error("Expected maintenance mode without an end to stay active")
+	}
+
+	if err := ClearMaintenance(dir); err != nil {
+		t.Fatalf("ClearMaintenance failed: %v", err)
+	}
+	if m, err = LoadMaintenance(dir); err != nil || m.Active(now) {
+		t.Errorf("Expected maintenance mode to be off once cleared, got %+v (%v)", m, err)
+	}
+	if err := ClearMaintenance(dir); err != nil {
+		t.Errorf("Expected clearing maintenance mode twice to succeed, got %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+
+	history, err := LoadHistory(dir, "b2-home")
+	if err != nil || len(history) != 0 {
+		t.Fatalf("Expected an empty history, got %v (%v)", history, err)
+	}
+
+	start := time.Unix(1700000000, 0).UTC()
+	appended := []Invocation{
+		{Time: start, Command: "backup", Prefix: "home", RunID: "9f2c4e1a7b3d5f60", Duration: 84.2, Exit: ExitSuccess},
+		{Time: start.Add(time.Minute), Command: "forget --prune", Prefix: "home", Duration: 3, Exit: ExitTransient, ExitCode: 11, Error: "repository is already locked"},
+	}
+	for _, invocation := range appended {
+		if err := AppendHistory(dir, "b2-home", invocation); err != nil {
+			t.Fatalf("AppendHistory failed: %v", err)
+		}
+	}
+	history, err = LoadHistory(dir, "b2-home")
+	if err != nil {
+		t.Fatalf("LoadHistory failed: %v", err)
+	}
+	if !reflect.DeepEqual(history, appended) {
+		t.Errorf("Expected %+v, got %+v", appended, history)
+	}
+
+	// A line cut short by a crash is skipped, anything else is an error
+	file, err := os.OpenFile(HistoryPath(dir, "b2-home"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(`{"time":"2023-11`)
+	_ = file.Close()
+	if history, err = LoadHistory(dir, "b2-home"); err != nil || len(history) != 2 {
+		t.Errorf("Expected the truncated line to be skipped, got %+v (%v)", history, err)
+	}
+	if err := os.WriteFile(HistoryPath(dir, "b2-home"), []byte("garbage\n{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadHistory(dir, "b2-home"); err == nil {
+		t.Error("Expected error for a corrupt history")
+	}
+}
@@ -0,0 +1,36 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// Listener returns the first socket passed to the process by systemd socket activation,
+// as named by LISTEN_PID and LISTEN_FDS. It returns nil without error when the process
+// was not socket activated.
+func Listener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// The variables are meant for this process only
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(listenFDsStart, "systemd-socket")
+	defer file.Close()
+	l, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use the socket passed by systemd: %w", err)
+	}
+	return l, nil
+}
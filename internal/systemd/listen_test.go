@@ -0,0 +1,21 @@
+package systemd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestListenerWithoutActivation(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if l, err := Listener(); l != nil || err != nil {
+		t.Errorf("Expected no listener for another process, got %v (%v)", l, err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "0")
+	if l, err := Listener(); l != nil || err != nil {
+		t.Errorf("Expected no listener without file descriptors, got %v (%v)", l, err)
+	}
+}
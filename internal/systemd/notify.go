@@ -0,0 +1,90 @@
+// Package systemd implements the sd_notify protocol so that the service manager can
+// track readiness, progress and liveness of a backup run started as a systemd service.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends a newline-separated list of VARIABLE=value assignments to the service
+// manager through the socket named by NOTIFY_SOCKET. It returns false without error when
+// the process is not running under systemd with notification support.
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+
+	// A leading '@' denotes a socket in the abstract namespace
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to send notification: %w", err)
+	}
+	return true, nil
+}
+
+// Ready tells the service manager that startup is complete.
+func Ready() error {
+	_, err := Notify("READY=1")
+	return err
+}
+
+// Status updates the free-form status line shown by 'systemctl status'.
+func Status(status string) error {
+	_, err := Notify("STATUS=" + status)
+	return err
+}
+
+// WatchdogInterval returns how often the service must ping the watchdog, which is half of
+// the configured WatchdogSec. It returns 0 if the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// StartWatchdog sends WATCHDOG=1 keep-alive pings in the background while the process is
+// healthy. The returned function stops the pings. If the watchdog is not enabled,
+// nothing is started and the returned function does nothing.
+func StartWatchdog() (stop func()) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = Notify("WATCHDOG=1")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
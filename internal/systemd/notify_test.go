@@ -0,0 +1,89 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on notify socket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	conn := listenNotifySocket(t)
+
+	if err := Ready(); err != nil {
+		t.Fatalf("Ready failed: %v", err)
+	}
+	if got := readNotification(t, conn); got != "READY=1" {
+		t.Errorf("Expected READY=1, got %q", got)
+	}
+
+	if err := Status("Uploading home"); err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if got := readNotification(t, conn); got != "STATUS=Uploading home" {
+		t.Errorf("Expected status notification, got %q", got)
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	sent, err := Notify("READY=1")
+	if err != nil || sent {
+		t.Errorf("Expected Notify to be a no-op without NOTIFY_SOCKET, got sent=%t err=%v", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("Expected disabled watchdog, got %v", got)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := WatchdogInterval(); got != 15*time.Second {
+		t.Errorf("Expected 15s interval, got %v", got)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("Expected watchdog for another process to be ignored, got %v", got)
+	}
+}
+
+func TestStartWatchdog(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	stop := StartWatchdog()
+	defer stop()
+
+	if got := readNotification(t, conn); got != "WATCHDOG=1" {
+		t.Errorf("Expected WATCHDOG=1, got %q", got)
+	}
+}
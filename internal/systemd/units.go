@@ -0,0 +1,126 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// UnitDir is the directory of locally installed system units.
+const UnitDir = "/etc/systemd/system"
+
+// validUnitName matches target names usable in unit names without escaping.
+var validUnitName = regexp.MustCompile(`^[A-Za-z0-9:_.\-]+$`)
+
+// UnitName returns the name of the service or timer unit backing up a target, with
+// suffix ".service" or ".timer".
+func UnitName(target, suffix string) string {
+	return "btrfs-backup-" + target + suffix
+}
+
+// Units holds the service and timer unit of a target.
+type Units struct {
+	Service string
+	Timer   string
+}
+
+// GenerateUnits returns the service running 'backup <target>' with executable and the
+// main configuration at configPath, and the timer starting it on schedule, a systemd
+// OnCalendar expression. The service is hardened only as far as btrfs and restic keep
+// working: /usr, /boot and /etc are read-only, while the snapshot directory and the
+// restic cache can be anywhere else.
+func GenerateUnits(target, executable, configPath, schedule string) (*Units, error) {
+	if !validUnitName.MatchString(target) {
+		return nil, fmt.Errorf("target name '%s' can't be used in a unit name", target)
+	}
+	if schedule == "" || strings.ContainsAny(schedule, "\n\r") {
+		return nil, fmt.Errorf("invalid schedule '%s'", schedule)
+	}
+
+	service := fmt.Sprintf(`# Generated by 'btrfs-backup systemd install %[1]s'
+[Unit]
+Description=btrfs-backup of target %[1]s
+Documentation=https://github.com/kreigan/btrfs-backup
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%[2]s --config %[3]s backup %[1]s
+Nice=10
+IOSchedulingClass=idle
+NoNewPrivileges=true
+PrivateTmp=true
+ProtectSystem=full
+ProtectKernelModules=true
+ProtectKernelLogs=true
+ProtectControlGroups=true
+ProtectClock=true
+ProtectHostname=true
+RestrictRealtime=true
+RestrictSUIDSGID=true
+LockPersonality=true
+`, target, quoteArg(executable), quoteArg(configPath))
+
+	timer := fmt.Sprintf(`# Generated by 'btrfs-backup systemd install %[1]s'
+[Unit]
+Description=Scheduled btrfs-backup of target %[1]s
+
+[Timer]
+OnCalendar=%[2]s
+Persistent=true
+RandomizedDelaySec=5min
+
+[Install]
+WantedBy=timers.target
+`, target, schedule)
+
+	return &Units{Service: service, Timer: timer}, nil
+}
+
+// quoteArg quotes an ExecStart argument containing spaces or quotes.
+func quoteArg(arg string) string {
+	if !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// InstallUnits writes the units of a target to dir, replacing earlier versions, and
+// returns their paths.
+func InstallUnits(dir, target string, units *Units) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create unit directory: %w", err)
+	}
+
+	var paths []string
+	for _, unit := range []struct{ suffix, content string }{{".service", units.Service}, {".timer", units.Timer}} {
+		path := filepath.Join(dir, UnitName(target, unit.suffix))
+		if err := os.WriteFile(path, []byte(unit.content), 0o644); err != nil {
+			return paths, fmt.Errorf("failed to write unit: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// UninstallUnits removes the units of a target from dir and returns the paths removed.
+// Units that don't exist are skipped.
+func UninstallUnits(dir, target string) ([]string, error) {
+	var paths []string
+	for _, suffix := range []string{".timer", ".service"} {
+		path := filepath.Join(dir, UnitName(target, suffix))
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return paths, fmt.Errorf("failed to remove unit: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,65 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateUnits(t *testing.T) {
+	units, err := GenerateUnits("home", "/usr/local/bin/btrfs-backup", "/etc/btrfs backup/config.yaml", "*-*-* 02:30")
+	if err != nil {
+		t.Fatalf("GenerateUnits failed: %v", err)
+	}
+
+	for _, expected := range []string{
+		`ExecStart=/usr/local/bin/btrfs-backup --config "/etc/btrfs backup/config.yaml" backup home`,
+		"Type=notify",
+		"ProtectSystem=full",
+	} {
+		if !strings.Contains(units.Service, expected) {
+			t.Errorf("Expected service to contain %q, got:\n%s", expected, units.Service)
+		}
+	}
+	for _, expected := range []string{"OnCalendar=*-*-* 02:30", "Persistent=true", "WantedBy=timers.target"} {
+		if !strings.Contains(units.Timer, expected) {
+			t.Errorf("Expected timer to contain %q, got:\n%s", expected, units.Timer)
+		}
+	}
+
+	for _, tt := range []struct{ target, schedule string }{
+		{"my home", "daily"},
+		{"home", ""},
+		{"home", "daily\nExecStart=/bin/sh"},
+	} {
+		if _, err := GenerateUnits(tt.target, "/usr/bin/btrfs-backup", "/etc/btrfs-backup/config.yaml", tt.schedule); err == nil {
+			t.Errorf("Expected error for target %q with schedule %q", tt.target, tt.schedule)
+		}
+	}
+}
+
+func TestInstallUninstallUnits(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "system")
+	units := &Units{Service: "[Service]\n", Timer: "[Timer]\n"}
+
+	paths, err := InstallUnits(dir, "home", units)
+	if err != nil {
+		t.Fatalf("InstallUnits failed: %v", err)
+	}
+	if len(paths) != 2 || paths[0] != filepath.Join(dir, "btrfs-backup-home.service") {
+		t.Errorf("Unexpected installed units %v", paths)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "btrfs-backup-home.timer"))
+	if err != nil || string(data) != units.Timer {
+		t.Errorf("Expected timer unit written, got %q (%v)", data, err)
+	}
+
+	paths, err = UninstallUnits(dir, "home")
+	if err != nil || len(paths) != 2 {
+		t.Errorf("Expected both units removed, got %v (%v)", paths, err)
+	}
+	if paths, err = UninstallUnits(dir, "home"); err != nil || len(paths) != 0 {
+		t.Errorf("Expected nothing to remove, got %v (%v)", paths, err)
+	}
+}
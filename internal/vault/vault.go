@@ -0,0 +1,169 @@
+// Package vault reads secrets from HashiCorp Vault over its HTTP API, so repository
+// credentials can be fetched at backup time instead of being stored on disk.
+package vault
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prefix marks repository configuration values that reference a Vault secret field as
+// 'vault:<path>#<field>'.
+const Prefix = "vault:"
+
+// requestTimeout limits each request to Vault.
+const requestTimeout = 30 * time.Second
+
+// Client reads secrets from a Vault server.
+type Client struct {
+	addr      string
+	token     string
+	namespace string
+	http      *http.Client
+	cache     map[string]map[string]any // secret data by path, each secret is read once
+}
+
+// NewFromEnv creates a client configured like the vault CLI: the server from VAULT_ADDR,
+// the token from VAULT_TOKEN or else ~/.vault-token, and the optional VAULT_NAMESPACE and
+// VAULT_CACERT. Returns an error if no server or token is configured.
+func NewFromEnv() (*Client, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				token = strings.TrimSpace(string(data))
+			}
+		}
+	}
+	if token == "" {
+		return nil, fmt.Errorf("neither VAULT_TOKEN nor ~/.vault-token is set")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile := os.Getenv("VAULT_CACERT"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read VAULT_CACERT: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in VAULT_CACERT %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &Client{
+		addr:      addr,
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		http:      &http.Client{Timeout: requestTimeout, Transport: transport},
+		cache:     map[string]map[string]any{},
+	}, nil
+}
+
+// ParseReference splits a 'vault:<path>#<field>' value into path and field. ok is false
+// if value is not a Vault reference.
+func ParseReference(value string) (path, field string, ok bool, err error) {
+	ref, found := strings.CutPrefix(value, Prefix)
+	if !found {
+		return "", "", false, nil
+	}
+	path, field, found = strings.Cut(ref, "#")
+	path = strings.Trim(path, "/")
+	if !found || path == "" || field == "" {
+		return "", "", true, fmt.Errorf("invalid Vault reference '%s', expected vault:<path>#<field>", value)
+	}
+	return path, field, true, nil
+}
+
+// Field returns the string field of the secret at path, e.g. 'secret/data/backup/b2' for
+// the KV version 2 engine mounted at secret/ or 'kv/backup/b2' for version 1.
+func (c *Client) Field(ctx context.Context, path, field string) (string, error) {
+	data, err := c.read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	value, found := data[field]
+	if !found {
+		return "", fmt.Errorf("secret %s has no field %s", path, field)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s of secret %s is not a string", field, path)
+	}
+	return s, nil
+}
+
+// read returns the data of the secret at path. The data of KV version 2 secrets is
+// nested in a second data object next to their metadata.
+func (c *Client) read(ctx context.Context, path string) (map[string]any, error) {
+	if data, found := c.cache[path]; found {
+		return data, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.addr+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %w", path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to read secret %s: %s%s", path, resp.Status, responseErrors(body))
+	}
+
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("invalid response for secret %s: %w", path, err)
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, hasMetadata := data["metadata"]; hasMetadata {
+			data = nested
+		}
+	}
+	if data == nil {
+		return nil, errors.New("secret " + path + " holds no data")
+	}
+	c.cache[path] = data
+	return data, nil
+}
+
+// responseErrors formats the errors of a Vault error response for an error message.
+func responseErrors(body []byte) string {
+	var response struct {
+		Errors []string `json:"errors"`
+	}
+	if json.Unmarshal(body, &response) != nil || len(response.Errors) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(response.Errors, "; ")
+}
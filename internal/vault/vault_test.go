@@ -0,0 +1,103 @@
+package vault
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/backup/b2":
+			_, _ = w.Write([]byte(`{"data":{"data":{"account_key":"key123","retries":3},"metadata":{"version":2}}}`))
+		case "/v1/kv/backup/b2":
+			_, _ = w.Write([]byte(`{"data":{"password":"secret"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestField(t *testing.T) {
+	server := newTestServer(t)
+	t.Setenv("VAULT_ADDR", server.URL+"/")
+	t.Setenv("VAULT_TOKEN", "s.token")
+	client, err := NewFromEnv()
+	if err != nil {
+		t.Fatalf("NewFromEnv failed: %v", err)
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		path, field   string
+		expected      string
+		errorContains string
+	}{
+		{path: "secret/data/backup/b2", field: "account_key", expected: "key123"},
+		{path: "kv/backup/b2", field: "password", expected: "secret"},
+		{path: "secret/data/backup/b2", field: "account_id", errorContains: "has no field account_id"},
+		{path: "secret/data/backup/b2", field: "retries", errorContains: "not a string"},
+		{path: "secret/data/backup/missing", field: "password", errorContains: "404 Not Found"},
+	}
+	for _, tt := range tests {
+		value, err := client.Field(ctx, tt.path, tt.field)
+		if tt.errorContains != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.errorContains) {
+				t.Errorf("Expected error containing %q for %s#%s, got %v", tt.errorContains, tt.path, tt.field, err)
+			}
+			continue
+		}
+		if err != nil || value != tt.expected {
+			t.Errorf("Expected %q for %s#%s, got %q (%v)", tt.expected, tt.path, tt.field, value, err)
+		}
+	}
+
+	t.Setenv("VAULT_TOKEN", "s.expired")
+	client, err = NewFromEnv()
+	if err != nil {
+		t.Fatalf("NewFromEnv failed: %v", err)
+	}
+	if _, err := client.Field(ctx, "kv/backup/b2", "password"); err == nil || !strings.Contains(err.Error(), "403 Forbidden: permission denied") {
+		t.Errorf("Expected permission error, got %v", err)
+	}
+}
+
+func TestNewFromEnvRequiresServerAndToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("VAULT_TOKEN", "s.token")
+	if _, err := NewFromEnv(); err == nil {
+		t.Error("Expected error without VAULT_ADDR")
+	}
+	t.Setenv("VAULT_ADDR", "https://vault.example.com")
+	t.Setenv("VAULT_TOKEN", "")
+	if _, err := NewFromEnv(); err == nil {
+		t.Error("Expected error without a token")
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	path, field, ok, err := ParseReference("vault:/secret/data/backup/b2#account_key")
+	if !ok || err != nil || path != "secret/data/backup/b2" || field != "account_key" {
+		t.Errorf("Unexpected reference %s#%s (%v, %v)", path, field, ok, err)
+	}
+	if _, _, ok, err := ParseReference("b2:bucket/home"); ok || err != nil {
+		t.Errorf("Expected plain value not to be a reference, got %v (%v)", ok, err)
+	}
+	for _, invalid := range []string{"vault:secret/data/backup/b2", "vault:#field", "vault:secret/b2#"} {
+		if _, _, ok, err := ParseReference(invalid); !ok || err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
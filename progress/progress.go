@@ -0,0 +1,47 @@
+// Package progress defines the events host applications embedding btrfs-backup receive
+// while backups run, see package btrfsbackup: the start and end of each run, the workflow
+// steps it enters, the progress of its restic upload and its warnings.
+package progress
+
+import "time"
+
+// EventKind is the kind of an Event.
+type EventKind string
+
+// Kinds of events.
+const (
+	EventRunStarted  EventKind = "run_started"
+	EventStepStarted EventKind = "step_started"
+	EventWarning     EventKind = "warning"
+	EventProgress    EventKind = "progress"
+	EventRunFinished EventKind = "run_finished"
+)
+
+// Event is the progress of a backup run.
+type Event struct {
+	Time time.Time
+	Kind EventKind
+	// Target is the target of the run, empty for EventProgress.
+	Target string
+	// Step is the workflow step entered for EventStepStarted, e.g. "snapshot" or
+	// "pre_backup", the names passed to the post_failure hooks as ERROR_STEP.
+	Step string
+	// Message describes an EventWarning.
+	Message string
+	// Err is the failure of an EventRunFinished, nil if the run succeeded, or the cause of
+	// an EventWarning.
+	Err error
+	// Progress is the status of the running restic upload for EventProgress.
+	Progress *Status
+}
+
+// Status is the progress of a restic upload, as reported by 'restic backup --json'.
+type Status struct {
+	SecondsElapsed   int64   `json:"seconds_elapsed"`
+	SecondsRemaining int64   `json:"seconds_remaining"`
+	PercentDone      float64 `json:"percent_done"` // from 0 to 1
+	TotalFiles       int     `json:"total_files"`
+	FilesDone        int     `json:"files_done"`
+	TotalBytes       int64   `json:"total_bytes"`
+	BytesDone        int64   `json:"bytes_done"`
+}